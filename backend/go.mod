@@ -5,10 +5,12 @@ go 1.21
 toolchain go1.21.6
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/casbin/casbin/v2 v2.85.0
 	github.com/casbin/gorm-adapter/v3 v3.21.0
 	github.com/disgoorg/log v1.2.1
 	github.com/erikgeiser/promptkit v0.9.0
+	github.com/glebarez/sqlite v1.11.0
 	github.com/go-playground/validator/v10 v10.24.0
 	github.com/gofiber/fiber/v2 v2.52.6
 	github.com/google/subcommands v1.2.0
@@ -18,7 +20,9 @@ require (
 	github.com/muesli/termenv v0.15.2
 	github.com/valyala/fasthttp v1.58.0
 	golang.org/x/oauth2 v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/mysql v1.5.6
+	gorm.io/driver/postgres v1.5.7
 	gorm.io/driver/sqlite v1.5.5
 	gorm.io/gorm v1.25.8
 )
@@ -40,7 +44,6 @@ require (
 	github.com/fasthttp/websocket v1.5.12 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.8 // indirect
 	github.com/glebarez/go-sqlite v1.22.0 // indirect
-	github.com/glebarez/sqlite v1.11.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-sql-driver/mysql v1.8.0 // indirect
@@ -89,7 +92,6 @@ require (
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
-	gorm.io/driver/postgres v1.5.7 // indirect
 	gorm.io/driver/sqlserver v1.5.3 // indirect
 	gorm.io/plugin/dbresolver v1.5.1 // indirect
 	modernc.org/gc/v3 v3.0.0-20240304020402-f0dba7c97c2b // indirect
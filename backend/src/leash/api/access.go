@@ -0,0 +1,213 @@
+package leash_backend_api
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// HOLD_BLOCKING_PRIORITY is the priority below which an active hold denies access, holds at or above it are only warnings
+const HOLD_BLOCKING_PRIORITY = 100
+
+const (
+	ACCESS_REASON_GRANTED            = "granted"
+	ACCESS_REASON_INVALID_TOKEN      = "invalid_token"
+	ACCESS_REASON_UNKNOWN_USER       = "unknown_user"
+	ACCESS_REASON_PENDING_APPROVAL   = "pending_approval"
+	ACCESS_REASON_OUT_OF_SERVICE     = "out_of_service"
+	ACCESS_REASON_HOLD               = "hold"
+	ACCESS_REASON_MISSING_TRAINING   = "missing_training"
+	ACCESS_REASON_TRAINING_EXPIRED   = "training_expired"
+	ACCESS_REASON_INSUFFICIENT_LEVEL = "insufficient_level"
+)
+
+// trainingLevelRank orders the training levels from least to most experienced
+var trainingLevelRank = map[string]int{
+	"in_progress":  0,
+	"supervised":   1,
+	"unsupervised": 2,
+	"can_train":    3,
+}
+
+// ACCESS_DEFAULT_MINIMUM_LEVEL is the training level needed when equipment does not set one, so a training that is
+// still in progress only grants access to equipment that explicitly allows it
+const ACCESS_DEFAULT_MINIMUM_LEVEL = "supervised"
+
+// accessUser is the part of a user an interlock needs to greet them
+type accessUser struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Pronouns string `json:"pronouns"`
+}
+
+type accessDecision struct {
+	Allowed   bool             `json:"allowed"`
+	Reason    string           `json:"reason"`
+	Message   string           `json:"message"`
+	User      *accessUser      `json:"user,omitempty"`
+	Equipment models.Equipment `json:"equipment"`
+	Training  *models.Training `json:"training,omitempty"`
+	Hold      *models.Hold     `json:"hold,omitempty"`
+	Warnings  []models.Hold    `json:"warnings"`
+}
+
+// activeHolds returns the holds currently in effect for a user, most severe first
+func activeHolds(db *gorm.DB, user models.User) []models.Hold {
+	var holds []models.Hold
+	db.Where(&models.Hold{UserID: user.ID}).Find(&holds)
+
+	now := time.Now()
+	active := []models.Hold{}
+	for _, hold := range holds {
+		if hold.Start != nil && hold.Start.After(now) {
+			continue
+		}
+
+		if hold.End != nil && hold.End.Before(now) {
+			continue
+		}
+
+		active = append(active, hold)
+	}
+
+	// Lower priorities are more severe
+	sort.SliceStable(active, func(i, j int) bool {
+		if active[i].Priority != active[j].Priority {
+			return active[i].Priority < active[j].Priority
+		}
+
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+
+	return active
+}
+
+// evaluateAccess decides whether a user may use a piece of equipment
+func evaluateAccess(db *gorm.DB, user models.User, equipment models.Equipment) accessDecision {
+	decision := accessDecision{
+		Allowed:   false,
+		User:      &accessUser{ID: user.ID, Name: user.Name, Pronouns: user.Pronouns},
+		Equipment: equipment,
+		Warnings:  []models.Hold{},
+	}
+
+	if !equipment.IsOperational() {
+		decision.Reason = ACCESS_REASON_OUT_OF_SERVICE
+		decision.Message = "Equipment is out of service: " + equipment.StatusReason
+		return decision
+	}
+
+	if user.PendingApproval {
+		decision.Reason = ACCESS_REASON_PENDING_APPROVAL
+		decision.Message = "User is pending approval"
+		return decision
+	}
+
+	// Any blocking hold denies access, the rest are passed along as warnings
+	for _, hold := range activeHolds(db, user) {
+		if hold.Priority < HOLD_BLOCKING_PRIORITY {
+			if decision.Hold == nil {
+				blocking := hold
+				decision.Hold = &blocking
+			}
+		} else {
+			decision.Warnings = append(decision.Warnings, hold)
+		}
+	}
+
+	if decision.Hold != nil {
+		decision.Reason = ACCESS_REASON_HOLD
+		decision.Message = "User has an active hold: " + decision.Hold.Reason
+		return decision
+	}
+
+	if equipment.RequiredTraining != "" {
+		var training = models.Training{
+			UserID: user.ID,
+			Name:   equipment.RequiredTraining,
+		}
+
+		if res := db.Limit(1).Where(&training).Find(&training); res.Error != nil || res.RowsAffected == 0 {
+			decision.Reason = ACCESS_REASON_MISSING_TRAINING
+			decision.Message = "User does not have the " + equipment.RequiredTraining + " training"
+			return decision
+		}
+
+		decision.Training = &training
+
+		if training.IsExpired() {
+			decision.Reason = ACCESS_REASON_TRAINING_EXPIRED
+			decision.Message = "User's " + equipment.RequiredTraining + " training has expired"
+			return decision
+		}
+
+		minimumLevel := equipment.MinimumLevel
+		if minimumLevel == "" {
+			minimumLevel = ACCESS_DEFAULT_MINIMUM_LEVEL
+		}
+
+		if trainingLevelRank[training.Level] < trainingLevelRank[minimumLevel] {
+			decision.Reason = ACCESS_REASON_INSUFFICIENT_LEVEL
+			decision.Message = "User's " + equipment.RequiredTraining + " training is below " + minimumLevel
+			return decision
+		}
+	}
+
+	decision.Allowed = true
+	decision.Reason = ACCESS_REASON_GRANTED
+	decision.Message = "Access granted"
+	return decision
+}
+
+// registerAccessEndpoints registers the access decision endpoints
+func registerAccessEndpoints(api fiber.Router) {
+	access_ep := api.Group("/access", leash_auth.ConcatPermissionPrefixMiddleware("access"))
+
+	// Check if a card or checkin token may use a piece of equipment
+	type accessCheckRequest struct {
+		CardID       *string `json:"card_id" xml:"card_id" form:"card_id" validate:"required_without=CheckinToken"`
+		CheckinToken *string `json:"checkin_token" xml:"checkin_token" form:"checkin_token" validate:"required_without=CardID"`
+		Equipment    string  `json:"equipment" xml:"equipment" form:"equipment" validate:"required"`
+	}
+	access_ep.Post("/check", skipAuditMiddleware, leash_auth.PrefixAuthorizationMiddleware("check"), models.GetBodyMiddleware[accessCheckRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("body").(accessCheckRequest)
+
+		equipment, ok := getEquipmentByName(db, req.Equipment)
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "Equipment not found")
+		}
+
+		var user models.User
+		if req.CardID != nil {
+			user.CardID = req.CardID
+		} else {
+			user_id, err := parseCheckinToken(c, *req.CheckinToken)
+			if err != nil {
+				return c.JSON(accessDecision{
+					Reason:    ACCESS_REASON_INVALID_TOKEN,
+					Message:   "Invalid or expired checkin token",
+					Equipment: equipment,
+					Warnings:  []models.Hold{},
+				})
+			}
+
+			user.ID = user_id
+		}
+
+		if res := db.Limit(1).Where(&user).Find(&user); res.Error != nil || res.RowsAffected == 0 {
+			return c.JSON(accessDecision{
+				Reason:    ACCESS_REASON_UNKNOWN_USER,
+				Message:   "User not found",
+				Equipment: equipment,
+				Warnings:  []models.Hold{},
+			})
+		}
+
+		return c.JSON(evaluateAccess(db, user, equipment))
+	})
+}
@@ -14,6 +14,7 @@ type listRequest struct {
 // RegisterAPIEndpoints registers all the API endpoints for Leash
 func RegisterAPIEndpoints(api fiber.Router) {
 	api.Use(leash_auth.AuthenticationMiddleware)
+	api.Use(auditMiddleware)
 
 	registerUserEndpoints(api)
 	registerTrainingEndpoints(api)
@@ -21,4 +22,14 @@ func RegisterAPIEndpoints(api fiber.Router) {
 	registerApiKeyEndpoints(api)
 	registerNotificationsEndpoints(api)
 	registerFeedEndpoints(api)
+	registerEquipmentEndpoints(api)
+	registerVisitEndpoints(api)
+	registerReportEndpoints(api)
+	registerAccessEndpoints(api)
+	registerOAuthClientEndpoints(api)
+	registerAuditEndpoints(api)
+	registerRoleEndpoints(api)
+
+	// Webhooks hook into the callbacks above, so they must be registered last
+	registerWebhookEndpoints(api)
 }
@@ -2,13 +2,17 @@ package leash_backend_api
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/disgoorg/log"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 )
 
+var apikeyCreateCallbacks []func(APIKeyEvent)
+var apikeyDeleteCallbacks []func(APIKeyEvent)
+
 // userApiKeyMiddleware is a middleware that fetches the api key from a user and stores it in the context
 func userApiKeyMiddleware(c *fiber.Ctx) error {
 	db := leash_auth.GetDB(c)
@@ -58,6 +62,17 @@ func generalApiKeyMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// validateAllowedCIDRs returns a bad request error if any entry of an api key's allowlist does not parse
+func validateAllowedCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, err := leash_auth.ParseAPIKeyCIDR(cidr); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid CIDR %q", cidr))
+		}
+	}
+
+	return nil
+}
+
 // addCommonApiKeyEndpoints adds the common endpoints for api keys
 func addCommonApiKeyEndpoints(apikey_ep fiber.Router) {
 	// Get current api key endpoint
@@ -74,14 +89,30 @@ func addCommonApiKeyEndpoints(apikey_ep fiber.Router) {
 		enforcer.DeletePermissionsForUser(fmt.Sprintf("apikey:%s", apikey.Key))
 
 		db.Delete(&apikey)
+
+		event := APIKeyEvent{
+			c:         c,
+			Target:    apikey,
+			Agent:     leash_auth.GetAuthentication(c).User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range apikeyDeleteCallbacks {
+			callback(event)
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 
 	// Update current api key endpoint
 	type apikeyUpdateRequest struct {
-		Description *string   `json:"description" xml:"description" form:"description"`
-		Permissions *[]string `json:"permissions" xml:"permissions" form:"permissions"`
-		FullAccess  *bool     `json:"full_access" xml:"full_access" form:"full_access"`
+		Description  *string    `json:"description" xml:"description" form:"description"`
+		Permissions  *[]string  `json:"permissions" xml:"permissions" form:"permissions"`
+		FullAccess   *bool      `json:"full_access" xml:"full_access" form:"full_access"`
+		ExpiresAt    *time.Time `json:"expires_at" xml:"expires_at" form:"expires_at"`
+		ClearExpiry  *bool      `json:"clear_expires_at" xml:"clear_expires_at" form:"clear_expires_at"`
+		AllowedCIDRs *[]string  `json:"allowed_cidrs" xml:"allowed_cidrs" form:"allowed_cidrs"`
+		RateLimit    *int       `json:"rate_limit" xml:"rate_limit" form:"rate_limit" validate:"omitempty,min=0"`
 	}
 
 	apikey_ep.Patch("/", leash_auth.PrefixAuthorizationMiddleware("update"), models.GetBodyMiddleware[apikeyUpdateRequest], func(c *fiber.Ctx) error {
@@ -89,11 +120,35 @@ func addCommonApiKeyEndpoints(apikey_ep fiber.Router) {
 		apikey := c.Locals("apikey").(models.APIKey)
 		req := c.Locals("body").(apikeyUpdateRequest)
 
+		clearExpiry := req.ClearExpiry != nil && *req.ClearExpiry
+		if clearExpiry && req.ExpiresAt != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Expiry cannot be set and cleared at once")
+		}
+
+		if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+			return fiber.NewError(fiber.StatusBadRequest, "Expiry must be in the future")
+		}
+
+		authentication := leash_auth.GetAuthentication(c)
+
+		// Restrictions are often set by an admin, so changing them needs more than updating the key
+		if req.AllowedCIDRs != nil || req.RateLimit != nil {
+			if authentication.Authorize(c.Locals("permission_prefix").(string)+":restrict") != nil {
+				return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to change this api key's restrictions")
+			}
+		}
+
+		if req.AllowedCIDRs != nil {
+			if err := validateAllowedCIDRs(*req.AllowedCIDRs); err != nil {
+				return err
+			}
+		}
+
 		if req.Description != nil {
 			apikey.Description = *req.Description
 		}
 
-		enforcer := leash_auth.GetAuthentication(c).Enforcer
+		enforcer := authentication.Enforcer
 
 		if req.Permissions != nil {
 			enforcer.SetPermissionsForAPIKey(apikey, *req.Permissions)
@@ -103,12 +158,77 @@ func addCommonApiKeyEndpoints(apikey_ep fiber.Router) {
 			apikey.FullAccess = *req.FullAccess
 		}
 
+		if req.ExpiresAt != nil {
+			apikey.ExpiresAt = req.ExpiresAt
+		}
+
+		// Cleared keys never expire
+		if clearExpiry {
+			apikey.ExpiresAt = nil
+		}
+
+		if req.AllowedCIDRs != nil {
+			apikey.AllowedCIDRs = *req.AllowedCIDRs
+		}
+
+		if req.RateLimit != nil {
+			apikey.RateLimit = *req.RateLimit
+		}
+
 		enforcer.SavePolicy()
 
 		db.Save(&apikey)
 
 		return c.JSON(apikey)
 	})
+
+	rejections_ep := apikey_ep.Group("/rejections", leash_auth.ConcatPermissionPrefixMiddleware("rejections"))
+
+	// List requests rejected by the api key's restrictions endpoint
+	rejections_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		apikey := c.Locals("apikey").(models.APIKey)
+		req := c.Locals("query").(listRequest)
+
+		var rejections []models.APIKeyRejection
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.APIKeyRejection{}).Where(models.APIKeyRejection{Key: apikey.Key})
+
+		// Count the total number of rejections
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results, newest first
+		con = con.Order("id desc")
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&rejections)
+
+		response := struct {
+			Data  []models.APIKeyRejection `json:"data"`
+			Total int64                    `json:"total"`
+		}{
+			Data:  rejections,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
 }
 
 // addUserApiKeyEndpoints adds the endpoints for api keys for a user
@@ -160,34 +280,70 @@ func addUserApiKeyEndpoints(user_ep fiber.Router) {
 
 	// Create api key endpoint
 	type apikeyCreateRequest struct {
-		Description *string   `json:"description" xml:"description" form:"description" validate:"omitempty"`
-		Permissions *[]string `json:"permissions" xml:"permissions" form:"permissions" validate:"required"`
-		FullAccess  *bool     `json:"full_access" xml:"full_access" form:"full_access" validate:"required"`
+		Description  *string    `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Permissions  *[]string  `json:"permissions" xml:"permissions" form:"permissions" validate:"required"`
+		FullAccess   *bool      `json:"full_access" xml:"full_access" form:"full_access" validate:"required"`
+		ExpiresAt    *time.Time `json:"expires_at" xml:"expires_at" form:"expires_at" validate:"omitempty"`
+		AllowedCIDRs *[]string  `json:"allowed_cidrs" xml:"allowed_cidrs" form:"allowed_cidrs" validate:"omitempty"`
+		RateLimit    *int       `json:"rate_limit" xml:"rate_limit" form:"rate_limit" validate:"omitempty,min=0"`
 	}
 	apikey_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[apikeyCreateRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		user := c.Locals("target_user").(models.User)
 		req := c.Locals("body").(apikeyCreateRequest)
 
-		key := uuid.New()
-
 		if req.Description == nil {
 			req.Description = new(string)
 		}
 
-		apikey := models.APIKey{
-			Description: *req.Description,
-			UserID:      user.ID,
-			FullAccess:  *req.FullAccess,
-			Key:         key.String(),
+		if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+			return fiber.NewError(fiber.StatusBadRequest, "Expiry must be in the future")
+		}
+
+		if req.AllowedCIDRs != nil {
+			if err := validateAllowedCIDRs(*req.AllowedCIDRs); err != nil {
+				return err
+			}
+		}
+
+		// Only the hash of the secret is stored, so the full key is returned this once
+		apikey, err := leash_auth.GenerateAPIKey()
+		if err != nil {
+			log.Error("Failed to generate api key: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		apikey.Description = *req.Description
+		apikey.UserID = user.ID
+		apikey.FullAccess = *req.FullAccess
+		apikey.ExpiresAt = req.ExpiresAt
+
+		if req.AllowedCIDRs != nil {
+			apikey.AllowedCIDRs = *req.AllowedCIDRs
+		}
+
+		if req.RateLimit != nil {
+			apikey.RateLimit = *req.RateLimit
 		}
 
 		db.Create(&apikey)
 
-		enforcer := leash_auth.GetAuthentication(c).Enforcer
+		authenticator := leash_auth.GetAuthentication(c)
+		enforcer := authenticator.Enforcer
 		enforcer.SetPermissionsForAPIKey(apikey, *req.Permissions)
 		enforcer.SavePolicy()
 
+		event := APIKeyEvent{
+			c:         c,
+			Target:    apikey,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range apikeyCreateCallbacks {
+			callback(event)
+		}
+
 		return c.JSON(apikey)
 	})
 
@@ -199,7 +355,20 @@ func addUserApiKeyEndpoints(user_ep fiber.Router) {
 func registerApiKeyEndpoints(api fiber.Router) {
 	apikey_ep := api.Group("/apikeys", leash_auth.ConcatPermissionPrefixMiddleware("apikeys"))
 
+	apikeyCreateCallbacks = []func(APIKeyEvent){}
+	apikeyDeleteCallbacks = []func(APIKeyEvent){}
+
 	single_apikey_ep := apikey_ep.Group("/:api_key", generalApiKeyMiddleware)
 
 	addCommonApiKeyEndpoints(single_apikey_ep)
 }
+
+// OnAPIKeyCreate registers a callback to be called when an api key is created
+func OnAPIKeyCreate(callback func(APIKeyEvent)) {
+	apikeyCreateCallbacks = append(apikeyCreateCallbacks, callback)
+}
+
+// OnAPIKeyDelete registers a callback to be called when an api key is deleted
+func OnAPIKeyDelete(callback func(APIKeyEvent)) {
+	apikeyDeleteCallbacks = append(apikeyDeleteCallbacks, callback)
+}
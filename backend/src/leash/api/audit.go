@@ -0,0 +1,272 @@
+package leash_backend_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+)
+
+// auditTargetLocals are the context locals endpoints store their target in, most specific first
+var auditTargetLocals = []struct {
+	local      string
+	targetType string
+}{
+	{"apikey", "apikey"},
+	{"hold", "hold"},
+	{"training", "training"},
+	{"notification", "notification"},
+	{"training_definition", "training_definition"},
+	{"equipment", "equipment"},
+	{"webhook", "webhook"},
+	{"oauth_client", "oauth_client"},
+	{"role", "role"},
+	{"target_feed", "feed"},
+	{"visit_user", "user"},
+	{"target_user", "user"},
+}
+
+// auditCollections are the route segments that create a target when posted to
+var auditCollections = map[string]string{
+	"users":         "user",
+	"service":       "user",
+	"trainings":     "training",
+	"holds":         "hold",
+	"apikeys":       "apikey",
+	"notifications": "notification",
+	"definitions":   "training_definition",
+	"feeds":         "feed",
+	"equipment":     "equipment",
+	"oauth_clients": "oauth_client",
+	"webhooks":      "webhook",
+	"roles":         "role",
+}
+
+// auditRedactedFields are never written to the audit log
+var auditRedactedFields = []string{"Token", "Secret", "SecretHash", "client_secret", "secret"}
+
+// auditJSON returns a value as JSON without its secrets, along with its ID
+func auditJSON(v interface{}) (string, string) {
+	var b []byte
+	switch v := v.(type) {
+	case []byte:
+		b = v
+	default:
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return "", ""
+		}
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return "", ""
+	}
+
+	for _, field := range auditRedactedFields {
+		delete(fields, field)
+	}
+
+	id := ""
+	for _, field := range []string{"ID", "Key", "ClientID", "Name"} {
+		if v, ok := fields[field]; ok {
+			id = fmt.Sprint(v)
+			break
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return "", id
+	}
+
+	return string(b), id
+}
+
+// skipAuditMiddleware marks a request that does not change anything so it is not audited
+func skipAuditMiddleware(c *fiber.Ctx) error {
+	c.Locals("skip_audit", true)
+	return c.Next()
+}
+
+// auditMiddleware records every successful request that changes something as an AuditEvent
+func auditMiddleware(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	if skip, ok := c.Locals("skip_audit").(bool); ok && skip {
+		return nil
+	}
+
+	status := c.Response().StatusCode()
+	if status >= fiber.StatusBadRequest {
+		return nil
+	}
+
+	authentication := leash_auth.GetAuthentication(c)
+	route := strings.TrimSuffix(c.Route().Path, "/")
+
+	event := models.AuditEvent{
+		ActorID: authentication.User.ID,
+		Action:  c.Method() + " " + route,
+		Status:  status,
+		IP:      c.IP(),
+	}
+
+	if requestID, ok := c.Locals("requestid").(string); ok {
+		event.RequestID = requestID
+	}
+
+	switch {
+	case authentication.IsAPIKey():
+		event.AuthMethod = "apikey"
+		event.APIKey = authentication.Data.(models.APIKey).Key
+	case authentication.IsOAuth():
+		event.AuthMethod = "oauth"
+	case authentication.IsUser():
+		event.AuthMethod = "session"
+	}
+
+	// The target stored by the endpoint's middleware is the state before the handler changed it
+	for _, target := range auditTargetLocals {
+		if v := c.Locals(target.local); v != nil {
+			event.TargetType = target.targetType
+			event.Before, event.TargetID = auditJSON(v)
+			break
+		}
+	}
+
+	// Posting to a collection creates a new target, which the response describes
+	segments := strings.Split(route, "/")
+	targetType, creates := auditCollections[segments[len(segments)-1]]
+	if c.Method() == fiber.MethodPost && creates {
+		event.TargetType = targetType
+		event.Before = ""
+		event.TargetID = ""
+	}
+
+	if c.Method() != fiber.MethodDelete && strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+		after, id := auditJSON(c.Response().Body())
+		event.After = after
+		if event.TargetID == "" && after != "" && event.TargetType != "" {
+			event.TargetID = id
+		}
+	}
+
+	if err := leash_auth.GetDB(c).Create(&event).Error; err != nil {
+		log.Error("Failed to record audit event: %s\n", err)
+	}
+
+	return nil
+}
+
+// registerAuditEndpoints registers the audit log endpoints
+func registerAuditEndpoints(api fiber.Router) {
+	audit_ep := api.Group("/audit", leash_auth.ConcatPermissionPrefixMiddleware("audit"))
+
+	// List audit events endpoint
+	type auditListRequest struct {
+		Limit          *int    `query:"limit" validate:"omitempty,min=1,max=100"`
+		Offset         *int    `query:"offset" validate:"omitempty,min=0"`
+		IncludeDeleted *bool   `query:"include_deleted"`
+		ActorID        *uint   `query:"actor_id" validate:"omitempty"`
+		AuthMethod     *string `query:"auth_method" validate:"omitempty,oneof=session apikey oauth"`
+		APIKey         *string `query:"api_key" validate:"omitempty"`
+		Action         *string `query:"action" validate:"omitempty"`
+		TargetType     *string `query:"target_type" validate:"omitempty"`
+		TargetID       *string `query:"target_id" validate:"omitempty"`
+		RequestID      *string `query:"request_id" validate:"omitempty"`
+		Start          *int64  `query:"start" validate:"omitempty,numeric"`
+		End            *int64  `query:"end" validate:"omitempty,numeric"`
+	}
+	audit_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[auditListRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(auditListRequest)
+
+		var events []models.AuditEvent
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.AuditEvent{})
+
+		if req.ActorID != nil {
+			con = con.Where("actor_id = ?", *req.ActorID)
+		}
+
+		if req.AuthMethod != nil {
+			con = con.Where(&models.AuditEvent{AuthMethod: *req.AuthMethod})
+		}
+
+		if req.APIKey != nil {
+			con = con.Where(&models.AuditEvent{APIKey: *req.APIKey})
+		}
+
+		if req.Action != nil {
+			con = con.Where("action LIKE ?", "%"+*req.Action+"%")
+		}
+
+		if req.TargetType != nil {
+			con = con.Where(&models.AuditEvent{TargetType: *req.TargetType})
+		}
+
+		if req.TargetID != nil {
+			con = con.Where(&models.AuditEvent{TargetID: *req.TargetID})
+		}
+
+		if req.RequestID != nil {
+			con = con.Where(&models.AuditEvent{RequestID: *req.RequestID})
+		}
+
+		if req.Start != nil {
+			con = con.Where("created_at >= ?", time.Unix(*req.Start, 0))
+		}
+
+		if req.End != nil {
+			con = con.Where("created_at < ?", time.Unix(*req.End, 0))
+		}
+
+		// Count the total number of matching events
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results, newest first
+		con = con.Order("id desc")
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&events)
+
+		response := struct {
+			Data  []models.AuditEvent `json:"data"`
+			Total int64               `json:"total"`
+		}{
+			Data:  events,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
@@ -0,0 +1,205 @@
+package leash_backend_api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	leash_mailer "github.com/mkrcx/mkrcx/src/leash/mailer"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// PENDING_EMAIL_EXPIRATION is how long a pending email change can be verified before it is dropped
+const PENDING_EMAIL_EXPIRATION = 24 * time.Hour
+
+// PENDING_EMAIL_EXPIRY_INTERVAL is how often expired pending email changes are cleared
+const PENDING_EMAIL_EXPIRY_INTERVAL = 10 * time.Minute
+
+var (
+	mailer    leash_mailer.Mailer = leash_mailer.NewLogMailer("leash@localhost", os.Stdout)
+	publicURL                     = ""
+)
+
+// SetMailer sets the mailer used to send verification emails and the public URL of the server used in links
+func SetMailer(m leash_mailer.Mailer, url string) {
+	mailer = m
+	publicURL = url
+}
+
+// setPendingEmail starts a pending email change, or cancels it when email is nil
+func setPendingEmail(user *models.User, email *string) {
+	user.PendingEmail = email
+	user.PendingEmailExpiresAt = nil
+
+	if email != nil {
+		expiresAt := time.Now().Add(PENDING_EMAIL_EXPIRATION)
+		user.PendingEmailExpiresAt = &expiresAt
+	}
+}
+
+// sendEmailVerification sends a link to the user's pending email that promotes it once opened
+func sendEmailVerification(c *fiber.Ctx, user models.User) error {
+	if user.PendingEmail == nil || user.PendingEmailExpiresAt == nil {
+		return errors.New("no pending email")
+	}
+
+	tok, err := jwt.NewBuilder().
+		Issuer(leash_auth.ISSUER).
+		IssuedAt(time.Now()).
+		Expiration(*user.PendingEmailExpiresAt).
+		Audience([]string{"leash", "email-verification"}).
+		Subject(strconv.FormatUint(uint64(user.ID), 10)).
+		Claim("email", *user.PendingEmail).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	signed, err := leash_auth.GetKeys(c).Sign(tok)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/auth/verify_email?" + url.Values{"token": {string(signed)}}.Encode()
+
+	return mailer.Send(c.Context(), leash_mailer.Message{
+		To:      *user.PendingEmail,
+		Subject: "Verify your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"A request was made to change the email address of your account to %s.\n\n"+
+			"Open this link to confirm the change:\n%s\n\n"+
+			"The link expires on %s. If you did not request this change you can ignore this email.\n",
+			user.Name, *user.PendingEmail, link, user.PendingEmailExpiresAt.Format(time.RFC1123)),
+	})
+}
+
+// VerifyPendingEmail checks an email verification token and promotes the pending email it was sent to
+func VerifyPendingEmail(c *fiber.Ctx, token string) (models.User, error) {
+	db := leash_auth.GetDB(c)
+
+	tok, err := leash_auth.GetKeys(c).Parse(token, []string{"leash", "email-verification"})
+	if err != nil {
+		return models.User{}, fiber.NewError(fiber.StatusBadRequest, "Invalid verification link")
+	}
+
+	id, err := strconv.ParseUint(tok.Subject(), 10, 0)
+	if err != nil {
+		return models.User{}, fiber.NewError(fiber.StatusBadRequest, "Invalid verification link")
+	}
+
+	val, valid := tok.Get("email")
+	email, ok := val.(string)
+	if !valid || !ok {
+		return models.User{}, fiber.NewError(fiber.StatusBadRequest, "Invalid verification link")
+	}
+
+	var user models.User
+	if res := db.Limit(1).Where("id = ?", id).Find(&user); res.Error != nil || res.RowsAffected == 0 {
+		return user, fiber.NewError(fiber.StatusNotFound, "User not found")
+	}
+
+	// The link is only valid for the pending change it was sent for
+	if user.PendingEmail == nil || *user.PendingEmail != email {
+		return user, fiber.NewError(fiber.StatusGone, "This email change was cancelled or already verified")
+	}
+
+	if user.PendingEmailExpiresAt != nil && user.PendingEmailExpiresAt.Before(time.Now()) {
+		return user, fiber.NewError(fiber.StatusGone, "This email change has expired")
+	}
+
+	return UpdatePendingEmail(user, c)
+}
+
+// ExpirePendingEmails drops pending email changes that were not verified in time
+func ExpirePendingEmails(db *gorm.DB) error {
+	return db.Model(&models.User{}).
+		Where("pending_email_expires_at < ?", time.Now()).
+		Updates(map[string]interface{}{
+			"pending_email":            nil,
+			"pending_email_expires_at": nil,
+		}).Error
+}
+
+// StartPendingEmailExpiry periodically drops expired pending email changes
+func StartPendingEmailExpiry(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(PENDING_EMAIL_EXPIRY_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := ExpirePendingEmails(db); err != nil {
+				log.Error("Failed to expire pending emails: %s\n", err)
+			}
+		}
+	}()
+}
+
+// addPendingEmailEndpoints creates the endpoints for managing a user's pending email change
+func addPendingEmailEndpoints(user_ep fiber.Router) {
+	pending_ep := user_ep.Group("/pending_email", leash_auth.ConcatPermissionPrefixMiddleware("pending_email"), noServiceMiddleware)
+
+	// Resend the verification email endpoint, the change gets a new expiry
+	pending_ep.Post("/resend", leash_auth.PrefixAuthorizationMiddleware("resend"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+
+		if user.PendingEmail == nil {
+			return fiber.NewError(fiber.StatusNotFound, "No pending email")
+		}
+
+		setPendingEmail(&user, user.PendingEmail)
+
+		if err := sendEmailVerification(c, user); err != nil {
+			log.Error("Failed to send verification email: %s\n", err)
+			return fiber.NewError(fiber.StatusBadGateway, "Failed to send verification email")
+		}
+
+		db.Save(&user)
+
+		return c.JSON(user)
+	})
+
+	// Cancel the pending email change endpoint
+	pending_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+
+		if user.PendingEmail == nil {
+			return fiber.NewError(fiber.StatusNotFound, "No pending email")
+		}
+
+		event := UserUpdateEvent{
+			UserEvent: UserEvent{
+				c:         c,
+				Target:    user,
+				Agent:     leash_auth.GetAuthentication(c).User,
+				Timestamp: time.Now().Unix(),
+			},
+			Changes: []UserChanges{
+				{
+					Old:   *user.PendingEmail,
+					New:   "",
+					Field: "pending_email",
+				},
+			},
+		}
+
+		setPendingEmail(&user, nil)
+		db.Save(&user)
+
+		// Run the update callbacks
+		for _, callback := range userUpdateCallbacks {
+			callback(event)
+		}
+
+		return c.JSON(user)
+	})
+}
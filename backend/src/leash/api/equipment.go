@@ -0,0 +1,291 @@
+package leash_backend_api
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	EQUIPMENT_STATUS_OPERATIONAL = "operational"
+	EQUIPMENT_STATUS_BROKEN      = "broken"
+	EQUIPMENT_STATUS_MAINTENANCE = "maintenance"
+)
+
+// getEquipmentByName fetches a piece of equipment by name
+func getEquipmentByName(db *gorm.DB, name string) (models.Equipment, bool) {
+	var equipment = models.Equipment{
+		Name: name,
+	}
+
+	if res := db.Limit(1).Where(&equipment).Find(&equipment); res.Error != nil || res.RowsAffected == 0 {
+		return equipment, false
+	}
+
+	return equipment, true
+}
+
+// setEquipmentStatus updates the status of a piece of equipment, a reason is required when taking it out of service
+func setEquipmentStatus(equipment *models.Equipment, status string, reason *string, agent models.User) error {
+	if status != EQUIPMENT_STATUS_OPERATIONAL && (reason == nil || *reason == "") {
+		return fiber.NewError(fiber.StatusBadRequest, "A reason is required when marking equipment out of service")
+	}
+
+	equipment.Status = status
+	equipment.StatusUpdatedBy = agent.ID
+	if status == EQUIPMENT_STATUS_OPERATIONAL {
+		equipment.StatusReason = ""
+	} else {
+		equipment.StatusReason = *reason
+	}
+
+	return nil
+}
+
+// equipmentMiddleware is a middleware that fetches the equipment by ID and stores it in the context
+func equipmentMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	authentication := leash_auth.GetAuthentication(c)
+
+	// Check if the user is authorized to perform the action
+	if authentication.Authorize("leash.equipment:target") != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to read equipment")
+	}
+
+	equipment_id, err := strconv.Atoi(c.Params("equipment_id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid equipment ID")
+	}
+
+	var equipment = models.Equipment{
+		ID: uint(equipment_id),
+	}
+
+	if res := db.Limit(1).Where(&equipment).Find(&equipment); res.Error != nil || res.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "Equipment not found")
+	}
+
+	c.Locals("equipment", equipment)
+
+	return c.Next()
+}
+
+// createBaseEquipmentEndpoints creates the base endpoints for the equipment endpoint
+func createBaseEquipmentEndpoints(equipment_ep fiber.Router) {
+	// Create equipment endpoint
+	type equipmentCreateRequest struct {
+		Name             string  `json:"name" xml:"name" form:"name" validate:"required"`
+		Description      *string `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Location         *string `json:"location" xml:"location" form:"location" validate:"omitempty"`
+		RequiredTraining *string `json:"required_training" xml:"required_training" form:"required_training" validate:"omitempty"`
+		MinimumLevel     *string `json:"minimum_level" xml:"minimum_level" form:"minimum_level" validate:"omitempty,oneof=in_progress supervised unsupervised can_train"`
+		Status           *string `json:"status" xml:"status" form:"status" validate:"omitempty,oneof=operational broken maintenance"`
+		StatusReason     *string `json:"status_reason" xml:"status_reason" form:"status_reason" validate:"omitempty"`
+	}
+	equipment_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[equipmentCreateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("body").(equipmentCreateRequest)
+		authenticator := leash_auth.GetAuthentication(c)
+
+		// Check if the equipment already exists
+		if _, ok := getEquipmentByName(db, req.Name); ok {
+			return fiber.NewError(fiber.StatusConflict, "Equipment already exists")
+		}
+
+		equipment := models.Equipment{
+			Name:    req.Name,
+			Status:  EQUIPMENT_STATUS_OPERATIONAL,
+			AddedBy: authenticator.User.ID,
+		}
+
+		if req.Description != nil {
+			equipment.Description = *req.Description
+		}
+
+		if req.Location != nil {
+			equipment.Location = *req.Location
+		}
+
+		if req.RequiredTraining != nil && *req.RequiredTraining != "" {
+			if _, err := getTrainingDefinition(db, *req.RequiredTraining); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "Unknown required training")
+			}
+
+			equipment.RequiredTraining = *req.RequiredTraining
+		}
+
+		if req.MinimumLevel != nil {
+			equipment.MinimumLevel = *req.MinimumLevel
+		}
+
+		if req.Status != nil {
+			if err := setEquipmentStatus(&equipment, *req.Status, req.StatusReason, authenticator.User); err != nil {
+				return err
+			}
+		}
+
+		db.Create(&equipment)
+
+		return c.JSON(equipment)
+	})
+
+	// List equipment endpoint
+	type equipmentListRequest struct {
+		listRequest
+		Status *string `query:"status" validate:"omitempty,oneof=operational broken maintenance"`
+	}
+	equipment_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[equipmentListRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(equipmentListRequest)
+
+		var equipment []models.Equipment
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.Equipment{})
+
+		if req.Status != nil {
+			con = con.Where(&models.Equipment{Status: *req.Status})
+		}
+
+		// Count the total number of equipment
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&equipment)
+
+		response := struct {
+			Data  []models.Equipment `json:"data"`
+			Total int64              `json:"total"`
+		}{
+			Data:  equipment,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
+
+// createCommonEquipmentEndpoints creates the endpoints for a single piece of equipment
+func createCommonEquipmentEndpoints(equipment_ep fiber.Router) {
+	// Get current equipment endpoint
+	equipment_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("get"), func(c *fiber.Ctx) error {
+		equipment := c.Locals("equipment").(models.Equipment)
+		return c.JSON(equipment)
+	})
+
+	// Update current equipment endpoint
+	type equipmentUpdateRequest struct {
+		Name             *string `json:"name" xml:"name" form:"name" validate:"omitempty"`
+		Description      *string `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Location         *string `json:"location" xml:"location" form:"location" validate:"omitempty"`
+		RequiredTraining *string `json:"required_training" xml:"required_training" form:"required_training" validate:"omitempty"`
+		MinimumLevel     *string `json:"minimum_level" xml:"minimum_level" form:"minimum_level" validate:"omitempty,oneof=in_progress supervised unsupervised can_train"`
+		Status           *string `json:"status" xml:"status" form:"status" validate:"omitempty,oneof=operational broken maintenance"`
+		StatusReason     *string `json:"status_reason" xml:"status_reason" form:"status_reason" validate:"omitempty"`
+	}
+	equipment_ep.Patch("/", leash_auth.PrefixAuthorizationMiddleware("update"), models.GetBodyMiddleware[equipmentUpdateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		equipment := c.Locals("equipment").(models.Equipment)
+		req := c.Locals("body").(equipmentUpdateRequest)
+
+		if req.Name != nil && *req.Name != equipment.Name {
+			if _, ok := getEquipmentByName(db, *req.Name); ok {
+				return fiber.NewError(fiber.StatusConflict, "Equipment already exists")
+			}
+
+			equipment.Name = *req.Name
+		}
+
+		if req.Description != nil {
+			equipment.Description = *req.Description
+		}
+
+		if req.Location != nil {
+			equipment.Location = *req.Location
+		}
+
+		if req.RequiredTraining != nil {
+			if *req.RequiredTraining != "" {
+				if _, err := getTrainingDefinition(db, *req.RequiredTraining); err != nil {
+					return fiber.NewError(fiber.StatusBadRequest, "Unknown required training")
+				}
+			}
+
+			equipment.RequiredTraining = *req.RequiredTraining
+		}
+
+		if req.MinimumLevel != nil {
+			equipment.MinimumLevel = *req.MinimumLevel
+		}
+
+		if req.Status != nil {
+			if err := setEquipmentStatus(&equipment, *req.Status, req.StatusReason, leash_auth.GetAuthentication(c).User); err != nil {
+				return err
+			}
+		}
+
+		db.Save(&equipment)
+
+		return c.JSON(equipment)
+	})
+
+	// Update current equipment status endpoint, allows marking equipment out of service without full update access
+	type equipmentStatusRequest struct {
+		Status string  `json:"status" xml:"status" form:"status" validate:"required,oneof=operational broken maintenance"`
+		Reason *string `json:"reason" xml:"reason" form:"reason" validate:"omitempty"`
+	}
+	equipment_ep.Put("/status", leash_auth.PrefixAuthorizationMiddleware("status"), models.GetBodyMiddleware[equipmentStatusRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		equipment := c.Locals("equipment").(models.Equipment)
+		req := c.Locals("body").(equipmentStatusRequest)
+
+		if err := setEquipmentStatus(&equipment, req.Status, req.Reason, leash_auth.GetAuthentication(c).User); err != nil {
+			return err
+		}
+
+		db.Save(&equipment)
+
+		return c.JSON(equipment)
+	})
+
+	// Delete current equipment endpoint
+	equipment_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		equipment := c.Locals("equipment").(models.Equipment)
+
+		db.Delete(&equipment)
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+}
+
+// registerEquipmentEndpoints registers the equipment endpoints
+func registerEquipmentEndpoints(api fiber.Router) {
+	equipment_ep := api.Group("/equipment", leash_auth.ConcatPermissionPrefixMiddleware("equipment"))
+
+	createBaseEquipmentEndpoints(equipment_ep)
+
+	equipment_id_ep := equipment_ep.Group("/:equipment_id", equipmentMiddleware)
+
+	createCommonEquipmentEndpoints(equipment_id_ep)
+}
@@ -255,6 +255,7 @@ func websocketFeedEndpoint(feed_ep fiber.Router, websocketConnections *connList)
 		db := leash_auth.GetDB(c)
 		keys := leash_auth.GetKeys(c)
 		e := leash_auth.GetEnforcer(c)
+		ip := c.IP()
 
 		return websocket.New(func(conn *websocket.Conn) {
 			defer conn.Close()
@@ -276,6 +277,12 @@ func websocketFeedEndpoint(feed_ep fiber.Router, websocketConnections *connList)
 							break
 						}
 
+						// Websockets authenticate after the middleware, so api key restrictions are checked here
+						if authentication.IsAPIKey() && leash_auth.CheckAPIKeyRestrictions(db, authentication.Data.(models.APIKey), ip) != nil {
+							conn.WriteMessage(websocket.TextMessage, []byte("Fail to authenticate"))
+							break
+						}
+
 						websocketConnections.Add(conn, authentication)
 						authenticated = true
 					}
@@ -10,6 +10,9 @@ import (
 	"github.com/mkrcx/mkrcx/src/shared/models"
 )
 
+var holdCreateCallbacks []func(HoldEvent)
+var holdDeleteCallbacks []func(HoldEvent)
+
 // userHoldMiddleware is a middleware that fetches the hold from a user and stores it in the context
 func userHoldMiddleware(c *fiber.Ctx) error {
 	db := leash_auth.GetDB(c)
@@ -78,11 +81,24 @@ func addCommonHoldEndpoints(hold_ep fiber.Router) {
 	hold_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		hold := c.Locals("hold").(models.Hold)
-		hold.RemovedBy = leash_auth.GetAuthentication(c).User.ID
+		authenticator := leash_auth.GetAuthentication(c)
+		hold.RemovedBy = authenticator.User.ID
 
 		db.Save(&hold)
 
 		db.Delete(&hold)
+
+		event := HoldEvent{
+			c:         c,
+			Target:    hold,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range holdDeleteCallbacks {
+			callback(event)
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 }
@@ -146,6 +162,7 @@ func addUserHoldsEndpoints(user_ep fiber.Router) {
 	hold_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[holdCreateRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		user := c.Locals("target_user").(models.User)
+		authenticator := leash_auth.GetAuthentication(c)
 		body := c.Locals("body").(holdCreateRequest)
 
 		// Check if the user already has a hold of this type
@@ -161,7 +178,7 @@ func addUserHoldsEndpoints(user_ep fiber.Router) {
 			Name:           body.Name,
 			Reason:         body.Reason,
 			UserID:         user.ID,
-			AddedBy:        leash_auth.GetAuthentication(c).User.ID,
+			AddedBy:        authenticator.User.ID,
 			ResolutionLink: body.ResolutionLink,
 			Priority:       *body.Priority,
 		}
@@ -186,6 +203,17 @@ func addUserHoldsEndpoints(user_ep fiber.Router) {
 
 		db.Save(&hold)
 
+		event := HoldEvent{
+			c:         c,
+			Target:    hold,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range holdCreateCallbacks {
+			callback(event)
+		}
+
 		return c.JSON(hold)
 	})
 
@@ -198,7 +226,20 @@ func addUserHoldsEndpoints(user_ep fiber.Router) {
 func registerHoldsEndpoints(api fiber.Router) {
 	holds_ep := api.Group("/holds", leash_auth.ConcatPermissionPrefixMiddleware("holds"))
 
+	holdCreateCallbacks = []func(HoldEvent){}
+	holdDeleteCallbacks = []func(HoldEvent){}
+
 	single_hold_ep := holds_ep.Group("/:hold_id", generalHoldMiddleware)
 
 	addCommonHoldEndpoints(single_hold_ep)
 }
+
+// OnHoldCreate registers a callback to be called when a hold is created
+func OnHoldCreate(callback func(HoldEvent)) {
+	holdCreateCallbacks = append(holdCreateCallbacks, callback)
+}
+
+// OnHoldDelete registers a callback to be called when a hold is deleted
+func OnHoldDelete(callback func(HoldEvent)) {
+	holdDeleteCallbacks = append(holdDeleteCallbacks, callback)
+}
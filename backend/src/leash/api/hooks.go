@@ -27,3 +27,51 @@ type UserUpdateEvent struct {
 	UserEvent
 	Changes []UserChanges `json:"changes"`
 }
+
+type TrainingEvent struct {
+	c         *fiber.Ctx
+	Target    models.Training `json:"target"`
+	Agent     models.User     `json:"agent"`
+	Timestamp int64           `json:"time"`
+}
+
+// GetCtx returns the context of the event
+func (e *TrainingEvent) GetCtx() *fiber.Ctx {
+	return e.c
+}
+
+type HoldEvent struct {
+	c         *fiber.Ctx
+	Target    models.Hold `json:"target"`
+	Agent     models.User `json:"agent"`
+	Timestamp int64       `json:"time"`
+}
+
+// GetCtx returns the context of the event
+func (e *HoldEvent) GetCtx() *fiber.Ctx {
+	return e.c
+}
+
+type NotificationEvent struct {
+	c         *fiber.Ctx
+	Target    models.Notification `json:"target"`
+	Agent     models.User         `json:"agent"`
+	Timestamp int64               `json:"time"`
+}
+
+// GetCtx returns the context of the event
+func (e *NotificationEvent) GetCtx() *fiber.Ctx {
+	return e.c
+}
+
+type APIKeyEvent struct {
+	c         *fiber.Ctx
+	Target    models.APIKey `json:"target"`
+	Agent     models.User   `json:"agent"`
+	Timestamp int64         `json:"time"`
+}
+
+// GetCtx returns the context of the event
+func (e *APIKeyEvent) GetCtx() *fiber.Ctx {
+	return e.c
+}
@@ -2,12 +2,16 @@ package leash_backend_api
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 )
 
+var notificationCreateCallbacks []func(NotificationEvent)
+var notificationDeleteCallbacks []func(NotificationEvent)
+
 // userNotificationMiddleware is a middleware that fetches the notification from a user and stores it in the context
 func userNotificationMiddleware(c *fiber.Ctx) error {
 	db := leash_auth.GetDB(c)
@@ -77,12 +81,24 @@ func addCommonNotificationEndpoints(notification_ep fiber.Router) {
 	notification_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		notification := c.Locals("notification").(models.Notification)
+		authenticator := leash_auth.GetAuthentication(c)
 
-		notification.RemovedBy = leash_auth.GetAuthentication(c).User.ID
+		notification.RemovedBy = authenticator.User.ID
 		db.Save(&notification)
 
 		db.Delete(&notification)
 
+		event := NotificationEvent{
+			c:         c,
+			Target:    notification,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range notificationDeleteCallbacks {
+			callback(event)
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 }
@@ -144,6 +160,7 @@ func addUserNotificationsEndpoints(user_ep fiber.Router) {
 	notification_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[notificationCreateRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		user := c.Locals("target_user").(models.User)
+		authenticator := leash_auth.GetAuthentication(c)
 		body := c.Locals("body").(notificationCreateRequest)
 
 		if body.Link == nil {
@@ -156,7 +173,7 @@ func addUserNotificationsEndpoints(user_ep fiber.Router) {
 
 		notification := models.Notification{
 			UserID:  user.ID,
-			AddedBy: leash_auth.GetAuthentication(c).User.ID,
+			AddedBy: authenticator.User.ID,
 			Title:   body.Title,
 			Message: body.Message,
 			Link:    *body.Link,
@@ -165,6 +182,17 @@ func addUserNotificationsEndpoints(user_ep fiber.Router) {
 
 		db.Save(&notification)
 
+		event := NotificationEvent{
+			c:         c,
+			Target:    notification,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range notificationCreateCallbacks {
+			callback(event)
+		}
+
 		return c.JSON(notification)
 	})
 
@@ -177,7 +205,20 @@ func addUserNotificationsEndpoints(user_ep fiber.Router) {
 func registerNotificationsEndpoints(api fiber.Router) {
 	notification_ep := api.Group("/notifications", leash_auth.ConcatPermissionPrefixMiddleware("notifications"))
 
+	notificationCreateCallbacks = []func(NotificationEvent){}
+	notificationDeleteCallbacks = []func(NotificationEvent){}
+
 	single_notification_ep := notification_ep.Group("/:notification_id", generalNotificationMiddleware)
 
 	addCommonNotificationEndpoints(single_notification_ep)
 }
+
+// OnNotificationCreate registers a callback to be called when a notification is created
+func OnNotificationCreate(callback func(NotificationEvent)) {
+	notificationCreateCallbacks = append(notificationCreateCallbacks, callback)
+}
+
+// OnNotificationDelete registers a callback to be called when a notification is deleted
+func OnNotificationDelete(callback func(NotificationEvent)) {
+	notificationDeleteCallbacks = append(notificationDeleteCallbacks, callback)
+}
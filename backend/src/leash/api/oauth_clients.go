@@ -0,0 +1,254 @@
+package leash_backend_api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+)
+
+// oauthClientResponse is an OAuth client along with its secret, which is only returned when it is generated
+type oauthClientResponse struct {
+	models.OAuthClient
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// generateOAuthClientSecret generates a random secret for a confidential OAuth client
+func generateOAuthClientSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validateOAuthScopes returns an error if any of the scopes are unknown
+func validateOAuthScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if _, ok := leash_auth.GetOAuthScope(scope); !ok {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown OAuth scope: %s", scope))
+		}
+	}
+
+	return nil
+}
+
+// oauthClientMiddleware is a middleware that fetches the OAuth client by client ID and stores it in the context
+func oauthClientMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	authentication := leash_auth.GetAuthentication(c)
+
+	// Check if the user is authorized to perform the action
+	if authentication.Authorize("leash.oauth_clients:target") != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to read OAuth clients")
+	}
+
+	var client models.OAuthClient
+	if res := db.Limit(1).Where("client_id = ?", c.Params("client_id")).Find(&client); res.Error != nil || res.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "OAuth client not found")
+	}
+
+	c.Locals("oauth_client", client)
+
+	return c.Next()
+}
+
+// createBaseOAuthClientEndpoints creates the base endpoints for the OAuth client endpoint
+func createBaseOAuthClientEndpoints(client_ep fiber.Router) {
+	// Create OAuth client endpoint
+	type oauthClientCreateRequest struct {
+		Name         string   `json:"name" xml:"name" form:"name" validate:"required"`
+		Description  *string  `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		RedirectURIs []string `json:"redirect_uris" xml:"redirect_uris" form:"redirect_uris" validate:"required,min=1,dive,url"`
+		Scopes       []string `json:"scopes" xml:"scopes" form:"scopes" validate:"required,min=1"`
+		Confidential *bool    `json:"confidential" xml:"confidential" form:"confidential" validate:"omitempty"`
+	}
+	client_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[oauthClientCreateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("body").(oauthClientCreateRequest)
+
+		if err := validateOAuthScopes(req.Scopes); err != nil {
+			return err
+		}
+
+		client := models.OAuthClient{
+			ClientID:     uuid.New().String(),
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+			Scopes:       req.Scopes,
+			Confidential: true,
+			AddedBy:      leash_auth.GetAuthentication(c).User.ID,
+		}
+
+		if req.Description != nil {
+			client.Description = *req.Description
+		}
+
+		if req.Confidential != nil {
+			client.Confidential = *req.Confidential
+		}
+
+		// Only the hash of the secret is stored, so it is returned this once
+		response := oauthClientResponse{}
+		if client.Confidential {
+			secret, err := generateOAuthClientSecret()
+			if err != nil {
+				log.Error("Failed to generate OAuth client secret: %s\n", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			client.SecretHash = leash_auth.HashOAuthSecret(secret)
+			response.ClientSecret = secret
+		}
+
+		if res := db.Create(&client); res.Error != nil {
+			log.Error("Failed to create OAuth client: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		response.OAuthClient = client
+
+		return c.JSON(response)
+	})
+
+	// List OAuth clients endpoint
+	client_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		var clients []models.OAuthClient
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.OAuthClient{})
+
+		// Count the total number of clients
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&clients)
+
+		response := struct {
+			Data  []models.OAuthClient `json:"data"`
+			Total int64                `json:"total"`
+		}{
+			Data:  clients,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
+
+// createCommonOAuthClientEndpoints creates the endpoints for a single OAuth client
+func createCommonOAuthClientEndpoints(client_ep fiber.Router) {
+	// Get current OAuth client endpoint
+	client_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("get"), func(c *fiber.Ctx) error {
+		client := c.Locals("oauth_client").(models.OAuthClient)
+		return c.JSON(client)
+	})
+
+	// Update current OAuth client endpoint
+	type oauthClientUpdateRequest struct {
+		Name         *string   `json:"name" xml:"name" form:"name" validate:"omitempty,min=1"`
+		Description  *string   `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		RedirectURIs *[]string `json:"redirect_uris" xml:"redirect_uris" form:"redirect_uris" validate:"omitempty,min=1,dive,url"`
+		Scopes       *[]string `json:"scopes" xml:"scopes" form:"scopes" validate:"omitempty,min=1"`
+	}
+	client_ep.Patch("/", leash_auth.PrefixAuthorizationMiddleware("update"), models.GetBodyMiddleware[oauthClientUpdateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		client := c.Locals("oauth_client").(models.OAuthClient)
+		req := c.Locals("body").(oauthClientUpdateRequest)
+
+		if req.Name != nil {
+			client.Name = *req.Name
+		}
+
+		if req.Description != nil {
+			client.Description = *req.Description
+		}
+
+		if req.RedirectURIs != nil {
+			client.RedirectURIs = *req.RedirectURIs
+		}
+
+		if req.Scopes != nil {
+			if err := validateOAuthScopes(*req.Scopes); err != nil {
+				return err
+			}
+
+			client.Scopes = *req.Scopes
+		}
+
+		db.Save(&client)
+
+		return c.JSON(client)
+	})
+
+	// Replace the secret of the current OAuth client endpoint
+	client_ep.Post("/secret", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		client := c.Locals("oauth_client").(models.OAuthClient)
+
+		if !client.Confidential {
+			return fiber.NewError(fiber.StatusBadRequest, "Public clients do not have a secret")
+		}
+
+		secret, err := generateOAuthClientSecret()
+		if err != nil {
+			log.Error("Failed to generate OAuth client secret: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		client.SecretHash = leash_auth.HashOAuthSecret(secret)
+		db.Save(&client)
+
+		return c.JSON(oauthClientResponse{
+			OAuthClient:  client,
+			ClientSecret: secret,
+		})
+	})
+
+	// Delete current OAuth client endpoint, tokens already issued to it stop working
+	client_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		client := c.Locals("oauth_client").(models.OAuthClient)
+
+		db.Delete(&client)
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+}
+
+// registerOAuthClientEndpoints registers the endpoints for managing OAuth clients
+func registerOAuthClientEndpoints(api fiber.Router) {
+	clients_ep := api.Group("/oauth_clients", leash_auth.ConcatPermissionPrefixMiddleware("oauth_clients"))
+
+	createBaseOAuthClientEndpoints(clients_ep)
+
+	client_ep := clients_ep.Group("/:client_id", oauthClientMiddleware)
+
+	createCommonOAuthClientEndpoints(client_ep)
+}
@@ -0,0 +1,143 @@
+package leash_backend_api
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+)
+
+// RegisterUser creates a self-registered user and runs the create callbacks with the user as the agent
+func RegisterUser(c *fiber.Ctx, user models.User) (models.User, error) {
+	db := leash_auth.GetDB(c)
+
+	// Check if the email is already used or pending for another user
+	_, err := searchEmail(db, user.Email)
+	if err == nil {
+		return user, fiber.NewError(fiber.StatusConflict, "User already exists")
+	}
+
+	res := db.Create(&user)
+	if res.Error != nil {
+		return user, fiber.NewError(fiber.StatusInternalServerError, "Failed to create user")
+	}
+
+	event := UserEvent{
+		c:         c,
+		Target:    user,
+		Agent:     user,
+		Timestamp: time.Now().Unix(),
+	}
+
+	for _, callback := range userCreateCallbacks {
+		callback(event)
+	}
+
+	return user, nil
+}
+
+// createRegistrationEndpoints creates the endpoints for reviewing self-registered users
+func createRegistrationEndpoints(users_ep fiber.Router) {
+	// List users waiting for approval endpoint
+	users_ep.Get("/pending", leash_auth.PrefixAuthorizationMiddleware("pending"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		var users []models.User
+
+		con := db.Model(&models.User{}).Where("pending_approval = ?", true)
+
+		// Count the total number of users
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Order("created_at").Find(&users)
+
+		response := struct {
+			Data  []models.User `json:"data"`
+			Total int64         `json:"total"`
+		}{
+			Data:  users,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
+
+// reviewUserEndpoints creates the endpoints for approving or rejecting a self-registered user
+func reviewUserEndpoints(user_ep fiber.Router) {
+	// Approve a registration, letting the user sign in
+	user_ep.Post("/approve", leash_auth.PrefixAuthorizationMiddleware("approve"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+
+		if !user.PendingApproval {
+			return fiber.NewError(fiber.StatusConflict, "User is not pending approval")
+		}
+
+		user.PendingApproval = false
+		db.Model(&user).Update("pending_approval", false)
+
+		event := UserUpdateEvent{
+			UserEvent: UserEvent{
+				c:         c,
+				Target:    user,
+				Agent:     leash_auth.GetAuthentication(c).User,
+				Timestamp: time.Now().Unix(),
+			},
+			Changes: []UserChanges{
+				{
+					Old:   "true",
+					New:   "false",
+					Field: "pending_approval",
+				},
+			},
+		}
+
+		for _, callback := range userUpdateCallbacks {
+			callback(event)
+		}
+
+		return c.JSON(user)
+	})
+
+	// Reject a registration, the user is removed so the email can register again
+	user_ep.Post("/reject", leash_auth.PrefixAuthorizationMiddleware("reject"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+
+		if !user.PendingApproval {
+			return fiber.NewError(fiber.StatusConflict, "User is not pending approval")
+		}
+
+		db.Unscoped().Delete(&user)
+
+		event := UserEvent{
+			c:         c,
+			Target:    user,
+			Agent:     leash_auth.GetAuthentication(c).User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range userDeleteCallbacks {
+			callback(event)
+		}
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+}
@@ -0,0 +1,262 @@
+package leash_backend_api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// DEFAULT_REPORT_RANGE is how far back reports look when no start is given
+const DEFAULT_REPORT_RANGE = 365 * 24 * time.Hour
+
+type reportRequest struct {
+	Start   *int64  `query:"start" validate:"omitempty,numeric"`
+	End     *int64  `query:"end" validate:"omitempty,numeric"`
+	GroupBy *string `query:"group_by" validate:"omitempty,oneof=day week month year"`
+	Format  *string `query:"format" validate:"omitempty,oneof=json csv"`
+	By      *string `query:"by" validate:"omitempty,oneof=type major role"`
+}
+
+type reportRow struct {
+	Period string `json:"period"`
+	Group  string `json:"group"`
+	Count  int64  `json:"count"`
+}
+
+type report struct {
+	Name    string      `json:"name"`
+	Start   int64       `json:"start"`
+	End     int64       `json:"end"`
+	GroupBy string      `json:"group_by"`
+	Data    []reportRow `json:"data"`
+}
+
+// reportRange returns the time range and period grouping requested for a report
+func reportRange(req reportRequest) (time.Time, time.Time, string, error) {
+	end := time.Now()
+	if req.End != nil {
+		end = time.Unix(*req.End, 0)
+	}
+
+	start := end.Add(-DEFAULT_REPORT_RANGE)
+	if req.Start != nil {
+		start = time.Unix(*req.Start, 0)
+	}
+
+	if start.After(end) {
+		return start, end, "", fiber.NewError(fiber.StatusBadRequest, "Start must be before end")
+	}
+
+	groupBy := "month"
+	if req.GroupBy != nil {
+		groupBy = *req.GroupBy
+	}
+
+	return start, end, groupBy, nil
+}
+
+// reportPeriod formats a time as the period it falls in
+func reportPeriod(t time.Time, groupBy string) string {
+	switch groupBy {
+	case "day":
+		return t.Format("2006-01-02")
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "year":
+		return t.Format("2006")
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+// reportCounter tallies report rows by period and group
+type reportCounter struct {
+	groupBy string
+	counts  map[[2]string]int64
+}
+
+func newReportCounter(groupBy string) *reportCounter {
+	return &reportCounter{
+		groupBy: groupBy,
+		counts:  map[[2]string]int64{},
+	}
+}
+
+// Add counts one occurrence of group at time t
+func (r *reportCounter) Add(t time.Time, group string) {
+	r.counts[[2]string{reportPeriod(t, r.groupBy), group}]++
+}
+
+// Rows returns the tallied rows sorted by period then group
+func (r *reportCounter) Rows() []reportRow {
+	rows := []reportRow{}
+	for key, count := range r.counts {
+		rows = append(rows, reportRow{
+			Period: key[0],
+			Group:  key[1],
+			Count:  count,
+		})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Period != rows[j].Period {
+			return rows[i].Period < rows[j].Period
+		}
+
+		return rows[i].Group < rows[j].Group
+	})
+
+	return rows
+}
+
+// sendReport responds with the report as JSON or CSV
+func sendReport(c *fiber.Ctx, req reportRequest, rep report) error {
+	if req.Format == nil || *req.Format == "json" {
+		return c.JSON(rep)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"period", "group", "count"})
+	for _, row := range rep.Data {
+		w.Write([]string{row.Period, row.Group, strconv.FormatInt(row.Count, 10)})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.csv\"", rep.Name))
+	return c.Send(buf.Bytes())
+}
+
+// reportEndpoint creates a handler that builds a report over a time range
+func reportEndpoint(name string, build func(db *gorm.DB, req reportRequest, start time.Time, end time.Time, counter *reportCounter) error) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(reportRequest)
+
+		start, end, groupBy, err := reportRange(req)
+		if err != nil {
+			return err
+		}
+
+		counter := newReportCounter(groupBy)
+		if err := build(db, req, start, end, counter); err != nil {
+			return err
+		}
+
+		return sendReport(c, req, report{
+			Name:    name,
+			Start:   start.Unix(),
+			End:     end.Unix(),
+			GroupBy: groupBy,
+			Data:    counter.Rows(),
+		})
+	}
+}
+
+// registerReportEndpoints registers the reporting endpoints
+func registerReportEndpoints(api fiber.Router) {
+	reports_ep := api.Group("/reports", leash_auth.ConcatPermissionPrefixMiddleware("reports"))
+
+	// Visitors report endpoint, counts unique visitors and total visits
+	reports_ep.Get("/visitors", leash_auth.PrefixAuthorizationMiddleware("visitors"), models.GetQueryMiddleware[reportRequest], reportEndpoint("visitors", func(db *gorm.DB, _ reportRequest, start time.Time, end time.Time, counter *reportCounter) error {
+		var visits []models.Visit
+		if err := db.Select("user_id", "check_in").Where("check_in BETWEEN ? AND ?", start, end).Find(&visits).Error; err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		for _, visit := range visits {
+			counter.Add(visit.CheckIn, "visits")
+
+			key := fmt.Sprintf("%s:%d", reportPeriod(visit.CheckIn, counter.groupBy), visit.UserID)
+			if !seen[key] {
+				seen[key] = true
+				counter.Add(visit.CheckIn, "unique_visitors")
+			}
+		}
+
+		return nil
+	}))
+
+	// Trainings report endpoint, counts trainings granted per training
+	reports_ep.Get("/trainings", leash_auth.PrefixAuthorizationMiddleware("trainings"), models.GetQueryMiddleware[reportRequest], reportEndpoint("trainings", func(db *gorm.DB, _ reportRequest, start time.Time, end time.Time, counter *reportCounter) error {
+		var trainings []models.Training
+		if err := db.Unscoped().Select("name", "created_at").Where("created_at BETWEEN ? AND ?", start, end).Find(&trainings).Error; err != nil {
+			return err
+		}
+
+		for _, training := range trainings {
+			counter.Add(training.CreatedAt, training.Name)
+		}
+
+		return nil
+	}))
+
+	// Holds report endpoint, counts holds placed per hold type
+	reports_ep.Get("/holds", leash_auth.PrefixAuthorizationMiddleware("holds"), models.GetQueryMiddleware[reportRequest], reportEndpoint("holds", func(db *gorm.DB, _ reportRequest, start time.Time, end time.Time, counter *reportCounter) error {
+		var holds []models.Hold
+		if err := db.Unscoped().Select("name", "created_at").Where("created_at BETWEEN ? AND ?", start, end).Find(&holds).Error; err != nil {
+			return err
+		}
+
+		for _, hold := range holds {
+			counter.Add(hold.CreatedAt, hold.Name)
+		}
+
+		return nil
+	}))
+
+	// Members report endpoint, counts new members grouped by type, major or role
+	reports_ep.Get("/members", leash_auth.PrefixAuthorizationMiddleware("members"), models.GetQueryMiddleware[reportRequest], reportEndpoint("members", func(db *gorm.DB, req reportRequest, start time.Time, end time.Time, counter *reportCounter) error {
+		by := "type"
+		if req.By != nil {
+			by = *req.By
+		}
+
+		var users []models.User
+		if err := db.Unscoped().Select("type", "major", "role", "created_at").Where("role <> ?", "service").Where("created_at BETWEEN ? AND ?", start, end).Find(&users).Error; err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			switch by {
+			case "major":
+				counter.Add(user.CreatedAt, user.Major)
+			case "role":
+				counter.Add(user.CreatedAt, user.Role)
+			default:
+				counter.Add(user.CreatedAt, user.Type)
+			}
+		}
+
+		return nil
+	}))
+
+	// Updates report endpoint, counts user updates per changed field
+	reports_ep.Get("/updates", leash_auth.PrefixAuthorizationMiddleware("updates"), models.GetQueryMiddleware[reportRequest], reportEndpoint("updates", func(db *gorm.DB, _ reportRequest, start time.Time, end time.Time, counter *reportCounter) error {
+		var updates []models.UserUpdate
+		if err := db.Unscoped().Select("field", "created_at").Where("created_at BETWEEN ? AND ?", start, end).Find(&updates).Error; err != nil {
+			return err
+		}
+
+		for _, update := range updates {
+			counter.Add(update.CreatedAt, update.Field)
+		}
+
+		return nil
+	}))
+}
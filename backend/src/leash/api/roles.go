@@ -0,0 +1,407 @@
+package leash_backend_api
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// ROLE_PREFIX starts the casbin subject of every Leash permission role
+const ROLE_PREFIX = "leash:"
+
+// role is a Leash permission role and what it grants
+type role struct {
+	Name string
+
+	// Inherits are the roles whose permissions this role also has
+	Inherits []string
+
+	// Members are the subjects given this role, mkr.cx roles (role:), users (user:) and roles inheriting it
+	Members     []string
+	Permissions []string
+
+	// Default roles are seeded by Leash and can not be deleted
+	Default bool
+
+	ImplicitRoles       []string `json:",omitempty"`
+	ImplicitPermissions []string `json:",omitempty"`
+}
+
+// roleSubject returns the casbin subject for a role name, which may be given with or without its prefix
+func roleSubject(name string) string {
+	if strings.HasPrefix(name, ROLE_PREFIX) {
+		return name
+	}
+
+	return ROLE_PREFIX + name
+}
+
+// listRoleSubjects returns every Leash permission role with a permission, a member or a role it inherits
+func listRoleSubjects(enforcer *casbin.Enforcer) []string {
+	subjects := map[string]bool{}
+	for _, subject := range append(enforcer.GetAllSubjects(), enforcer.GetAllRoles()...) {
+		if strings.HasPrefix(subject, ROLE_PREFIX) {
+			subjects[subject] = true
+		}
+	}
+
+	for _, grouping := range enforcer.GetGroupingPolicy() {
+		if len(grouping) > 0 && strings.HasPrefix(grouping[0], ROLE_PREFIX) {
+			subjects[grouping[0]] = true
+		}
+	}
+
+	names := []string{}
+	for subject := range subjects {
+		names = append(names, subject)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// loadRole reads a role from casbin, with the roles and permissions it inherits if implicit is set
+func loadRole(db *gorm.DB, enforcer *casbin.Enforcer, name string, implicit bool) (role, error) {
+	r := role{
+		Name:        name,
+		Inherits:    []string{},
+		Members:     []string{},
+		Permissions: []string{},
+	}
+
+	inherits, err := enforcer.GetRolesForUser(name)
+	if err != nil {
+		return r, err
+	}
+
+	members, err := enforcer.GetUsersForRole(name)
+	if err != nil {
+		return r, err
+	}
+
+	r.Inherits = append(r.Inherits, inherits...)
+	r.Members = append(r.Members, members...)
+
+	perms, err := enforcer.GetPermissionsForUser(name)
+	if err != nil {
+		return r, err
+	}
+
+	for _, p := range perms {
+		r.Permissions = append(r.Permissions, p[1])
+	}
+
+	sort.Strings(r.Inherits)
+	sort.Strings(r.Members)
+	sort.Strings(r.Permissions)
+
+	// Roles are default if Leash ever seeded a permission for them or gave them to a subject
+	var seeds int64
+	db.Model(&models.PolicySeed{}).
+		Where("(type = ? AND subject = ?) OR (type = ? AND object = ?)", "p", name, "g", name).
+		Count(&seeds)
+	r.Default = seeds > 0
+
+	if !implicit {
+		return r, nil
+	}
+
+	implicitRoles, err := enforcer.GetImplicitRolesForUser(name)
+	if err != nil {
+		return r, err
+	}
+
+	r.ImplicitRoles = append([]string{}, implicitRoles...)
+
+	implicitPerms, err := enforcer.GetImplicitPermissionsForUser(name)
+	if err != nil {
+		return r, err
+	}
+
+	r.ImplicitPermissions = []string{}
+	for _, p := range implicitPerms {
+		if !slices.Contains(r.ImplicitPermissions, p[1]) {
+			r.ImplicitPermissions = append(r.ImplicitPermissions, p[1])
+		}
+	}
+
+	sort.Strings(r.ImplicitRoles)
+	sort.Strings(r.ImplicitPermissions)
+
+	return r, nil
+}
+
+// validateRoleMember returns an error if the subject can not be given the role
+func validateRoleMember(enforcer *casbin.Enforcer, name string, subject string) error {
+	switch {
+	case strings.HasPrefix(subject, "role:"), strings.HasPrefix(subject, "user:"):
+		return nil
+	case strings.HasPrefix(subject, ROLE_PREFIX):
+		if subject == name {
+			return fiber.NewError(fiber.StatusBadRequest, "A role can not inherit itself")
+		}
+
+		// The member inherits the role, so the role must not already inherit the member
+		inherited, err := enforcer.GetImplicitRolesForUser(name)
+		if err != nil {
+			return err
+		}
+
+		if slices.Contains(inherited, subject) {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s already inherits %s", name, subject))
+		}
+
+		return nil
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Members must start with role:, user: or %s", ROLE_PREFIX))
+	}
+}
+
+// roleMiddleware is a middleware that fetches the role by name and stores it in the context
+func roleMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	enforcer := leash_auth.GetEnforcer(c)
+	authentication := leash_auth.GetAuthentication(c)
+
+	// Check if the user is authorized to perform the action
+	if authentication.Authorize("leash.roles:target") != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to read roles")
+	}
+
+	name, err := url.PathUnescape(c.Params("role"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid role")
+	}
+
+	name = roleSubject(name)
+	if !slices.Contains(listRoleSubjects(enforcer), name) {
+		return fiber.NewError(fiber.StatusNotFound, "Role not found")
+	}
+
+	r, err := loadRole(db, enforcer, name, false)
+	if err != nil {
+		return err
+	}
+
+	c.Locals("role", r)
+
+	return c.Next()
+}
+
+// createBaseRoleEndpoints creates the base endpoints for the role endpoint
+func createBaseRoleEndpoints(roles_ep fiber.Router) {
+	// List roles endpoint
+	roles_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		enforcer := leash_auth.GetEnforcer(c)
+
+		roles := []role{}
+		for _, name := range listRoleSubjects(enforcer) {
+			r, err := loadRole(db, enforcer, name, false)
+			if err != nil {
+				return err
+			}
+
+			roles = append(roles, r)
+		}
+
+		response := struct {
+			Data  []role `json:"data"`
+			Total int64  `json:"total"`
+		}{
+			Data:  roles,
+			Total: int64(len(roles)),
+		}
+
+		return c.JSON(response)
+	})
+
+	// Create custom role endpoint
+	type roleCreateRequest struct {
+		Name        string   `json:"name" xml:"name" form:"name" validate:"required,notblank,excludesall=:/ "`
+		Inherits    []string `json:"inherits" xml:"inherits" form:"inherits" validate:"omitempty"`
+		Members     []string `json:"members" xml:"members" form:"members" validate:"omitempty"`
+		Permissions []string `json:"permissions" xml:"permissions" form:"permissions" validate:"omitempty,dive,required"`
+	}
+	roles_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[roleCreateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		enforcer := leash_auth.GetEnforcer(c)
+		req := c.Locals("body").(roleCreateRequest)
+
+		// Roles only exist through their policies, so a role without any would not be found again
+		if len(req.Inherits) == 0 && len(req.Members) == 0 && len(req.Permissions) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "A role needs a permission, a member or a role to inherit")
+		}
+
+		roles := listRoleSubjects(enforcer)
+		name := roleSubject(req.Name)
+		if slices.Contains(roles, name) {
+			return fiber.NewError(fiber.StatusConflict, "Role already exists")
+		}
+
+		// Everything the new role will inherit, which none of its members may be
+		inherited := []string{}
+		for _, parent := range req.Inherits {
+			parent = roleSubject(parent)
+			if !slices.Contains(roles, parent) {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Role %s not found", parent))
+			}
+
+			implicit, err := enforcer.GetImplicitRolesForUser(parent)
+			if err != nil {
+				return err
+			}
+
+			inherited = append(append(inherited, parent), implicit...)
+		}
+
+		for _, member := range req.Members {
+			if err := validateRoleMember(enforcer, name, member); err != nil {
+				return err
+			}
+
+			if slices.Contains(inherited, member) {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s would inherit %s", name, member))
+			}
+		}
+
+		for _, parent := range req.Inherits {
+			enforcer.AddRoleForUser(name, roleSubject(parent))
+		}
+
+		for _, member := range req.Members {
+			enforcer.AddRoleForUser(member, name)
+		}
+
+		for _, permission := range req.Permissions {
+			enforcer.AddPermissionForUser(name, permission)
+		}
+
+		enforcer.SavePolicy()
+
+		r, err := loadRole(db, enforcer, name, true)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(r)
+	})
+}
+
+// createCommonRoleEndpoints creates the endpoints for a single role
+func createCommonRoleEndpoints(role_ep fiber.Router) {
+	// Get role endpoint, with everything it inherits
+	role_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("get"), func(c *fiber.Ctx) error {
+		r := c.Locals("role").(role)
+
+		r, err := loadRole(leash_auth.GetDB(c), leash_auth.GetEnforcer(c), r.Name, true)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(r)
+	})
+
+	// Delete custom role endpoint
+	role_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		enforcer := leash_auth.GetEnforcer(c)
+		r := c.Locals("role").(role)
+
+		if r.Default {
+			return fiber.NewError(fiber.StatusBadRequest, "Default roles can not be deleted")
+		}
+
+		// Remove the roles it inherits as well as its members and permissions
+		if _, err := enforcer.DeleteUser(r.Name); err != nil {
+			return err
+		}
+
+		if _, err := enforcer.DeleteRole(r.Name); err != nil {
+			return err
+		}
+
+		enforcer.SavePolicy()
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	// changeRole applies a change to the role and responds with the role after it
+	changeRole := func(c *fiber.Ctx, change func(enforcer *casbin.Enforcer, name string, value string) error) error {
+		db := leash_auth.GetDB(c)
+		enforcer := leash_auth.GetEnforcer(c)
+		r := c.Locals("role").(role)
+
+		value, err := url.PathUnescape(c.Params("value"))
+		if err != nil || value == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid value")
+		}
+
+		if err := change(enforcer, r.Name, value); err != nil {
+			return err
+		}
+
+		enforcer.SavePolicy()
+
+		r, err = loadRole(db, enforcer, r.Name, false)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(r)
+	}
+
+	// Add permission to role endpoint
+	role_ep.Put("/permissions/:value", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		return changeRole(c, func(enforcer *casbin.Enforcer, name string, permission string) error {
+			_, err := enforcer.AddPermissionForUser(name, permission)
+			return err
+		})
+	})
+
+	// Remove permission from role endpoint
+	role_ep.Delete("/permissions/:value", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		return changeRole(c, func(enforcer *casbin.Enforcer, name string, permission string) error {
+			_, err := enforcer.DeletePermissionForUser(name, permission)
+			return err
+		})
+	})
+
+	// Give role to a member endpoint
+	role_ep.Put("/members/:value", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		return changeRole(c, func(enforcer *casbin.Enforcer, name string, member string) error {
+			if err := validateRoleMember(enforcer, name, member); err != nil {
+				return err
+			}
+
+			_, err := enforcer.AddRoleForUser(member, name)
+			return err
+		})
+	})
+
+	// Take role from a member endpoint
+	role_ep.Delete("/members/:value", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		return changeRole(c, func(enforcer *casbin.Enforcer, name string, member string) error {
+			_, err := enforcer.DeleteRoleForUser(member, name)
+			return err
+		})
+	})
+}
+
+// registerRoleEndpoints registers the role endpoints
+func registerRoleEndpoints(api fiber.Router) {
+	roles_ep := api.Group("/roles", leash_auth.ConcatPermissionPrefixMiddleware("roles"))
+
+	createBaseRoleEndpoints(roles_ep)
+
+	role_ep := roles_ep.Group("/:role", roleMiddleware)
+
+	createCommonRoleEndpoints(role_ep)
+}
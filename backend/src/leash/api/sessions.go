@@ -0,0 +1,169 @@
+package leash_backend_api
+
+import (
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// SESSION_SWEEP_INTERVAL is how often expired sessions are purged
+const SESSION_SWEEP_INTERVAL = time.Hour
+
+// sessionResponse is a session along with whether it is the one making the request
+type sessionResponse struct {
+	models.Session
+	Current bool
+}
+
+// currentSessionID returns the session making the request, or an empty string for api keys
+func currentSessionID(c *fiber.Ctx) string {
+	authentication := leash_auth.GetAuthentication(c)
+	if !authentication.IsUser() {
+		return ""
+	}
+
+	return authentication.Data.(string)
+}
+
+// rotateSecurityStamp revokes every session of a user, both the session rows and any tokens already issued
+func rotateSecurityStamp(db *gorm.DB, user *models.User) error {
+	user.SecurityStamp = uuid.New().String()
+
+	if err := db.Model(user).Update("security_stamp", user.SecurityStamp).Error; err != nil {
+		return err
+	}
+
+	return db.Where("user_id = ?", user.ID).Delete(&models.Session{}).Error
+}
+
+// PurgeExpiredSessions permanently deletes expired and logged out sessions along with their refresh tokens, and expired OAuth codes
+func PurgeExpiredSessions(db *gorm.DB) error {
+	err := db.Unscoped().
+		Where("expires_at < ? OR deleted_at IS NOT NULL", time.Now()).
+		Delete(&models.Session{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Unscoped().
+		Where("expires_at < ? OR session_id NOT IN (?)", time.Now(), db.Unscoped().Model(&models.Session{}).Select("api_key")).
+		Delete(&models.RefreshToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OAuthCode{}).Error
+}
+
+// StartSessionSweep periodically purges expired sessions
+func StartSessionSweep(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(SESSION_SWEEP_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := PurgeExpiredSessions(db); err != nil {
+				log.Error("Failed to purge expired sessions: %s\n", err)
+			}
+		}
+	}()
+}
+
+// addUserSessionsEndpoints adds the endpoints for a user's login sessions
+func addUserSessionsEndpoints(user_ep fiber.Router) {
+	sessions_ep := user_ep.Group("/sessions", leash_auth.ConcatPermissionPrefixMiddleware("sessions"))
+
+	// List active sessions endpoint
+	sessions_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+		req := c.Locals("query").(listRequest)
+
+		con := db.Model(&models.Session{}).Where("user_id = ? AND expires_at > ?", user.ID, time.Now())
+
+		// Count the total number of sessions
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		con = con.Order("created_at desc")
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		var sessions []models.Session
+		con.Find(&sessions)
+
+		current := currentSessionID(c)
+		data := make([]sessionResponse, len(sessions))
+		for i, session := range sessions {
+			data[i] = sessionResponse{
+				Session: session,
+				Current: session.SessionID == current,
+			}
+		}
+
+		response := struct {
+			Data  []sessionResponse `json:"data"`
+			Total int64             `json:"total"`
+		}{
+			Data:  data,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+
+	// Revoke all sessions endpoint, optionally keeping the one making the request
+	type revokeSessionsRequest struct {
+		KeepCurrent bool `query:"keep_current"`
+	}
+	sessions_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), models.GetQueryMiddleware[revokeSessionsRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+		req := c.Locals("query").(revokeSessionsRequest)
+
+		con := db.Where("user_id = ?", user.ID)
+		if current := currentSessionID(c); req.KeepCurrent && current != "" {
+			con = con.Where("api_key <> ?", current)
+		}
+
+		if res := con.Delete(&models.Session{}); res.Error != nil {
+			log.Error("Failed to revoke sessions: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Revoke a session endpoint
+	sessions_ep.Delete("/:session_id", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+
+		var session models.Session
+		if res := db.Limit(1).Where("api_key = ? AND user_id = ?", c.Params("session_id"), user.ID).Find(&session); res.Error != nil || res.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusNotFound, "Session not found")
+		}
+
+		if res := db.Delete(&session); res.Error != nil {
+			log.Error("Failed to revoke session: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
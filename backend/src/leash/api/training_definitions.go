@@ -0,0 +1,279 @@
+package leash_backend_api
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// getTrainingDefinition fetches a training definition from the catalog by name
+func getTrainingDefinition(db *gorm.DB, name string) (models.TrainingDefinition, error) {
+	var definition = models.TrainingDefinition{
+		Name: name,
+	}
+
+	if res := db.Limit(1).Where(&definition).Find(&definition); res.Error != nil || res.RowsAffected == 0 {
+		return definition, fmt.Errorf("unknown training: %s", name)
+	}
+
+	return definition, nil
+}
+
+// validateTrainingPrerequisites checks that every prerequisite names a training in the catalog, and that none of them
+// require the training themselves, directly or through their own prerequisites
+func validateTrainingPrerequisites(db *gorm.DB, name string, prerequisites []string) error {
+	for _, prerequisite := range prerequisites {
+		if prerequisite == name {
+			return fiber.NewError(fiber.StatusBadRequest, "A training cannot be its own prerequisite")
+		}
+
+		if _, err := getTrainingDefinition(db, prerequisite); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown prerequisite training: %s", prerequisite))
+		}
+	}
+
+	// Walk the prerequisite graph, a training that ends up requiring itself could never be earned
+	visited := map[string]bool{}
+	pending := append([]string{}, prerequisites...)
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if visited[current] {
+			continue
+		}
+
+		visited[current] = true
+
+		definition, err := getTrainingDefinition(db, current)
+		if err != nil {
+			continue
+		}
+
+		for _, prerequisite := range definition.Prerequisites {
+			if prerequisite == name {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Prerequisite training %s already requires %s", current, name))
+			}
+
+			pending = append(pending, prerequisite)
+		}
+	}
+
+	return nil
+}
+
+// trainingDefinitionMiddleware is a middleware that fetches the training definition by name and stores it in the context
+func trainingDefinitionMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	authentication := leash_auth.GetAuthentication(c)
+
+	// Check if the user is authorized to perform the action
+	if authentication.Authorize("leash.trainings.definitions:target") != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to read training definitions")
+	}
+
+	definition_name, err := url.QueryUnescape(c.Params("definition_name"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid training definition name")
+	}
+
+	definition, err := getTrainingDefinition(db, definition_name)
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Training definition not found")
+	}
+
+	c.Locals("training_definition", definition)
+
+	return c.Next()
+}
+
+// addTrainingDefinitionEndpoints adds the endpoints for the training catalog
+func addTrainingDefinitionEndpoints(trainings_ep fiber.Router) {
+	definitions_ep := trainings_ep.Group("/definitions", leash_auth.ConcatPermissionPrefixMiddleware("definitions"))
+
+	// List training definitions endpoint
+	definitions_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		var definitions []models.TrainingDefinition
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.TrainingDefinition{})
+
+		// Count the total number of definitions
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&definitions)
+
+		response := struct {
+			Data  []models.TrainingDefinition `json:"data"`
+			Total int64                       `json:"total"`
+		}{
+			Data:  definitions,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+
+	// Create training definition endpoint
+	type trainingDefinitionCreateRequest struct {
+		Name          string   `json:"name" xml:"name" form:"name" validate:"required"`
+		Description   *string  `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Prerequisites []string `json:"prerequisites" xml:"prerequisites" form:"prerequisites" validate:"omitempty"`
+		Levels        []string `json:"levels" xml:"levels" form:"levels" validate:"omitempty,dive,oneof=in_progress supervised unsupervised can_train"`
+		ValidFor      *int64   `json:"valid_for" xml:"valid_for" form:"valid_for" validate:"omitempty,min=0"`
+	}
+	definitions_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[trainingDefinitionCreateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("body").(trainingDefinitionCreateRequest)
+
+		// Check if the definition already exists
+		if _, err := getTrainingDefinition(db, req.Name); err == nil {
+			return fiber.NewError(fiber.StatusConflict, "Training definition already exists")
+		}
+
+		if err := validateTrainingPrerequisites(db, req.Name, req.Prerequisites); err != nil {
+			return err
+		}
+
+		definition := models.TrainingDefinition{
+			Name:          req.Name,
+			Prerequisites: req.Prerequisites,
+			Levels:        req.Levels,
+			AddedBy:       leash_auth.GetAuthentication(c).User.ID,
+		}
+
+		if definition.Prerequisites == nil {
+			definition.Prerequisites = []string{}
+		}
+
+		if definition.Levels == nil {
+			definition.Levels = []string{}
+		}
+
+		if req.Description != nil {
+			definition.Description = *req.Description
+		}
+
+		if req.ValidFor != nil {
+			definition.ValidFor = *req.ValidFor
+		}
+
+		db.Create(&definition)
+
+		return c.JSON(definition)
+	})
+
+	definition_ep := definitions_ep.Group("/:definition_name", trainingDefinitionMiddleware)
+
+	// Get current training definition endpoint
+	definition_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("get"), func(c *fiber.Ctx) error {
+		definition := c.Locals("training_definition").(models.TrainingDefinition)
+		return c.JSON(definition)
+	})
+
+	// Update current training definition endpoint
+	type trainingDefinitionUpdateRequest struct {
+		Description   *string   `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Prerequisites *[]string `json:"prerequisites" xml:"prerequisites" form:"prerequisites" validate:"omitempty"`
+		Levels        *[]string `json:"levels" xml:"levels" form:"levels" validate:"omitempty,dive,oneof=in_progress supervised unsupervised can_train"`
+		ValidFor      *int64    `json:"valid_for" xml:"valid_for" form:"valid_for" validate:"omitempty,min=0"`
+	}
+	definition_ep.Patch("/", leash_auth.PrefixAuthorizationMiddleware("update"), models.GetBodyMiddleware[trainingDefinitionUpdateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		definition := c.Locals("training_definition").(models.TrainingDefinition)
+		req := c.Locals("body").(trainingDefinitionUpdateRequest)
+
+		if req.Description != nil {
+			definition.Description = *req.Description
+		}
+
+		if req.Prerequisites != nil {
+			if err := validateTrainingPrerequisites(db, definition.Name, *req.Prerequisites); err != nil {
+				return err
+			}
+
+			definition.Prerequisites = *req.Prerequisites
+		}
+
+		if req.Levels != nil {
+			definition.Levels = *req.Levels
+		}
+
+		if req.ValidFor != nil {
+			definition.ValidFor = *req.ValidFor
+		}
+
+		db.Save(&definition)
+
+		return c.JSON(definition)
+	})
+
+	// Delete current training definition endpoint
+	definition_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		definition := c.Locals("training_definition").(models.TrainingDefinition)
+
+		// A training still required elsewhere would leave those requiring one that no longer exists
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var required int64
+			if err := tx.Model(&models.Equipment{}).Where("required_training = ?", definition.Name).Count(&required).Error; err != nil {
+				return err
+			}
+
+			if required > 0 {
+				return fiber.NewError(fiber.StatusConflict, "Training definition is required by equipment")
+			}
+
+			var definitions []models.TrainingDefinition
+			if err := tx.Find(&definitions).Error; err != nil {
+				return err
+			}
+
+			for _, other := range definitions {
+				if slices.Contains(other.Prerequisites, definition.Name) {
+					return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("Training definition is a prerequisite of %s", other.Name))
+				}
+			}
+
+			return tx.Delete(&definition).Error
+		})
+
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				return e
+			}
+
+			log.Error("Failed to delete training definition: %s\n", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to delete training definition")
+		}
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+}
@@ -3,12 +3,16 @@ package leash_backend_api
 import (
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 )
 
+var trainingCreateCallbacks []func(TrainingEvent)
+var trainingDeleteCallbacks []func(TrainingEvent)
+
 // userTrainingMiddleware is a middleware that fetches the training from a user and stores it in the context
 func userTrainingMiddleware(c *fiber.Ctx) error {
 	db := leash_auth.GetDB(c)
@@ -80,11 +84,24 @@ func addCommonTrainingEndpoints(training_ep fiber.Router) {
 	training_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		training := c.Locals("training").(models.Training)
-		training.RemovedBy = leash_auth.GetAuthentication(c).User.ID
+		authenticator := leash_auth.GetAuthentication(c)
+		training.RemovedBy = authenticator.User.ID
 
 		db.Save(&training)
 
 		db.Delete(&training)
+
+		event := TrainingEvent{
+			c:         c,
+			Target:    training,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range trainingDeleteCallbacks {
+			callback(event)
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 }
@@ -147,13 +164,48 @@ func addUserTrainingEndpoints(user_ep fiber.Router) {
 		authenticator := leash_auth.GetAuthentication(c)
 		req := c.Locals("body").(trainingCreateRequest)
 
-		// Check if training already exists for user
+		// Check that the training is in the catalog
+		definition, err := getTrainingDefinition(db, req.Name)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unknown training")
+		}
+
+		if !definition.AllowsLevel(req.Level) {
+			return fiber.NewError(fiber.StatusBadRequest, "This training cannot be granted at this level")
+		}
+
+		// Check if training already exists for user, expired trainings can be renewed
 		var existingTraining = models.Training{
 			UserID: user.ID,
 			Name:   req.Name,
 		}
+		renew := false
 		if res := db.Limit(1).Where(&existingTraining).Find(&existingTraining); res.Error == nil && res.RowsAffected != 0 {
-			return fiber.NewError(fiber.StatusConflict, "User already has this training")
+			if !existingTraining.IsExpired() {
+				return fiber.NewError(fiber.StatusConflict, "User already has this training")
+			}
+
+			renew = true
+		}
+
+		// Check that the user has completed every prerequisite
+		for _, prerequisite := range definition.Prerequisites {
+			var prerequisiteTraining = models.Training{
+				UserID: user.ID,
+				Name:   prerequisite,
+			}
+
+			res := db.Limit(1).Where(&prerequisiteTraining).Find(&prerequisiteTraining)
+			if res.Error != nil || res.RowsAffected == 0 || prerequisiteTraining.IsExpired() || prerequisiteTraining.Level == "in_progress" {
+				return fiber.NewError(fiber.StatusPreconditionFailed, "Missing prerequisite training: "+prerequisite)
+			}
+		}
+
+		// Replace the expired training with the renewed one
+		if renew {
+			existingTraining.RemovedBy = authenticator.User.ID
+			db.Save(&existingTraining)
+			db.Delete(&existingTraining)
 		}
 
 		training := models.Training{
@@ -162,8 +214,24 @@ func addUserTrainingEndpoints(user_ep fiber.Router) {
 			AddedBy: authenticator.User.ID,
 		}
 
+		if definition.ValidFor > 0 {
+			expiresAt := time.Now().Add(time.Duration(definition.ValidFor) * time.Second)
+			training.ExpiresAt = &expiresAt
+		}
+
 		db.Model(&user).Association("Trainings").Append(&training)
 
+		event := TrainingEvent{
+			c:         c,
+			Target:    training,
+			Agent:     authenticator.User,
+			Timestamp: time.Now().Unix(),
+		}
+
+		for _, callback := range trainingCreateCallbacks {
+			callback(event)
+		}
+
 		return c.JSON(training)
 	})
 
@@ -176,7 +244,23 @@ func addUserTrainingEndpoints(user_ep fiber.Router) {
 func registerTrainingEndpoints(api fiber.Router) {
 	trainings_ep := api.Group("/trainings", leash_auth.ConcatPermissionPrefixMiddleware("trainings"))
 
+	trainingCreateCallbacks = []func(TrainingEvent){}
+	trainingDeleteCallbacks = []func(TrainingEvent){}
+
+	// The catalog must be registered before the training ID group so it is not treated as an ID
+	addTrainingDefinitionEndpoints(trainings_ep)
+
 	single_training_ep := trainings_ep.Group("/:training_id", generalTrainingMiddleware)
 
 	addCommonTrainingEndpoints(single_training_ep)
 }
+
+// OnTrainingCreate registers a callback to be called when a training is created
+func OnTrainingCreate(callback func(TrainingEvent)) {
+	trainingCreateCallbacks = append(trainingCreateCallbacks, callback)
+}
+
+// OnTrainingDelete registers a callback to be called when a training is deleted
+func OnTrainingDelete(callback func(TrainingEvent)) {
+	trainingDeleteCallbacks = append(trainingDeleteCallbacks, callback)
+}
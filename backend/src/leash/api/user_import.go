@@ -0,0 +1,416 @@
+package leash_backend_api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	USER_IMPORT_CREATE    = "create"
+	USER_IMPORT_UPDATE    = "update"
+	USER_IMPORT_UNCHANGED = "unchanged"
+	USER_IMPORT_ERROR     = "error"
+)
+
+// USER_CSV_COLUMNS are the columns used to import and export users, matching the user create request
+var USER_CSV_COLUMNS = []string{"email", "name", "pronouns", "role", "type", "graduation_year", "major", "department", "job_title"}
+
+// USER_CSV_REQUIRED_COLUMNS must be present in the header of an imported file
+var USER_CSV_REQUIRED_COLUMNS = []string{"email", "name", "pronouns", "role", "type"}
+
+var errUserImportRollback = errors.New("user import rolled back")
+
+type UserImportRow struct {
+	Row     int           `json:"row"`
+	Email   string        `json:"email"`
+	Action  string        `json:"action"`
+	Errors  []string      `json:"errors,omitempty"`
+	Changes []UserChanges `json:"changes,omitempty"`
+
+	user models.User
+}
+
+type UserImportResult struct {
+	DryRun    bool            `json:"dry_run"`
+	Created   int             `json:"created"`
+	Updated   int             `json:"updated"`
+	Unchanged int             `json:"unchanged"`
+	Failed    int             `json:"failed"`
+	Rows      []UserImportRow `json:"rows"`
+}
+
+// parseUserCSVRow reads an imported row into a user create request using the header column positions
+func parseUserCSVRow(columns map[string]int, record []string) (userCreateRequest, []string) {
+	get := func(column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+
+		return ""
+	}
+
+	req := userCreateRequest{
+		Email:      get("email"),
+		Name:       get("name"),
+		Pronouns:   get("pronouns"),
+		Role:       get("role"),
+		Type:       get("type"),
+		Major:      get("major"),
+		Department: get("department"),
+		JobTitle:   get("job_title"),
+	}
+
+	rowErrors := []string{}
+
+	if graduationYear := get("graduation_year"); graduationYear != "" {
+		year, err := strconv.Atoi(graduationYear)
+		if err != nil {
+			rowErrors = append(rowErrors, "GraduationYear: numeric")
+		}
+
+		req.GraduationYear = year
+	}
+
+	for _, err := range models.ValidateStruct(req) {
+		rowErrors = append(rowErrors, fmt.Sprintf("%s: %s", strings.TrimPrefix(err.FailedField, "userCreateRequest."), err.Tag))
+	}
+
+	return req, rowErrors
+}
+
+// applyUserImport updates a user from an imported row and returns the changes made
+func applyUserImport(user *models.User, req userCreateRequest) []UserChanges {
+	changes := []UserChanges{}
+
+	modified := func(original *string, new string, field string) {
+		if *original != new {
+			changes = append(changes, UserChanges{
+				Old:   *original,
+				New:   new,
+				Field: field,
+			})
+			*original = new
+		}
+	}
+
+	modified(&user.Name, req.Name, "name")
+	modified(&user.Pronouns, req.Pronouns, "pronouns")
+	modified(&user.Role, req.Role, "role")
+	modified(&user.Type, req.Type, "type")
+
+	if user.GraduationYear != req.GraduationYear {
+		changes = append(changes, UserChanges{
+			Old:   fmt.Sprint(user.GraduationYear),
+			New:   fmt.Sprint(req.GraduationYear),
+			Field: "graduation_year",
+		})
+		user.GraduationYear = req.GraduationYear
+	}
+
+	modified(&user.Major, req.Major, "major")
+	modified(&user.Department, req.Department, "department")
+	modified(&user.JobTitle, req.JobTitle, "job_title")
+
+	return changes
+}
+
+// ImportUsersCSV creates or updates users by email from a CSV file, nothing is written if any row fails or on a dry run
+func ImportUsersCSV(db *gorm.DB, r io.Reader, dryRun bool) (UserImportResult, error) {
+	result := UserImportResult{
+		DryRun: dryRun,
+		Rows:   []UserImportRow{},
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return result, fiber.NewError(fiber.StatusBadRequest, "Missing CSV header")
+	}
+
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+
+	for _, column := range USER_CSV_REQUIRED_COLUMNS {
+		if _, ok := columns[column]; !ok {
+			return result, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Missing CSV column: %s", column))
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		seen := map[string]int{}
+
+		for rowNum := 2; ; rowNum++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid CSV on row %d", rowNum))
+			}
+
+			req, rowErrors := parseUserCSVRow(columns, record)
+			row := UserImportRow{
+				Row:    rowNum,
+				Email:  req.Email,
+				Errors: rowErrors,
+			}
+
+			if first, ok := seen[req.Email]; ok && req.Email != "" {
+				row.Errors = append(row.Errors, fmt.Sprintf("Email is duplicated on row %d", first))
+			} else {
+				seen[req.Email] = rowNum
+			}
+
+			if len(row.Errors) == 0 {
+				var user models.User
+				res := tx.Limit(1).Where(&models.User{Email: req.Email}).Find(&user)
+
+				switch {
+				case res.Error != nil:
+					row.Errors = append(row.Errors, "Failed to look up user")
+				case res.RowsAffected == 0:
+					if _, err := searchEmail(tx, req.Email); err == nil {
+						row.Errors = append(row.Errors, "Email is pending for another user")
+						break
+					}
+
+					row.Action = USER_IMPORT_CREATE
+					row.user = models.User{Email: req.Email}
+					applyUserImport(&row.user, req)
+
+					if !dryRun {
+						if err := tx.Create(&row.user).Error; err != nil {
+							row.Errors = append(row.Errors, "Failed to create user")
+						}
+					}
+				case user.Role == "service":
+					row.Errors = append(row.Errors, "Cannot import over a service account")
+				default:
+					row.user = user
+					row.Changes = applyUserImport(&row.user, req)
+					row.Action = USER_IMPORT_UNCHANGED
+
+					if len(row.Changes) > 0 {
+						row.Action = USER_IMPORT_UPDATE
+
+						if !dryRun {
+							if row.user.Role != user.Role {
+								if err := rotateSecurityStamp(tx, &row.user); err != nil {
+									row.Errors = append(row.Errors, "Failed to revoke sessions")
+								}
+							}
+
+							if err := tx.Save(&row.user).Error; err != nil {
+								row.Errors = append(row.Errors, "Failed to update user")
+							}
+						}
+					}
+				}
+			}
+
+			if len(row.Errors) > 0 {
+				row.Action = USER_IMPORT_ERROR
+				row.Changes = nil
+			}
+
+			switch row.Action {
+			case USER_IMPORT_CREATE:
+				result.Created++
+			case USER_IMPORT_UPDATE:
+				result.Updated++
+			case USER_IMPORT_UNCHANGED:
+				result.Unchanged++
+			default:
+				result.Failed++
+			}
+
+			result.Rows = append(result.Rows, row)
+		}
+
+		if dryRun || result.Failed > 0 {
+			return errUserImportRollback
+		}
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errUserImportRollback) {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// ExportUsersCSV writes users as CSV with the same columns accepted by ImportUsersCSV
+func ExportUsersCSV(w io.Writer, users []models.User) error {
+	writer := csv.NewWriter(w)
+
+	header := append([]string{"id"}, USER_CSV_COLUMNS...)
+	header = append(header, "created_at")
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		graduationYear := ""
+		if user.GraduationYear != 0 {
+			graduationYear = strconv.Itoa(user.GraduationYear)
+		}
+
+		err := writer.Write([]string{
+			strconv.FormatUint(uint64(user.ID), 10),
+			user.Email,
+			user.Name,
+			user.Pronouns,
+			user.Role,
+			user.Type,
+			graduationYear,
+			user.Major,
+			user.Department,
+			user.JobTitle,
+			user.CreatedAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// createImportExportEndpoints creates the endpoints for bulk importing and exporting users
+func createImportExportEndpoints(users_ep fiber.Router) {
+	// Import users endpoint, accepts a CSV body or a multipart file named file
+	type userImportQuery struct {
+		DryRun *bool `query:"dry_run" validate:"omitempty"`
+	}
+	users_ep.Post("/import", leash_auth.PrefixAuthorizationMiddleware("import"), models.GetQueryMiddleware[userImportQuery], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(userImportQuery)
+		authenticator := leash_auth.GetAuthentication(c)
+
+		var body io.Reader = bytes.NewReader(c.Body())
+		if file, err := c.FormFile("file"); err == nil {
+			f, err := file.Open()
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "Invalid file")
+			}
+			defer f.Close()
+
+			body = f
+		}
+
+		dryRun := req.DryRun != nil && *req.DryRun
+
+		result, err := ImportUsersCSV(db, body, dryRun)
+		if err != nil {
+			return err
+		}
+
+		if result.Failed > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(result)
+		}
+
+		if dryRun {
+			return c.JSON(result)
+		}
+
+		// Run the create and update callbacks now that the import has been committed
+		now := time.Now().Unix()
+		for _, row := range result.Rows {
+			event := UserEvent{
+				c:         c,
+				Target:    row.user,
+				Agent:     authenticator.User,
+				Timestamp: now,
+			}
+
+			switch row.Action {
+			case USER_IMPORT_CREATE:
+				for _, callback := range userCreateCallbacks {
+					callback(event)
+				}
+			case USER_IMPORT_UPDATE:
+				for _, callback := range userUpdateCallbacks {
+					callback(UserUpdateEvent{
+						UserEvent: event,
+						Changes:   row.Changes,
+					})
+				}
+			}
+		}
+
+		return c.JSON(result)
+	})
+
+	// Export users endpoint
+	type userExportQuery struct {
+		Query          *string `query:"query" validate:"omitempty"`
+		Role           *string `query:"role" validate:"omitempty,oneof=member volunteer staff admin"`
+		Type           *string `query:"type" validate:"omitempty,oneof=undergrad grad employee alumni program other"`
+		Major          *string `query:"major" validate:"omitempty"`
+		GraduationYear *int    `query:"graduation_year" validate:"omitempty,numeric"`
+		IncludeDeleted *bool   `query:"include_deleted"`
+	}
+	users_ep.Get("/export", leash_auth.PrefixAuthorizationMiddleware("export"), models.GetQueryMiddleware[userExportQuery], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(userExportQuery)
+
+		var users []models.User
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.User{}).Where("role <> ?", "service")
+
+		if req.Query != nil {
+			con = con.Where(db.Where("name LIKE ?", "%"+*req.Query+"%").Or("email LIKE ?", "%"+*req.Query+"%"))
+		}
+
+		if req.Role != nil {
+			con = con.Where(&models.User{Role: *req.Role})
+		}
+
+		if req.Type != nil {
+			con = con.Where(&models.User{Type: *req.Type})
+		}
+
+		if req.Major != nil {
+			con = con.Where(&models.User{Major: *req.Major})
+		}
+
+		if req.GraduationYear != nil {
+			con = con.Where(&models.User{GraduationYear: *req.GraduationYear})
+		}
+
+		con.Order("id").Find(&users)
+
+		var buf bytes.Buffer
+		if err := ExportUsersCSV(&buf, users); err != nil {
+			return err
+		}
+
+		c.Set(fiber.HeaderContentType, "text/csv")
+		c.Set(fiber.HeaderContentDisposition, "attachment; filename=\"users.csv\"")
+		return c.Send(buf.Bytes())
+	})
+}
@@ -97,6 +97,36 @@ func searchEmail(db *gorm.DB, email string) (models.User, error) {
 	return user, nil
 }
 
+// parseCheckinToken verifies a checkin token and returns the user ID it was issued for
+func parseCheckinToken(c *fiber.Ctx, token string) (uint, error) {
+	hmac := leash_auth.GetHMAC(c)
+
+	// Decode the token
+	data, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(data) <= 12 {
+		return 0, fiber.NewError(fiber.StatusBadRequest, "Invalid token")
+	}
+
+	// Check if the token is expired
+	expires := int64(binary.LittleEndian.Uint64(data[4:12]))
+	if time.Now().Unix() > expires {
+		return 0, fiber.NewError(fiber.StatusUnauthorized, "Token expired")
+	}
+
+	// Verify the token
+	_, err = hmac.Write(data[:12])
+	if err != nil {
+		return 0, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+	}
+
+	if string(hmac.Sum(nil)) != string(data[12:]) {
+		return 0, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+	}
+
+	// Get the user ID from the token
+	return uint(binary.LittleEndian.Uint32(data[:4])), nil
+}
+
 // selfMiddleware is a middleware that sets the target user to the current user
 func selfMiddleware(c *fiber.Ctx) error {
 	authentication := leash_auth.GetAuthentication(c)
@@ -162,24 +192,26 @@ func onlyServiceMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// userCreateRequest is the body for creating a user, also used to validate imported rows
+type userCreateRequest struct {
+	Email    string `json:"email" xml:"email" form:"email" validate:"required,email"`
+	Name     string `json:"name" xml:"name" form:"name" validate:"required"`
+	Pronouns string `json:"pronouns" xml:"pronouns" form:"pronouns" validate:"required"`
+	Role     string `json:"role" xml:"role" form:"role" validate:"required,oneof=member volunteer staff admin"`
+	Type     string `json:"type" xml:"type" form:"type" validate:"required,oneof=undergrad grad employee alumni program other"`
+
+	// Sutudent-like fields
+	GraduationYear int    `json:"graduation_year" xml:"graduation_year" form:"graduation_year" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program,numeric"`
+	Major          string `json:"major" xml:"major" form:"major" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program"`
+
+	// Employee-like fields
+	Department string `json:"department" xml:"department" form:"department" validate:"required_if=Type employee"`
+	JobTitle   string `json:"job_title" xml:"job_title" form:"job_title" validate:"required_if=Type employee"`
+}
+
 // createBaseEndpoints creates the common endpoints for the base user endpoint
 func createBaseEndpoints(users_ep fiber.Router) {
 	// Create a new user endpoint
-	type userCreateRequest struct {
-		Email    string `json:"email" xml:"email" form:"email" validate:"required,email"`
-		Name     string `json:"name" xml:"name" form:"name" validate:"required"`
-		Pronouns string `json:"pronouns" xml:"pronouns" form:"pronouns" validate:"required"`
-		Role     string `json:"role" xml:"role" form:"role" validate:"required,oneof=member volunteer staff admin"`
-		Type     string `json:"type" xml:"type" form:"type" validate:"required,oneof=undergrad grad employee alumni program other"`
-
-		// Sutudent-like fields
-		GraduationYear int    `json:"graduation_year" xml:"graduation_year" form:"graduation_year" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program,numeric"`
-		Major          string `json:"major" xml:"major" form:"major" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program"`
-
-		// Employee-like fields
-		Department string `json:"department" xml:"department" form:"department" validate:"required_if=Type employee"`
-		JobTitle   string `json:"job_title" xml:"job_title" form:"job_title" validate:"required_if=Type employee"`
-	}
 	users_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[userCreateRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		req := c.Locals("body").(userCreateRequest)
@@ -344,7 +376,7 @@ func createGetUserEndpoints(get_ep fiber.Router) {
 		return c.JSON(user)
 	})
 
-	get_ep.Get("/card/:card", leash_auth.PrefixAuthorizationMiddleware("card"), models.GetQueryMiddleware[userGetRequest], func(c *fiber.Ctx) error {
+	get_ep.Get("/card/:card", leash_auth.RateLimitMiddleware(leash_auth.RATE_LIMIT_LOOKUPS), leash_auth.PrefixAuthorizationMiddleware("card"), models.GetQueryMiddleware[userGetRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		card_id := c.Params("card")
 
@@ -367,39 +399,17 @@ func createGetUserEndpoints(get_ep fiber.Router) {
 	})
 
 	// Get a user by checkin token endpoint
-	get_ep.Get("/checkin/:token", leash_auth.PrefixAuthorizationMiddleware("checkin"), models.GetQueryMiddleware[userGetRequest], func(c *fiber.Ctx) error {
+	get_ep.Get("/checkin/:token", leash_auth.RateLimitMiddleware(leash_auth.RATE_LIMIT_LOOKUPS), leash_auth.PrefixAuthorizationMiddleware("checkin"), models.GetQueryMiddleware[userGetRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
-		hmac := leash_auth.GetHMAC(c)
-		token := c.Params("token")
-
-		// Decode the token
-		data, err := base64.URLEncoding.DecodeString(token)
-		if err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, "Invalid token")
-		}
 
-		// Check if the token is expired
-		expires := int64(binary.LittleEndian.Uint64(data[4:12]))
-		if time.Now().Unix() > expires {
-			return fiber.NewError(fiber.StatusUnauthorized, "Token expired")
-		}
-
-		// Verify the token
-		_, err = hmac.Write(data[:12])
+		user_id, err := parseCheckinToken(c, c.Params("token"))
 		if err != nil {
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
-		}
-
-		if string(hmac.Sum(nil)) != string(data[12:]) {
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+			return err
 		}
 
-		// Get the user ID from the token
-		user_id := binary.LittleEndian.Uint32(data[:4])
-
 		// Check if the user exists
 		var user = models.User{
-			ID: uint(user_id),
+			ID: user_id,
 		}
 
 		if res := db.Limit(1).Where(&user).Find(&user); res.Error != nil || res.RowsAffected == 0 {
@@ -565,7 +575,13 @@ func updateUserEndpoint(user_ep fiber.Router) {
 					Field: "pending_email",
 				})
 
-				user.PendingEmail = req.Email
+				setPendingEmail(&user, req.Email)
+
+				// The new email only replaces the current one once it has been verified
+				if err := sendEmailVerification(c, user); err != nil {
+					log.Error("Failed to send verification email: %s\n", err)
+					return fiber.NewError(fiber.StatusBadGateway, "Failed to send verification email")
+				}
 			} else if user.PendingEmail != nil && *req.Email == user.Email {
 				event.Changes = append(event.Changes, UserChanges{
 					Old:   *user.PendingEmail,
@@ -573,7 +589,7 @@ func updateUserEndpoint(user_ep fiber.Router) {
 					Field: "pending_email",
 				})
 
-				user.PendingEmail = nil
+				setPendingEmail(&user, nil)
 			}
 		}
 
@@ -635,6 +651,11 @@ func updateUserEndpoint(user_ep fiber.Router) {
 						Field: "card_id",
 					})
 
+					if err := rotateSecurityStamp(db, &user); err != nil {
+						log.Error("Failed to revoke sessions: %s\n", err)
+						return c.SendStatus(fiber.StatusInternalServerError)
+					}
+
 					db.Save(&user)
 				}
 			} else {
@@ -651,6 +672,11 @@ func updateUserEndpoint(user_ep fiber.Router) {
 						Field: "role",
 					})
 					user.Role = *req.Role
+
+					if err := rotateSecurityStamp(db, &user); err != nil {
+						log.Error("Failed to revoke sessions: %s\n", err)
+						return c.SendStatus(fiber.StatusInternalServerError)
+					}
 				}
 			} else {
 				return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to update the role")
@@ -674,6 +700,11 @@ func deleteUserEndpoint(user_ep fiber.Router) {
 		user := c.Locals("target_user").(models.User)
 		db := leash_auth.GetDB(c)
 
+		if err := rotateSecurityStamp(db, &user); err != nil {
+			log.Error("Failed to revoke sessions: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
 		db.Delete(&user)
 		db.Delete(&models.UserUpdate{}, "user_id = ?", user.ID)
 		db.Delete(&models.Training{}, "user_id = ?", user.ID)
@@ -902,6 +933,8 @@ func registerUserEndpoints(api fiber.Router) {
 	})
 
 	createBaseEndpoints(users_ep)
+	createImportExportEndpoints(users_ep)
+	createRegistrationEndpoints(users_ep)
 
 	get_ep := users_ep.Group("/get", leash_auth.ConcatPermissionPrefixMiddleware("get"))
 	createGetUserEndpoints(get_ep)
@@ -920,12 +953,16 @@ func registerUserEndpoints(api fiber.Router) {
 	addUserHoldsEndpoints(self_ep)
 	addUserApiKeyEndpoints(self_ep)
 	addUserNotificationsEndpoints(self_ep)
+	addUserVisitsEndpoints(self_ep)
+	addPendingEmailEndpoints(self_ep)
+	addUserSessionsEndpoints(self_ep)
 
 	user_ep := users_ep.Group("/:user_id", leash_auth.ConcatPermissionPrefixMiddleware("others"), userMiddleware)
 	getUserEndpoint(user_ep)
 	updateUserEndpoint(user_ep)
 	updateServiceEndpoint(user_ep)
 	deleteUserEndpoint(user_ep)
+	reviewUserEndpoints(user_ep)
 	checkinUserEndpoint(user_ep)
 	getPermissionsEndpoint(user_ep)
 	addUserUpdateEndpoints(user_ep)
@@ -933,6 +970,9 @@ func registerUserEndpoints(api fiber.Router) {
 	addUserHoldsEndpoints(user_ep)
 	addUserApiKeyEndpoints(user_ep)
 	addUserNotificationsEndpoints(user_ep)
+	addUserVisitsEndpoints(user_ep)
+	addPendingEmailEndpoints(user_ep)
+	addUserSessionsEndpoints(user_ep)
 }
 
 // OnUserCreate registers a callback to be called when a user is created
@@ -981,7 +1021,12 @@ func UpdatePendingEmail(user models.User, c *fiber.Ctx) (models.User, error) {
 	}
 
 	user.Email = *user.PendingEmail
-	user.PendingEmail = nil
+	setPendingEmail(&user, nil)
+
+	if err := rotateSecurityStamp(db, &user); err != nil {
+		return user, err
+	}
+
 	db.Save(&user)
 
 	// Run the update callbacks
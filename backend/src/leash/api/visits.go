@@ -0,0 +1,236 @@
+package leash_backend_api
+
+import (
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	VISIT_METHOD_CARD  = "card"
+	VISIT_METHOD_TOKEN = "token"
+)
+
+// DEFAULT_CLOSING_TIME is the time of day open visits are checked out at if no closing time is configured
+const DEFAULT_CLOSING_TIME = "00:00"
+
+// VISIT_AUTO_CHECKOUT_INTERVAL is how often open visits are checked against the closing time
+const VISIT_AUTO_CHECKOUT_INTERVAL = time.Minute
+
+var visitClosingTime, _ = time.Parse("15:04", DEFAULT_CLOSING_TIME)
+
+// SetVisitClosingTime sets the time of day (formatted as 15:04) after which open visits are automatically checked out
+func SetVisitClosingTime(closing string) error {
+	t, err := time.Parse("15:04", closing)
+	if err != nil {
+		return err
+	}
+
+	visitClosingTime = t
+	return nil
+}
+
+// lastClosingTime returns the most recent closing time at or before now
+func lastClosingTime(now time.Time) time.Time {
+	closing := time.Date(now.Year(), now.Month(), now.Day(), visitClosingTime.Hour(), visitClosingTime.Minute(), 0, 0, now.Location())
+	if closing.After(now) {
+		closing = closing.AddDate(0, 0, -1)
+	}
+
+	return closing
+}
+
+// AutoCheckoutVisits checks out every visit that was still open at the last closing time
+func AutoCheckoutVisits(db *gorm.DB) error {
+	closing := lastClosingTime(time.Now())
+
+	return db.Model(&models.Visit{}).
+		Where("check_out IS NULL AND check_in < ?", closing).
+		Updates(map[string]interface{}{"check_out": closing, "auto_checkout": true}).Error
+}
+
+// StartVisitAutoCheckout periodically checks out visits left open past closing time
+func StartVisitAutoCheckout(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(VISIT_AUTO_CHECKOUT_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := AutoCheckoutVisits(db); err != nil {
+				log.Error("Failed to automatically check out visits: %s\n", err)
+			}
+		}
+	}()
+}
+
+// getOpenVisit fetches the visit a user is currently checked in with
+func getOpenVisit(db *gorm.DB, user models.User) (models.Visit, bool) {
+	var visit models.Visit
+	if res := db.Limit(1).Where("user_id = ? AND check_out IS NULL", user.ID).Find(&visit); res.Error != nil || res.RowsAffected == 0 {
+		return visit, false
+	}
+
+	return visit, true
+}
+
+type visitRequest struct {
+	CardID       *string `json:"card_id" xml:"card_id" form:"card_id" validate:"required_without=CheckinToken"`
+	CheckinToken *string `json:"checkin_token" xml:"checkin_token" form:"checkin_token" validate:"required_without=CardID"`
+}
+
+// visitUserMiddleware is a middleware that finds the user from a card or checkin token and stores it in the context
+func visitUserMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	req := c.Locals("body").(visitRequest)
+
+	var user models.User
+	method := VISIT_METHOD_CARD
+	if req.CardID != nil {
+		user.CardID = req.CardID
+	} else {
+		user_id, err := parseCheckinToken(c, *req.CheckinToken)
+		if err != nil {
+			return err
+		}
+
+		user.ID = user_id
+		method = VISIT_METHOD_TOKEN
+	}
+
+	if res := db.Limit(1).Where(&user).Find(&user); res.Error != nil || res.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "User not found")
+	}
+
+	if err := AutoCheckoutVisits(db); err != nil {
+		log.Error("Failed to automatically check out visits: %s\n", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	c.Locals("visit_user", user)
+	c.Locals("visit_method", method)
+
+	return c.Next()
+}
+
+// listVisits responds with a paginated list of visits, newest first
+func listVisits(c *fiber.Ctx, con *gorm.DB, req listRequest) error {
+	var visits []models.Visit
+
+	if req.IncludeDeleted != nil && *req.IncludeDeleted {
+		con = con.Unscoped()
+	}
+
+	con = con.Model(&models.Visit{})
+
+	// Count the total number of visits
+	total := int64(0)
+	con.Count(&total)
+
+	// Paginate the results
+	con = con.Order("check_in desc")
+	if req.Limit != nil {
+		con = con.Limit(*req.Limit)
+	} else {
+		con = con.Limit(10)
+	}
+
+	if req.Offset != nil {
+		con = con.Offset(*req.Offset)
+	} else {
+		con = con.Offset(0)
+	}
+
+	con.Find(&visits)
+
+	response := struct {
+		Data  []models.Visit `json:"data"`
+		Total int64          `json:"total"`
+	}{
+		Data:  visits,
+		Total: total,
+	}
+
+	return c.JSON(response)
+}
+
+// addUserVisitsEndpoints adds the endpoints for visits for a user
+func addUserVisitsEndpoints(user_ep fiber.Router) {
+	visits_ep := user_ep.Group("/visits", leash_auth.ConcatPermissionPrefixMiddleware("visits"))
+
+	// List visit history endpoint
+	visits_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("target_user").(models.User)
+		req := c.Locals("query").(listRequest)
+
+		return listVisits(c, db.Where(&models.Visit{UserID: user.ID}), req)
+	})
+}
+
+// registerVisitEndpoints registers the visit endpoints
+func registerVisitEndpoints(api fiber.Router) {
+	visits_ep := api.Group("/visits", leash_auth.ConcatPermissionPrefixMiddleware("visits"))
+
+	// List all visits endpoint
+	visits_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		return listVisits(c, db, req)
+	})
+
+	// List who is currently in the space endpoint
+	visits_ep.Get("/present", leash_auth.PrefixAuthorizationMiddleware("present"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		if err := AutoCheckoutVisits(db); err != nil {
+			log.Error("Failed to automatically check out visits: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return listVisits(c, db.Preload("User").Where("check_out IS NULL"), req)
+	})
+
+	// Check in endpoint
+	visits_ep.Post("/checkin", leash_auth.PrefixAuthorizationMiddleware("checkin"), models.GetBodyMiddleware[visitRequest], visitUserMiddleware, func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("visit_user").(models.User)
+
+		if _, ok := getOpenVisit(db, user); ok {
+			return fiber.NewError(fiber.StatusConflict, "User is already checked in")
+		}
+
+		visit := models.Visit{
+			UserID:  user.ID,
+			CheckIn: time.Now(),
+			Method:  c.Locals("visit_method").(string),
+		}
+
+		db.Create(&visit)
+
+		return c.JSON(visit)
+	})
+
+	// Check out endpoint
+	visits_ep.Post("/checkout", leash_auth.PrefixAuthorizationMiddleware("checkout"), models.GetBodyMiddleware[visitRequest], visitUserMiddleware, func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := c.Locals("visit_user").(models.User)
+
+		visit, ok := getOpenVisit(db, user)
+		if !ok {
+			return fiber.NewError(fiber.StatusConflict, "User is not checked in")
+		}
+
+		now := time.Now()
+		visit.CheckOut = &now
+
+		db.Save(&visit)
+
+		return c.JSON(visit)
+	})
+}
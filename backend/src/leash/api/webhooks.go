@@ -0,0 +1,482 @@
+package leash_backend_api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	WEBHOOK_EVENT_USER_CREATE = "user.create"
+	WEBHOOK_EVENT_USER_UPDATE = "user.update"
+	WEBHOOK_EVENT_USER_DELETE = "user.delete"
+
+	WEBHOOK_EVENT_TRAINING_CREATE = "training.create"
+	WEBHOOK_EVENT_TRAINING_DELETE = "training.delete"
+
+	WEBHOOK_EVENT_HOLD_CREATE = "hold.create"
+	WEBHOOK_EVENT_HOLD_DELETE = "hold.delete"
+
+	WEBHOOK_EVENT_NOTIFICATION_CREATE = "notification.create"
+	WEBHOOK_EVENT_NOTIFICATION_DELETE = "notification.delete"
+)
+
+// webhookEvents is the set of events that webhooks can subscribe to
+var webhookEvents = map[string]bool{
+	WEBHOOK_EVENT_USER_CREATE: true,
+	WEBHOOK_EVENT_USER_UPDATE: true,
+	WEBHOOK_EVENT_USER_DELETE: true,
+
+	WEBHOOK_EVENT_TRAINING_CREATE: true,
+	WEBHOOK_EVENT_TRAINING_DELETE: true,
+
+	WEBHOOK_EVENT_HOLD_CREATE: true,
+	WEBHOOK_EVENT_HOLD_DELETE: true,
+
+	WEBHOOK_EVENT_NOTIFICATION_CREATE: true,
+	WEBHOOK_EVENT_NOTIFICATION_DELETE: true,
+}
+
+const webhookMaxAttempts = 5
+const webhookInitialBackoff = 10 * time.Second
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of the timestamp and payload
+func signWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookResponse is a webhook along with its signing secret, which is only returned when it is set
+type webhookResponse struct {
+	models.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// generateWebhookSecret generates a random secret for signing webhook payloads
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// attemptWebhookDelivery sends a single signed POST to the webhook and records the attempt
+func attemptWebhookDelivery(db *gorm.DB, webhook models.Webhook, deliveryID string, event string, payload []byte, attempt int) bool {
+	delivery := models.WebhookDelivery{
+		WebhookID:  webhook.ID,
+		DeliveryID: deliveryID,
+		Event:      event,
+		Payload:    string(payload),
+		Attempt:    attempt,
+	}
+
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		db.Create(&delivery)
+		return false
+	}
+
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "Leash-Webhook")
+	req.Header.Set("X-Leash-Event", event)
+	req.Header.Set("X-Leash-Delivery", deliveryID)
+	req.Header.Set("X-Leash-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Leash-Signature", "sha256="+signWebhookPayload(webhook.Secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		db.Create(&delivery)
+		return false
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Success {
+		delivery.Error = resp.Status
+	}
+
+	db.Create(&delivery)
+	return delivery.Success
+}
+
+// deliverWebhook delivers a payload to a webhook, retrying with exponential backoff on failure
+func deliverWebhook(db *gorm.DB, webhook models.Webhook, event string, payload []byte) {
+	deliveryID := uuid.New().String()
+	backoff := webhookInitialBackoff
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attemptWebhookDelivery(db, webhook, deliveryID, event, payload, attempt) {
+			return
+		}
+
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Error("Webhook %d failed to deliver %s after %d attempts\n", webhook.ID, deliveryID, webhookMaxAttempts)
+}
+
+// dispatchWebhookEvent sends an event to every active webhook subscribed to it
+func dispatchWebhookEvent(db *gorm.DB, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Error("Failed to marshal webhook payload for %s: %s\n", event, err)
+		return
+	}
+
+	var webhooks []models.Webhook
+	db.Where(&models.Webhook{Active: true}).Find(&webhooks)
+
+	for _, webhook := range webhooks {
+		for _, subscribed := range webhook.Events {
+			if subscribed == event {
+				go deliverWebhook(db, webhook, event, payload)
+				break
+			}
+		}
+	}
+}
+
+// validateWebhookEvents returns an error if any of the events are unknown
+func validateWebhookEvents(events []string) error {
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown webhook event: %s", event))
+		}
+	}
+
+	return nil
+}
+
+// webhookMiddleware is a middleware that fetches the webhook by ID and stores it in the context
+func webhookMiddleware(c *fiber.Ctx) error {
+	db := leash_auth.GetDB(c)
+	authentication := leash_auth.GetAuthentication(c)
+
+	// Check if the user is authorized to perform the action
+	if authentication.Authorize("leash.webhooks:target") != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to read webhooks")
+	}
+
+	webhook_id, err := strconv.Atoi(c.Params("webhook_id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid webhook ID")
+	}
+
+	var webhook = models.Webhook{
+		ID: uint(webhook_id),
+	}
+
+	if res := db.Limit(1).Where(&webhook).Find(&webhook); res.Error != nil || res.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "Webhook not found")
+	}
+
+	c.Locals("webhook", webhook)
+
+	return c.Next()
+}
+
+// createBaseWebhookEndpoints creates the base endpoints for the webhook endpoint
+func createBaseWebhookEndpoints(webhook_ep fiber.Router) {
+	// Create webhook endpoint
+	type webhookCreateRequest struct {
+		URL         string   `json:"url" xml:"url" form:"url" validate:"required,url"`
+		Events      []string `json:"events" xml:"events" form:"events" validate:"required,min=1"`
+		Description *string  `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Secret      *string  `json:"secret" xml:"secret" form:"secret" validate:"omitempty,min=16"`
+		Active      *bool    `json:"active" xml:"active" form:"active" validate:"omitempty"`
+	}
+	webhook_ep.Post("/", leash_auth.PrefixAuthorizationMiddleware("create"), models.GetBodyMiddleware[webhookCreateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("body").(webhookCreateRequest)
+
+		if err := validateWebhookEvents(req.Events); err != nil {
+			return err
+		}
+
+		webhook := models.Webhook{
+			URL:     req.URL,
+			Events:  req.Events,
+			Active:  true,
+			AddedBy: leash_auth.GetAuthentication(c).User.ID,
+		}
+
+		if req.Description != nil {
+			webhook.Description = *req.Description
+		}
+
+		if req.Active != nil {
+			webhook.Active = *req.Active
+		}
+
+		if req.Secret != nil {
+			webhook.Secret = *req.Secret
+		} else {
+			secret, err := generateWebhookSecret()
+			if err != nil {
+				log.Error("Failed to generate webhook secret: %s\n", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			webhook.Secret = secret
+		}
+
+		db.Create(&webhook)
+
+		return c.JSON(webhookResponse{
+			Webhook: webhook,
+			Secret:  webhook.Secret,
+		})
+	})
+
+	// List webhooks endpoint
+	webhook_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		req := c.Locals("query").(listRequest)
+
+		var webhooks []models.Webhook
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.Webhook{})
+
+		// Count the total number of webhooks
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&webhooks)
+
+		response := struct {
+			Data  []models.Webhook `json:"data"`
+			Total int64            `json:"total"`
+		}{
+			Data:  webhooks,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
+
+// createCommonWebhookEndpoints creates the endpoints for a single webhook
+func createCommonWebhookEndpoints(webhook_ep fiber.Router) {
+	// Get current webhook endpoint
+	webhook_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("get"), func(c *fiber.Ctx) error {
+		webhook := c.Locals("webhook").(models.Webhook)
+		return c.JSON(webhook)
+	})
+
+	// Update current webhook endpoint
+	type webhookUpdateRequest struct {
+		URL         *string   `json:"url" xml:"url" form:"url" validate:"omitempty,url"`
+		Events      *[]string `json:"events" xml:"events" form:"events" validate:"omitempty,min=1"`
+		Description *string   `json:"description" xml:"description" form:"description" validate:"omitempty"`
+		Secret      *string   `json:"secret" xml:"secret" form:"secret" validate:"omitempty,min=16"`
+		Active      *bool     `json:"active" xml:"active" form:"active" validate:"omitempty"`
+	}
+	webhook_ep.Patch("/", leash_auth.PrefixAuthorizationMiddleware("update"), models.GetBodyMiddleware[webhookUpdateRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		webhook := c.Locals("webhook").(models.Webhook)
+		req := c.Locals("body").(webhookUpdateRequest)
+
+		if req.URL != nil {
+			webhook.URL = *req.URL
+		}
+
+		if req.Events != nil {
+			if err := validateWebhookEvents(*req.Events); err != nil {
+				return err
+			}
+
+			webhook.Events = *req.Events
+		}
+
+		if req.Description != nil {
+			webhook.Description = *req.Description
+		}
+
+		if req.Secret != nil {
+			webhook.Secret = *req.Secret
+		}
+
+		if req.Active != nil {
+			webhook.Active = *req.Active
+		}
+
+		db.Save(&webhook)
+
+		return c.JSON(webhook)
+	})
+
+	// Replace the signing secret of the current webhook endpoint
+	webhook_ep.Post("/secret", leash_auth.PrefixAuthorizationMiddleware("update"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		webhook := c.Locals("webhook").(models.Webhook)
+
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			log.Error("Failed to generate webhook secret: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		webhook.Secret = secret
+		db.Save(&webhook)
+
+		return c.JSON(webhookResponse{
+			Webhook: webhook,
+			Secret:  secret,
+		})
+	})
+
+	// Delete current webhook endpoint
+	webhook_ep.Delete("/", leash_auth.PrefixAuthorizationMiddleware("delete"), func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		webhook := c.Locals("webhook").(models.Webhook)
+
+		db.Delete(&webhook)
+
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	deliveries_ep := webhook_ep.Group("/deliveries", leash_auth.ConcatPermissionPrefixMiddleware("deliveries"))
+
+	// List webhook deliveries endpoint
+	deliveries_ep.Get("/", leash_auth.PrefixAuthorizationMiddleware("list"), models.GetQueryMiddleware[listRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		webhook := c.Locals("webhook").(models.Webhook)
+		req := c.Locals("query").(listRequest)
+
+		var deliveries []models.WebhookDelivery
+
+		con := db
+		if req.IncludeDeleted != nil && *req.IncludeDeleted {
+			con = con.Unscoped()
+		}
+
+		con = con.Model(&models.WebhookDelivery{}).Where(models.WebhookDelivery{WebhookID: webhook.ID})
+
+		// Count the total number of deliveries
+		total := int64(0)
+		con.Count(&total)
+
+		// Paginate the results, newest first
+		con = con.Order("id desc")
+		if req.Limit != nil {
+			con = con.Limit(*req.Limit)
+		} else {
+			con = con.Limit(10)
+		}
+
+		if req.Offset != nil {
+			con = con.Offset(*req.Offset)
+		} else {
+			con = con.Offset(0)
+		}
+
+		con.Find(&deliveries)
+
+		response := struct {
+			Data  []models.WebhookDelivery `json:"data"`
+			Total int64                    `json:"total"`
+		}{
+			Data:  deliveries,
+			Total: total,
+		}
+
+		return c.JSON(response)
+	})
+}
+
+// registerWebhookEndpoints registers the webhook endpoints and the callbacks that deliver them
+func registerWebhookEndpoints(api fiber.Router) {
+	webhooks_ep := api.Group("/webhooks", leash_auth.ConcatPermissionPrefixMiddleware("webhooks"))
+
+	OnUserCreate(func(event UserEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_USER_CREATE, event)
+	})
+
+	OnUserUpdate(func(event UserUpdateEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_USER_UPDATE, event)
+	})
+
+	OnUserDelete(func(event UserEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_USER_DELETE, event)
+	})
+
+	OnTrainingCreate(func(event TrainingEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_TRAINING_CREATE, event)
+	})
+
+	OnTrainingDelete(func(event TrainingEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_TRAINING_DELETE, event)
+	})
+
+	OnHoldCreate(func(event HoldEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_HOLD_CREATE, event)
+	})
+
+	OnHoldDelete(func(event HoldEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_HOLD_DELETE, event)
+	})
+
+	OnNotificationCreate(func(event NotificationEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_NOTIFICATION_CREATE, event)
+	})
+
+	OnNotificationDelete(func(event NotificationEvent) {
+		dispatchWebhookEvent(leash_auth.GetDB(event.GetCtx()), WEBHOOK_EVENT_NOTIFICATION_DELETE, event)
+	})
+
+	// API key events are not exposed as webhooks since their payload contains the key itself
+
+	createBaseWebhookEndpoints(webhooks_ep)
+
+	webhook_ep := webhooks_ep.Group("/:webhook_id", webhookMiddleware)
+	createCommonWebhookEndpoints(webhook_ep)
+}
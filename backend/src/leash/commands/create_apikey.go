@@ -5,7 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
+	"strconv"
 	"strings"
 
 	"github.com/erikgeiser/promptkit/confirmation"
@@ -13,17 +13,16 @@ import (
 	"github.com/erikgeiser/promptkit/textinput"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/subcommands"
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
 	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"github.com/muesli/termenv"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
 )
 
-type NewApiKeyCmd struct{}
+type NewApiKeyCmd struct {
+	config leash_config.Flags
+}
 
 func (*NewApiKeyCmd) Name() string     { return "new_apikey" }
 func (*NewApiKeyCmd) Synopsis() string { return "Create a new api key for a service user" }
@@ -33,26 +32,32 @@ func (*NewApiKeyCmd) Usage() string {
   `
 }
 
-func (p *NewApiKeyCmd) SetFlags(f *flag.FlagSet) {}
+func (p *NewApiKeyCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+}
 
 func (p *NewApiKeyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	// dotenv Setup
-	err := godotenv.Load()
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateDatabase()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatalf("Invalid configuration:\n%s\n", err)
 	}
 
 	// Initialize DB
-	db_host := os.Getenv("DB_USERNAME") + ":" + os.Getenv("DB_PASSWORD") + "@tcp(" + os.Getenv("DB_HOST") + ")/" + os.Getenv("DB_TABLE") + "?parseTime=true"
-	db, err := gorm.Open(mysql.Open(db_host), &gorm.Config{})
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	log.Println("Migrating database schema...")
-	err = leash_helpers.MigrateSchema(db)
+	log.Println("Checking database schema...")
+	err = leash_helpers.CheckSchema(db)
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln(err)
 	}
 
 	// Initialize RBAC
@@ -62,7 +67,10 @@ func (p *NewApiKeyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 		log.Panicln(err)
 	}
 
-	leash_helpers.SetupCasbin(e)
+	err = leash_helpers.SetupCasbin(db, e)
+	if err != nil {
+		log.Panicln(err)
+	}
 
 	enforcer := leash_auth.EnforcerWrapper{
 		Enforcer: e,
@@ -97,11 +105,13 @@ func (p *NewApiKeyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 		return subcommands.ExitFailure
 	}
 
-	apikey := models.APIKey{
-		Key:    uuid.New().String(),
-		UserID: selectedUser.ID,
+	apikey, err := leash_auth.GenerateAPIKey()
+	if err != nil {
+		log.Panicln(err)
 	}
 
+	apikey.UserID = selectedUser.ID
+
 	descriptor := textinput.New("Description:")
 	descriptor.Validate = func(value string) error {
 		return nil
@@ -150,6 +160,44 @@ func (p *NewApiKeyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 		}
 	}
 
+	cidrsInput := textinput.New("Allowed networks (CIDRs seperated by commas and/or spaces, empty allows any):")
+	cidrsInput.Validate = func(value string) error {
+		for _, cidr := range strings.Fields(strings.ReplaceAll(value, ",", " ")) {
+			if _, err := leash_auth.ParseAPIKeyCIDR(cidr); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	cidrs, err := cidrsInput.RunPrompt()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	apikey.AllowedCIDRs = strings.Fields(strings.ReplaceAll(cidrs, ",", " "))
+
+	rateLimitInput := textinput.New("Requests per minute (0 is unlimited):")
+	rateLimitInput.InitialValue = "0"
+	rateLimitInput.Validate = func(value string) error {
+		limit, err := strconv.Atoi(value)
+		if err == nil && limit < 0 {
+			return fmt.Errorf("rate limit can not be negative")
+		}
+
+		return err
+	}
+
+	rateLimit, err := rateLimitInput.RunPrompt()
+	if err != nil {
+		log.Println(err)
+		return subcommands.ExitFailure
+	}
+
+	apikey.RateLimit, _ = strconv.Atoi(rateLimit)
+
 	log.Println("Creating API Key...")
 
 	err = db.Create(&apikey).Error
@@ -159,7 +207,7 @@ func (p *NewApiKeyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 
 	enforcer.SetPermissionsForAPIKey(apikey, apikey.Permissions)
 
-	log.Println("API Key:", apikey.Key)
+	log.Println("API Key:", apikey.Token)
 
 	log.Println("API Key created successfully!")
 
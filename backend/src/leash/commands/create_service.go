@@ -5,21 +5,20 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 
 	"github.com/erikgeiser/promptkit/textinput"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/subcommands"
-	"github.com/joho/godotenv"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
 	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
 )
 
-type NewServiceUserCmd struct{}
+type NewServiceUserCmd struct {
+	config leash_config.Flags
+}
 
 func (*NewServiceUserCmd) Name() string     { return "new_service" }
 func (*NewServiceUserCmd) Synopsis() string { return "Create a new service user" }
@@ -29,26 +28,32 @@ func (*NewServiceUserCmd) Usage() string {
   `
 }
 
-func (p *NewServiceUserCmd) SetFlags(f *flag.FlagSet) {}
+func (p *NewServiceUserCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+}
 
 func (p *NewServiceUserCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	// dotenv Setup
-	err := godotenv.Load()
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateDatabase()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatalf("Invalid configuration:\n%s\n", err)
 	}
 
 	// Initialize DB
-	db_host := os.Getenv("DB_USERNAME") + ":" + os.Getenv("DB_PASSWORD") + "@tcp(" + os.Getenv("DB_HOST") + ")/" + os.Getenv("DB_TABLE") + "?parseTime=true"
-	db, err := gorm.Open(mysql.Open(db_host), &gorm.Config{})
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	log.Println("Migrating database schema...")
-	err = leash_helpers.MigrateSchema(db)
+	log.Println("Checking database schema...")
+	err = leash_helpers.CheckSchema(db)
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln(err)
 	}
 
 	// Initialize RBAC
@@ -58,7 +63,10 @@ func (p *NewServiceUserCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...int
 		log.Panicln(err)
 	}
 
-	leash_helpers.SetupCasbin(e)
+	err = leash_helpers.SetupCasbin(db, e)
+	if err != nil {
+		log.Panicln(err)
+	}
 
 	enforcer := leash_auth.EnforcerWrapper{
 		Enforcer: e,
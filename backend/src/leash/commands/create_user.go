@@ -5,22 +5,21 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 
 	"github.com/erikgeiser/promptkit/selection"
 	"github.com/erikgeiser/promptkit/textinput"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/subcommands"
-	"github.com/joho/godotenv"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
 	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"github.com/muesli/termenv"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
 )
 
-type NewUserCmd struct{}
+type NewUserCmd struct {
+	config leash_config.Flags
+}
 
 func (*NewUserCmd) Name() string     { return "new_user" }
 func (*NewUserCmd) Synopsis() string { return "Create a new user" }
@@ -30,26 +29,32 @@ func (*NewUserCmd) Usage() string {
   `
 }
 
-func (p *NewUserCmd) SetFlags(f *flag.FlagSet) {}
+func (p *NewUserCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+}
 
 func (p *NewUserCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	// dotenv Setup
-	err := godotenv.Load()
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateDatabase()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatalf("Invalid configuration:\n%s\n", err)
 	}
 
 	// Initialize DB
-	db_host := os.Getenv("DB_USERNAME") + ":" + os.Getenv("DB_PASSWORD") + "@tcp(" + os.Getenv("DB_HOST") + ")/" + os.Getenv("DB_TABLE") + "?parseTime=true"
-	db, err := gorm.Open(mysql.Open(db_host), &gorm.Config{})
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	log.Println("Migrating database schema...")
-	err = leash_helpers.MigrateSchema(db)
+	log.Println("Checking database schema...")
+	err = leash_helpers.CheckSchema(db)
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln(err)
 	}
 
 	validate := validator.New()
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
+	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
+)
+
+type ImportUsersCmd struct {
+	config leash_config.Flags
+	dryRun bool
+}
+
+func (*ImportUsersCmd) Name() string     { return "import_users" }
+func (*ImportUsersCmd) Synopsis() string { return "Create or update users from a CSV file" }
+func (*ImportUsersCmd) Usage() string {
+	return `import_users [-dry-run] <file.csv>:
+	  Create or update users by email from a CSV file with the columns
+	  email, name, pronouns, role, type, graduation_year, major, department, job_title
+  `
+}
+
+func (p *ImportUsersCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+	f.BoolVar(&p.dryRun, "dry-run", false, "validate the file and report changes without writing them")
+}
+
+func (p *ImportUsersCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateDatabase()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s\n", err)
+	}
+
+	// Initialize DB
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	log.Println("Checking database schema...")
+	err = leash_helpers.CheckSchema(db)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	file, err := os.Open(f.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+
+		return subcommands.ExitFailure
+	}
+	defer file.Close()
+
+	log.Println("Importing users...")
+	result, err := leash_api.ImportUsersCSV(db, file, p.dryRun)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+
+		return subcommands.ExitFailure
+	}
+
+	for _, row := range result.Rows {
+		switch row.Action {
+		case leash_api.USER_IMPORT_ERROR:
+			fmt.Printf("Row %d (%s): %s\n", row.Row, row.Email, strings.Join(row.Errors, ", "))
+		case leash_api.USER_IMPORT_UPDATE:
+			fields := []string{}
+			for _, change := range row.Changes {
+				fields = append(fields, change.Field)
+			}
+
+			fmt.Printf("Row %d (%s): update %s\n", row.Row, row.Email, strings.Join(fields, ", "))
+		case leash_api.USER_IMPORT_CREATE:
+			fmt.Printf("Row %d (%s): create\n", row.Row, row.Email)
+		}
+	}
+
+	fmt.Printf("%d created, %d updated, %d unchanged, %d failed\n", result.Created, result.Updated, result.Unchanged, result.Failed)
+
+	if result.Failed > 0 {
+		log.Println("Import failed, no users were changed")
+		return subcommands.ExitFailure
+	}
+
+	if p.dryRun {
+		log.Println("Dry run, no users were changed")
+	} else {
+		log.Println("Users imported successfully")
+	}
+
+	return subcommands.ExitSuccess
+}
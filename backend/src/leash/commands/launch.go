@@ -4,21 +4,20 @@ import (
 	"context"
 	"flag"
 	"log"
-	"os"
-
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/subcommands"
-	"github.com/joho/godotenv"
+	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
 	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
+	leash_oauth "github.com/mkrcx/mkrcx/src/leash/oauth"
+	leash_signin "github.com/mkrcx/mkrcx/src/leash/signin"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 )
 
-const DEFAULT_HOST = ":8000"
-
-type LaunchCmd struct{}
+type LaunchCmd struct {
+	config leash_config.Flags
+}
 
 func (*LaunchCmd) Name() string     { return "launch" }
 func (*LaunchCmd) Synopsis() string { return "Launch the Leash server" }
@@ -28,49 +27,71 @@ func (*LaunchCmd) Usage() string {
   `
 }
 
-func (p *LaunchCmd) SetFlags(f *flag.FlagSet) {}
+func (p *LaunchCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+}
 
-func (p *LaunchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	// dotenv Setup
-	err := godotenv.Load()
+func (p *LaunchCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	// Load Config
+	cfg, err := p.config.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatalln(err)
 	}
 
-	// Initialize DB
-	db_host := os.Getenv("DB_USERNAME") + ":" + os.Getenv("DB_PASSWORD") + "@tcp(" + os.Getenv("DB_HOST") + ")/" + os.Getenv("DB_TABLE") + "?parseTime=true"
-	db, err := gorm.Open(mysql.Open(db_host), &gorm.Config{})
+	err = cfg.ValidateServer()
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalf("Invalid configuration:\n%s\n", err)
 	}
 
-	log.Println("Migrating database schema...")
-	err = leash_helpers.MigrateSchema(db)
+	// Initialize DB
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	// Google OAuth2
-	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
-	if googleClientID == "" {
-		log.Panicln("GOOGLE_CLIENT_ID is not set")
+	log.Println("Checking database schema...")
+	err = leash_helpers.CheckSchema(db)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	googleClientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
-	if googleClientSecret == "" {
-		log.Panicln("GOOGLE_CLIENT_SECRET is not set")
+	// Login providers, the first registered is the default
+	redirectURL := cfg.URL + "/auth/callback"
+	externalProviders := leash_auth.NewExternalProviders()
+
+	if cfg.GoogleEnabled() {
+		googleAuth := leash_auth.GetGoogleAuthenticator(cfg.Google.ClientID, cfg.Google.ClientSecret, redirectURL)
+		err = externalProviders.Register("google", "Google", googleAuth)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	googleRedirectURL := os.Getenv("LEASH_URL") + "/auth/callback"
-	externalAuth := leash_auth.GetGoogleAuthenticator(googleClientID, googleClientSecret, googleRedirectURL)
+	if cfg.OIDCEnabled() {
+		log.Println("Discovering OIDC provider...")
+		oidcAuth, err := leash_auth.GetOIDCAuthenticator(ctx, leash_auth.OIDCConfig{
+			Issuer:         cfg.OIDC.Issuer,
+			ClientID:       cfg.OIDC.ClientID,
+			ClientSecret:   cfg.OIDC.ClientSecret,
+			RedirectURL:    redirectURL,
+			Scopes:         leash_config.SplitList(cfg.OIDC.Scopes),
+			EmailClaim:     cfg.OIDC.EmailClaim,
+			DomainClaim:    cfg.OIDC.DomainClaim,
+			AllowedDomains: leash_config.SplitList(cfg.OIDC.AllowedDomains),
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		err = externalProviders.Register(cfg.OIDC.Name, cfg.OIDC.DisplayName, oidcAuth)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	// JWT Key
 	log.Println("Initializing JWT Keys...")
-	key_file := os.Getenv("KEY_FILE")
-	if key_file == "" {
-		log.Panicln("KEY_FILE is not set")
-	}
-	set, err := leash_auth.CreateOrGetKeysFromFile(key_file)
+	set, err := leash_auth.CreateOrGetKeysFromFile(cfg.KeyFile)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -80,11 +101,6 @@ func (p *LaunchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		log.Panicln(err)
 	}
 
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		log.Panicln("HMAC_SECRET is not set")
-	}
-
 	// Initialize RBAC
 	log.Println("Initializing RBAC...")
 	enforcer, err := leash_auth.InitializeCasbin(db)
@@ -92,25 +108,72 @@ func (p *LaunchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 		log.Panicln(err)
 	}
 
-	leash_helpers.SetupCasbin(enforcer)
+	err = leash_helpers.SetupCasbin(db, enforcer)
+	if err != nil {
+		log.Panicln(err)
+	}
 
-	// Create App
-	log.Println("Initializing Fiber...")
-	host := os.Getenv("HOST")
-	if host == "" {
-		host = DEFAULT_HOST
+	// Visits
+	err = leash_api.SetVisitClosingTime(cfg.ClosingTime)
+	if err != nil {
+		log.Panicln(err)
 	}
 
-	app := fiber.New()
+	leash_api.StartVisitAutoCheckout(db)
+
+	// Email verification
+	mailer, err := leash_helpers.OpenMailer(cfg.Mail)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	leash_api.SetMailer(mailer, cfg.URL)
+	leash_api.StartPendingEmailExpiry(db)
+	leash_api.StartSessionSweep(db)
+
+	// Registration
+	err = leash_signin.SetRegistrationMode(cfg.Registration)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	// OAuth server
+	leash_oauth.SetOAuthServer(cfg.URL, cfg.OAuth.ConsentURL)
+
+	// Rate limits, ValidateServer has already checked they parse
+	rateLimits := leash_auth.RateLimits{Buckets: map[string]leash_auth.RateLimit{}}
+	for bucket, value := range map[string]string{
+		leash_auth.RATE_LIMIT_REQUESTS: cfg.RateLimit.Requests,
+		leash_auth.RATE_LIMIT_LOOKUPS:  cfg.RateLimit.Lookups,
+		leash_auth.RATE_LIMIT_SIGNIN:   cfg.RateLimit.Signin,
+	} {
+		requests, window, _ := leash_config.ParseRateLimit(value)
+		rateLimits.Buckets[bucket] = leash_auth.RateLimit{Max: requests, Window: window}
+	}
+
+	requests, window, _ := leash_config.ParseRateLimit(cfg.RateLimit.Lockout)
+	rateLimits.Lockout = leash_auth.RateLimit{Max: requests, Window: window}
+
+	leash_auth.SetRateLimits(leash_auth.NewMemoryRateLimitStore(), rateLimits)
+
+	// Create App
+	log.Println("Initializing Fiber...")
+	app := fiber.New(fiber.Config{
+		// Client IPs are only read from the proxy header when the request comes from a trusted proxy
+		ProxyHeader:             cfg.ProxyHeader,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          leash_config.SplitList(cfg.TrustedProxies),
+		EnableIPValidation:      true,
+	})
 
 	log.Println("Setting up middleware...")
-	leash_helpers.SetupMiddlewares(app, db, keys, []byte(hmacSecret), externalAuth, enforcer)
+	leash_helpers.SetupMiddlewares(app, db, keys, []byte(cfg.HMACSecret), externalProviders, enforcer)
 
 	log.Println("Setting up routes...")
 	leash_helpers.SetupRoutes(app)
 
-	log.Printf("Starting server on port %s\n", host)
-	app.Listen(host)
+	log.Printf("Starting server on port %s\n", cfg.Host)
+	app.Listen(cfg.Host)
 
 	return subcommands.ExitSuccess
 }
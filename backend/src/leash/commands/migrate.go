@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/google/subcommands"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
+	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
+	leash_migrations "github.com/mkrcx/mkrcx/src/leash/migrations"
+)
+
+type MigrateCmd struct {
+	config leash_config.Flags
+	steps  int
+}
+
+func (*MigrateCmd) Name() string     { return "migrate" }
+func (*MigrateCmd) Synopsis() string { return "Apply, roll back or list database schema migrations" }
+func (*MigrateCmd) Usage() string {
+	return `migrate [-steps N] up|down|status:
+	  up      Apply every pending migration
+	  down    Roll back the most recent migrations, one by default
+	  status  List every migration and whether it has been applied
+  `
+}
+
+func (p *MigrateCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+	f.IntVar(&p.steps, "steps", 1, "number of migrations to roll back with down")
+}
+
+func (p *MigrateCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateDatabase()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s\n", err)
+	}
+
+	// Initialize DB
+	db, err := leash_helpers.OpenDatabase(cfg.Database)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	switch f.Arg(0) {
+	case "up":
+		applied, err := leash_migrations.Up(db)
+		for _, migration := range applied {
+			fmt.Printf("Applied %d %s\n", migration.Version, migration.Name)
+		}
+
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return subcommands.ExitFailure
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+	case "down":
+		if p.steps < 1 {
+			fmt.Println("Error: -steps must be at least 1")
+			return subcommands.ExitUsageError
+		}
+
+		rolledBack, err := leash_migrations.Down(db, p.steps)
+		for _, migration := range rolledBack {
+			fmt.Printf("Rolled back %d %s\n", migration.Version, migration.Name)
+		}
+
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return subcommands.ExitFailure
+		}
+
+		if len(rolledBack) == 0 {
+			fmt.Println("No migrations to roll back")
+		}
+	case "status":
+		status, err := leash_migrations.Status(db)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return subcommands.ExitFailure
+		}
+
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Printf("%4d  %-24s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+
+	return subcommands.ExitSuccess
+}
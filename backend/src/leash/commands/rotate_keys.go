@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/subcommands"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+)
+
+type RotateKeysCmd struct {
+	config leash_config.Flags
+	retain time.Duration
+}
+
+func (*RotateKeysCmd) Name() string { return "rotate_keys" }
+func (*RotateKeysCmd) Synopsis() string {
+	return "Add a new JWT signing key and retire the previous ones"
+}
+func (*RotateKeysCmd) Usage() string {
+	return `rotate_keys [-retain DURATION]:
+	  Add a new JWT signing key to the key file. Previous keys stop signing but keep
+	  verifying tokens until they have been retired for longer than -retain, then
+	  they are removed on a later rotation. Restart Leash to sign with the new key.
+  `
+}
+
+func (p *RotateKeysCmd) SetFlags(f *flag.FlagSet) {
+	p.config.SetFlags(f)
+	f.DurationVar(&p.retain, "retain", 8*24*time.Hour, "how long retired keys keep verifying tokens, at least the longest token lifetime")
+}
+
+func (p *RotateKeysCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	// Load Config
+	cfg, err := p.config.Load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = cfg.ValidateKeys()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s\n", err)
+	}
+
+	key, removed, err := leash_auth.RotateKeyFile(cfg.KeyFile, p.retain)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return subcommands.ExitFailure
+	}
+
+	for _, kid := range removed {
+		fmt.Printf("Removed expired key %s\n", kid)
+	}
+
+	fmt.Printf("Added signing key %s\n", key.KeyID())
+	fmt.Println("Restart Leash to start signing tokens with the new key")
+
+	return subcommands.ExitSuccess
+}
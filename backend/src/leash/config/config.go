@@ -0,0 +1,422 @@
+package leash_config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DB_DRIVER_MYSQL    = "mysql"
+	DB_DRIVER_POSTGRES = "postgres"
+	DB_DRIVER_SQLITE   = "sqlite"
+)
+
+const (
+	MAIL_DRIVER_SMTP = "smtp"
+	MAIL_DRIVER_FILE = "file"
+	MAIL_DRIVER_LOG  = "log"
+)
+
+// CONFIG_FILE_ENV is the env var used to find the config file when the -config flag is not given
+const CONFIG_FILE_ENV = "LEASH_CONFIG"
+
+type DatabaseConfig struct {
+	Driver   string `yaml:"driver" toml:"driver" env:"DB_DRIVER" flag:"db-driver" usage:"database driver, one of mysql, postgres or sqlite"`
+	Host     string `yaml:"host" toml:"host" env:"DB_HOST" flag:"db-host" usage:"database host and port"`
+	Username string `yaml:"username" toml:"username" env:"DB_USERNAME" flag:"db-username" usage:"database username"`
+	Password string `yaml:"password" toml:"password" env:"DB_PASSWORD" flag:"db-password" usage:"database password"`
+	Name     string `yaml:"name" toml:"name" env:"DB_TABLE" flag:"db-name" usage:"database name"`
+	Path     string `yaml:"path" toml:"path" env:"DB_PATH" flag:"db-path" usage:"database file for the sqlite driver"`
+	SSLMode  string `yaml:"ssl_mode" toml:"ssl_mode" env:"DB_SSLMODE" flag:"db-sslmode" usage:"ssl mode for the postgres driver"`
+}
+
+type MailConfig struct {
+	Driver   string `yaml:"driver" toml:"driver" env:"MAIL_DRIVER" flag:"mail-driver" usage:"mail driver, one of smtp, file or log"`
+	From     string `yaml:"from" toml:"from" env:"MAIL_FROM" flag:"mail-from" usage:"address emails are sent from"`
+	Host     string `yaml:"host" toml:"host" env:"SMTP_HOST" flag:"smtp-host" usage:"SMTP server host and port"`
+	Username string `yaml:"username" toml:"username" env:"SMTP_USERNAME" flag:"smtp-username" usage:"SMTP username"`
+	Password string `yaml:"password" toml:"password" env:"SMTP_PASSWORD" flag:"smtp-password" usage:"SMTP password"`
+	File     string `yaml:"file" toml:"file" env:"MAIL_FILE" flag:"mail-file" usage:"file emails are appended to for the file driver"`
+}
+
+// GoogleConfig configures the Google login provider, enabled when the client ID is set
+type GoogleConfig struct {
+	ClientID     string `yaml:"client_id" toml:"client_id" env:"GOOGLE_CLIENT_ID" flag:"google-client-id" usage:"Google OAuth2 client ID"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret" env:"GOOGLE_CLIENT_SECRET" flag:"google-client-secret" usage:"Google OAuth2 client secret"`
+}
+
+// OIDCConfig configures a generic OpenID Connect login provider, enabled when the issuer is set
+type OIDCConfig struct {
+	Name           string `yaml:"name" toml:"name" env:"OIDC_NAME" flag:"oidc-name" usage:"name of the OpenID Connect provider used in /auth/login?provider="`
+	DisplayName    string `yaml:"display_name" toml:"display_name" env:"OIDC_DISPLAY_NAME" flag:"oidc-display-name" usage:"OpenID Connect provider name shown on the login page"`
+	Issuer         string `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER" flag:"oidc-issuer" usage:"OpenID Connect issuer URL, enables the OpenID Connect provider"`
+	ClientID       string `yaml:"client_id" toml:"client_id" env:"OIDC_CLIENT_ID" flag:"oidc-client-id" usage:"OpenID Connect client ID"`
+	ClientSecret   string `yaml:"client_secret" toml:"client_secret" env:"OIDC_CLIENT_SECRET" flag:"oidc-client-secret" usage:"OpenID Connect client secret"`
+	Scopes         string `yaml:"scopes" toml:"scopes" env:"OIDC_SCOPES" flag:"oidc-scopes" usage:"comma separated scopes to request, openid is always included"`
+	EmailClaim     string `yaml:"email_claim" toml:"email_claim" env:"OIDC_EMAIL_CLAIM" flag:"oidc-email-claim" usage:"ID token claim holding the user's email"`
+	DomainClaim    string `yaml:"domain_claim" toml:"domain_claim" env:"OIDC_DOMAIN_CLAIM" flag:"oidc-domain-claim" usage:"ID token claim checked against the allowed domains, defaults to the email domain"`
+	AllowedDomains string `yaml:"allowed_domains" toml:"allowed_domains" env:"OIDC_ALLOWED_DOMAINS" flag:"oidc-allowed-domains" usage:"comma separated domains allowed to sign in, any when empty"`
+}
+
+// OAuthConfig configures Leash as an OAuth2 authorization server for other mkr.cx apps
+type OAuthConfig struct {
+	ConsentURL string `yaml:"consent_url" toml:"consent_url" env:"OAUTH_CONSENT_URL" flag:"oauth-consent-url" usage:"frontend page users approve OAuth clients on, enables /oauth/authorize"`
+}
+
+// RateLimitConfig configures request rate limits, each is formatted as <requests>/<duration> and disabled when empty
+type RateLimitConfig struct {
+	Requests string `yaml:"requests" toml:"requests" env:"RATE_LIMIT_REQUESTS" flag:"rate-limit-requests" usage:"requests allowed per IP, user and api key, e.g. 600/1m"`
+	Lookups  string `yaml:"lookups" toml:"lookups" env:"RATE_LIMIT_LOOKUPS" flag:"rate-limit-lookups" usage:"card and checkin token lookups allowed per IP, user and api key"`
+	Signin   string `yaml:"signin" toml:"signin" env:"RATE_LIMIT_SIGNIN" flag:"rate-limit-signin" usage:"sign in callbacks allowed per IP"`
+	Lockout  string `yaml:"lockout" toml:"lockout" env:"RATE_LIMIT_LOCKOUT" flag:"rate-limit-lockout" usage:"failed authentications from an IP for the same api key or user before it is locked out for the duration"`
+}
+
+type Config struct {
+	Host           string          `yaml:"host" toml:"host" env:"HOST" flag:"host" usage:"address to listen on"`
+	URL            string          `yaml:"url" toml:"url" env:"LEASH_URL" flag:"url" usage:"public URL of the Leash server"`
+	KeyFile        string          `yaml:"key_file" toml:"key_file" env:"KEY_FILE" flag:"key-file" usage:"file the JWT keys are stored in"`
+	HMACSecret     string          `yaml:"hmac_secret" toml:"hmac_secret" env:"HMAC_SECRET" flag:"hmac-secret" usage:"secret used to sign checkin tokens"`
+	ClosingTime    string          `yaml:"closing_time" toml:"closing_time" env:"CLOSING_TIME" flag:"closing-time" usage:"time of day (HH:MM) open visits are checked out"`
+	Registration   string          `yaml:"registration" toml:"registration" env:"REGISTRATION" flag:"registration" usage:"whether unknown users can register, one of disabled, open or approval"`
+	ProxyHeader    string          `yaml:"proxy_header" toml:"proxy_header" env:"PROXY_HEADER" flag:"proxy-header" usage:"header a reverse proxy puts the client IP in, e.g. X-Forwarded-For"`
+	TrustedProxies string          `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies" usage:"comma separated IPs and CIDRs of the reverse proxies the proxy header is read from"`
+	Database       DatabaseConfig  `yaml:"database" toml:"database"`
+	Mail           MailConfig      `yaml:"mail" toml:"mail"`
+	Google         GoogleConfig    `yaml:"google" toml:"google"`
+	OIDC           OIDCConfig      `yaml:"oidc" toml:"oidc"`
+	OAuth          OAuthConfig     `yaml:"oauth" toml:"oauth"`
+	RateLimit      RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+// Default returns the configuration used when a setting is not given anywhere
+func Default() Config {
+	return Config{
+		Host:         ":8000",
+		ClosingTime:  "00:00",
+		Registration: "disabled",
+		Database: DatabaseConfig{
+			Driver:  DB_DRIVER_MYSQL,
+			SSLMode: "disable",
+		},
+		Mail: MailConfig{
+			Driver: MAIL_DRIVER_LOG,
+			From:   "leash@localhost",
+		},
+		OIDC: OIDCConfig{
+			Name:        "oidc",
+			DisplayName: "Single Sign-On",
+			Scopes:      "email,profile",
+			EmailClaim:  "email",
+		},
+		RateLimit: RateLimitConfig{
+			Requests: "600/1m",
+			Lookups:  "60/1m",
+			Signin:   "20/1m",
+			Lockout:  "10/15m",
+		},
+	}
+}
+
+// Flags holds the command line flags for a subcommand, registered with SetFlags and applied by Load
+type Flags struct {
+	file   string
+	values map[string]*string
+}
+
+// SetFlags registers the config file flag and a flag for every setting
+func (f *Flags) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "config", "", "YAML or TOML config file, defaults to $"+CONFIG_FILE_ENV)
+
+	f.values = map[string]*string{}
+	walkSettings(reflect.ValueOf(&Config{}).Elem(), func(field reflect.StructField, _ reflect.Value) {
+		name := field.Tag.Get("flag")
+		f.values[name] = fs.String(name, "", field.Tag.Get("usage")+" ($"+field.Tag.Get("env")+")")
+	})
+}
+
+// Load builds the configuration from, in increasing priority, defaults, the config file, .env, the environment and flags
+func (f *Flags) Load() (Config, error) {
+	cfg := Default()
+
+	file := f.file
+	if file == "" {
+		file = os.Getenv(CONFIG_FILE_ENV)
+	}
+
+	if file != "" {
+		if err := loadFile(file, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	// A .env file is optional, but a broken one is not
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cfg, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	walkSettings(reflect.ValueOf(&cfg).Elem(), func(field reflect.StructField, value reflect.Value) {
+		if env, ok := os.LookupEnv(field.Tag.Get("env")); ok && env != "" {
+			value.SetString(env)
+		}
+
+		if flagValue, ok := f.values[field.Tag.Get("flag")]; ok && *flagValue != "" {
+			value.SetString(*flagValue)
+		}
+	})
+
+	return cfg, nil
+}
+
+// loadFile reads a YAML or TOML config file into cfg based on its extension
+func loadFile(file string, cfg *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", file)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// walkSettings calls fn for every string setting in the config, descending into nested sections
+func walkSettings(v reflect.Value, fn func(field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			walkSettings(value, fn)
+		case reflect.String:
+			fn(field, value)
+		}
+	}
+}
+
+// required returns an error naming the setting if it is empty
+func required(value string, name string, env string) error {
+	if value == "" {
+		return fmt.Errorf("%s is not set (set %s in the environment or %s in the config file)", env, env, name)
+	}
+
+	return nil
+}
+
+// ValidateDatabase checks the settings needed to connect to the database
+func (c Config) ValidateDatabase() error {
+	db := c.Database
+
+	switch db.Driver {
+	case DB_DRIVER_MYSQL, DB_DRIVER_POSTGRES:
+		return errors.Join(
+			required(db.Host, "database.host", "DB_HOST"),
+			required(db.Username, "database.username", "DB_USERNAME"),
+			required(db.Name, "database.name", "DB_TABLE"),
+		)
+	case DB_DRIVER_SQLITE:
+		return required(db.Path, "database.path", "DB_PATH")
+	default:
+		return fmt.Errorf("DB_DRIVER %q is not supported, expected one of %s, %s or %s", db.Driver, DB_DRIVER_MYSQL, DB_DRIVER_POSTGRES, DB_DRIVER_SQLITE)
+	}
+}
+
+// GoogleEnabled reports whether the Google login provider is configured
+func (c Config) GoogleEnabled() bool {
+	return c.Google.ClientID != "" || c.Google.ClientSecret != ""
+}
+
+// OIDCEnabled reports whether the OpenID Connect login provider is configured
+func (c Config) OIDCEnabled() bool {
+	return c.OIDC.Issuer != ""
+}
+
+// ValidateAuthentication checks that at least one login provider is enabled and every enabled provider is complete
+func (c Config) ValidateAuthentication() error {
+	if !c.GoogleEnabled() && !c.OIDCEnabled() {
+		return errors.New("no login provider is configured (set GOOGLE_CLIENT_ID or OIDC_ISSUER)")
+	}
+
+	errs := []error{}
+
+	if c.GoogleEnabled() {
+		errs = append(errs,
+			required(c.Google.ClientID, "google.client_id", "GOOGLE_CLIENT_ID"),
+			required(c.Google.ClientSecret, "google.client_secret", "GOOGLE_CLIENT_SECRET"),
+		)
+	}
+
+	if c.OIDCEnabled() {
+		errs = append(errs,
+			required(c.OIDC.Name, "oidc.name", "OIDC_NAME"),
+			required(c.OIDC.ClientID, "oidc.client_id", "OIDC_CLIENT_ID"),
+			required(c.OIDC.ClientSecret, "oidc.client_secret", "OIDC_CLIENT_SECRET"),
+			required(c.OIDC.EmailClaim, "oidc.email_claim", "OIDC_EMAIL_CLAIM"),
+		)
+
+		if c.GoogleEnabled() && c.OIDC.Name == "google" {
+			errs = append(errs, errors.New(`OIDC_NAME must not be "google" while the Google provider is enabled`))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SplitList splits a comma separated setting, dropping empty entries
+func SplitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// ValidateMail checks the settings needed to send emails
+func (c Config) ValidateMail() error {
+	m := c.Mail
+
+	var from error
+	if _, err := m.ParseFrom(); err != nil {
+		from = fmt.Errorf("MAIL_FROM %q is not a valid address", m.From)
+	}
+
+	switch m.Driver {
+	case MAIL_DRIVER_SMTP:
+		return errors.Join(
+			from,
+			required(m.Host, "mail.host", "SMTP_HOST"),
+		)
+	case MAIL_DRIVER_FILE:
+		return errors.Join(
+			from,
+			required(m.File, "mail.file", "MAIL_FILE"),
+		)
+	case MAIL_DRIVER_LOG:
+		return from
+	default:
+		return fmt.Errorf("MAIL_DRIVER %q is not supported, expected one of %s, %s or %s", m.Driver, MAIL_DRIVER_SMTP, MAIL_DRIVER_FILE, MAIL_DRIVER_LOG)
+	}
+}
+
+// ParseFrom parses the address emails are sent from
+func (m MailConfig) ParseFrom() (*mail.Address, error) {
+	return mail.ParseAddress(m.From)
+}
+
+// ValidateKeys checks the settings needed to load the JWT keys
+func (c Config) ValidateKeys() error {
+	return required(c.KeyFile, "key_file", "KEY_FILE")
+}
+
+// ParseRateLimit parses a rate limit formatted as <requests>/<duration>, an empty one is disabled and parses as 0 requests
+func ParseRateLimit(value string) (int, time.Duration, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	count, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("rate limit %q must be formatted as <requests>/<duration>", value)
+	}
+
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests < 0 {
+		return 0, 0, fmt.Errorf("rate limit %q must start with a number of requests", value)
+	}
+
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return 0, 0, fmt.Errorf("rate limit %q must end with a duration like 1m", value)
+	}
+
+	return requests, duration, nil
+}
+
+// ValidateRateLimits checks every rate limit parses
+func (c Config) ValidateRateLimits() error {
+	errs := []error{}
+	for env, value := range map[string]string{
+		"RATE_LIMIT_REQUESTS": c.RateLimit.Requests,
+		"RATE_LIMIT_LOOKUPS":  c.RateLimit.Lookups,
+		"RATE_LIMIT_SIGNIN":   c.RateLimit.Signin,
+		"RATE_LIMIT_LOCKOUT":  c.RateLimit.Lockout,
+	} {
+		if _, _, err := ParseRateLimit(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateProxies checks every trusted proxy is an IP or CIDR
+func (c Config) ValidateProxies() error {
+	errs := []error{}
+	for _, proxy := range SplitList(c.TrustedProxies) {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("TRUSTED_PROXIES %q is not an IP or CIDR", proxy))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateServer checks every setting needed to launch the server
+func (c Config) ValidateServer() error {
+	var closingTime error
+	if _, err := time.Parse("15:04", c.ClosingTime); err != nil {
+		closingTime = fmt.Errorf("CLOSING_TIME %q must be formatted as HH:MM", c.ClosingTime)
+	}
+
+	var registration error
+	switch c.Registration {
+	case "disabled", "open", "approval":
+	default:
+		registration = fmt.Errorf("REGISTRATION %q is not supported, expected one of disabled, open or approval", c.Registration)
+	}
+
+	return errors.Join(
+		c.ValidateDatabase(),
+		required(c.URL, "url", "LEASH_URL"),
+		c.ValidateKeys(),
+		required(c.HMACSecret, "hmac_secret", "HMAC_SECRET"),
+		c.ValidateAuthentication(),
+		c.ValidateMail(),
+		c.ValidateRateLimits(),
+		c.ValidateProxies(),
+		closingTime,
+		registration,
+	)
+}
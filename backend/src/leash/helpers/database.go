@@ -0,0 +1,46 @@
+package leash_helpers
+
+import (
+	"fmt"
+	"net/url"
+
+	// Pure Go sqlite driver so the server can be built without cgo
+	"github.com/glebarez/sqlite"
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// DatabaseDialector returns the gorm dialector for the configured database driver
+func DatabaseDialector(cfg leash_config.DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case leash_config.DB_DRIVER_MYSQL:
+		dsn := cfg.Username + ":" + cfg.Password + "@tcp(" + cfg.Host + ")/" + cfg.Name + "?parseTime=true"
+		return mysql.Open(dsn), nil
+	case leash_config.DB_DRIVER_POSTGRES:
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(cfg.Username, cfg.Password),
+			Host:     cfg.Host,
+			Path:     cfg.Name,
+			RawQuery: url.Values{"sslmode": {cfg.SSLMode}}.Encode(),
+		}
+
+		return postgres.Open(dsn.String()), nil
+	case leash_config.DB_DRIVER_SQLITE:
+		return sqlite.Open(cfg.Path), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// OpenDatabase connects to the configured database
+func OpenDatabase(cfg leash_config.DatabaseConfig) (*gorm.DB, error) {
+	dialector, err := DatabaseDialector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return gorm.Open(dialector, &gorm.Config{})
+}
@@ -0,0 +1,28 @@
+package leash_helpers
+
+import (
+	"fmt"
+	"os"
+
+	leash_config "github.com/mkrcx/mkrcx/src/leash/config"
+	leash_mailer "github.com/mkrcx/mkrcx/src/leash/mailer"
+)
+
+// OpenMailer creates the mailer for the configured mail driver
+func OpenMailer(cfg leash_config.MailConfig) (leash_mailer.Mailer, error) {
+	switch cfg.Driver {
+	case leash_config.MAIL_DRIVER_SMTP:
+		return &leash_mailer.SMTPMailer{
+			Host:     cfg.Host,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		}, nil
+	case leash_config.MAIL_DRIVER_FILE:
+		return leash_mailer.NewFileMailer(cfg.From, cfg.File)
+	case leash_config.MAIL_DRIVER_LOG:
+		return leash_mailer.NewLogMailer(cfg.From, os.Stdout), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
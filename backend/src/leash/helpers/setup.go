@@ -4,223 +4,370 @@ import (
 	"github.com/casbin/casbin/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
+	leash_migrations "github.com/mkrcx/mkrcx/src/leash/migrations"
+	leash_oauth "github.com/mkrcx/mkrcx/src/leash/oauth"
 	leash_signin "github.com/mkrcx/mkrcx/src/leash/signin"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"gorm.io/gorm"
 )
 
-// SetupCasbin sets up the casbin RBAC for Leash
-func SetupCasbin(enforcer *casbin.Enforcer) {
+// policySeeder adds default policies that have never been added before, so changes made through /api/roles
+// are not overwritten on the next boot while new defaults are still picked up
+type policySeeder struct {
+	db       *gorm.DB
+	enforcer *casbin.Enforcer
+	seeded   map[policyKey]bool
+	err      error
+}
+
+type policyKey struct {
+	ptype   string
+	subject string
+	object  string
+}
+
+// seed adds the policy with add unless it has been seeded before
+func (s *policySeeder) seed(ptype string, subject string, object string, add func(string, ...string) (bool, error)) {
+	key := policyKey{ptype, subject, object}
+	if s.err != nil || s.seeded[key] {
+		return
+	}
+
+	if _, err := add(subject, object); err != nil {
+		s.err = err
+		return
+	}
+
+	s.err = s.db.Create(&models.PolicySeed{Type: ptype, Subject: subject, Object: object}).Error
+	s.seeded[key] = true
+}
+
+// AddPermissionForUser seeds a permission for a role
+func (s *policySeeder) AddPermissionForUser(role string, permission string) {
+	s.seed("p", role, permission, s.enforcer.AddPermissionForUser)
+}
+
+// AddRoleForUser seeds a role for a subject
+func (s *policySeeder) AddRoleForUser(subject string, role string) {
+	s.seed("g", subject, role, func(subject string, role ...string) (bool, error) {
+		return s.enforcer.AddRoleForUser(subject, role[0])
+	})
+}
+
+// SetupCasbin sets up the casbin RBAC for Leash, seeding the default roles without undoing changes made to them
+func SetupCasbin(db *gorm.DB, enforcer *casbin.Enforcer) error {
+	var seeds []models.PolicySeed
+	if err := db.Find(&seeds).Error; err != nil {
+		return err
+	}
+
+	seeder := &policySeeder{
+		db:       db,
+		enforcer: enforcer,
+		seeded:   map[policyKey]bool{},
+	}
+
+	for _, seed := range seeds {
+		seeder.seeded[policyKey{seed.Type, seed.Subject, seed.Object}] = true
+	}
+
 	// Roles
 	member := "leash:member"
 	volunteer := "leash:volunteer"
 	staff := "leash:staff"
 	admin := "leash:admin"
 
-	// Delete Leash permission roles
-	enforcer.DeleteRole(member)
-	enforcer.DeleteRole(volunteer)
-	enforcer.DeleteRole(staff)
-	enforcer.DeleteRole(admin)
-
 	// Create Leash permission role hierarchy
-	enforcer.AddRoleForUser(admin, staff)
-	enforcer.AddRoleForUser(staff, volunteer)
-	enforcer.AddRoleForUser(volunteer, member)
+	seeder.AddRoleForUser(admin, staff)
+	seeder.AddRoleForUser(staff, volunteer)
+	seeder.AddRoleForUser(volunteer, member)
 
 	// Link Leash permission roles to mkr.cx roles
-	enforcer.AddRoleForUser("role:admin", "leash:admin")
-	enforcer.AddRoleForUser("role:staff", "leash:staff")
-	enforcer.AddRoleForUser("role:volunteer", "leash:volunteer")
-	enforcer.AddRoleForUser("role:member", "leash:member")
+	seeder.AddRoleForUser("role:admin", "leash:admin")
+	seeder.AddRoleForUser("role:staff", "leash:staff")
+	seeder.AddRoleForUser("role:volunteer", "leash:volunteer")
+	seeder.AddRoleForUser("role:member", "leash:member")
 
 	// User Target Permissions
-	enforcer.AddPermissionForUser(member, "leash.users:target_self")
-	enforcer.AddPermissionForUser(volunteer, "leash.users:target_others")
+	seeder.AddPermissionForUser(member, "leash.users:target_self")
+	seeder.AddPermissionForUser(volunteer, "leash.users:target_others")
 
 	// User Base EPs
-	enforcer.AddPermissionForUser(admin, "leash.users:create")
-	enforcer.AddPermissionForUser(admin, "leash.users.service:create")
-	enforcer.AddPermissionForUser(volunteer, "leash.users:search")
+	seeder.AddPermissionForUser(admin, "leash.users:create")
+	seeder.AddPermissionForUser(admin, "leash.users.service:create")
+	seeder.AddPermissionForUser(volunteer, "leash.users:search")
+	seeder.AddPermissionForUser(admin, "leash.users:import")
+	seeder.AddPermissionForUser(staff, "leash.users:export")
+	seeder.AddPermissionForUser(staff, "leash.users:pending")
 
 	// User Get EPs
-	enforcer.AddPermissionForUser(volunteer, "leash.users.get:email")
-	enforcer.AddPermissionForUser(admin, "leash.users.get:card")
-	enforcer.AddPermissionForUser(admin, "leash.users.get:checkin")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.get.trainings:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.get.holds:list")
-	enforcer.AddPermissionForUser(admin, "leash.users.get.apikeys:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.get.updates:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.get.notifications:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.get:email")
+	seeder.AddPermissionForUser(admin, "leash.users.get:card")
+	seeder.AddPermissionForUser(admin, "leash.users.get:checkin")
+	seeder.AddPermissionForUser(volunteer, "leash.users.get.trainings:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.get.holds:list")
+	seeder.AddPermissionForUser(admin, "leash.users.get.apikeys:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.get.updates:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.get.notifications:list")
 
 	// Self EPs
-	enforcer.AddPermissionForUser(member, "leash.users.self:get")
-	enforcer.AddPermissionForUser(member, "leash.users.self:update")
-	enforcer.AddPermissionForUser(admin, "leash.users.self:update_card_id")
-	enforcer.AddPermissionForUser(admin, "leash.users.self:update_role")
-	enforcer.AddPermissionForUser(admin, "leash.users.self:service_update")
+	seeder.AddPermissionForUser(member, "leash.users.self:get")
+	seeder.AddPermissionForUser(member, "leash.users.self:update")
+	seeder.AddPermissionForUser(admin, "leash.users.self:update_card_id")
+	seeder.AddPermissionForUser(admin, "leash.users.self:update_role")
+	seeder.AddPermissionForUser(admin, "leash.users.self:service_update")
 	// --No self delete EP--
-	enforcer.AddPermissionForUser(member, "leash.users.self:checkin")
-	enforcer.AddPermissionForUser(member, "leash.users.self:permissions")
+	seeder.AddPermissionForUser(member, "leash.users.self:checkin")
+	seeder.AddPermissionForUser(member, "leash.users.self:permissions")
 	//   Updates
-	enforcer.AddPermissionForUser(member, "leash.users.self.updates:list")
+	seeder.AddPermissionForUser(member, "leash.users.self.updates:list")
 	//   Trainings
-	enforcer.AddPermissionForUser(member, "leash.users.self.trainings:target")
-	enforcer.AddPermissionForUser(member, "leash.users.self.trainings:list")
-	enforcer.AddPermissionForUser(member, "leash.users.self.trainings:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.self.trainings:create")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.self.trainings:delete")
+	seeder.AddPermissionForUser(member, "leash.users.self.trainings:target")
+	seeder.AddPermissionForUser(member, "leash.users.self.trainings:list")
+	seeder.AddPermissionForUser(member, "leash.users.self.trainings:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.self.trainings:create")
+	seeder.AddPermissionForUser(volunteer, "leash.users.self.trainings:delete")
 	//   Holds
-	enforcer.AddPermissionForUser(member, "leash.users.self.holds:target")
-	enforcer.AddPermissionForUser(member, "leash.users.self.holds:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.self.holds:create")
-	enforcer.AddPermissionForUser(member, "leash.users.self.holds:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.self.holds:delete")
+	seeder.AddPermissionForUser(member, "leash.users.self.holds:target")
+	seeder.AddPermissionForUser(member, "leash.users.self.holds:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.self.holds:create")
+	seeder.AddPermissionForUser(member, "leash.users.self.holds:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.self.holds:delete")
 	//   API Keys
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:target")
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:list")
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:create")
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:get")
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:update")
-	enforcer.AddPermissionForUser(member, "leash.users.self.apikeys:delete")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:target")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:list")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:create")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:get")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:update")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys:delete")
+	seeder.AddPermissionForUser(member, "leash.users.self.apikeys.rejections:list")
+	seeder.AddPermissionForUser(admin, "leash.users.self.apikeys:restrict")
 	//   Notifications
-	enforcer.AddPermissionForUser(member, "leash.users.self.notifications:target")
-	enforcer.AddPermissionForUser(member, "leash.users.self.notifications:list")
-	enforcer.AddPermissionForUser(member, "leash.users.self.notifications:get")
-	enforcer.AddPermissionForUser(member, "leash.users.self.notifications:delete")
-	enforcer.AddPermissionForUser(member, "leash.users.self.notifications:create")
+	seeder.AddPermissionForUser(member, "leash.users.self.notifications:target")
+	seeder.AddPermissionForUser(member, "leash.users.self.notifications:list")
+	seeder.AddPermissionForUser(member, "leash.users.self.notifications:get")
+	seeder.AddPermissionForUser(member, "leash.users.self.notifications:delete")
+	seeder.AddPermissionForUser(member, "leash.users.self.notifications:create")
+	//   Visits
+	seeder.AddPermissionForUser(member, "leash.users.self.visits:list")
+
+	seeder.AddPermissionForUser(member, "leash.users.self.pending_email:resend")
+	seeder.AddPermissionForUser(member, "leash.users.self.pending_email:delete")
+	//   Sessions
+	seeder.AddPermissionForUser(member, "leash.users.self.sessions:list")
+	seeder.AddPermissionForUser(member, "leash.users.self.sessions:delete")
 
 	// Others EPs
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others:update")
-	enforcer.AddPermissionForUser(admin, "leash.users.others:update_card_id")
-	enforcer.AddPermissionForUser(admin, "leash.users.others:update_role")
-	enforcer.AddPermissionForUser(admin, "leash.users.others:service_update")
-	enforcer.AddPermissionForUser(admin, "leash.users.others:delete")
-	enforcer.AddPermissionForUser(admin, "leash.users.others:checkin")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others:permissions")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others:update")
+	seeder.AddPermissionForUser(admin, "leash.users.others:update_card_id")
+	seeder.AddPermissionForUser(admin, "leash.users.others:update_role")
+	seeder.AddPermissionForUser(admin, "leash.users.others:service_update")
+	seeder.AddPermissionForUser(admin, "leash.users.others:delete")
+	seeder.AddPermissionForUser(staff, "leash.users.others:approve")
+	seeder.AddPermissionForUser(staff, "leash.users.others:reject")
+	seeder.AddPermissionForUser(admin, "leash.users.others:checkin")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others:permissions")
 	//   Updates
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.updates:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.updates:list")
 	//   Trainings
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.trainings:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.trainings:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.trainings:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.trainings:create")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.trainings:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.trainings:target")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.trainings:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.trainings:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.trainings:create")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.trainings:delete")
 	//   Holds
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.holds:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.holds:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.holds:create")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.holds:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.holds:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.holds:target")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.holds:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.holds:create")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.holds:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.holds:delete")
 	//   API Keys
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:target")
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:list")
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:create")
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:get")
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:delete")
-	enforcer.AddPermissionForUser(admin, "leash.users.others.apikeys:update")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:target")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:list")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:create")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:get")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:delete")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:update")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys.rejections:list")
+	seeder.AddPermissionForUser(admin, "leash.users.others.apikeys:restrict")
 	//   Notifications
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.notifications:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.notifications:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.notifications:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.notifications:delete")
-	enforcer.AddPermissionForUser(volunteer, "leash.users.others.notifications:create")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.notifications:target")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.notifications:list")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.notifications:get")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.notifications:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.notifications:create")
+	//   Visits
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.visits:list")
+
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.pending_email:resend")
+	seeder.AddPermissionForUser(volunteer, "leash.users.others.pending_email:delete")
+	//   Sessions
+	seeder.AddPermissionForUser(admin, "leash.users.others.sessions:list")
+	seeder.AddPermissionForUser(admin, "leash.users.others.sessions:delete")
 
 	// Training EPs
-	enforcer.AddPermissionForUser(volunteer, "leash.trainings:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.trainings:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.trainings:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.trainings:target")
+	seeder.AddPermissionForUser(volunteer, "leash.trainings:get")
+	seeder.AddPermissionForUser(volunteer, "leash.trainings:delete")
+	//   Definitions
+	seeder.AddPermissionForUser(member, "leash.trainings.definitions:target")
+	seeder.AddPermissionForUser(member, "leash.trainings.definitions:list")
+	seeder.AddPermissionForUser(member, "leash.trainings.definitions:get")
+	seeder.AddPermissionForUser(admin, "leash.trainings.definitions:create")
+	seeder.AddPermissionForUser(admin, "leash.trainings.definitions:update")
+	seeder.AddPermissionForUser(admin, "leash.trainings.definitions:delete")
 
 	// Hold EPs
-	enforcer.AddPermissionForUser(volunteer, "leash.holds:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.holds:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.holds:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.holds:target")
+	seeder.AddPermissionForUser(volunteer, "leash.holds:get")
+	seeder.AddPermissionForUser(volunteer, "leash.holds:delete")
 
 	// API Key EPs
-	enforcer.AddPermissionForUser(admin, "leash.apikeys:target")
-	enforcer.AddPermissionForUser(admin, "leash.apikeys:get")
-	enforcer.AddPermissionForUser(admin, "leash.apikeys:delete")
-	enforcer.AddPermissionForUser(admin, "leash.apikeys:update")
+	seeder.AddPermissionForUser(admin, "leash.apikeys:target")
+	seeder.AddPermissionForUser(admin, "leash.apikeys:get")
+	seeder.AddPermissionForUser(admin, "leash.apikeys:delete")
+	seeder.AddPermissionForUser(admin, "leash.apikeys:update")
+	seeder.AddPermissionForUser(admin, "leash.apikeys.rejections:list")
+	seeder.AddPermissionForUser(admin, "leash.apikeys:restrict")
 
 	// Notification EPs
 
-	enforcer.AddPermissionForUser(volunteer, "leash.notifications:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.notifications:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.notifications:get")
+	seeder.AddPermissionForUser(volunteer, "leash.notifications:delete")
+
+	// Equipment EPs
+	seeder.AddPermissionForUser(member, "leash.equipment:target")
+	seeder.AddPermissionForUser(member, "leash.equipment:list")
+	seeder.AddPermissionForUser(member, "leash.equipment:get")
+	seeder.AddPermissionForUser(volunteer, "leash.equipment:status")
+	seeder.AddPermissionForUser(staff, "leash.equipment:update")
+	seeder.AddPermissionForUser(admin, "leash.equipment:create")
+	seeder.AddPermissionForUser(admin, "leash.equipment:delete")
+
+	// Access EPs
+	seeder.AddPermissionForUser(admin, "leash.access:check")
+
+	// Visit EPs
+	seeder.AddPermissionForUser(admin, "leash.visits:checkin")
+	seeder.AddPermissionForUser(admin, "leash.visits:checkout")
+	seeder.AddPermissionForUser(volunteer, "leash.visits:present")
+	seeder.AddPermissionForUser(staff, "leash.visits:list")
+
+	// Report EPs
+	seeder.AddPermissionForUser(staff, "leash.reports:visitors")
+	seeder.AddPermissionForUser(staff, "leash.reports:trainings")
+	seeder.AddPermissionForUser(staff, "leash.reports:holds")
+	seeder.AddPermissionForUser(staff, "leash.reports:members")
+	seeder.AddPermissionForUser(staff, "leash.reports:updates")
 
 	// Sign In EPs
-	enforcer.AddPermissionForUser(member, "leash:login")
+	seeder.AddPermissionForUser(member, "leash:login")
 
 	// TODO: add feed permissions
-	enforcer.AddPermissionForUser(volunteer, "leash.feeds:target")
-	enforcer.AddPermissionForUser(volunteer, "leash.feeds:get")
-	enforcer.AddPermissionForUser(volunteer, "leash.feeds:list")
-	enforcer.AddPermissionForUser(volunteer, "leash.feeds:ws")
-	enforcer.AddPermissionForUser(admin, "leash.feeds:create")
-	enforcer.AddPermissionForUser(admin, "leash.feeds:delete")
+	seeder.AddPermissionForUser(volunteer, "leash.feeds:target")
+	seeder.AddPermissionForUser(volunteer, "leash.feeds:get")
+	seeder.AddPermissionForUser(volunteer, "leash.feeds:list")
+	seeder.AddPermissionForUser(volunteer, "leash.feeds:ws")
+	seeder.AddPermissionForUser(admin, "leash.feeds:create")
+	seeder.AddPermissionForUser(admin, "leash.feeds:delete")
+
+	// Webhook EPs
+	seeder.AddPermissionForUser(admin, "leash.webhooks:target")
+	seeder.AddPermissionForUser(admin, "leash.webhooks:list")
+	seeder.AddPermissionForUser(admin, "leash.webhooks:create")
+	seeder.AddPermissionForUser(admin, "leash.webhooks:get")
+	seeder.AddPermissionForUser(admin, "leash.webhooks:update")
+	seeder.AddPermissionForUser(admin, "leash.webhooks:delete")
+	seeder.AddPermissionForUser(admin, "leash.webhooks.deliveries:list")
+
+	// OAuth EPs
+	seeder.AddPermissionForUser(member, "leash.oauth:authorize")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:target")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:list")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:create")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:get")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:update")
+	seeder.AddPermissionForUser(admin, "leash.oauth_clients:delete")
+
+	// Audit EPs
+	seeder.AddPermissionForUser(admin, "leash.audit:list")
+
+	// Role EPs
+	seeder.AddPermissionForUser(admin, "leash.roles:target")
+	seeder.AddPermissionForUser(admin, "leash.roles:list")
+	seeder.AddPermissionForUser(admin, "leash.roles:create")
+	seeder.AddPermissionForUser(admin, "leash.roles:get")
+	seeder.AddPermissionForUser(admin, "leash.roles:update")
+	seeder.AddPermissionForUser(admin, "leash.roles:delete")
+
+	// OAuth scopes, a client can only do what both its scopes and its user allow
+	enforcer.DeletePermissionsForUser("scope:profile")
+	enforcer.AddPermissionForUser("scope:profile", "leash.users:target_self")
+	enforcer.AddPermissionForUser("scope:profile", "leash.users.self:get")
+	enforcer.AddPermissionForUser("scope:profile", "leash.users.self:permissions")
+
+	enforcer.DeletePermissionsForUser("scope:trainings")
+	enforcer.AddPermissionForUser("scope:trainings", "leash.users:target_self")
+	enforcer.AddPermissionForUser("scope:trainings", "leash.users.self.trainings:target")
+	enforcer.AddPermissionForUser("scope:trainings", "leash.users.self.trainings:list")
+	enforcer.AddPermissionForUser("scope:trainings", "leash.users.self.trainings:get")
+
+	enforcer.DeletePermissionsForUser("scope:holds")
+	enforcer.AddPermissionForUser("scope:holds", "leash.users:target_self")
+	enforcer.AddPermissionForUser("scope:holds", "leash.users.self.holds:target")
+	enforcer.AddPermissionForUser("scope:holds", "leash.users.self.holds:list")
+	enforcer.AddPermissionForUser("scope:holds", "leash.users.self.holds:get")
+
+	enforcer.DeletePermissionsForUser("scope:visits")
+	enforcer.AddPermissionForUser("scope:visits", "leash.users:target_self")
+	enforcer.AddPermissionForUser("scope:visits", "leash.users.self.visits:list")
+
+	enforcer.DeletePermissionsForUser("scope:equipment")
+	enforcer.AddPermissionForUser("scope:equipment", "leash.equipment:target")
+	enforcer.AddPermissionForUser("scope:equipment", "leash.equipment:list")
+	enforcer.AddPermissionForUser("scope:equipment", "leash.equipment:get")
+
+	enforcer.DeletePermissionsForUser("scope:access")
+	enforcer.AddPermissionForUser("scope:access", "leash.access:check")
+
+	if seeder.err != nil {
+		return seeder.err
+	}
 
-	enforcer.SavePolicy()
+	if err := enforcer.SavePolicy(); err != nil {
+		return err
+	}
 
 	models.SetupEnforcer(enforcer)
+	return nil
 }
 
+// MigrateSchema applies every pending schema migration
 func MigrateSchema(db *gorm.DB) error {
 	err := models.SetupValidator()
 	if err != nil {
 		return err
 	}
 
-	err = db.AutoMigrate(&models.User{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.APIKey{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.Training{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.UserUpdate{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.Hold{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.Session{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.Notification{})
-	if err != nil {
-		return err
-	}
-
-	err = db.AutoMigrate(&models.Feed{})
-	if err != nil {
-		return err
-	}
+	_, err = leash_migrations.Up(db)
+	return err
+}
 
-	err = db.AutoMigrate(&models.FeedMessage{})
+// CheckSchema returns an error if the database schema is not fully migrated
+func CheckSchema(db *gorm.DB) error {
+	err := models.SetupValidator()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return leash_migrations.CheckCurrent(db)
 }
 
-func SetupMiddlewares(app *fiber.App, db *gorm.DB, keys *leash_auth.Keys, hmacSecret []byte, externalAuth leash_auth.ExternalAuthenticator, enforcer *casbin.Enforcer) {
+func SetupMiddlewares(app *fiber.App, db *gorm.DB, keys *leash_auth.Keys, hmacSecret []byte, externalProviders *leash_auth.ExternalProviders, enforcer *casbin.Enforcer) {
 	// Allow all origins in development
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
@@ -228,7 +375,12 @@ func SetupMiddlewares(app *fiber.App, db *gorm.DB, keys *leash_auth.Keys, hmacSe
 		AllowMethods: "*",
 	}))
 
-	app.Use(leash_auth.LocalsMiddleware(db, keys, hmacSecret, externalAuth, enforcer))
+	// Tag every request so audit events and logs can be tied back to it
+	app.Use(requestid.New())
+
+	app.Use(leash_auth.LocalsMiddleware(db, keys, hmacSecret, externalProviders, enforcer))
+
+	app.Use(leash_auth.RateLimitMiddleware(leash_auth.RATE_LIMIT_REQUESTS))
 }
 
 func SetupRoutes(app *fiber.App) {
@@ -236,6 +388,12 @@ func SetupRoutes(app *fiber.App) {
 		return c.SendString("Welcome to the Leash!")
 	})
 
+	// Public keys so other services can verify tokens signed by Leash
+	app.Get("/.well-known/jwks.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+		return c.JSON(leash_auth.GetKeys(c).GetPublicKeys())
+	})
+
 	api := app.Group("/api", leash_auth.SetPermissionPrefixMiddleware("leash"))
 
 	leash_api.RegisterAPIEndpoints(api)
@@ -243,4 +401,10 @@ func SetupRoutes(app *fiber.App) {
 	auth := app.Group("/auth")
 
 	leash_signin.RegisterAuthenticationEndpoints(auth)
+
+	leash_oauth.RegisterDiscoveryEndpoint(app)
+
+	oauth := app.Group("/oauth")
+
+	leash_oauth.RegisterOAuthEndpoints(oauth)
 }
@@ -17,6 +17,9 @@ func main() {
 	subcommands.Register(&commands.NewUserCmd{}, "")
 	subcommands.Register(&commands.NewServiceUserCmd{}, "")
 	subcommands.Register(&commands.NewApiKeyCmd{}, "")
+	subcommands.Register(&commands.ImportUsersCmd{}, "")
+	subcommands.Register(&commands.MigrateCmd{}, "")
+	subcommands.Register(&commands.RotateKeysCmd{}, "")
 
 	flag.Parse()
 	ctx := context.Background()
@@ -1,12 +1,24 @@
 package main_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -14,8 +26,16 @@ import (
 	"github.com/casbin/casbin/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
 	leash_helpers "github.com/mkrcx/mkrcx/src/leash/helpers"
+	leash_mailer "github.com/mkrcx/mkrcx/src/leash/mailer"
+	leash_migrations "github.com/mkrcx/mkrcx/src/leash/migrations"
+	leash_oauth "github.com/mkrcx/mkrcx/src/leash/oauth"
+	leash_signin "github.com/mkrcx/mkrcx/src/leash/signin"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"github.com/valyala/fasthttp"
@@ -32,6 +52,9 @@ const (
 
 const MAX_ROLE = ROLE_ADMIN
 
+// TEST_APIKEY_SECRET is the secret of the api keys test users authenticate with
+const TEST_APIKEY_SECRET = "testing-secret"
+
 func roleFromNumber(roleNum int) string {
 	switch roleNum {
 	case ROLE_MEMBER:
@@ -51,20 +74,34 @@ var _ leash_auth.ExternalAuthenticator = (*DebugExternalAuth)(nil)
 
 type DebugExternalAuth struct{}
 
-func (d *DebugExternalAuth) GetAuthURL(state string) string {
+func (d *DebugExternalAuth) GetAuthURL(state string, nonce string) string {
 	return "http://localhost:3000/auth/callback?code=admin@example.com&state=" + state
 }
 
-func (d *DebugExternalAuth) Callback(ctx context.Context, code string) (string, error) {
+func (d *DebugExternalAuth) Callback(ctx context.Context, code string, nonce string) (string, error) {
 	return code, nil
 }
 
+var _ leash_auth.ExternalAuthenticator = (*RejectingExternalAuth)(nil)
+
+// RejectingExternalAuth is a second login provider that rejects every code
+type RejectingExternalAuth struct{}
+
+func (d *RejectingExternalAuth) GetAuthURL(state string, nonce string) string {
+	return "http://localhost:3000/auth/callback?code=rejected&state=" + state
+}
+
+func (d *RejectingExternalAuth) Callback(ctx context.Context, code string, nonce string) (string, error) {
+	return "", fmt.Errorf("code %s rejected", code)
+}
+
 func purgeUser(db *gorm.DB, user models.User) {
 	db.Unscoped().Delete(&models.UserUpdate{}, &models.UserUpdate{UserID: user.ID})
 	db.Unscoped().Delete(&models.Training{}, &models.Training{UserID: user.ID})
 	db.Unscoped().Delete(&models.Hold{}, &models.Hold{UserID: user.ID})
 	db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{UserID: user.ID})
 	db.Unscoped().Delete(&models.Notification{}, &models.Notification{UserID: user.ID})
+	db.Unscoped().Delete(&models.Visit{}, &models.Visit{UserID: user.ID})
 }
 
 type TestUser struct {
@@ -149,6 +186,7 @@ func (e *EndpointTester) RequiresPermissions(permissions []string) *EndpointTest
 		e.db.Create(&user)
 		apiKey := models.APIKey{
 			Key:         userUUID,
+			SecretHash:  leash_auth.HashAPIKeySecret(TEST_APIKEY_SECRET),
 			UserID:      user.ID,
 			FullAccess:  true,
 			Permissions: []string{},
@@ -179,7 +217,7 @@ func (e *EndpointTester) RequiresPermissions(permissions []string) *EndpointTest
 
 			e.t.Log("Testing permissions: ", testPermissions)
 
-			status, _ := e.TestEndpoint(t, "API-Key "+apiKey.Key)
+			status, _ := e.TestEndpoint(t, "API-Key "+apiKey.Key+"."+TEST_APIKEY_SECRET)
 
 			if len(testPermissions) == len(permissions) {
 				if status == fiber.StatusUnauthorized {
@@ -235,6 +273,7 @@ func (e *EndpointTester) MinimumRole(minimumRole int) *EndpointTester {
 
 			apiKey := models.APIKey{
 				Key:         userUUID,
+				SecretHash:  leash_auth.HashAPIKeySecret(TEST_APIKEY_SECRET),
 				UserID:      user.ID,
 				FullAccess:  true,
 				Permissions: []string{},
@@ -250,7 +289,7 @@ func (e *EndpointTester) MinimumRole(minimumRole int) *EndpointTester {
 
 			e.t.Log("Testing role: ", roleFromNumber(i))
 
-			status, _ := e.TestEndpoint(t, "API-Key "+apiKey.Key)
+			status, _ := e.TestEndpoint(t, "API-Key "+apiKey.Key+"."+TEST_APIKEY_SECRET)
 
 			if i >= minimumRole {
 				if status == fiber.StatusUnauthorized {
@@ -318,6 +357,7 @@ func (e *EndpointTester) GivesResponse(responseTesters ...ResponseTester) *Endpo
 
 		apiKey := models.APIKey{
 			Key:         userUUID,
+			SecretHash:  leash_auth.HashAPIKeySecret(TEST_APIKEY_SECRET),
 			UserID:      user.ID,
 			FullAccess:  true,
 			Permissions: []string{},
@@ -332,7 +372,7 @@ func (e *EndpointTester) GivesResponse(responseTesters ...ResponseTester) *Endpo
 			}
 		}
 
-		status, b := e.TestEndpoint(t, "API-Key "+apiKey.Key)
+		status, b := e.TestEndpoint(t, "API-Key "+apiKey.Key+"."+TEST_APIKEY_SECRET)
 
 		for _, tester := range responseTesters {
 			tester.Test(t, e.testingID(), status, b)
@@ -498,6 +538,406 @@ func setupTester(t *testing.T, db *gorm.DB, enforcer *casbin.Enforcer) *Tester {
 	}
 }
 
+func TestMigrations(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:migrations?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leash_migrations.CheckCurrent(db) == nil {
+		t.Fatal("Expected an empty database to have pending migrations")
+	}
+
+	applied, err := leash_migrations.Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) == 0 {
+		t.Fatal("Expected migrations to be applied")
+	}
+
+	if err := leash_migrations.CheckCurrent(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshots the migrations are built from must add up to the current models
+	current := []interface{}{
+		&models.User{}, &models.APIKey{}, &models.APIKeyRejection{}, &models.Training{}, &models.TrainingDefinition{},
+		&models.Hold{}, &models.Equipment{}, &models.Visit{}, &models.UserUpdate{}, &models.Notification{},
+		&models.Session{}, &models.RefreshToken{}, &models.OAuthClient{}, &models.OAuthCode{}, &models.AuditEvent{},
+		&models.PolicySeed{}, &models.Feed{}, &models.FeedMessage{}, &models.Webhook{}, &models.WebhookDelivery{},
+	}
+
+	for _, model := range current {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+
+		if !db.Migrator().HasTable(model) {
+			t.Fatalf("Expected the %s table to exist", stmt.Schema.Table)
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Fatalf("Expected the %s table to have the %s column", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+
+	// Applying again is a no-op
+	if applied, err := leash_migrations.Up(db); err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no migrations to be applied, got %d (%v)", len(applied), err)
+	}
+
+	rolledBack, err := leash_migrations.Down(db, len(applied))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rolledBack) != len(applied) {
+		t.Fatalf("Expected %d migrations to be rolled back, got %d", len(applied), len(rolledBack))
+	}
+
+	if db.Migrator().HasTable(&models.User{}) {
+		t.Fatal("Expected the users table to be dropped")
+	}
+
+	if _, err := leash_migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leash_migrations.CheckCurrent(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// downTo rolls back every migration up to and including the named one
+	downTo := func(name string) {
+		status, err := leash_migrations.Status(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		steps := 0
+		for i := len(status) - 1; i >= 0 && status[i].Migration.Name != name; i-- {
+			steps++
+		}
+
+		if _, err := leash_migrations.Down(db, steps+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys issued as bare UUIDs are hashed and keep working
+	downTo("hashed_api_keys")
+
+	legacyKey := uuid.New().String()
+	if err := db.Table("api_keys").Create(map[string]interface{}{"api_key": legacyKey, "user_id": 1, "full_access": true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leash_migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []string
+	db.Table("api_keys").Where("api_key = ?", legacyKey).Pluck("api_key", &stored)
+	if len(stored) != 0 {
+		t.Fatal("Expected the legacy key to no longer be stored in plaintext")
+	}
+
+	prefix, secret := leash_auth.SplitAPIKey(legacyKey)
+	db.Table("api_keys").Where("api_key = ?", prefix).Pluck("secret_hash", &stored)
+	if len(stored) != 1 || stored[0] != leash_auth.HashAPIKeySecret(secret) {
+		t.Fatalf("Expected the legacy key to be found by its derived prefix, got %v", stored)
+	}
+
+	// Trainings given out before the catalog existed can still be granted and renewed
+	downTo("training_catalog")
+
+	if db.Migrator().HasTable(&models.TrainingDefinition{}) || db.Migrator().HasColumn(&models.Training{}, "expires_at") {
+		t.Fatal("Expected the training catalog to be rolled back")
+	}
+
+	for _, name := range []string{"woodshop", "laser_cutter", "woodshop", ""} {
+		if err := db.Table("trainings").Create(map[string]interface{}{"user_id": 1, "name": name, "level": "supervised"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := leash_migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var definitions []models.TrainingDefinition
+	db.Order("name").Find(&definitions)
+	if len(definitions) != 2 || definitions[0].Name != "laser_cutter" || definitions[1].Name != "woodshop" {
+		t.Fatalf("Expected a definition for every existing training, got %v", definitions)
+	}
+
+	for _, definition := range definitions {
+		if definition.ValidFor != 0 || len(definition.Prerequisites) != 0 || !definition.AllowsLevel("can_train") {
+			t.Fatalf("Expected %s to be unrestricted, got %v", definition.Name, definition)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyFile := t.TempDir() + "/keys.json"
+
+	loadKeys := func() *leash_auth.Keys {
+		set, err := leash_auth.CreateOrGetKeysFromFile(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := leash_auth.CreateKeys(set)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return keys
+	}
+
+	signToken := func(keys *leash_auth.Keys) string {
+		tok, err := jwt.NewBuilder().
+			Issuer(leash_auth.ISSUER).
+			IssuedAt(time.Now()).
+			Expiration(time.Now().Add(time.Hour)).
+			Audience([]string{"leash", "session"}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := keys.Sign(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(signed)
+	}
+
+	oldKeys := loadKeys()
+	oldToken := signToken(oldKeys)
+
+	key, removed, err := leash_auth.RotateKeyFile(keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 0 {
+		t.Fatalf("Expected no keys to be removed, got %v", removed)
+	}
+
+	keys := loadKeys()
+	if keys.GetPrivateKey().KeyID() != key.KeyID() {
+		t.Fatalf("Expected the new key %s to sign, got %s", key.KeyID(), keys.GetPrivateKey().KeyID())
+	}
+
+	// Tokens carry the kid of the key that signed them
+	newToken := signToken(keys)
+	msg, err := jws.Parse([]byte(newToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kid := msg.Signatures()[0].ProtectedHeaders().KeyID(); kid != key.KeyID() {
+		t.Fatalf("Expected the token to be signed by %s, got %s", key.KeyID(), kid)
+	}
+
+	// The retired key keeps verifying tokens
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := keys.Parse(token, []string{"leash", "session"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only public parameters are published
+	published, err := json.Marshal(keys.GetPublicKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys.GetPublicKeys().Len() != 2 || strings.Contains(string(published), `"d"`) || strings.Contains(string(published), leash_auth.KEY_RETIRED_AT) {
+		t.Fatalf("Expected the two public keys, got %s", string(published))
+	}
+
+	// Once retired for longer than the retention the old key is removed
+	_, removed, err = leash_auth.RotateKeyFile(keyFile, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != oldKeys.GetPrivateKey().KeyID() {
+		t.Fatalf("Expected the old key to be removed, got %v", removed)
+	}
+
+	keys = loadKeys()
+	if _, err := keys.Parse(oldToken, []string{"leash", "session"}); err == nil {
+		t.Fatal("Expected tokens signed by a removed key to be rejected")
+	}
+
+	if _, err := keys.Parse(newToken, []string{"leash", "session"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	signingKeys, err := leash_auth.GenerateJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedKeys, err := leash_auth.GenerateJWTKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeys, err := jwk.PublicSetOf(signingKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stub identity provider, the authorization code picks the ID token it issues
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(publicKeys)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		keys := signingKeys
+		tok := jwt.New()
+		tok.Set(jwt.IssuerKey, idp.URL)
+		tok.Set(jwt.AudienceKey, "leash")
+		tok.Set(jwt.SubjectKey, "1234")
+		tok.Set(jwt.IssuedAtKey, time.Now())
+		tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		tok.Set("email", "student@example.edu")
+		tok.Set("email_verified", true)
+		tok.Set("tid", "example.edu")
+		tok.Set("nonce", "login-nonce")
+
+		switch r.Form.Get("code") {
+		case "audience":
+			tok.Set(jwt.AudienceKey, "other")
+		case "issuer":
+			tok.Set(jwt.IssuerKey, "https://other.example.com")
+		case "expired":
+			tok.Set(jwt.ExpirationKey, time.Now().Add(-time.Hour))
+		case "domain":
+			tok.Set("email", "student@gmail.com")
+			tok.Set("tid", "gmail.com")
+		case "unverified":
+			tok.Set("email_verified", false)
+		case "upn":
+			tok.Set("upn", "staff@example.edu")
+		case "forged":
+			keys = forgedKeys
+		case "nonce":
+			tok.Set("nonce", "other-nonce")
+		case "no-nonce":
+			tok.Remove("nonce")
+		}
+
+		key, _ := keys.Key(0)
+		signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256, key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     string(signed),
+		})
+	})
+
+	config := leash_auth.OIDCConfig{
+		Issuer:         idp.URL,
+		ClientID:       "leash",
+		ClientSecret:   "secret",
+		RedirectURL:    "http://localhost/auth/callback",
+		AllowedDomains: []string{"example.edu"},
+	}
+
+	authenticator, err := leash_auth.GetOIDCAuthenticator(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := url.Parse(authenticator.GetAuthURL("state", "login-nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := authURL.Query()
+	if authURL.Path != "/authorize" || query.Get("state") != "state" || query.Get("nonce") != "login-nonce" || !strings.Contains(query.Get("scope"), "openid") {
+		t.Fatalf("Unexpected auth URL %s", authURL)
+	}
+
+	email, err := authenticator.Callback(context.Background(), "valid", "login-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email != "student@example.edu" {
+		t.Fatalf("Expected student@example.edu, got %s", email)
+	}
+
+	for _, code := range []string{"audience", "issuer", "expired", "domain", "unverified", "forged", "nonce", "no-nonce"} {
+		if email, err := authenticator.Callback(context.Background(), code, "login-nonce"); err == nil {
+			t.Fatalf("Expected the %s ID token to be rejected, got %s", code, email)
+		}
+	}
+
+	// ID tokens are only accepted for the login that sent their nonce
+	for _, nonce := range []string{"other-nonce", ""} {
+		if email, err := authenticator.Callback(context.Background(), "valid", nonce); err == nil {
+			t.Fatalf("Expected the ID token to be rejected for nonce %q, got %s", nonce, email)
+		}
+	}
+
+	// The email and domain claims are configurable
+	config.EmailClaim = "upn"
+	config.DomainClaim = "tid"
+	authenticator, err = leash_auth.GetOIDCAuthenticator(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if email, err := authenticator.Callback(context.Background(), "upn", "login-nonce"); err != nil || email != "staff@example.edu" {
+		t.Fatalf("Expected staff@example.edu, got %s (%v)", email, err)
+	}
+
+	if _, err := authenticator.Callback(context.Background(), "valid", "login-nonce"); err == nil {
+		t.Fatal("Expected an ID token without the email claim to be rejected")
+	}
+
+	// Discovery fails when the issuer does not match
+	config.Issuer = idp.URL + "/"
+	if _, err := leash_auth.GetOIDCAuthenticator(context.Background(), config); err == nil {
+		t.Fatal("Expected discovery to fail for a mismatched issuer")
+	}
+}
+
 func TestLeash(t *testing.T) {
 	// Initialize DB
 	t.Log("Initializing DB...")
@@ -513,7 +953,18 @@ func TestLeash(t *testing.T) {
 	}
 
 	t.Log("Setting up auth...")
-	externalAuth := &DebugExternalAuth{}
+	externalProviders := leash_auth.NewExternalProviders()
+	if err := externalProviders.Register("debug", "Debug", &DebugExternalAuth{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := externalProviders.Register("reject", "Reject", &RejectingExternalAuth{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if externalProviders.Register("debug", "Debug", &DebugExternalAuth{}) == nil {
+		t.Fatal("Expected registering a duplicate provider to fail")
+	}
 
 	// JWT Key
 	t.Log("Initializing JWT Keys...")
@@ -537,7 +988,15 @@ func TestLeash(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	leash_helpers.SetupCasbin(enforcer)
+	if err := leash_helpers.SetupCasbin(db, enforcer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed the training catalog
+	for _, name := range []string{"other", "laser_cutter"} {
+		definition := models.TrainingDefinition{Name: name}
+		db.FirstOrCreate(&definition, &definition)
+	}
 
 	// Setup tester
 	t.Log("Setting tester...")
@@ -548,8 +1007,14 @@ func TestLeash(t *testing.T) {
 
 	app := fiber.New()
 
+	t.Log("Setting up mail...")
+	mailBox := &bytes.Buffer{}
+	leash_api.SetMailer(leash_mailer.NewLogMailer("leash@testing.mkr.cx", mailBox), "http://localhost:3000")
+
+	leash_oauth.SetOAuthServer("http://localhost:3000", "http://localhost:5173/oauth/authorize")
+
 	t.Log("Setting up middleware...")
-	leash_helpers.SetupMiddlewares(app, db, keys, hmacKey, externalAuth, enforcer)
+	leash_helpers.SetupMiddlewares(app, db, keys, hmacKey, externalProviders, enforcer)
 
 	t.Log("Setting up routes...")
 	leash_helpers.SetupRoutes(app)
@@ -727,6 +1192,16 @@ func TestLeash(t *testing.T) {
 				testAPIKey.CreatedAt = responseAPIKey.CreatedAt
 				testAPIKey.UserID = responseAPIKey.UserID
 				testAPIKey.Key = responseAPIKey.Key
+
+				// Created keys are returned once in full, and work with only their hash stored
+				if responseAPIKey.Token != "" {
+					if _, ok := leash_auth.FindAPIKey(db, responseAPIKey.Token); !ok || !strings.HasPrefix(responseAPIKey.Token, responseAPIKey.Key+".") {
+						t.Fatalf("Expected a usable key starting with its prefix, got %v", responseAPIKey.Token)
+					}
+
+					testAPIKey.Token = responseAPIKey.Token
+				}
+
 				expected := string(encode(testAPIKey))
 
 				if expected != string(b) {
@@ -1096,6 +1571,13 @@ func TestLeash(t *testing.T) {
 				expectApiKey.UpdatedAt = testAPIKey.UpdatedAt
 				expectApiKey.CreatedAt = testAPIKey.CreatedAt
 
+				// The key was just used to make this request
+				if testAPIKey.LastUsedAt == nil {
+					t.Fatal("Expected the api key to record its last use")
+				}
+
+				expectApiKey.LastUsedAt = testAPIKey.LastUsedAt
+
 				expectUser := responseUser
 				expectUser.APIKeys = []models.APIKey{expectApiKey}
 				expectUser.ID = responseUser.ID
@@ -1463,26 +1945,178 @@ func TestLeash(t *testing.T) {
 					)
 			})
 
-		test.Endpoint("/api/users/self/notifications", fiber.MethodGet).
-			Test("Get Self Notifications Empty", func(e *EndpointTester) {
-				e.RequiresPermissions([]string{"leash.users:target_self", "leash.users.self.notifications:list"}).
-					MinimumRole(ROLE_MEMBER).
+		test.Endpoint("/api/users/self/apikeys/test", fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"allowed_cidrs": []string{"10.0.0.0/8", "192.168.1.20"},
+				"rate_limit":    60,
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				apiKey := models.APIKey{
+					Key:         "test",
+					UserID:      user.ID,
+					FullAccess:  true,
+					Permissions: []string{},
+				}
+				return db.Create(&apiKey).Error
+			}).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{Key: "test"}).Error
+			}).
+			Test("Update Self Api Key Restrictions", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_self", "leash.users.self.apikeys:target", "leash.users.self.apikeys:update", "leash.users.self.apikeys:restrict"}).
+					MinimumRole(ROLE_ADMIN).
 					GivesResponse(
 						statusCode(fiber.StatusOK),
-						listLengthEQ(0),
+						ResponseTester{
+							Name: "Restrictions Saved",
+							Test: func(t *testing.T, _ string, _ int, b []byte) {
+								var apiKey models.APIKey
+								if err := json.Unmarshal(b, &apiKey); err != nil {
+									t.Fatal(err)
+								}
+
+								if !reflect.DeepEqual(apiKey.AllowedCIDRs, []string{"10.0.0.0/8", "192.168.1.20"}) || apiKey.RateLimit != 60 {
+									t.Fatalf("Expected the restrictions to be updated, got %s", string(b))
+								}
+							},
+						},
 					)
 			})
 
-		newNotification := models.Notification{
-			Title:   "Test Notification",
-			Message: "Test Message",
-			UserID:  responseUser.ID,
-			AddedBy: responseUser.ID,
-		}
-
-		test.Endpoint("/api/users/self/notifications", fiber.MethodPost).
+		test.Endpoint("/api/users/self/apikeys/test", fiber.MethodPatch).
 			WithBody(encode(map[string]interface{}{
-				"title":   "Test Notification",
+				"allowed_cidrs": []string{"not-a-network"},
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				apiKey := models.APIKey{
+					Key:         "test",
+					UserID:      user.ID,
+					FullAccess:  true,
+					Permissions: []string{},
+				}
+				return db.Create(&apiKey).Error
+			}).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{Key: "test"}).Error
+			}).
+			Test("Update Self Api Key Invalid CIDR", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/users/self/apikeys/test", fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"expires_at": time.Now().Add(-time.Hour),
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				apiKey := models.APIKey{
+					Key:         "test",
+					UserID:      user.ID,
+					FullAccess:  true,
+					Permissions: []string{},
+				}
+				return db.Create(&apiKey).Error
+			}).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{Key: "test"}).Error
+			}).
+			Test("Update Self Api Key Past Expiry", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/users/self/apikeys/test", fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"clear_expires_at": true,
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				expiresAt := time.Now().Add(time.Hour)
+				apiKey := models.APIKey{
+					Key:         "test",
+					UserID:      user.ID,
+					FullAccess:  true,
+					Permissions: []string{},
+					ExpiresAt:   &expiresAt,
+				}
+				return db.Create(&apiKey).Error
+			}).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{Key: "test"}).Error
+			}).
+			Test("Update Self Api Key Clear Expiry", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Expiry Cleared",
+						Test: func(t *testing.T, _ string, _ int, b []byte) {
+							var apiKey models.APIKey
+							if err := json.Unmarshal(b, &apiKey); err != nil {
+								t.Fatal(err)
+							}
+
+							if apiKey.ExpiresAt != nil {
+								t.Fatalf("Expected the expiry to be cleared, got %s", string(b))
+							}
+
+							var saved models.APIKey
+							db.Where(&models.APIKey{Key: "test"}).First(&saved)
+							if saved.ExpiresAt != nil {
+								t.Fatalf("Expected the cleared expiry to be saved, got %v", saved.ExpiresAt)
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/api/users/self/apikeys/test/rejections", fiber.MethodGet).
+			SetupUser(func(_ string, user models.User) error {
+				apiKey := models.APIKey{
+					Key:         "test",
+					UserID:      user.ID,
+					FullAccess:  true,
+					Permissions: []string{},
+				}
+				if err := db.Create(&apiKey).Error; err != nil {
+					return err
+				}
+
+				return db.Create(&models.APIKeyRejection{Key: "test", IP: "203.0.113.7", Reason: leash_auth.APIKEY_REJECTION_IP}).Error
+			}).
+			CleanupUser(func(_ string, user models.User) error {
+				db.Unscoped().Delete(&models.APIKeyRejection{}, &models.APIKeyRejection{Key: "test"})
+				return db.Unscoped().Delete(&models.APIKey{}, &models.APIKey{Key: "test"}).Error
+			}).
+			Test("List Self Api Key Rejections", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_self", "leash.users.self.apikeys:target", "leash.users.self.apikeys.rejections:list"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint("/api/users/self/notifications", fiber.MethodGet).
+			Test("Get Self Notifications Empty", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_self", "leash.users.self.notifications:list"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(0),
+					)
+			})
+
+		newNotification := models.Notification{
+			Title:   "Test Notification",
+			Message: "Test Message",
+			UserID:  responseUser.ID,
+			AddedBy: responseUser.ID,
+		}
+
+		test.Endpoint("/api/users/self/notifications", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"title":   "Test Notification",
 				"message": "Test Message",
 			})).
 			Test("Create Self Notification", func(e *EndpointTester) {
@@ -2222,6 +2856,7 @@ func TestLeash(t *testing.T) {
 			Audience([]string{"leash", "login-callback"}).
 			Claim("return", "/").
 			Claim("state", "state").
+			Claim("nonce", "nonce").
 			Build()
 
 		if err != nil {
@@ -2272,5 +2907,3244 @@ func TestLeash(t *testing.T) {
 			Test("Login Callback With User that has login permissions", func(e *EndpointTester) {
 				e.GivesResponseNoAuth(statusCode(fiber.StatusFound))
 			})
+
+		providerState := func(provider string) string {
+			tok, err := jwt.NewBuilder().
+				Issuer(leash_auth.ISSUER).
+				IssuedAt(time.Now()).
+				Expiration(time.Now().Add(5*time.Minute)).
+				Audience([]string{"leash", "login-callback"}).
+				Claim("return", "/").
+				Claim("state", "state").
+				Claim("provider", provider).
+				Claim("nonce", "nonce").
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := keys.Sign(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return string(signed)
+		}
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  user.Email,
+				"state": providerState("debug"),
+			}).
+			Test("Login Callback With Named Provider", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusFound))
+			})
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  user.Email,
+				"state": providerState("reject"),
+			}).
+			Test("Login Callback Dispatches To The Provider In The State", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		tok.Remove("nonce")
+		withoutNonce, err := keys.Sign(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  user.Email,
+				"state": string(withoutNonce),
+			}).
+			Test("Login Callback Without Nonce", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  user.Email,
+				"state": providerState("unknown"),
+			}).
+			Test("Login Callback With Unknown Provider", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/login", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"provider": "reject",
+			}).
+			Test("Login Redirect With Provider", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusFound))
+			})
+
+		test.Endpoint("/auth/login", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"provider": "unknown",
+			}).
+			Test("Login Redirect With Unknown Provider", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/providers", fiber.MethodGet).
+			Test("List Login Providers", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Lists the providers in order",
+						Test: func(t *testing.T, _ string, _ int, b []byte) {
+							var providers []leash_auth.ExternalProvider
+							if err := json.Unmarshal(b, &providers); err != nil {
+								t.Fatal(err)
+							}
+
+							if len(providers) != 2 || providers[0].Name != "debug" || providers[1].Name != "reject" || providers[0].DisplayName != "Debug" {
+								t.Fatalf("Unexpected providers %s", string(b))
+							}
+						},
+					},
+				)
+			})
+	})
+
+	tester.Test("Registration Endpoints", func(test *Tester) {
+		registerEmails := []string{"register1@testing.mkr.cx", "register2@testing.mkr.cx"}
+
+		cleanupRegistered := func(_ string, _ models.User) error {
+			var users []models.User
+			db.Unscoped().Where("email IN ?", registerEmails).Find(&users)
+			for _, user := range users {
+				purgeUser(db, user)
+			}
+
+			return db.Unscoped().Where("email IN ?", registerEmails).Delete(&models.User{}).Error
+		}
+
+		cleanupRegistered("", models.User{})
+		defer cleanupRegistered("", models.User{})
+
+		signToken := func(audience string, claims map[string]interface{}) string {
+			builder := jwt.NewBuilder().
+				Issuer(leash_auth.ISSUER).
+				IssuedAt(time.Now()).
+				Expiration(time.Now().Add(5 * time.Minute)).
+				Audience([]string{"leash", audience})
+
+			for k, v := range claims {
+				builder = builder.Claim(k, v)
+			}
+
+			tok, err := builder.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := keys.Sign(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return string(signed)
+		}
+
+		loginState := signToken("login-callback", map[string]interface{}{"return": "/", "state": "state", "nonce": "nonce"})
+
+		registerBody := func(email string) []byte {
+			return encode(map[string]interface{}{
+				"token":    signToken("registration", map[string]interface{}{"email": email}),
+				"name":     "Registered User",
+				"pronouns": "they/them",
+				"type":     "other",
+			})
+		}
+
+		registrationEQ := func(email string, pending bool, session bool) ResponseTester {
+			return ResponseTester{
+				Name: "Registration Response Tester",
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var response struct {
+						User  models.User `json:"user"`
+						Token string      `json:"token"`
+					}
+
+					if err := json.Unmarshal(b, &response); err != nil {
+						t.Fatal(err)
+					}
+
+					if response.User.Email != email || response.User.Role != "member" || response.User.PendingApproval != pending {
+						t.Fatalf("Unexpected registered user %s", string(b))
+					}
+
+					if (response.Token != "") != session {
+						t.Fatalf("Expected a session token: %v, got %s", session, string(b))
+					}
+				},
+			}
+		}
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(registerBody(registerEmails[0])).
+			Test("Register With Registration Disabled", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusForbidden))
+			})
+
+		leash_signin.SetRegistrationMode(leash_signin.REGISTRATION_OPEN)
+		defer leash_signin.SetRegistrationMode(leash_signin.REGISTRATION_DISABLED)
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  registerEmails[0],
+				"state": loginState,
+			}).
+			Test("Login Callback Redirects Unknown User To Registration", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusFound))
+			})
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"token":    loginState,
+				"name":     "Registered User",
+				"pronouns": "they/them",
+				"type":     "other",
+			})).
+			Test("Register With Invalid Token", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"token": signToken("registration", map[string]interface{}{"email": registerEmails[0]}),
+				"name":  "Registered User",
+				"type":  "undergrad",
+			})).
+			Test("Register With Missing Fields", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(registerBody(registerEmails[0])).
+			Test("Register", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusCreated),
+					registrationEQ(registerEmails[0], false, true),
+				)
+			})
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(registerBody(registerEmails[0])).
+			Test("Register Existing User", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusConflict))
+			})
+
+		leash_signin.SetRegistrationMode(leash_signin.REGISTRATION_APPROVAL)
+
+		test.Endpoint("/auth/register", fiber.MethodPost).
+			WithBody(registerBody(registerEmails[1])).
+			Test("Register Pending Approval", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusAccepted),
+					registrationEQ(registerEmails[1], true, false),
+				)
+			})
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  registerEmails[1],
+				"state": loginState,
+			}).
+			Test("Login Callback With User Pending Approval", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusForbidden))
+			})
+
+		var pendingUser models.User
+		db.Where(&models.User{Email: registerEmails[1]}).First(&pendingUser)
+
+		resetPending := func(_ string, _ models.User) error {
+			user := pendingUser
+			user.PendingApproval = true
+			return db.Save(&user).Error
+		}
+
+		test.Endpoint("/api/users/pending", fiber.MethodGet).
+			Test("List Users Pending Approval", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:pending"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/users/%d/approve", pendingUser.ID), fiber.MethodPost).
+			SetupUser(resetPending).
+			Test("Approve User", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others:approve"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						ResponseTester{
+							Name: "User Is Approved",
+							Test: func(t *testing.T, _ string, _ int, b []byte) {
+								var user models.User
+								if err := json.Unmarshal(b, &user); err != nil {
+									t.Fatal(err)
+								}
+
+								if user.PendingApproval {
+									t.Fatalf("Expected the user to be approved, got %s", string(b))
+								}
+							},
+						},
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/users/%d/approve", pendingUser.ID), fiber.MethodPost).
+			Test("Approve User Not Pending Approval", func(e *EndpointTester) {
+				e.GivesResponse(statusCode(fiber.StatusConflict))
+			})
+
+		test.Endpoint("/auth/callback", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"code":  registerEmails[1],
+				"state": loginState,
+			}).
+			Test("Login Callback With Approved User", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusFound))
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/users/%d/reject", pendingUser.ID), fiber.MethodPost).
+			SetupUser(resetPending).
+			Test("Reject User", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others:reject"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						ResponseTester{
+							Name: "User Is Removed",
+							Test: func(t *testing.T, _ string, _ int, _ []byte) {
+								var count int64
+								db.Unscoped().Model(&models.User{}).Where("id = ?", pendingUser.ID).Count(&count)
+								if count != 0 {
+									t.Fatal("Expected the rejected user to be removed")
+								}
+							},
+						},
+					)
+			})
+	})
+
+	tester.Test("Email Verification Endpoints", func(test *Tester) {
+		newEmail := "verified@testing.mkr.cx"
+		verifyUser := models.User{
+			Name:  "Verify User",
+			Email: "verify@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		cleanupVerify := func() {
+			db.Unscoped().Where("email IN ?", []string{verifyUser.Email, newEmail}).Delete(&models.User{})
+		}
+
+		cleanupVerify()
+		defer cleanupVerify()
+
+		db.Create(&verifyUser)
+		userEP := fmt.Sprintf("/api/users/%d", verifyUser.ID)
+
+		setPending := func(expiresAt time.Time) func(string, models.User) error {
+			return func(_ string, _ models.User) error {
+				return db.Model(&models.User{}).Where("id = ?", verifyUser.ID).Updates(map[string]interface{}{
+					"email":                    verifyUser.Email,
+					"pending_email":            newEmail,
+					"pending_email_expires_at": expiresAt,
+				}).Error
+			}
+		}
+
+		tokenPattern := regexp.MustCompile(`verify_email\?token=(\S+)`)
+		latestToken := func() string {
+			matches := tokenPattern.FindAllStringSubmatch(mailBox.String(), -1)
+			if len(matches) == 0 {
+				t.Fatal("Expected a verification email to be sent")
+			}
+
+			token, err := url.QueryUnescape(matches[len(matches)-1][1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return token
+		}
+
+		pendingEQ := func(email string, pending *string) ResponseTester {
+			return ResponseTester{
+				Name: "Pending Email Response Tester",
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var user models.User
+					if err := json.Unmarshal(b, &user); err != nil {
+						t.Fatal(err)
+					}
+
+					if user.Email != email || (pending == nil) != (user.PendingEmail == nil) || (pending != nil && *user.PendingEmail != *pending) {
+						t.Fatalf("Unexpected user %s", string(b))
+					}
+
+					if (user.PendingEmail == nil) != (user.PendingEmailExpiresAt == nil) {
+						t.Fatalf("Expected the pending email expiry to match the pending email, got %s", string(b))
+					}
+				},
+			}
+		}
+
+		mailSentTo := func(email string) ResponseTester {
+			return ResponseTester{
+				Name: "Verification Email Sent",
+				Test: func(t *testing.T, _ string, _ int, _ []byte) {
+					if !strings.Contains(mailBox.String(), "To: "+email) {
+						t.Fatalf("Expected a verification email to %s, got %s", email, mailBox.String())
+					}
+				},
+			}
+		}
+
+		verifyPage := func(token string) *EndpointBuilder {
+			return test.Endpoint("/auth/verify_email", fiber.MethodGet).
+				WithQuery(QueryArgs{
+					"token": token,
+				})
+		}
+
+		mailBox.Reset()
+		test.Endpoint(userEP, fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"email": newEmail,
+			})).
+			Test("Change Email Sends Verification", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					pendingEQ(verifyUser.Email, &newEmail),
+					mailSentTo(newEmail),
+				)
+			})
+
+		cancelledToken := latestToken()
+
+		verifyPage("invalid").
+			Test("Verify Email With Invalid Token", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint(userEP+"/pending_email", fiber.MethodDelete).
+			SetupUser(setPending(time.Now().Add(time.Hour))).
+			Test("Cancel Pending Email", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.pending_email:delete"}).
+					MinimumRole(ROLE_VOLUNTEER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						pendingEQ(verifyUser.Email, nil),
+					)
+			})
+
+		verifyPage(cancelledToken).
+			Test("Verify Cancelled Email", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusGone))
+			})
+
+		mailBox.Reset()
+		test.Endpoint(userEP+"/pending_email/resend", fiber.MethodPost).
+			SetupUser(setPending(time.Now().Add(time.Hour))).
+			Test("Resend Verification Email", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.pending_email:resend"}).
+					MinimumRole(ROLE_VOLUNTEER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						pendingEQ(verifyUser.Email, &newEmail),
+						mailSentTo(newEmail),
+					)
+			})
+
+		token := latestToken()
+
+		verifyPage(token).
+			Test("Verify Email", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Email Is Changed",
+						Test: func(t *testing.T, _ string, _ int, _ []byte) {
+							var user models.User
+							db.First(&user, verifyUser.ID)
+							if user.Email != newEmail || user.PendingEmail != nil || user.PendingEmailExpiresAt != nil {
+								t.Fatalf("Expected the email to be changed to %s, got %s", newEmail, user.Email)
+							}
+						},
+					},
+				)
+			})
+
+		verifyPage(token).
+			Test("Verify Email Twice", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusGone))
+			})
+
+		test.Test("Expire Pending Emails", func(test *Tester) {
+			setPending(time.Now().Add(-time.Minute))("", models.User{})
+
+			if err := leash_api.ExpirePendingEmails(db); err != nil {
+				t.Fatal(err)
+			}
+
+			var user models.User
+			db.First(&user, verifyUser.ID)
+			if user.PendingEmail != nil || user.PendingEmailExpiresAt != nil {
+				t.Fatal("Expected the expired pending email to be dropped")
+			}
+		})
+	})
+
+	tester.Endpoint("/.well-known/jwks.json", fiber.MethodGet).
+		Test("JWKS Endpoint", func(e *EndpointTester) {
+			e.GivesResponseNoAuth(
+				statusCode(fiber.StatusOK),
+				ResponseTester{
+					Name: "Publishes The Public Signing Key",
+					Test: func(t *testing.T, _ string, _ int, b []byte) {
+						set, err := jwk.Parse(b)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						if _, ok := set.LookupKeyID(keys.GetPublicKey().KeyID()); !ok || set.Len() != 1 {
+							t.Fatalf("Expected the signing key to be published, got %s", string(b))
+						}
+
+						tok, err := jwt.NewBuilder().Issuer(leash_auth.ISSUER).Build()
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						signed, err := keys.Sign(tok)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						if _, err := jwt.Parse(signed, jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true))); err != nil {
+							t.Fatalf("Expected tokens to verify with the published keys: %s", err)
+						}
+					},
+				},
+			)
+		})
+
+	tester.Test("Session Endpoints", func(test *Tester) {
+		sessionUser := models.User{
+			Name:  "Session User",
+			Email: "sessions@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		cleanupSessions := func() {
+			db.Unscoped().Where("user_id = ?", sessionUser.ID).Delete(&models.Session{})
+			db.Unscoped().Where("email = ?", sessionUser.Email).Delete(&models.User{})
+		}
+
+		db.Unscoped().Where("email = ?", sessionUser.Email).Delete(&models.User{})
+		db.Create(&sessionUser)
+		defer cleanupSessions()
+
+		userEP := fmt.Sprintf("/api/users/%d/sessions", sessionUser.ID)
+
+		createSessions := func(_ string, _ models.User) error {
+			db.Unscoped().Where("user_id = ?", sessionUser.ID).Delete(&models.Session{})
+
+			return db.Create(&[]models.Session{
+				{SessionID: "session-active-1", UserID: sessionUser.ID, ExpiresAt: time.Now().Add(time.Hour), IP: "10.0.0.1", UserAgent: "Test Agent"},
+				{SessionID: "session-active-2", UserID: sessionUser.ID, ExpiresAt: time.Now().Add(time.Hour)},
+				{SessionID: "session-expired", UserID: sessionUser.ID, ExpiresAt: time.Now().Add(-time.Hour)},
+			}).Error
+		}
+
+		sessionExists := func(session_id string, exists bool) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Session %s Exists %v", session_id, exists),
+				Test: func(t *testing.T, _ string, _ int, _ []byte) {
+					var count int64
+					db.Model(&models.Session{}).Where("api_key = ?", session_id).Count(&count)
+					if (count != 0) != exists {
+						t.Fatalf("Expected session %s to exist: %v", session_id, exists)
+					}
+				},
+			}
+		}
+
+		test.Endpoint(userEP, fiber.MethodGet).
+			SetupUser(createSessions).
+			Test("List Sessions", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.sessions:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(2),
+					)
+			})
+
+		test.Endpoint(userEP+"/session-active-1", fiber.MethodDelete).
+			SetupUser(createSessions).
+			Test("Revoke Session", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.sessions:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusNoContent),
+						sessionExists("session-active-1", false),
+						sessionExists("session-active-2", true),
+					)
+			})
+
+		test.Endpoint(userEP+"/unknown", fiber.MethodDelete).
+			Test("Revoke Unknown Session", func(e *EndpointTester) {
+				e.GivesResponse(statusCode(fiber.StatusNotFound))
+			})
+
+		test.Endpoint(userEP, fiber.MethodDelete).
+			SetupUser(createSessions).
+			Test("Revoke All Sessions", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.sessions:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusNoContent),
+						sessionExists("session-active-1", false),
+						sessionExists("session-active-2", false),
+					)
+			})
+
+		test.Test("Purge Expired Sessions", func(test *Tester) {
+			createSessions("", models.User{})
+			db.Delete(&models.Session{SessionID: "session-active-2"})
+
+			if err := leash_api.PurgeExpiredSessions(db); err != nil {
+				t.Fatal(err)
+			}
+
+			var sessions []models.Session
+			db.Unscoped().Where("user_id = ?", sessionUser.ID).Find(&sessions)
+			if len(sessions) != 1 || sessions[0].SessionID != "session-active-1" {
+				t.Fatalf("Expected only the active session to remain, got %v", sessions)
+			}
+		})
+	})
+
+	tester.Test("Security Stamp", func(test *Tester) {
+		stampUser := models.User{
+			Name:  "Stamp User",
+			Email: "stamp@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", stampUser.Email).Delete(&models.User{})
+		db.Create(&stampUser)
+		defer db.Unscoped().Where("email = ?", stampUser.Email).Delete(&models.User{})
+		defer db.Unscoped().Where("user_id = ?", stampUser.ID).Delete(&models.Session{})
+
+		userEP := fmt.Sprintf("/api/users/%d", stampUser.ID)
+
+		// sessionToken signs in the user the same way the login callback does
+		sessionToken := func() string {
+			var user models.User
+			db.First(&user, stampUser.ID)
+
+			session := models.Session{
+				SessionID: uuid.New().String(),
+				UserID:    user.ID,
+				ExpiresAt: time.Now().Add(time.Hour),
+			}
+			db.Create(&session)
+
+			tok, err := jwt.NewBuilder().
+				Issuer(leash_auth.ISSUER).
+				IssuedAt(time.Now()).
+				Expiration(session.ExpiresAt).
+				Audience([]string{"leash", "session"}).
+				Claim("email", user.Email).
+				Claim("session", session.SessionID).
+				Claim("stamp", user.SecurityStamp).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signed, err := keys.Sign(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return string(signed)
+		}
+
+		sessionValid := func(token string, valid bool) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Session Valid %v", valid),
+				Test: func(t *testing.T, _ string, _ int, _ []byte) {
+					_, err := leash_auth.AuthenticateHeader("Bearer "+token, db, keys, enforcer)
+					if (err == nil) != valid {
+						t.Fatalf("Expected the session to be valid: %v, got %v", valid, err)
+					}
+				},
+			}
+		}
+
+		token := sessionToken()
+		test.Endpoint(userEP, fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"name": "Stamp User Renamed",
+			})).
+			Test("Session Survives Profile Update", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					sessionValid(token, true),
+				)
+			})
+
+		test.Endpoint(userEP, fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"role": "volunteer",
+			})).
+			Test("Role Change Revokes Sessions", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					sessionValid(token, false),
+					ResponseTester{
+						Name: "Session Rows Removed",
+						Test: func(t *testing.T, _ string, _ int, _ []byte) {
+							var count int64
+							db.Model(&models.Session{}).Where("user_id = ?", stampUser.ID).Count(&count)
+							if count != 0 {
+								t.Fatalf("Expected the sessions to be removed, got %d", count)
+							}
+						},
+					},
+				)
+			})
+
+		token = sessionToken()
+		test.Endpoint(userEP, fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"card_id": "stamp-card",
+			})).
+			Test("Card Change Revokes Sessions", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					sessionValid(token, false),
+				)
+			})
+
+		token = sessionToken()
+		test.Endpoint(userEP, fiber.MethodDelete).
+			Test("Delete Revokes Sessions", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					sessionValid(token, false),
+				)
+			})
+	})
+
+	tester.Test("Session Token Endpoints", func(test *Tester) {
+		tokenUser := models.User{
+			Name:  "Token User",
+			Email: "tokens@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", tokenUser.Email).Delete(&models.User{})
+		db.Create(&tokenUser)
+		defer db.Unscoped().Where("email = ?", tokenUser.Email).Delete(&models.User{})
+
+		session := models.Session{
+			SessionID: uuid.New().String(),
+			UserID:    tokenUser.ID,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		db.Create(&session)
+		defer db.Unscoped().Where("session_id = ?", session.SessionID).Delete(&models.RefreshToken{})
+		defer db.Unscoped().Delete(&session)
+
+		tok, err := jwt.NewBuilder().
+			Issuer(leash_auth.ISSUER).
+			IssuedAt(time.Now()).
+			Expiration(time.Now().Add(time.Minute)).
+			Audience([]string{"leash", "login-code"}).
+			Claim("session", session.SessionID).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, err := keys.Sign(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type sessionTokens struct {
+			Token            string    `json:"token"`
+			ExpiresAt        time.Time `json:"expires_at"`
+			RefreshToken     string    `json:"refresh_token"`
+			RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+		}
+
+		// issuedTokens checks the response is a usable short lived token pair and keeps it
+		issuedTokens := func(tokens *sessionTokens) ResponseTester {
+			return ResponseTester{
+				Name: "Issues Session Tokens",
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					if err := json.Unmarshal(b, tokens); err != nil {
+						t.Fatal(err)
+					}
+
+					if tokens.RefreshToken == "" || tokens.ExpiresAt.After(time.Now().Add(time.Hour)) || !tokens.RefreshExpiresAt.After(tokens.ExpiresAt) {
+						t.Fatalf("Expected a short lived access token and a refresh token, got %s", string(b))
+					}
+
+					if _, err := leash_auth.AuthenticateHeader("Bearer "+tokens.Token, db, keys, enforcer); err != nil {
+						t.Fatalf("Expected the access token to authenticate: %s", err)
+					}
+
+					var count int64
+					db.Model(&models.RefreshToken{}).Where("hash = ?", tokens.RefreshToken).Count(&count)
+					if count != 0 {
+						t.Fatal("Expected the refresh token to only be stored hashed")
+					}
+				},
+			}
+		}
+
+		var first, second sessionTokens
+
+		test.Endpoint("/auth/token", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"code": string(code),
+			})).
+			Test("Exchange Login Code", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusOK),
+					issuedTokens(&first),
+				)
+			})
+
+		test.Endpoint("/auth/token", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"code": string(code),
+			})).
+			Test("Exchange Login Code Twice", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusBadRequest))
+			})
+
+		test.Endpoint("/auth/refresh", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"refresh_token": first.RefreshToken,
+			})).
+			Test("Refresh Tokens", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusOK),
+					issuedTokens(&second),
+				)
+			})
+
+		test.Endpoint("/auth/refresh", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"refresh_token": first.RefreshToken,
+			})).
+			Test("Reused Refresh Token Revokes Session", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusUnauthorized),
+					ResponseTester{
+						Name: "Session Revoked",
+						Test: func(t *testing.T, _ string, _ int, _ []byte) {
+							if _, err := leash_auth.AuthenticateHeader("Bearer "+second.Token, db, keys, enforcer); err == nil {
+								t.Fatal("Expected the access token of the revoked session to be rejected")
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/auth/refresh", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"refresh_token": second.RefreshToken,
+			})).
+			Test("Refresh Revoked Session", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(statusCode(fiber.StatusUnauthorized))
+			})
+	})
+
+	tester.Test("User Import Endpoints", func(test *Tester) {
+		importEmails := []string{"import1@testing.mkr.cx", "import2@testing.mkr.cx"}
+
+		cleanupImported := func(_ string, _ models.User) error {
+			return db.Unscoped().Where("email IN ?", importEmails).Delete(&models.User{}).Error
+		}
+
+		importCSV := []byte("email,name,pronouns,role,type,graduation_year,major,department,job_title\n" +
+			importEmails[0] + ",Import One,they/them,member,undergrad,2027,Computer Science,,\n" +
+			importEmails[1] + ",Import Two,she/her,member,employee,,,Facilities,Technician\n")
+
+		importResultEQ := func(created int, updated int, failed int, written bool) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Import Result %d %d %d", created, updated, failed),
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var result struct {
+						Created int `json:"created"`
+						Updated int `json:"updated"`
+						Failed  int `json:"failed"`
+					}
+
+					if err := json.Unmarshal(b, &result); err != nil {
+						t.Fatal(err)
+					}
+
+					if result.Created != created || result.Updated != updated || result.Failed != failed {
+						t.Fatalf("Expected %d created, %d updated, %d failed, got %d, %d, %d", created, updated, failed, result.Created, result.Updated, result.Failed)
+					}
+
+					var count int64
+					db.Model(&models.User{}).Where("email IN ?", importEmails).Where("name LIKE ?", "Import%").Count(&count)
+
+					if written && count != int64(len(importEmails)) {
+						t.Fatalf("Expected imported users to be written, found %d", count)
+					} else if !written && count != 0 {
+						t.Fatalf("Expected no imported users to be written, found %d", count)
+					}
+				},
+			}
+		}
+
+		test.Endpoint("/api/users/import", fiber.MethodPost).
+			WithQuery(QueryArgs{"dry_run": "true"}).
+			WithBody(importCSV).
+			SetupUser(cleanupImported).
+			CleanupUser(cleanupImported).
+			Test("Import Users Dry Run", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:import"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						importResultEQ(2, 0, 0, false),
+					)
+			})
+
+		test.Endpoint("/api/users/import", fiber.MethodPost).
+			WithBody(importCSV).
+			SetupUser(cleanupImported).
+			CleanupUser(cleanupImported).
+			Test("Import Users", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:import"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						importResultEQ(2, 0, 0, true),
+					)
+			})
+
+		test.Endpoint("/api/users/import", fiber.MethodPost).
+			WithBody(importCSV).
+			SetupUser(func(prefix string, user models.User) error {
+				if err := cleanupImported(prefix, user); err != nil {
+					return err
+				}
+
+				return db.Create(&models.User{Email: importEmails[0], Name: "Old Name", Pronouns: "they/them", Role: "member", Type: "other"}).Error
+			}).
+			CleanupUser(cleanupImported).
+			Test("Import Users Updates Existing", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					importResultEQ(1, 1, 0, true),
+				)
+			})
+
+		test.Endpoint("/api/users/import", fiber.MethodPost).
+			WithBody([]byte("email,name,pronouns,role,type\n"+
+				importEmails[0]+",Import One,they/them,member,other\n"+
+				"not-an-email,Import Bad,they/them,wizard,other\n")).
+			SetupUser(cleanupImported).
+			CleanupUser(cleanupImported).
+			Test("Import Users With Invalid Row", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+					importResultEQ(1, 0, 1, false),
+				)
+			})
+
+		test.Endpoint("/api/users/import", fiber.MethodPost).
+			WithBody([]byte("email,name\n"+importEmails[0]+",Import One\n")).
+			Test("Import Users Missing Column", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/users/export", fiber.MethodGet).
+			WithQuery(QueryArgs{"query": "import1@testing", "type": "undergrad"}).
+			SetupUser(func(prefix string, user models.User) error {
+				if err := cleanupImported(prefix, user); err != nil {
+					return err
+				}
+
+				return db.Create(&models.User{Email: importEmails[0], Name: "Import One", Pronouns: "they/them", Role: "member", Type: "undergrad", GraduationYear: 2027, Major: "Computer Science"}).Error
+			}).
+			CleanupUser(cleanupImported).
+			Test("Export Users", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:export"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						ResponseTester{
+							Name: "Export CSV",
+							Test: func(t *testing.T, _ string, _ int, b []byte) {
+								lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+								if len(lines) != 2 {
+									t.Fatalf("Expected a header and 1 user, got %d lines", len(lines))
+								}
+
+								if lines[0] != "id,email,name,pronouns,role,type,graduation_year,major,department,job_title,created_at" {
+									t.Fatalf("Unexpected header %v", lines[0])
+								}
+
+								if !strings.Contains(lines[1], importEmails[0]+",Import One,they/them,member,undergrad,2027,Computer Science,,") {
+									t.Fatalf("Unexpected row %v", lines[1])
+								}
+							},
+						},
+					)
+			})
+	})
+
+	tester.Test("Training Definition Endpoints", func(test *Tester) {
+		definition := models.TrainingDefinition{
+			Name:          "cnc_router",
+			Description:   "Tormach CNC router",
+			Prerequisites: []string{"other"},
+			Levels:        []string{"supervised", "unsupervised"},
+			ValidFor:      int64((365 * 24 * time.Hour).Seconds()),
+		}
+
+		db.Unscoped().Delete(&models.TrainingDefinition{}, &models.TrainingDefinition{Name: definition.Name})
+		db.Create(&definition)
+
+		restoreDefinition := func(_ string, _ models.User) error {
+			return db.Unscoped().Model(&definition).Update("deleted_at", nil).Error
+		}
+
+		test.Endpoint("/api/trainings/definitions", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":          "lathe",
+				"prerequisites": []string{"other"},
+				"levels":        []string{"supervised"},
+			})).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Unscoped().Delete(&models.TrainingDefinition{}, &models.TrainingDefinition{Name: "lathe"}).Error
+			}).
+			Test("Create Training Definition", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.trainings.definitions:create"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/trainings/definitions", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":          "lathe",
+				"prerequisites": []string{"not_a_training"},
+			})).
+			Test("Create Training Definition With Unknown Prerequisite", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/trainings/definitions", fiber.MethodGet).
+			Test("List Training Definitions", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.trainings.definitions:list"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(3),
+					)
+			})
+
+		test.Endpoint("/api/trainings/definitions/cnc_router", fiber.MethodGet).
+			Test("Get Training Definition", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.trainings.definitions:target", "leash.trainings.definitions:get"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/trainings/definitions/cnc_router", fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"description": "Tormach 1100 CNC router",
+			})).
+			Test("Update Training Definition", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.trainings.definitions:target", "leash.trainings.definitions:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/trainings/definitions/other", fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"prerequisites": []string{"cnc_router"},
+			})).
+			Test("Update Training Definition With Prerequisite Cycle", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/trainings/definitions/cnc_router", fiber.MethodDelete).
+			SetupUser(restoreDefinition).
+			CleanupUser(restoreDefinition).
+			Test("Delete Training Definition", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.trainings.definitions:target", "leash.trainings.definitions:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						defaultStatusResponse,
+					)
+			})
+
+		test.Endpoint("/api/trainings/definitions/other", fiber.MethodDelete).
+			Test("Delete Required Training Definition", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusConflict),
+				)
+			})
+
+		test.Endpoint("/api/trainings/definitions/laser_cutter", fiber.MethodDelete).
+			SetupUser(func(_ string, _ models.User) error {
+				return db.Create(&models.Equipment{Name: "Epilog Laser", RequiredTraining: "laser_cutter"}).Error
+			}).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Unscoped().Where("name = ?", "Epilog Laser").Delete(&models.Equipment{}).Error
+			}).
+			Test("Delete Training Definition Required By Equipment", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusConflict),
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "not_a_training",
+				"level": "supervised",
+			})).
+			Test("Create Unknown Training", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "cnc_router",
+				"level": "can_train",
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				return db.Create(&models.Training{Name: "other", Level: "unsupervised", UserID: user.ID, AddedBy: user.ID}).Error
+			}).
+			Test("Create Training With Disallowed Level", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "cnc_router",
+				"level": "supervised",
+			})).
+			Test("Create Training Without Prerequisite", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusPreconditionFailed),
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "cnc_router",
+				"level": "supervised",
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				return db.Create(&models.Training{Name: "other", Level: "unsupervised", UserID: user.ID, AddedBy: user.ID}).Error
+			}).
+			Test("Create Training With Expiry", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Training Expiry",
+						Test: func(t *testing.T, _ string, _ int, b []byte) {
+							var training models.Training
+							if err := json.Unmarshal(b, &training); err != nil {
+								t.Fatal(err)
+							}
+
+							if training.ExpiresAt == nil {
+								t.Fatal("Expected training to have an expiry")
+							}
+
+							expected := time.Now().Add(365 * 24 * time.Hour)
+							if training.ExpiresAt.Sub(expected).Abs() > time.Minute {
+								t.Fatalf("Expected expiry near %v, got %v", expected, training.ExpiresAt)
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "cnc_router",
+				"level": "supervised",
+			})).
+			SetupUser(func(_ string, user models.User) error {
+				expired := time.Now().Add(-time.Hour)
+				if err := db.Create(&models.Training{Name: "other", Level: "unsupervised", UserID: user.ID, AddedBy: user.ID}).Error; err != nil {
+					return err
+				}
+
+				return db.Create(&models.Training{Name: "cnc_router", Level: "supervised", UserID: user.ID, AddedBy: user.ID, ExpiresAt: &expired}).Error
+			}).
+			Test("Renew Expired Training", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+				)
+			})
+
+		db.Unscoped().Delete(&definition)
+	})
+
+	tester.Test("Equipment Endpoints", func(test *Tester) {
+		equipment := models.Equipment{
+			Name:             "equipment_testing_laser",
+			Location:         "Main Shop",
+			RequiredTraining: "laser_cutter",
+			MinimumLevel:     "supervised",
+			Status:           "operational",
+		}
+
+		db.Create(&equipment)
+
+		restoreEquipment := func(_ string, _ models.User) error {
+			return db.Unscoped().Model(&equipment).Update("deleted_at", nil).Error
+		}
+
+		test.Endpoint("/api/equipment", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":              "equipment_testing_new",
+				"location":          "Main Shop",
+				"required_training": "laser_cutter",
+				"minimum_level":     "unsupervised",
+			})).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Unscoped().Delete(&models.Equipment{}, &models.Equipment{Name: "equipment_testing_new"}).Error
+			}).
+			Test("Create Equipment", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:create"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/equipment", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name": equipment.Name,
+			})).
+			Test("Create Duplicate Equipment", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusConflict),
+				)
+			})
+
+		test.Endpoint("/api/equipment", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":              "equipment_testing_unknown",
+				"required_training": "not_a_training",
+			})).
+			Test("Create Equipment With Unknown Training", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/equipment", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":   "equipment_testing_broken",
+				"status": "broken",
+			})).
+			Test("Create Broken Equipment Without Reason", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/equipment", fiber.MethodGet).
+			Test("List Equipment", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:list"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint("/api/equipment", fiber.MethodGet).
+			WithQuery(QueryArgs{"status": "broken"}).
+			Test("List Broken Equipment", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					listLengthEQ(0),
+				)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/equipment/%d", equipment.ID), fiber.MethodGet).
+			Test("Get Equipment", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:target", "leash.equipment:get"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/equipment/%d", equipment.ID), fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"location": "Back Room",
+			})).
+			Test("Update Equipment", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:target", "leash.equipment:update"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/equipment/%d/status", equipment.ID), fiber.MethodPut).
+			WithBody(encode(map[string]interface{}{
+				"status": "broken",
+				"reason": "Tube is cracked",
+			})).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Model(&equipment).Updates(map[string]interface{}{"status": "operational", "status_reason": ""}).Error
+			}).
+			Test("Mark Equipment Out Of Service", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:target", "leash.equipment:status"}).
+					MinimumRole(ROLE_VOLUNTEER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/equipment/%d/status", equipment.ID), fiber.MethodPut).
+			WithBody(encode(map[string]interface{}{
+				"status": "maintenance",
+			})).
+			Test("Mark Equipment Out Of Service Without Reason", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/equipment/%d", equipment.ID), fiber.MethodDelete).
+			SetupUser(restoreEquipment).
+			Test("Delete Equipment", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.equipment:target", "leash.equipment:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						defaultStatusResponse,
+					)
+			})
+
+		db.Unscoped().Delete(&equipment)
+	})
+
+	tester.Test("Visit Endpoints", func(test *Tester) {
+		cardID := "visit-testing-card"
+		visitor := models.User{
+			Name:   "Visit Test User",
+			Email:  "visit@testing.mkr.cx",
+			Role:   "member",
+			Type:   "other",
+			CardID: &cardID,
+		}
+
+		db.Unscoped().Delete(&models.User{}, &models.User{Email: visitor.Email})
+		db.Create(&visitor)
+
+		clearVisits := func(_ string, _ models.User) error {
+			return db.Unscoped().Delete(&models.Visit{}, &models.Visit{UserID: visitor.ID}).Error
+		}
+
+		openVisit := func(checkIn time.Time) func(string, models.User) error {
+			return func(prefix string, user models.User) error {
+				if err := clearVisits(prefix, user); err != nil {
+					return err
+				}
+
+				return db.Create(&models.Visit{UserID: visitor.ID, CheckIn: checkIn, Method: "card"}).Error
+			}
+		}
+
+		swipe := encode(map[string]interface{}{
+			"card_id": cardID,
+		})
+
+		test.Endpoint("/api/visits/checkin", fiber.MethodPost).
+			WithBody(swipe).
+			SetupUser(clearVisits).
+			CleanupUser(clearVisits).
+			Test("Check In", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.visits:checkin"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/visits/checkin", fiber.MethodPost).
+			WithBody(swipe).
+			SetupUser(openVisit(time.Now())).
+			CleanupUser(clearVisits).
+			Test("Check In While Checked In", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusConflict),
+				)
+			})
+
+		test.Endpoint("/api/visits/checkin", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"card_id": "not-a-card",
+			})).
+			Test("Check In Unknown Card", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusNotFound),
+				)
+			})
+
+		test.Endpoint("/api/visits/checkout", fiber.MethodPost).
+			WithBody(swipe).
+			SetupUser(openVisit(time.Now())).
+			CleanupUser(clearVisits).
+			Test("Check Out", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.visits:checkout"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/visits/checkout", fiber.MethodPost).
+			WithBody(swipe).
+			SetupUser(clearVisits).
+			Test("Check Out While Checked Out", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusConflict),
+				)
+			})
+
+		test.Endpoint("/api/visits/present", fiber.MethodGet).
+			SetupUser(openVisit(time.Now())).
+			CleanupUser(clearVisits).
+			Test("List Present Visitors", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.visits:present"}).
+					MinimumRole(ROLE_VOLUNTEER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint("/api/visits/present", fiber.MethodGet).
+			SetupUser(openVisit(time.Now().AddDate(0, 0, -2))).
+			CleanupUser(clearVisits).
+			Test("Automatically Check Out After Closing", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					listLengthEQ(0),
+					ResponseTester{
+						Name: "Visit Checked Out",
+						Test: func(t *testing.T, _ string, _ int, _ []byte) {
+							var visit models.Visit
+							db.Where(&models.Visit{UserID: visitor.ID}).First(&visit)
+
+							if visit.CheckOut == nil || !visit.AutoCheckout {
+								t.Fatal("Expected visit to be automatically checked out")
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/api/visits", fiber.MethodGet).
+			SetupUser(openVisit(time.Now())).
+			CleanupUser(clearVisits).
+			Test("List Visits", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.visits:list"}).
+					MinimumRole(ROLE_STAFF).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/users/%d/visits", visitor.ID), fiber.MethodGet).
+			SetupUser(openVisit(time.Now())).
+			CleanupUser(clearVisits).
+			Test("List User Visits", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_others", "leash.users.others.visits:list"}).
+					MinimumRole(ROLE_VOLUNTEER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint("/api/users/self/visits", fiber.MethodGet).
+			SetupUser(func(_ string, user models.User) error {
+				return db.Create(&models.Visit{UserID: user.ID, CheckIn: time.Now(), Method: "card"}).Error
+			}).
+			Test("List Self Visits", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.users:target_self", "leash.users.self.visits:list"}).
+					MinimumRole(ROLE_MEMBER).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		purgeUser(db, visitor)
+		db.Unscoped().Delete(&visitor)
+	})
+
+	tester.Test("Report Endpoints", func(test *Tester) {
+		reportStart := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.Local)
+		reportEnd := time.Date(2001, time.December, 31, 0, 0, 0, 0, time.Local)
+		reportRange := QueryArgs{
+			"start": fmt.Sprint(reportStart.Unix()),
+			"end":   fmt.Sprint(reportEnd.Unix()),
+		}
+
+		reportTraining := models.Training{Name: "report_testing", Level: "supervised"}
+		reportTraining.CreatedAt = time.Date(2001, time.March, 15, 12, 0, 0, 0, time.Local)
+		db.Create(&reportTraining)
+
+		reportRowsEQ := func(rows []map[string]interface{}) ResponseTester {
+			return ResponseTester{
+				Name: "Report Rows",
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var rep struct {
+						Data []map[string]interface{} `json:"data"`
+					}
+
+					if err := json.Unmarshal(b, &rep); err != nil {
+						t.Fatal(err)
+					}
+
+					if !reflect.DeepEqual(rep.Data, rows) {
+						t.Fatalf("Expected rows %v, got %v", rows, rep.Data)
+					}
+				},
+			}
+		}
+
+		for _, name := range []string{"visitors", "trainings", "holds", "members", "updates"} {
+			test.Endpoint("/api/reports/"+name, fiber.MethodGet).
+				Test(fmt.Sprintf("Get %s Report", name), func(e *EndpointTester) {
+					e.RequiresPermissions([]string{"leash.reports:" + name}).
+						MinimumRole(ROLE_STAFF).
+						GivesResponse(
+							statusCode(fiber.StatusOK),
+						)
+				})
+		}
+
+		test.Endpoint("/api/reports/trainings", fiber.MethodGet).
+			WithQuery(reportRange).
+			Test("Get Trainings Report Rows", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					reportRowsEQ([]map[string]interface{}{
+						{"period": "2001-03", "group": "report_testing", "count": float64(1)},
+					}),
+				)
+			})
+
+		test.Endpoint("/api/reports/trainings", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"start":    reportRange["start"],
+				"end":      reportRange["end"],
+				"group_by": "day",
+				"format":   "csv",
+			}).
+			Test("Get Trainings Report CSV", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Report CSV",
+						Test: func(t *testing.T, _ string, _ int, b []byte) {
+							expected := "period,group,count\n2001-03-15,report_testing,1\n"
+							if string(b) != expected {
+								t.Fatalf("Expected %q, got %q", expected, string(b))
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/api/reports/trainings", fiber.MethodGet).
+			WithQuery(QueryArgs{
+				"start": reportRange["end"],
+				"end":   reportRange["start"],
+			}).
+			Test("Get Report With Invalid Range", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		db.Unscoped().Delete(&reportTraining)
+	})
+
+	tester.Test("Access Endpoints", func(test *Tester) {
+		cardID := "access-testing-card"
+		cardholder := models.User{
+			Name:   "Access Test User",
+			Email:  "access@testing.mkr.cx",
+			Role:   "member",
+			Type:   "other",
+			CardID: &cardID,
+		}
+
+		db.Unscoped().Delete(&models.User{}, &models.User{Email: cardholder.Email})
+		db.Create(&cardholder)
+
+		equipment := models.Equipment{
+			Name:             "access_laser_cutter",
+			RequiredTraining: "laser_cutter",
+			MinimumLevel:     "unsupervised",
+		}
+
+		db.Unscoped().Delete(&models.Equipment{}, &models.Equipment{Name: equipment.Name})
+		db.Create(&equipment)
+
+		cardholderState := func(level string, holdPriorities ...int) func(string, models.User) error {
+			return func(_ string, _ models.User) error {
+				purgeUser(db, cardholder)
+
+				if level != "" {
+					training := models.Training{Name: "laser_cutter", Level: level, UserID: cardholder.ID, AddedBy: cardholder.ID}
+					if err := db.Create(&training).Error; err != nil {
+						return err
+					}
+				}
+
+				for i, priority := range holdPriorities {
+					hold := models.Hold{Name: fmt.Sprintf("hold_%d", i), Reason: "Testing", Priority: priority, UserID: cardholder.ID, AddedBy: cardholder.ID}
+					if err := db.Create(&hold).Error; err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+		}
+
+		accessDecisionEQ := func(allowed bool, reason string, warnings int) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Access Decision %v %s", allowed, reason),
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var decision struct {
+						Allowed  bool          `json:"allowed"`
+						Reason   string        `json:"reason"`
+						Warnings []models.Hold `json:"warnings"`
+					}
+
+					if err := json.Unmarshal(b, &decision); err != nil {
+						t.Fatal(err)
+					}
+
+					if decision.Allowed != allowed || decision.Reason != reason {
+						t.Fatalf("Expected allowed %v with reason %v, got %v with reason %v", allowed, reason, decision.Allowed, decision.Reason)
+					}
+
+					if len(decision.Warnings) != warnings {
+						t.Fatalf("Expected %d warnings, got %d", warnings, len(decision.Warnings))
+					}
+				},
+			}
+		}
+
+		checkCard := encode(map[string]interface{}{
+			"card_id":   cardID,
+			"equipment": equipment.Name,
+		})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(cardholderState("unsupervised")).
+			Test("Access Granted", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.access:check"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						accessDecisionEQ(true, "granted", 0),
+						ResponseTester{
+							Name: "Access Decision User",
+							Test: func(t *testing.T, _ string, _ int, b []byte) {
+								var decision struct {
+									User map[string]interface{} `json:"user"`
+								}
+
+								if err := json.Unmarshal(b, &decision); err != nil {
+									t.Fatal(err)
+								}
+
+								// Interlocks only get what they need to greet the user
+								expected := map[string]interface{}{"id": float64(cardholder.ID), "name": cardholder.Name, "pronouns": cardholder.Pronouns}
+								if !reflect.DeepEqual(decision.User, expected) {
+									t.Fatalf("Expected user %v, got %v", expected, decision.User)
+								}
+							},
+						},
+					)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(func(_ string, user models.User) error {
+				if err := cardholderState("can_train")("", user); err != nil {
+					return err
+				}
+
+				return db.Model(&cardholder).Update("pending_approval", true).Error
+			}).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Model(&cardholder).Update("pending_approval", false).Error
+			}).
+			Test("Access Denied Pending Approval", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "pending_approval", 0),
+				)
+			})
+
+		// minimumLevel sets the equipment's minimum level for a test, restoring it afterwards
+		minimumLevel := func(level string, trainingLevel string) (func(string, models.User) error, func(string, models.User) error) {
+			setup := func(_ string, user models.User) error {
+				if err := cardholderState(trainingLevel)("", user); err != nil {
+					return err
+				}
+
+				return db.Model(&equipment).Update("minimum_level", level).Error
+			}
+
+			cleanup := func(_ string, _ models.User) error {
+				return db.Model(&equipment).Update("minimum_level", "unsupervised").Error
+			}
+
+			return setup, cleanup
+		}
+
+		setup, cleanup := minimumLevel("", "in_progress")
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(setup).
+			CleanupUser(cleanup).
+			Test("Access Denied In Progress Without Minimum Level", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "insufficient_level", 0),
+				)
+			})
+
+		setup, cleanup = minimumLevel("in_progress", "in_progress")
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(setup).
+			CleanupUser(cleanup).
+			Test("Access Granted In Progress When Allowed", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(true, "granted", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(cardholderState("")).
+			Test("Access Denied Without Training", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "missing_training", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(cardholderState("supervised")).
+			Test("Access Denied With Insufficient Level", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "insufficient_level", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(cardholderState("can_train", 10, 150)).
+			Test("Access Denied With Hold", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "hold", 1),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(cardholderState("can_train", 150)).
+			Test("Access Granted With Warning Hold", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(true, "granted", 1),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(checkCard).
+			SetupUser(func(_ string, user models.User) error {
+				if err := cardholderState("can_train")("", user); err != nil {
+					return err
+				}
+
+				return db.Model(&equipment).Updates(map[string]interface{}{"status": "maintenance", "status_reason": "Cleaning"}).Error
+			}).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Model(&equipment).Updates(map[string]interface{}{"status": "operational", "status_reason": ""}).Error
+			}).
+			Test("Access Denied Out Of Service", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "out_of_service", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"card_id":   "not-a-card",
+				"equipment": equipment.Name,
+			})).
+			Test("Access Denied With Unknown Card", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "unknown_user", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"card_id":   cardID,
+				"equipment": "not_equipment",
+			})).
+			Test("Access Check With Unknown Equipment", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusNotFound),
+				)
+			})
+
+		// Mint a checkin token the same way the checkin endpoint does
+		tokenData := make([]byte, 12)
+		binary.LittleEndian.PutUint32(tokenData, uint32(cardholder.ID))
+		binary.LittleEndian.PutUint64(tokenData[4:], uint64(time.Now().Add(2*time.Minute).Unix()))
+		mac := hmac.New(md5.New, hmacKey)
+		mac.Write(tokenData)
+		checkinToken := base64.URLEncoding.EncodeToString(mac.Sum(tokenData))
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"checkin_token": checkinToken,
+				"equipment":     equipment.Name,
+			})).
+			SetupUser(cardholderState("unsupervised")).
+			Test("Access Granted With Checkin Token", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(true, "granted", 0),
+				)
+			})
+
+		test.Endpoint("/api/access/check", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"checkin_token": "bm90LWEtdG9rZW4tYXQtYWxs",
+				"equipment":     equipment.Name,
+			})).
+			Test("Access Denied With Invalid Checkin Token", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					accessDecisionEQ(false, "invalid_token", 0),
+				)
+			})
+
+		purgeUser(db, cardholder)
+		db.Unscoped().Delete(&cardholder)
+		db.Unscoped().Delete(&equipment)
+	})
+
+	tester.Test("Webhook Endpoints", func(test *Tester) {
+		webhook := models.Webhook{
+			URL:    "http://localhost:3001/webhook",
+			Secret: "webhook-testing-secret",
+			Events: []string{"user.create"},
+			Active: false,
+		}
+
+		db.Create(&webhook)
+
+		restoreWebhook := func(_ string, _ models.User) error {
+			return db.Unscoped().Model(&webhook).Update("deleted_at", nil).Error
+		}
+
+		// webhookSecret checks whether the response reveals the signing secret
+		webhookSecret := func(revealed bool) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Webhook Secret Revealed %v", revealed),
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var response struct {
+						ID     uint   `json:"ID"`
+						Secret string `json:"secret"`
+					}
+
+					if err := json.Unmarshal(b, &response); err != nil {
+						t.Fatal(err)
+					}
+
+					if strings.Contains(string(b), "webhook-testing-secret") {
+						t.Fatal("Expected the stored secret to not be returned")
+					}
+
+					if !revealed {
+						if response.Secret != "" {
+							t.Fatalf("Expected the secret to be hidden, got %s", string(b))
+						}
+
+						return
+					}
+
+					var stored models.Webhook
+					db.First(&stored, response.ID)
+					if response.Secret == "" || stored.Secret != response.Secret {
+						t.Fatalf("Expected the new secret to be returned, got %s", string(b))
+					}
+				},
+			}
+		}
+
+		test.Endpoint("/api/webhooks", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"url":    "http://localhost:3001/webhook",
+				"events": []string{"user.create", "user.delete"},
+				"active": false,
+			})).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.Webhook{}, &models.Webhook{AddedBy: user.ID}).Error
+			}).
+			Test("Create Webhook", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:create"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						webhookSecret(true),
+					)
+			})
+
+		test.Endpoint("/api/webhooks", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"url":    "http://localhost:3001/webhook",
+				"events": []string{"user.explode"},
+			})).
+			Test("Create Webhook With Unknown Event", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/webhooks", fiber.MethodGet).
+			Test("List Webhooks", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/webhooks/%d", webhook.ID), fiber.MethodGet).
+			Test("Get Webhook", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:target", "leash.webhooks:get"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						webhookSecret(false),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/webhooks/%d", webhook.ID), fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"description": "Door controller",
+			})).
+			Test("Update Webhook", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:target", "leash.webhooks:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						webhookSecret(false),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/webhooks/%d/secret", webhook.ID), fiber.MethodPost).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Model(&webhook).Update("secret", "webhook-testing-secret").Error
+			}).
+			Test("Rotate Webhook Secret", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:target", "leash.webhooks:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						webhookSecret(true),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/webhooks/%d/deliveries", webhook.ID), fiber.MethodGet).
+			Test("List Webhook Deliveries", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:target", "leash.webhooks.deliveries:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(0),
+					)
+			})
+
+		test.Endpoint(fmt.Sprintf("/api/webhooks/%d", webhook.ID), fiber.MethodDelete).
+			SetupUser(restoreWebhook).
+			Test("Delete Webhook", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.webhooks:target", "leash.webhooks:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						defaultStatusResponse,
+					)
+			})
+
+		db.Unscoped().Delete(&webhook)
+
+		// Receive a delivery from a live webhook
+		received := make(chan *http.Request, 1)
+		receivedBody := make(chan []byte, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			received <- r
+			receivedBody <- body
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		liveWebhook := models.Webhook{
+			URL:    server.URL,
+			Secret: "webhook-testing-secret",
+			Events: []string{"user.create", "training.create"},
+			Active: true,
+		}
+
+		db.Create(&liveWebhook)
+
+		webhookDelivered := func(eventName string, check func(t *testing.T, body []byte)) ResponseTester {
+			return ResponseTester{
+				Name: fmt.Sprintf("Webhook Delivered %s", eventName),
+				Test: func(t *testing.T, _ string, _ int, _ []byte) {
+					select {
+					case r := <-received:
+						body := <-receivedBody
+
+						if r.Header.Get("X-Leash-Event") != eventName {
+							t.Fatalf("Expected event %v, got %v", eventName, r.Header.Get("X-Leash-Event"))
+						}
+
+						mac := hmac.New(sha256.New, []byte(liveWebhook.Secret))
+						mac.Write([]byte(r.Header.Get("X-Leash-Timestamp") + "."))
+						mac.Write(body)
+						expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+						if r.Header.Get("X-Leash-Signature") != expected {
+							t.Fatalf("Expected signature %v, got %v", expected, r.Header.Get("X-Leash-Signature"))
+						}
+
+						check(t, body)
+					case <-time.After(5 * time.Second):
+						t.Fatal("Webhook was not delivered")
+					}
+				},
+			}
+		}
+
+		test.Endpoint("/api/users", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":     "Webhook User",
+				"pronouns": "they/them",
+				"email":    "webhook@testing.mkr.cx",
+				"role":     "member",
+				"type":     "other",
+			})).
+			CleanupUser(func(_ string, _ models.User) error {
+				return db.Unscoped().Delete(&models.User{}, &models.User{Email: "webhook@testing.mkr.cx"}).Error
+			}).
+			Test("Webhook Delivery On User Create", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					webhookDelivered("user.create", func(t *testing.T, body []byte) {
+						var event struct {
+							Target models.User `json:"target"`
+						}
+
+						if err := json.Unmarshal(body, &event); err != nil {
+							t.Fatal(err)
+						}
+
+						if event.Target.Email != "webhook@testing.mkr.cx" {
+							t.Fatalf("Expected target webhook@testing.mkr.cx, got %v", event.Target.Email)
+						}
+					}),
+				)
+			})
+
+		test.Endpoint("/api/users/self/trainings", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":  "laser_cutter",
+				"level": "supervised",
+			})).
+			Test("Webhook Delivery On Training Create", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusOK),
+					webhookDelivered("training.create", func(t *testing.T, body []byte) {
+						var event struct {
+							Target models.Training `json:"target"`
+							Agent  models.User     `json:"agent"`
+							Time   int64           `json:"time"`
+						}
+
+						if err := json.Unmarshal(body, &event); err != nil {
+							t.Fatal(err)
+						}
+
+						if event.Target.Name != "laser_cutter" || event.Target.Level != "supervised" {
+							t.Fatalf("Expected laser_cutter supervised training, got %v %v", event.Target.Name, event.Target.Level)
+						}
+
+						if event.Agent.ID != event.Target.UserID || event.Time == 0 {
+							t.Fatalf("Expected agent %v and a timestamp, got %v at %v", event.Target.UserID, event.Agent.ID, event.Time)
+						}
+					}),
+				)
+			})
+
+		db.Unscoped().Delete(&models.WebhookDelivery{}, &models.WebhookDelivery{WebhookID: liveWebhook.ID})
+		db.Unscoped().Delete(&liveWebhook)
+	})
+
+	tester.Test("API Key Authentication", func(test *Tester) {
+		keyUser := models.User{
+			Name:  "API Key User",
+			Email: "apikey@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", keyUser.Email).Delete(&models.User{})
+		db.Create(&keyUser)
+		defer db.Unscoped().Where("email = ?", keyUser.Email).Delete(&models.User{})
+		defer db.Unscoped().Where("user_id = ?", keyUser.ID).Delete(&models.APIKey{})
+
+		authenticates := func(token string) bool {
+			_, err := leash_auth.AuthenticateHeader("API-Key "+token, db, keys, enforcer)
+			return err == nil
+		}
+
+		apiKey, err := leash_auth.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apiKey.UserID = keyUser.ID
+		db.Create(&apiKey)
+
+		test.t.Run("Prefixed Key", func(t *testing.T) {
+			if !authenticates(apiKey.Token) {
+				t.Fatal("Expected the generated key to authenticate")
+			}
+
+			var count int64
+			db.Model(&models.APIKey{}).Where("api_key = ? OR secret_hash = ?", apiKey.Token, apiKey.Token).Count(&count)
+			if count != 0 {
+				t.Fatal("Expected the secret to only be stored hashed")
+			}
+
+			if authenticates(apiKey.Key+".not-the-secret") || authenticates(apiKey.Key) {
+				t.Fatal("Expected a key with the wrong secret to be rejected")
+			}
+		})
+
+		test.t.Run("Expired Key", func(t *testing.T) {
+			expired := time.Now().Add(-time.Minute)
+			db.Model(&apiKey).Update("expires_at", expired)
+
+			if authenticates(apiKey.Token) {
+				t.Fatal("Expected an expired key to be rejected")
+			}
+		})
+
+		test.t.Run("Legacy Key", func(t *testing.T) {
+			legacyKey := uuid.New().String()
+			db.Create(&models.APIKey{
+				Key:        leash_auth.LegacyAPIKeyPrefix(legacyKey),
+				SecretHash: leash_auth.HashAPIKeySecret(legacyKey),
+				UserID:     keyUser.ID,
+			})
+
+			if !authenticates(legacyKey) {
+				t.Fatal("Expected a migrated legacy key to authenticate")
+			}
+		})
+
+		test.Endpoint("/api/users/self/apikeys", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"full_access": true,
+				"permissions": []string{},
+				"expires_at":  time.Now().Add(-time.Hour),
+			})).
+			Test("Create Expired Api Key", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+	})
+
+	tester.Test("API Key Restrictions", func(test *Tester) {
+		keyUser := models.User{
+			Name:  "Restricted Key User",
+			Email: "restricted-apikey@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", keyUser.Email).Delete(&models.User{})
+		db.Create(&keyUser)
+		defer db.Unscoped().Where("email = ?", keyUser.Email).Delete(&models.User{})
+		defer db.Unscoped().Where("user_id = ?", keyUser.ID).Delete(&models.APIKey{})
+
+		// request calls an endpoint with an api key, tests connect from 127.0.0.1
+		request := func(t *testing.T, apiKey models.APIKey) int {
+			agent := fiber.AcquireAgent()
+
+			req := agent.Request()
+			req.Header.SetMethod(fiber.MethodGet)
+			req.SetRequestURI("http://localhost:3000/api/users/self")
+			req.Header.Set("Authorization", "API-Key "+apiKey.Token)
+
+			if err := agent.Parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			status, _, errs := agent.Bytes()
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+
+			return status
+		}
+
+		rejections := func(apiKey models.APIKey, reason string) int64 {
+			var count int64
+			db.Model(&models.APIKeyRejection{}).Where(models.APIKeyRejection{Key: apiKey.Key, Reason: reason}).Count(&count)
+			return count
+		}
+
+		newKey := func(t *testing.T, cidrs []string, rateLimit int) models.APIKey {
+			apiKey, err := leash_auth.GenerateAPIKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			apiKey.UserID = keyUser.ID
+			apiKey.FullAccess = true
+			apiKey.AllowedCIDRs = cidrs
+			apiKey.RateLimit = rateLimit
+			db.Create(&apiKey)
+
+			t.Cleanup(func() {
+				db.Unscoped().Delete(&models.APIKeyRejection{}, &models.APIKeyRejection{Key: apiKey.Key})
+			})
+
+			return apiKey
+		}
+
+		test.t.Run("Allowed Network", func(t *testing.T) {
+			apiKey := newKey(t, []string{"10.0.0.0/8", "127.0.0.0/8"}, 0)
+
+			if status := request(t, apiKey); status != fiber.StatusOK {
+				t.Fatalf("Expected a request from an allowed network to succeed, got %d", status)
+			}
+		})
+
+		test.t.Run("Disallowed Network", func(t *testing.T) {
+			apiKey := newKey(t, []string{"203.0.113.0/24"}, 0)
+
+			for i := 0; i < 2; i++ {
+				if status := request(t, apiKey); status != fiber.StatusForbidden {
+					t.Fatalf("Expected a request from outside the allowlist to be forbidden, got %d", status)
+				}
+			}
+
+			if count := rejections(apiKey, leash_auth.APIKEY_REJECTION_IP); count != 1 {
+				t.Fatalf("Expected the repeated rejection to be recorded once, got %d", count)
+			}
+		})
+
+		test.t.Run("Rate Limit", func(t *testing.T) {
+			apiKey := newKey(t, nil, 2)
+
+			for i := 0; i < 2; i++ {
+				if status := request(t, apiKey); status != fiber.StatusOK {
+					t.Fatalf("Expected request %d to be within the rate limit, got %d", i+1, status)
+				}
+			}
+
+			if status := request(t, apiKey); status != fiber.StatusTooManyRequests {
+				t.Fatalf("Expected the request over the rate limit to be rejected, got %d", status)
+			}
+
+			if count := rejections(apiKey, leash_auth.APIKEY_REJECTION_RATE_LIMIT); count != 1 {
+				t.Fatalf("Expected the rate limit rejection to be recorded, got %d", count)
+			}
+		})
+	})
+
+	tester.Test("Rate Limiting", func(test *Tester) {
+		store := leash_auth.NewMemoryRateLimitStore()
+		leash_auth.SetRateLimits(store, leash_auth.RateLimits{
+			Buckets: map[string]leash_auth.RateLimit{
+				leash_auth.RATE_LIMIT_LOOKUPS: {Max: 2, Window: time.Minute},
+			},
+			Lockout: leash_auth.RateLimit{Max: 3, Window: time.Minute},
+		})
+		defer leash_auth.SetRateLimits(leash_auth.NewMemoryRateLimitStore(), leash_auth.RateLimits{})
+
+		limitedUser := models.User{
+			Name:  "Rate Limited User",
+			Email: "ratelimited@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", limitedUser.Email).Delete(&models.User{})
+		db.Create(&limitedUser)
+		defer db.Unscoped().Where("email = ?", limitedUser.Email).Delete(&models.User{})
+		defer db.Unscoped().Where("user_id = ?", limitedUser.ID).Delete(&models.APIKey{})
+
+		apiKey, err := leash_auth.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apiKey.UserID = limitedUser.ID
+		apiKey.FullAccess = true
+		db.Create(&apiKey)
+
+		// request calls an endpoint with an api key, returning the status and Retry-After header
+		request := func(t *testing.T, path string, token string) (int, string) {
+			agent := fiber.AcquireAgent()
+
+			req := agent.Request()
+			req.Header.SetMethod(fiber.MethodGet)
+			req.SetRequestURI("http://localhost:3000" + path)
+			req.Header.Set("Authorization", "API-Key "+token)
+
+			if err := agent.Parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := fiber.AcquireResponse()
+			defer fiber.ReleaseResponse(resp)
+			agent.SetResponse(resp)
+
+			status, _, errs := agent.Bytes()
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+
+			return status, string(resp.Header.Peek(fiber.HeaderRetryAfter))
+		}
+
+		test.t.Run("Lookups", func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				if status, _ := request(t, "/api/users/get/card/not-a-card", apiKey.Token); status == fiber.StatusTooManyRequests {
+					t.Fatalf("Expected lookup %d to be within the limit", i+1)
+				}
+			}
+
+			status, retryAfter := request(t, "/api/users/get/card/not-a-card", apiKey.Token)
+			if status != fiber.StatusTooManyRequests || retryAfter == "" {
+				t.Fatalf("Expected the lookup over the limit to be rejected with Retry-After, got %d %q", status, retryAfter)
+			}
+
+			// Other endpoints are counted separately
+			if status, _ := request(t, "/api/users/self", apiKey.Token); status != fiber.StatusOK {
+				t.Fatalf("Expected other endpoints to be unaffected, got %d", status)
+			}
+		})
+
+		test.t.Run("Lockout", func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				if status, _ := request(t, "/api/users/self", apiKey.Key+".not-the-secret"); status != fiber.StatusUnauthorized {
+					t.Fatalf("Expected attempt %d with the wrong secret to be unauthorized, got %d", i+1, status)
+				}
+			}
+
+			if status, _ := request(t, "/api/users/self", apiKey.Key+".not-the-secret"); status != fiber.StatusTooManyRequests {
+				t.Fatalf("Expected the locked out key to be rejected, got %d", status)
+			}
+
+			// The address the key was guessed from is locked out of it, even with the right secret
+			if status, _ := request(t, "/api/users/self", apiKey.Token); status != fiber.StatusTooManyRequests {
+				t.Fatalf("Expected the locked out address to be rejected with the right secret, got %d", status)
+			}
+
+			// Other keys used from the same address are not locked out
+			otherKey, err := leash_auth.GenerateAPIKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			otherKey.UserID = limitedUser.ID
+			otherKey.FullAccess = true
+			db.Create(&otherKey)
+
+			if status, _ := request(t, "/api/users/self", otherKey.Token); status != fiber.StatusOK {
+				t.Fatalf("Expected another key from the same address to not be locked out, got %d", status)
+			}
+
+			// Anyone can claim a key's prefix, so the key itself is not locked out and works from another address
+			for _, ip := range []string{"127.0.0.1", "::1"} {
+				store.Reset("lockout:ip:" + ip + ":apikey:" + apiKey.Key)
+			}
+
+			if status, _ := request(t, "/api/users/self", apiKey.Token); status != fiber.StatusOK {
+				t.Fatalf("Expected the key to not be locked out by failures from another address, got %d", status)
+			}
+		})
+
+		test.t.Run("Expired Credentials", func(t *testing.T) {
+			expiredKey, err := leash_auth.GenerateAPIKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expired := time.Now().Add(-time.Hour)
+			expiredKey.UserID = limitedUser.ID
+			expiredKey.ExpiresAt = &expired
+			db.Create(&expiredKey)
+
+			// Expired keys are not guesses, so using one never counts towards a lockout
+			for i := 0; i < 4; i++ {
+				if status, _ := request(t, "/api/users/self", expiredKey.Token); status != fiber.StatusUnauthorized {
+					t.Fatalf("Expected attempt %d with the expired key to be unauthorized, got %d", i+1, status)
+				}
+			}
+		})
+	})
+
+	tester.Test("Audit Log", func(test *Tester) {
+		auditor := models.User{
+			Name:  "Auditing Admin",
+			Email: "auditor@testing.mkr.cx",
+			Role:  "admin",
+			Type:  "other",
+		}
+
+		audited := models.User{
+			Name:  "Audited User",
+			Email: "audited@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		for _, user := range []*models.User{&auditor, &audited} {
+			db.Unscoped().Where("email = ?", user.Email).Delete(&models.User{})
+			db.Create(user)
+			defer db.Unscoped().Where("email = ?", user.Email).Delete(&models.User{})
+			defer db.Unscoped().Where("user_id = ?", user.ID).Delete(&models.APIKey{})
+		}
+
+		defer db.Unscoped().Where("actor_id = ?", auditor.ID).Delete(&models.AuditEvent{})
+
+		apiKey, err := leash_auth.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apiKey.UserID = auditor.ID
+		apiKey.FullAccess = true
+		db.Create(&apiKey)
+
+		// request calls an endpoint with the auditor's api key, returning the status and request ID
+		request := func(t *testing.T, method string, path string, body []byte) (int, string) {
+			agent := fiber.AcquireAgent()
+
+			req := agent.Request()
+			req.Header.SetMethod(method)
+			req.SetRequestURI("http://localhost:3000" + path)
+			req.Header.Set("Authorization", "API-Key "+apiKey.Token)
+			req.Header.SetContentType(fiber.MIMEApplicationJSON)
+			req.SetBody(body)
+
+			if err := agent.Parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := fiber.AcquireResponse()
+			defer fiber.ReleaseResponse(resp)
+			agent.SetResponse(resp)
+
+			status, _, errs := agent.Bytes()
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+
+			return status, string(resp.Header.Peek(fiber.HeaderXRequestID))
+		}
+
+		lastEvent := func(t *testing.T, requestID string) models.AuditEvent {
+			var event models.AuditEvent
+			if res := db.Limit(1).Where(&models.AuditEvent{RequestID: requestID}).Find(&event); res.Error != nil || res.RowsAffected == 0 {
+				t.Fatalf("Expected an audit event for request %s", requestID)
+			}
+
+			return event
+		}
+
+		test.t.Run("Records Updates", func(t *testing.T) {
+			status, requestID := request(t, fiber.MethodPatch, fmt.Sprintf("/api/users/%d", audited.ID), encode(map[string]interface{}{
+				"name": "Renamed User",
+			}))
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected the update to succeed, got %d", status)
+			}
+
+			event := lastEvent(t, requestID)
+			if event.ActorID != auditor.ID || event.AuthMethod != "apikey" || event.APIKey != apiKey.Key {
+				t.Fatalf("Expected the event to record the actor and api key, got %+v", event)
+			}
+
+			if event.Action != "PATCH /api/users/:user_id" || event.TargetType != "user" || event.TargetID != fmt.Sprint(audited.ID) {
+				t.Fatalf("Expected the event to record the action and target, got %+v", event)
+			}
+
+			if !strings.Contains(event.Before, "Audited User") || !strings.Contains(event.After, "Renamed User") || event.IP == "" {
+				t.Fatalf("Expected the event to record the change, got %+v", event)
+			}
+		})
+
+		test.t.Run("Records Creates Without Secrets", func(t *testing.T) {
+			status, requestID := request(t, fiber.MethodPost, fmt.Sprintf("/api/users/%d/apikeys", audited.ID), encode(map[string]interface{}{
+				"full_access": true,
+				"permissions": []string{},
+			}))
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected the api key to be created, got %d", status)
+			}
+
+			event := lastEvent(t, requestID)
+			if event.TargetType != "apikey" || event.TargetID == "" || event.Before != "" {
+				t.Fatalf("Expected the event to target the created api key, got %+v", event)
+			}
+
+			if strings.Contains(event.After, "Token") {
+				t.Fatal("Expected the api key to be recorded without its secret")
+			}
+		})
+
+		test.t.Run("Skips Reads", func(t *testing.T) {
+			_, requestID := request(t, fiber.MethodGet, fmt.Sprintf("/api/users/%d", audited.ID), nil)
+
+			var count int64
+			db.Model(&models.AuditEvent{}).Where(&models.AuditEvent{RequestID: requestID}).Count(&count)
+			if count != 0 {
+				t.Fatal("Expected reads not to be audited")
+			}
+		})
+
+		test.Endpoint("/api/audit", fiber.MethodGet).
+			WithQuery(QueryArgs{"actor_id": fmt.Sprint(auditor.ID), "target_type": "user"}).
+			Test("List Audit Events", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.audit:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+	})
+
+	tester.Test("Role Endpoints", func(test *Tester) {
+		deleteRole := func(_ string, _ models.User) error {
+			if _, err := enforcer.DeleteUser("leash:shop_tech"); err != nil {
+				return err
+			}
+
+			_, err := enforcer.DeleteRole("leash:shop_tech")
+			return err
+		}
+
+		createRole := func(name string, user models.User) error {
+			if err := deleteRole(name, user); err != nil {
+				return err
+			}
+
+			_, err := enforcer.AddPermissionForUser("leash:shop_tech", "leash.equipment:update")
+			return err
+		}
+
+		// roleResponse checks a role in the response
+		roleResponse := func(name string, check func(t *testing.T, role map[string]interface{})) ResponseTester {
+			return ResponseTester{
+				Name: "Role " + name,
+				Test: func(t *testing.T, _ string, _ int, b []byte) {
+					var role map[string]interface{}
+					if err := json.Unmarshal(b, &role); err != nil {
+						t.Fatal(err)
+					}
+
+					if role["Name"] != name {
+						t.Fatalf("Expected role %s, got %s", name, string(b))
+					}
+
+					check(t, role)
+				},
+			}
+		}
+
+		contains := func(role map[string]interface{}, field string, value string) bool {
+			values, _ := role[field].([]interface{})
+			for _, v := range values {
+				if v == value {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		test.Endpoint("/api/roles", fiber.MethodGet).
+			Test("List Roles", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(4),
+					)
+			})
+
+		test.Endpoint("/api/roles/staff", fiber.MethodGet).
+			Test("Get Role Hierarchy", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:target", "leash.roles:get"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						roleResponse("leash:staff", func(t *testing.T, role map[string]interface{}) {
+							if role["Default"] != true || !contains(role, "Inherits", "leash:volunteer") || !contains(role, "Members", "leash:admin") {
+								t.Fatalf("Expected staff to sit between volunteer and admin, got %v", role)
+							}
+
+							if !contains(role, "ImplicitRoles", "leash:member") || !contains(role, "ImplicitPermissions", "leash.users:target_self") {
+								t.Fatalf("Expected staff to inherit member, got %v", role)
+							}
+						}),
+					)
+			})
+
+		test.Endpoint("/api/roles", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":        "shop_tech",
+				"inherits":    []string{"member"},
+				"members":     []string{"role:staff"},
+				"permissions": []string{"leash.equipment:update"},
+			})).
+			SetupUser(deleteRole).
+			CleanupUser(deleteRole).
+			Test("Create Role", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:create"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						roleResponse("leash:shop_tech", func(t *testing.T, role map[string]interface{}) {
+							if role["Default"] != false || !contains(role, "Inherits", "leash:member") || !contains(role, "Members", "role:staff") {
+								t.Fatalf("Expected the custom role to be created, got %v", role)
+							}
+						}),
+					)
+			})
+
+		test.Endpoint("/api/roles", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":     "looping",
+				"inherits": []string{"member"},
+				"members":  []string{"leash:member"},
+			})).
+			Test("Create Role With Cycle", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/roles/shop_tech/permissions/leash.holds:list", fiber.MethodPut).
+			SetupUser(createRole).
+			CleanupUser(deleteRole).
+			Test("Add Role Permission", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:target", "leash.roles:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						roleResponse("leash:shop_tech", func(t *testing.T, role map[string]interface{}) {
+							if !contains(role, "Permissions", "leash.holds:list") || !contains(role, "Permissions", "leash.equipment:update") {
+								t.Fatalf("Expected the permission to be added, got %v", role)
+							}
+						}),
+					)
+			})
+
+		test.Endpoint("/api/roles/shop_tech/permissions/leash.equipment:update", fiber.MethodDelete).
+			SetupUser(func(name string, user models.User) error {
+				if err := createRole(name, user); err != nil {
+					return err
+				}
+
+				_, err := enforcer.AddRoleForUser("leash:shop_tech", "leash:member")
+				return err
+			}).
+			CleanupUser(deleteRole).
+			Test("Remove Role Permission", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:target", "leash.roles:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						roleResponse("leash:shop_tech", func(t *testing.T, role map[string]interface{}) {
+							if contains(role, "Permissions", "leash.equipment:update") {
+								t.Fatalf("Expected the permission to be removed, got %v", role)
+							}
+						}),
+					)
+			})
+
+		test.Endpoint("/api/roles/admin/members/leash:member", fiber.MethodPut).
+			Test("Add Role Member With Cycle", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/roles/shop_tech", fiber.MethodDelete).
+			SetupUser(createRole).
+			CleanupUser(deleteRole).
+			Test("Delete Role", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.roles:target", "leash.roles:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						defaultStatusResponse,
+					)
+			})
+
+		test.Endpoint("/api/roles/member", fiber.MethodDelete).
+			Test("Delete Default Role", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.t.Run("Seeding Keeps Changes", func(t *testing.T) {
+			enforcer.DeletePermissionForUser("leash:admin", "leash.audit:list")
+			defer enforcer.AddPermissionForUser("leash:admin", "leash.audit:list")
+
+			if err := leash_helpers.SetupCasbin(db, enforcer); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, _ := enforcer.Enforce("role:admin", "leash.audit:list"); ok {
+				t.Fatal("Expected a removed default permission to stay removed")
+			}
+
+			if ok, _ := enforcer.Enforce("role:admin", "leash.roles:list"); !ok {
+				t.Fatal("Expected the other defaults to be kept")
+			}
+		})
+	})
+
+	tester.Test("OAuth Client Endpoints", func(test *Tester) {
+		client := models.OAuthClient{
+			ClientID:     uuid.New().String(),
+			Name:         "Testing App",
+			RedirectURIs: []string{"http://localhost:3002/callback"},
+			Scopes:       []string{"openid"},
+			Confidential: true,
+		}
+
+		db.Create(&client)
+		defer db.Unscoped().Delete(&client)
+
+		restoreClient := func(_ string, _ models.User) error {
+			return db.Unscoped().Model(&client).Update("deleted_at", nil).Error
+		}
+
+		test.Endpoint("/api/oauth_clients", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":          "Created App",
+				"redirect_uris": []string{"http://localhost:3002/callback"},
+				"scopes":        []string{"openid", "email"},
+			})).
+			CleanupUser(func(_ string, user models.User) error {
+				return db.Unscoped().Delete(&models.OAuthClient{}, &models.OAuthClient{AddedBy: user.ID}).Error
+			}).
+			Test("Create OAuth Client", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.oauth_clients:create"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						ResponseTester{
+							Name: "Returns Secret Once",
+							Test: func(t *testing.T, _ string, _ int, b []byte) {
+								var created struct {
+									ClientID     string `json:"ClientID"`
+									ClientSecret string `json:"client_secret"`
+									SecretHash   string `json:"SecretHash"`
+								}
+
+								if err := json.Unmarshal(b, &created); err != nil {
+									t.Fatal(err)
+								}
+
+								if created.ClientID == "" || created.ClientSecret == "" || created.SecretHash != "" {
+									t.Fatalf("Expected a client ID and secret without the hash, got %s", string(b))
+								}
+
+								var stored models.OAuthClient
+								db.Where("client_id = ?", created.ClientID).First(&stored)
+								if stored.SecretHash != leash_auth.HashOAuthSecret(created.ClientSecret) {
+									t.Fatal("Expected the client secret to be stored hashed")
+								}
+							},
+						},
+					)
+			})
+
+		test.Endpoint("/api/oauth_clients", fiber.MethodPost).
+			WithBody(encode(map[string]interface{}{
+				"name":          "Created App",
+				"redirect_uris": []string{"http://localhost:3002/callback"},
+				"scopes":        []string{"everything"},
+			})).
+			Test("Create OAuth Client With Unknown Scope", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusBadRequest),
+				)
+			})
+
+		test.Endpoint("/api/oauth_clients", fiber.MethodGet).
+			Test("List OAuth Clients", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.oauth_clients:list"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						listLengthEQ(1),
+					)
+			})
+
+		test.Endpoint("/api/oauth_clients/"+client.ClientID, fiber.MethodGet).
+			Test("Get OAuth Client", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.oauth_clients:target", "leash.oauth_clients:get"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/oauth_clients/"+client.ClientID, fiber.MethodPatch).
+			WithBody(encode(map[string]interface{}{
+				"scopes": []string{"openid", "profile"},
+			})).
+			Test("Update OAuth Client", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.oauth_clients:target", "leash.oauth_clients:update"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+					)
+			})
+
+		test.Endpoint("/api/oauth_clients/"+client.ClientID, fiber.MethodDelete).
+			SetupUser(restoreClient).
+			Test("Delete OAuth Client", func(e *EndpointTester) {
+				e.RequiresPermissions([]string{"leash.oauth_clients:target", "leash.oauth_clients:delete"}).
+					MinimumRole(ROLE_ADMIN).
+					GivesResponse(
+						statusCode(fiber.StatusOK),
+						defaultStatusResponse,
+					)
+			})
+	})
+
+	tester.Test("OAuth Server", func(test *Tester) {
+		clientSecret := "oauth-testing-secret"
+		client := models.OAuthClient{
+			ClientID:     uuid.New().String(),
+			SecretHash:   leash_auth.HashOAuthSecret(clientSecret),
+			Name:         "Testing App",
+			RedirectURIs: []string{"http://localhost:3002/callback"},
+			Scopes:       []string{"openid", "email", "trainings"},
+			Confidential: true,
+		}
+
+		db.Create(&client)
+		defer db.Unscoped().Delete(&client)
+
+		oauthUser := models.User{
+			Name:  "OAuth User",
+			Email: "oauth@testing.mkr.cx",
+			Role:  "member",
+			Type:  "other",
+		}
+
+		db.Unscoped().Where("email = ?", oauthUser.Email).Delete(&models.User{})
+		db.Create(&oauthUser)
+		defer db.Unscoped().Where("email = ?", oauthUser.Email).Delete(&models.User{})
+
+		session := models.Session{
+			SessionID: uuid.New().String(),
+			UserID:    oauthUser.ID,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		db.Create(&session)
+		defer db.Unscoped().Delete(&session)
+		defer db.Unscoped().Where("user_id = ?", oauthUser.ID).Delete(&models.OAuthCode{})
+
+		tok, err := jwt.NewBuilder().
+			Issuer(leash_auth.ISSUER).
+			IssuedAt(time.Now()).
+			Expiration(time.Now().Add(time.Hour)).
+			Audience([]string{"leash", "session"}).
+			Claim("email", oauthUser.Email).
+			Claim("session", session.SessionID).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessionToken, err := keys.Sign(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// request calls an endpoint the way a browser or client app would, the tester only sends API keys
+		request := func(t *testing.T, method string, path string, auth string, contentType string, body []byte) (int, []byte) {
+			agent := fiber.AcquireAgent()
+
+			req := agent.Request()
+			req.Header.SetMethod(method)
+			req.SetRequestURI("http://localhost:3000" + path)
+			req.Header.Set("Authorization", auth)
+			req.Header.SetContentType(contentType)
+			req.SetBody(body)
+
+			if err := agent.Parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			status, b, errs := agent.Bytes()
+			if len(errs) != 0 {
+				t.Fatal(errs)
+			}
+
+			return status, b
+		}
+
+		verifier := "oauth-testing-code-verifier-that-is-long-enough-for-pkce"
+		sum := sha256.Sum256([]byte(verifier))
+
+		authorizeParams := map[string]interface{}{
+			"response_type":         "code",
+			"client_id":             client.ClientID,
+			"redirect_uri":          "http://localhost:3002/callback",
+			"scope":                 "openid email trainings",
+			"state":                 "testing-state",
+			"code_challenge":        base64.RawURLEncoding.EncodeToString(sum[:]),
+			"code_challenge_method": "S256",
+			"nonce":                 "testing-nonce",
+		}
+
+		authorizeQuery := func(overrides map[string]string) string {
+			q := url.Values{}
+			for key, value := range authorizeParams {
+				q.Set(key, value.(string))
+			}
+
+			for key, value := range overrides {
+				q.Set(key, value)
+			}
+
+			return q.Encode()
+		}
+
+		// consent approves or denies the authorization request and returns the redirect query
+		consent := func(t *testing.T, approve bool) url.Values {
+			body := map[string]interface{}{"approve": approve}
+			for key, value := range authorizeParams {
+				body[key] = value
+			}
+
+			status, b := request(t, fiber.MethodPost, "/oauth/consent", "Bearer "+string(sessionToken), fiber.MIMEApplicationJSON, encode(body))
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected consent to succeed, got %d %s", status, string(b))
+			}
+
+			var response struct {
+				RedirectTo string `json:"redirect_to"`
+			}
+
+			if err := json.Unmarshal(b, &response); err != nil {
+				t.Fatal(err)
+			}
+
+			redirect, err := url.Parse(response.RedirectTo)
+			if err != nil || !strings.HasPrefix(response.RedirectTo, "http://localhost:3002/callback?") {
+				t.Fatalf("Expected a redirect to the client, got %s", response.RedirectTo)
+			}
+
+			return redirect.Query()
+		}
+
+		exchange := func(t *testing.T, code string, codeVerifier string, secret string) (int, []byte) {
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {code},
+				"redirect_uri":  {"http://localhost:3002/callback"},
+				"code_verifier": {codeVerifier},
+			}
+
+			basic := base64.StdEncoding.EncodeToString([]byte(client.ClientID + ":" + secret))
+			return request(t, fiber.MethodPost, "/oauth/token", "Basic "+basic, fiber.MIMEApplicationForm, []byte(form.Encode()))
+		}
+
+		test.Endpoint("/.well-known/openid-configuration", fiber.MethodGet).
+			Test("OpenID Configuration", func(e *EndpointTester) {
+				e.GivesResponseNoAuth(
+					statusCode(fiber.StatusOK),
+					ResponseTester{
+						Name: "Discovery Document",
+						Test: func(t *testing.T, _ string, _ int, b []byte) {
+							var discovery struct {
+								Issuer        string `json:"issuer"`
+								TokenEndpoint string `json:"token_endpoint"`
+							}
+
+							if err := json.Unmarshal(b, &discovery); err != nil {
+								t.Fatal(err)
+							}
+
+							if discovery.Issuer != "http://localhost:3000" || discovery.TokenEndpoint != "http://localhost:3000/oauth/token" {
+								t.Fatalf("Unexpected discovery document %s", string(b))
+							}
+						},
+					},
+				)
+			})
+
+		test.Endpoint("/oauth/consent?"+authorizeQuery(nil), fiber.MethodGet).
+			Test("Consent Requires Session", func(e *EndpointTester) {
+				e.GivesResponse(
+					statusCode(fiber.StatusUnauthorized),
+				)
+			})
+
+		test.t.Run("Describe Consent", func(t *testing.T) {
+			status, b := request(t, fiber.MethodGet, "/oauth/consent?"+authorizeQuery(nil), "Bearer "+string(sessionToken), fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected status 200, got %d %s", status, string(b))
+			}
+
+			var described struct {
+				Client struct {
+					Name string `json:"name"`
+				} `json:"client"`
+				Scopes []leash_auth.OAuthScope `json:"scopes"`
+			}
+
+			if err := json.Unmarshal(b, &described); err != nil {
+				t.Fatal(err)
+			}
+
+			if described.Client.Name != client.Name || len(described.Scopes) != 3 || described.Scopes[2].Description == "" {
+				t.Fatalf("Unexpected consent description %s", string(b))
+			}
+		})
+
+		test.t.Run("Reject Invalid Authorization Requests", func(t *testing.T) {
+			for name, overrides := range map[string]map[string]string{
+				"Redirect URI":   {"redirect_uri": "http://localhost:3002/evil"},
+				"Scope":          {"scope": "openid holds"},
+				"Plain PKCE":     {"code_challenge_method": "plain"},
+				"Implicit Grant": {"response_type": "token"},
+			} {
+				status, _ := request(t, fiber.MethodGet, "/oauth/consent?"+authorizeQuery(overrides), "Bearer "+string(sessionToken), fiber.MIMEApplicationJSON, nil)
+				if status != fiber.StatusBadRequest {
+					t.Fatalf("Expected an invalid %s to be rejected, got %d", name, status)
+				}
+			}
+		})
+
+		test.t.Run("Deny Consent", func(t *testing.T) {
+			query := consent(t, false)
+			if query.Get("error") != "access_denied" || query.Get("code") != "" || query.Get("state") != "testing-state" {
+				t.Fatalf("Expected access_denied, got %v", query)
+			}
+		})
+
+		test.t.Run("Wrong Code Verifier", func(t *testing.T) {
+			code := consent(t, true).Get("code")
+
+			status, b := exchange(t, code, "not-the-verifier", clientSecret)
+			if status != fiber.StatusBadRequest || !strings.Contains(string(b), "invalid_grant") {
+				t.Fatalf("Expected invalid_grant, got %d %s", status, string(b))
+			}
+		})
+
+		test.t.Run("Wrong Client Secret", func(t *testing.T) {
+			code := consent(t, true).Get("code")
+
+			status, b := exchange(t, code, verifier, "not-the-secret")
+			if status != fiber.StatusUnauthorized || !strings.Contains(string(b), "invalid_client") {
+				t.Fatalf("Expected invalid_client, got %d %s", status, string(b))
+			}
+		})
+
+		var tokens struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+			Scope       string `json:"scope"`
+		}
+
+		test.t.Run("Exchange Code", func(t *testing.T) {
+			query := consent(t, true)
+			if query.Get("state") != "testing-state" {
+				t.Fatalf("Expected the state to be passed back, got %v", query)
+			}
+
+			status, b := exchange(t, query.Get("code"), verifier, clientSecret)
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected status 200, got %d %s", status, string(b))
+			}
+
+			if err := json.Unmarshal(b, &tokens); err != nil {
+				t.Fatal(err)
+			}
+
+			if tokens.Scope != "openid email trainings" {
+				t.Fatalf("Expected the requested scopes, got %s", tokens.Scope)
+			}
+
+			idToken, err := jwt.ParseString(tokens.IDToken, jwt.WithKeySet(keys.GetPublicKeys(), jws.WithInferAlgorithmFromKey(true)), jwt.WithIssuer("http://localhost:3000"), jwt.WithAudience(client.ClientID))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonce, _ := idToken.Get("nonce")
+			email, _ := idToken.Get("email")
+			if nonce != "testing-nonce" || email != oauthUser.Email || idToken.Subject() != fmt.Sprint(oauthUser.ID) {
+				t.Fatalf("Unexpected ID token claims %v", idToken.PrivateClaims())
+			}
+
+			status, b = exchange(t, query.Get("code"), verifier, clientSecret)
+			if status != fiber.StatusBadRequest {
+				t.Fatalf("Expected a reused code to be rejected, got %d %s", status, string(b))
+			}
+		})
+
+		test.t.Run("Introspect Token", func(t *testing.T) {
+			form := url.Values{
+				"token":         {tokens.AccessToken},
+				"client_id":     {client.ClientID},
+				"client_secret": {clientSecret},
+			}
+
+			status, b := request(t, fiber.MethodPost, "/oauth/introspect", "", fiber.MIMEApplicationForm, []byte(form.Encode()))
+			if status != fiber.StatusOK || !strings.Contains(string(b), `"active":true`) || !strings.Contains(string(b), oauthUser.Email) {
+				t.Fatalf("Expected an active token, got %d %s", status, string(b))
+			}
+
+			form.Set("token", string(sessionToken))
+			status, b = request(t, fiber.MethodPost, "/oauth/introspect", "", fiber.MIMEApplicationForm, []byte(form.Encode()))
+			if status != fiber.StatusOK || string(b) != `{"active":false}` {
+				t.Fatalf("Expected a session token to be inactive, got %d %s", status, string(b))
+			}
+		})
+
+		test.t.Run("User Info", func(t *testing.T) {
+			status, b := request(t, fiber.MethodGet, "/oauth/userinfo", "Bearer "+tokens.AccessToken, fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusOK || !strings.Contains(string(b), oauthUser.Email) || strings.Contains(string(b), oauthUser.Name) {
+				t.Fatalf("Expected the email claim without the profile claims, got %d %s", status, string(b))
+			}
+
+			status, _ = request(t, fiber.MethodGet, "/oauth/userinfo", "Bearer "+string(sessionToken), fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusUnauthorized {
+				t.Fatalf("Expected a session token to be rejected, got %d", status)
+			}
+		})
+
+		test.t.Run("Scoped API Access", func(t *testing.T) {
+			status, b := request(t, fiber.MethodGet, "/api/users/self/trainings", "Bearer "+tokens.AccessToken, fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("Expected the trainings scope to allow listing trainings, got %d %s", status, string(b))
+			}
+
+			status, _ = request(t, fiber.MethodGet, "/api/users/self/holds", "Bearer "+tokens.AccessToken, fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusUnauthorized {
+				t.Fatalf("Expected holds to be outside of the granted scopes, got %d", status)
+			}
+
+			status, _ = request(t, fiber.MethodGet, "/oauth/consent?"+authorizeQuery(nil), "Bearer "+tokens.AccessToken, fiber.MIMEApplicationJSON, nil)
+			if status != fiber.StatusUnauthorized {
+				t.Fatalf("Expected an OAuth token to be unable to approve clients, got %d", status)
+			}
+		})
+
+		test.t.Run("Deleting Client Revokes Tokens", func(t *testing.T) {
+			db.Delete(&client)
+
+			if _, err := leash_auth.AuthenticateHeader("Bearer "+tokens.AccessToken, db, keys, enforcer); err == nil {
+				t.Fatal("Expected the token of a deleted client to be rejected")
+			}
+		})
 	})
 }
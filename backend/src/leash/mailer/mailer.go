@@ -0,0 +1,133 @@
+package leash_mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format renders a message as an RFC 5322 email
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return []byte(b.String())
+}
+
+// validHeader rejects header values that could inject extra headers
+func validHeader(values ...string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid email header %q", value)
+		}
+	}
+
+	return nil
+}
+
+// SMTPMailer sends emails through an SMTP server, using STARTTLS when the server supports it
+type SMTPMailer struct {
+	// Host is the host and port of the SMTP server
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+var _ Mailer = (*SMTPMailer)(nil)
+
+func (m *SMTPMailer) Send(_ context.Context, msg Message) error {
+	if err := validHeader(m.From, msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Host)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// The envelope needs the bare addresses without display names
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Host, auth, from.Address, []string{to.Address}, format(m.From, msg))
+}
+
+// LogMailer writes emails to a writer instead of sending them, for development and tests
+type LogMailer struct {
+	From string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ Mailer = (*LogMailer)(nil)
+
+// NewLogMailer creates a mailer that writes every email to w
+func NewLogMailer(from string, w io.Writer) *LogMailer {
+	return &LogMailer{
+		From: from,
+		w:    w,
+	}
+}
+
+// NewFileMailer creates a mailer that appends every email to a file
+func NewFileMailer(from string, path string) (*LogMailer, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLogMailer(from, file), nil
+}
+
+func (m *LogMailer) Send(_ context.Context, msg Message) error {
+	if err := validHeader(m.From, msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.w.Write(append(format(m.From, msg), '\r', '\n'))
+	return err
+}
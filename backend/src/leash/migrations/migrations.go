@@ -0,0 +1,179 @@
+package leash_migrations
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records a migration that has been applied to the database
+type SchemaMigration struct {
+	Version   uint `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName sets the table name for applied migrations
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+// appliedMigrations returns the applied migrations keyed by version
+func appliedMigrations(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	applied := map[uint]SchemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// Status returns every known migration and whether it has been applied
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, migration := range migrations {
+		s := MigrationStatus{Migration: migration}
+		if row, ok := applied[migration.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = &row.AppliedAt
+		}
+
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+// Pending returns the migrations that have not been applied yet, in order
+func Pending(db *gorm.DB) ([]Migration, error) {
+	status, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, s := range status {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// CheckCurrent returns an error if the database has pending migrations or was migrated by a newer version
+func CheckCurrent(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	known := map[uint]bool{}
+	pending := 0
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		if _, ok := applied[migration.Version]; !ok {
+			pending++
+		}
+	}
+
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database has unknown migration %d applied, it was migrated by a newer version of leash", version)
+		}
+	}
+
+	if pending > 0 {
+		return fmt.Errorf("database has %d pending migrations, run `leash migrate up`", pending)
+	}
+
+	return nil
+}
+
+// Up applies every pending migration in order and returns the ones that were applied
+func Up(db *gorm.DB) ([]Migration, error) {
+	pending, err := Pending(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d %s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return pending, nil
+}
+
+// Down rolls back the most recently applied migrations and returns the ones that were rolled back
+func Down(db *gorm.DB, steps int) ([]Migration, error) {
+	status, err := Status(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rolledBack := []Migration{}
+	for i := len(status) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		migration := status[i].Migration
+		if !status[i].Applied {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+
+			return tx.Delete(&SchemaMigration{Version: migration.Version}).Error
+		})
+
+		if err != nil {
+			return rolledBack, fmt.Errorf("rolling back migration %d %s failed: %w", migration.Version, migration.Name, err)
+		}
+
+		rolledBack = append(rolledBack, migration)
+	}
+
+	return rolledBack, nil
+}
@@ -0,0 +1,366 @@
+package leash_migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The structs in this file are frozen copies of the models as each migration found them. Migrations must only
+// use these snapshots, never the live models, so a database at a given version always has the same schema.
+// Add a new snapshot for every schema change instead of editing an existing one.
+
+// Model is the fields every model shares, exported so gorm reads the embedded fields
+type Model struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// Version 1 initial_schema
+
+type userV1 struct {
+	Model
+	ID           uint    `gorm:"primarykey"`
+	Email        string  `gorm:"unique"`
+	PendingEmail *string `gorm:"unique"`
+	CardID       *string `gorm:"unique"`
+	Name         string
+	Pronouns     string
+	Role         string
+	Type         string
+
+	GraduationYear int
+	Major          string
+
+	Department string
+	JobTitle   string
+
+	Trainings     []trainingV1     `gorm:"foreignKey:UserID"`
+	Holds         []holdV1         `gorm:"foreignKey:UserID"`
+	APIKeys       []apiKeyV1       `gorm:"foreignKey:UserID"`
+	UserUpdates   []userUpdateV1   `gorm:"foreignKey:UserID"`
+	Notifications []notificationV1 `gorm:"foreignKey:UserID"`
+}
+
+func (userV1) TableName() string { return "users" }
+
+type apiKeyV1 struct {
+	Model
+	Key         string `gorm:"column:api_key;primaryKey;size:36"`
+	UserID      uint
+	Description string
+	FullAccess  bool
+}
+
+func (apiKeyV1) TableName() string { return "api_keys" }
+
+type trainingV1 struct {
+	Model
+	ID        uint `gorm:"primarykey"`
+	UserID    uint
+	Name      string
+	Level     string
+	AddedBy   uint
+	RemovedBy uint
+}
+
+func (trainingV1) TableName() string { return "trainings" }
+
+type holdV1 struct {
+	Model
+	ID             uint `gorm:"primarykey"`
+	UserID         uint
+	Name           string
+	Reason         string
+	Start          *time.Time
+	End            *time.Time
+	ResolutionLink string
+	AddedBy        uint
+	RemovedBy      uint
+	Priority       int
+}
+
+func (holdV1) TableName() string { return "holds" }
+
+type userUpdateV1 struct {
+	Model
+	ID       uint `gorm:"primarykey"`
+	UserID   uint
+	EditedBy uint
+	Field    string
+	NewValue string
+	OldValue string
+}
+
+func (userUpdateV1) TableName() string { return "user_updates" }
+
+type notificationV1 struct {
+	Model
+	ID        uint `gorm:"primarykey"`
+	UserID    uint
+	AddedBy   uint
+	RemovedBy uint
+	Title     string
+	Message   string
+	Link      string
+	Group     string
+}
+
+func (notificationV1) TableName() string { return "notifications" }
+
+type sessionV1 struct {
+	Model
+	SessionID string `gorm:"column:api_key;primaryKey"`
+	UserID    uint
+	ExpiresAt time.Time
+}
+
+func (sessionV1) TableName() string { return "sessions" }
+
+type feedV1 struct {
+	Model
+	ID       uint `gorm:"primarykey"`
+	Name     string
+	Messages []feedMessageV1 `gorm:"foreignKey:FeedId"`
+}
+
+func (feedV1) TableName() string { return "feeds" }
+
+type feedMessageV1 struct {
+	Model
+	ID                   uint `gorm:"primarykey"`
+	FeedId               uint
+	AddedBy              uint
+	LogLevel             uint
+	UserID               uint
+	Title                string
+	Message              string
+	PendingUserSpecifier string
+	PendingUserData      string
+}
+
+func (feedMessageV1) TableName() string { return "feed_messages" }
+
+// Version 2 webhooks
+
+type webhookV2 struct {
+	Model
+	ID          uint `gorm:"primarykey"`
+	URL         string
+	Secret      string
+	Description string
+	Events      []string `gorm:"serializer:json"`
+	Active      bool
+	AddedBy     uint
+}
+
+func (webhookV2) TableName() string { return "webhooks" }
+
+type webhookDeliveryV2 struct {
+	Model
+	ID         uint `gorm:"primarykey"`
+	WebhookID  uint `gorm:"index"`
+	DeliveryID string
+	Event      string
+	Payload    string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Success    bool
+}
+
+func (webhookDeliveryV2) TableName() string { return "webhook_deliveries" }
+
+// Version 3 training_catalog
+
+type trainingV3 struct {
+	ExpiresAt *time.Time
+}
+
+func (trainingV3) TableName() string { return "trainings" }
+
+type trainingDefinitionV3 struct {
+	Model
+	ID            uint   `gorm:"primarykey"`
+	Name          string `gorm:"index"`
+	Description   string
+	Prerequisites []string `gorm:"serializer:json"`
+	Levels        []string `gorm:"serializer:json"`
+	ValidFor      int64
+	AddedBy       uint
+}
+
+func (trainingDefinitionV3) TableName() string { return "training_definitions" }
+
+// Version 4 equipment
+
+type equipmentV4 struct {
+	Model
+	ID               uint   `gorm:"primarykey"`
+	Name             string `gorm:"index"`
+	Description      string
+	Location         string
+	RequiredTraining string
+	MinimumLevel     string
+	Status           string `gorm:"default:operational"`
+	StatusReason     string
+	StatusUpdatedBy  uint
+	AddedBy          uint
+}
+
+func (equipmentV4) TableName() string { return "equipment" }
+
+// Version 5 visits
+
+type visitV5 struct {
+	Model
+	ID           uint    `gorm:"primarykey"`
+	UserID       uint    `gorm:"index"`
+	User         *userV1 `gorm:"foreignKey:UserID"`
+	CheckIn      time.Time
+	CheckOut     *time.Time `gorm:"index"`
+	Method       string
+	AutoCheckout bool
+}
+
+func (visitV5) TableName() string { return "visits" }
+
+// Version 6 user_pending_approval
+
+type userV6 struct {
+	PendingApproval bool
+}
+
+func (userV6) TableName() string { return "users" }
+
+// Version 7 user_pending_email_expiry
+
+type userV7 struct {
+	PendingEmailExpiresAt *time.Time
+}
+
+func (userV7) TableName() string { return "users" }
+
+// Version 8 session_activity
+
+type sessionV8 struct {
+	LastUsedAt *time.Time
+	IP         string
+	UserAgent  string
+}
+
+func (sessionV8) TableName() string { return "sessions" }
+
+// Version 9 user_security_stamp
+
+type userV9 struct {
+	SecurityStamp string
+}
+
+func (userV9) TableName() string { return "users" }
+
+// Version 10 refresh_tokens
+
+type refreshTokenV10 struct {
+	Model
+	Hash      string `gorm:"primaryKey"`
+	SessionID string `gorm:"index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func (refreshTokenV10) TableName() string { return "refresh_tokens" }
+
+// Version 11 oauth_server
+
+type oauthClientV11 struct {
+	Model
+	ID           uint   `gorm:"primarykey"`
+	ClientID     string `gorm:"unique"`
+	SecretHash   string
+	Name         string
+	Description  string
+	RedirectURIs []string `gorm:"serializer:json"`
+	Scopes       []string `gorm:"serializer:json"`
+	Confidential bool
+	AddedBy      uint
+}
+
+func (oauthClientV11) TableName() string { return "o_auth_clients" }
+
+type oauthCodeV11 struct {
+	Model
+	Hash          string `gorm:"primaryKey"`
+	ClientID      string
+	UserID        uint
+	RedirectURI   string
+	Scopes        []string `gorm:"serializer:json"`
+	CodeChallenge string
+	Nonce         string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+func (oauthCodeV11) TableName() string { return "o_auth_codes" }
+
+// Version 12 hashed_api_keys
+
+type apiKeyV12 struct {
+	Key        string `gorm:"column:api_key;primaryKey;size:36"`
+	SecretHash string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+func (apiKeyV12) TableName() string { return "api_keys" }
+
+// Version 13 api_key_restrictions
+
+type apiKeyV13 struct {
+	AllowedCIDRs []string `gorm:"serializer:json"`
+	RateLimit    int
+}
+
+func (apiKeyV13) TableName() string { return "api_keys" }
+
+type apiKeyRejectionV13 struct {
+	Model
+	ID     uint   `gorm:"primarykey"`
+	Key    string `gorm:"column:api_key;index"`
+	IP     string
+	Reason string
+}
+
+func (apiKeyRejectionV13) TableName() string { return "api_key_rejections" }
+
+// Version 14 audit_events
+
+type auditEventV14 struct {
+	Model
+	ID         uint `gorm:"primarykey"`
+	ActorID    uint `gorm:"index"`
+	AuthMethod string
+	APIKey     string
+	Action     string `gorm:"index"`
+	TargetType string `gorm:"index:idx_audit_events_target"`
+	TargetID   string `gorm:"index:idx_audit_events_target"`
+	Before     string
+	After      string
+	Status     int
+	IP         string
+	RequestID  string `gorm:"index"`
+}
+
+func (auditEventV14) TableName() string { return "audit_events" }
+
+// Version 15 policy_seeds
+
+type policySeedV15 struct {
+	Model
+	Type    string `gorm:"primaryKey;size:8"`
+	Subject string `gorm:"primaryKey;size:191"`
+	Object  string `gorm:"primaryKey;size:191"`
+}
+
+func (policySeedV15) TableName() string { return "policy_seeds" }
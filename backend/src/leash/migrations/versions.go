@@ -0,0 +1,318 @@
+package leash_migrations
+
+import (
+	"slices"
+
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"gorm.io/gorm"
+)
+
+// migrations is the ordered list of schema migrations, append new migrations to the end and never reorder them.
+// Each migration only uses the snapshots of the models it introduced, see snapshots.go. Databases created before
+// versioned migrations existed were auto migrated at startup and may already have any of the tables and columns,
+// so migrations must stay safe to run against them.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(
+				&userV1{},
+				&apiKeyV1{},
+				&trainingV1{},
+				&userUpdateV1{},
+				&holdV1{},
+				&sessionV1{},
+				&notificationV1{},
+				&feedV1{},
+				&feedMessageV1{},
+			)
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(
+				&feedMessageV1{},
+				&feedV1{},
+				&notificationV1{},
+				&sessionV1{},
+				&holdV1{},
+				&userUpdateV1{},
+				&trainingV1{},
+				&apiKeyV1{},
+				&userV1{},
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "webhooks",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&webhookV2{}, &webhookDeliveryV2{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&webhookDeliveryV2{}, &webhookV2{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "training_catalog",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&trainingV3{}, "ExpiresAt") {
+				if err := tx.Migrator().AddColumn(&trainingV3{}, "ExpiresAt"); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.AutoMigrate(&trainingDefinitionV3{}); err != nil {
+				return err
+			}
+
+			// Trainings can only be granted from the catalog, so every training already given out gets a definition
+			var names []string
+			err := tx.Table("trainings").Where("name <> ''").Distinct("name").Order("name").Pluck("name", &names).Error
+			if err != nil {
+				return err
+			}
+
+			var defined []string
+			if err := tx.Model(&trainingDefinitionV3{}).Pluck("name", &defined).Error; err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if slices.Contains(defined, name) {
+					continue
+				}
+
+				definition := trainingDefinitionV3{
+					Name:          name,
+					Prerequisites: []string{},
+					Levels:        []string{},
+				}
+
+				if err := tx.Create(&definition).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&trainingDefinitionV3{}); err != nil {
+				return err
+			}
+
+			return tx.Migrator().DropColumn(&trainingV3{}, "ExpiresAt")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "equipment",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&equipmentV4{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&equipmentV4{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "visits",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&visitV5{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&visitV5{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "user_pending_approval",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&userV6{}, "PendingApproval") {
+				return nil
+			}
+
+			return tx.Migrator().AddColumn(&userV6{}, "PendingApproval")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&userV6{}, "PendingApproval")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "user_pending_email_expiry",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&userV7{}, "PendingEmailExpiresAt") {
+				return nil
+			}
+
+			return tx.Migrator().AddColumn(&userV7{}, "PendingEmailExpiresAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&userV7{}, "PendingEmailExpiresAt")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "session_activity",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"LastUsedAt", "IP", "UserAgent"} {
+				if tx.Migrator().HasColumn(&sessionV8{}, column) {
+					continue
+				}
+
+				if err := tx.Migrator().AddColumn(&sessionV8{}, column); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"LastUsedAt", "IP", "UserAgent"} {
+				if err := tx.Migrator().DropColumn(&sessionV8{}, column); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version: 9,
+		Name:    "user_security_stamp",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&userV9{}, "SecurityStamp") {
+				return nil
+			}
+
+			return tx.Migrator().AddColumn(&userV9{}, "SecurityStamp")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&userV9{}, "SecurityStamp")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "refresh_tokens",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&refreshTokenV10{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&refreshTokenV10{})
+		},
+	},
+	{
+		Version: 11,
+		Name:    "oauth_server",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&oauthClientV11{}, &oauthCodeV11{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&oauthCodeV11{}, &oauthClientV11{})
+		},
+	},
+	{
+		Version: 12,
+		Name:    "hashed_api_keys",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"SecretHash", "ExpiresAt", "LastUsedAt"} {
+				if tx.Migrator().HasColumn(&apiKeyV12{}, column) {
+					continue
+				}
+
+				if err := tx.Migrator().AddColumn(&apiKeyV12{}, column); err != nil {
+					return err
+				}
+			}
+
+			// Existing keys are bare UUIDs, they are given a prefix derived from the UUID so they keep working
+			var keys []string
+			err := tx.Session(&gorm.Session{SkipHooks: true}).Unscoped().
+				Model(&apiKeyV12{}).
+				Where("secret_hash IS NULL OR secret_hash = ''").
+				Pluck("api_key", &keys).Error
+			if err != nil {
+				return err
+			}
+
+			hasPolicies := tx.Migrator().HasTable("casbin_rule")
+			for _, key := range keys {
+				prefix := leash_auth.LegacyAPIKeyPrefix(key)
+
+				err := tx.Unscoped().Model(&apiKeyV12{}).Where("api_key = ?", key).Updates(map[string]interface{}{
+					"api_key":     prefix,
+					"secret_hash": leash_auth.HashAPIKeySecret(key),
+				}).Error
+				if err != nil {
+					return err
+				}
+
+				// Permissions are stored against the key, so they move with it
+				if hasPolicies {
+					if err := tx.Table("casbin_rule").Where("v0 = ?", "apikey:"+key).Update("v0", "apikey:"+prefix).Error; err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// The UUIDs can not be recovered from their hashes, keys issued before rolling back stop working
+			for _, column := range []string{"SecretHash", "ExpiresAt", "LastUsedAt"} {
+				if err := tx.Migrator().DropColumn(&apiKeyV12{}, column); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version: 13,
+		Name:    "api_key_restrictions",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []string{"AllowedCIDRs", "RateLimit"} {
+				if tx.Migrator().HasColumn(&apiKeyV13{}, column) {
+					continue
+				}
+
+				if err := tx.Migrator().AddColumn(&apiKeyV13{}, column); err != nil {
+					return err
+				}
+			}
+
+			return tx.AutoMigrate(&apiKeyRejectionV13{})
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range []string{"AllowedCIDRs", "RateLimit"} {
+				if err := tx.Migrator().DropColumn(&apiKeyV13{}, column); err != nil {
+					return err
+				}
+			}
+
+			return tx.Migrator().DropTable(&apiKeyRejectionV13{})
+		},
+	},
+	{
+		Version: 14,
+		Name:    "audit_events",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&auditEventV14{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&auditEventV14{})
+		},
+	},
+	{
+		Version: 15,
+		Name:    "policy_seeds",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&policySeedV15{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&policySeedV15{})
+		},
+	},
+}
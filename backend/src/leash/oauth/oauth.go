@@ -0,0 +1,537 @@
+package leash_oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// codeExpiration is how long an authorization code can be exchanged for tokens
+	codeExpiration = 5 * time.Minute
+
+	// tokenExpiration is how long an access token issued to a client is valid, there are no refresh tokens
+	tokenExpiration = time.Hour
+)
+
+// issuerURL is the public URL of the server, used as the OpenID Connect issuer
+var issuerURL = ""
+
+// consentURL is the frontend page users approve clients on, the authorize endpoint is disabled without it
+var consentURL = ""
+
+// SetOAuthServer sets the public URL of the server and the frontend consent page
+func SetOAuthServer(issuer string, consent string) {
+	issuerURL = strings.TrimSuffix(issuer, "/")
+	consentURL = consent
+}
+
+// oauthError responds with an error in the format of RFC 6749
+func oauthError(c *fiber.Ctx, status int, code string, description string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// authorizeRequest is an authorization request, as sent by the client to /oauth/authorize
+type authorizeRequest struct {
+	ResponseType        string `query:"response_type" json:"response_type" xml:"response_type" form:"response_type" validate:"required"`
+	ClientID            string `query:"client_id" json:"client_id" xml:"client_id" form:"client_id" validate:"required"`
+	RedirectURI         string `query:"redirect_uri" json:"redirect_uri" xml:"redirect_uri" form:"redirect_uri" validate:"required"`
+	Scope               string `query:"scope" json:"scope" xml:"scope" form:"scope" validate:"required"`
+	State               string `query:"state" json:"state" xml:"state" form:"state"`
+	CodeChallenge       string `query:"code_challenge" json:"code_challenge" xml:"code_challenge" form:"code_challenge" validate:"required"`
+	CodeChallengeMethod string `query:"code_challenge_method" json:"code_challenge_method" xml:"code_challenge_method" form:"code_challenge_method" validate:"required"`
+	Nonce               string `query:"nonce" json:"nonce" xml:"nonce" form:"nonce"`
+}
+
+// validateAuthorizeRequest checks an authorization request against the registered client and returns the requested scopes
+func validateAuthorizeRequest(db *gorm.DB, req authorizeRequest) (models.OAuthClient, []string, error) {
+	var client models.OAuthClient
+	if res := db.Limit(1).Where("client_id = ?", req.ClientID).Find(&client); res.Error != nil || res.RowsAffected == 0 {
+		return client, nil, fiber.NewError(fiber.StatusBadRequest, "Unknown client")
+	}
+
+	// Redirect URIs must match exactly, there is no prefix matching
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return client, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid redirect URI")
+	}
+
+	if req.ResponseType != "code" {
+		return client, nil, fiber.NewError(fiber.StatusBadRequest, "Unsupported response type")
+	}
+
+	if req.CodeChallengeMethod != "S256" {
+		return client, nil, fiber.NewError(fiber.StatusBadRequest, "PKCE with the S256 method is required")
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		return client, nil, fiber.NewError(fiber.StatusBadRequest, "No scope requested")
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return client, nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid scope: %s", scope))
+		}
+	}
+
+	return client, scopes, nil
+}
+
+// redirectWith returns the redirect URI with the parameters added to its query
+func redirectWith(redirectURI string, params map[string]string) (string, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	for key, value := range params {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// authenticateClient authenticates a client with HTTP Basic auth or the client_id and client_secret form parameters
+func authenticateClient(c *fiber.Ctx, db *gorm.DB, clientID string, clientSecret string) (models.OAuthClient, bool) {
+	if id, secret, ok := basicAuth(c.Get(fiber.HeaderAuthorization)); ok {
+		clientID = id
+		clientSecret = secret
+	}
+
+	var client models.OAuthClient
+	if res := db.Limit(1).Where("client_id = ?", clientID).Find(&client); res.Error != nil || res.RowsAffected == 0 {
+		return client, false
+	}
+
+	// Public clients have no secret, PKCE proves they started the request
+	if !client.Confidential {
+		return client, clientSecret == ""
+	}
+
+	hash := leash_auth.HashOAuthSecret(clientSecret)
+	return client, clientSecret != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash)) == 1
+}
+
+// basicAuth parses the client credentials from a Basic authorization header
+func basicAuth(authorization string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(authorization, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+
+	id, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+
+	// Client credentials are form encoded before being put in the header
+	if unescaped, err := url.QueryUnescape(id); err == nil {
+		id = unescaped
+	}
+
+	if unescaped, err := url.QueryUnescape(secret); err == nil {
+		secret = unescaped
+	}
+
+	return id, secret, true
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge it was created with
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// userClaims returns the OpenID Connect claims about the user the scopes allow
+func userClaims(user models.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": strconv.FormatUint(uint64(user.ID), 10),
+	}
+
+	if slices.Contains(scopes, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = true
+	}
+
+	if slices.Contains(scopes, "profile") {
+		claims["name"] = user.Name
+		claims["pronouns"] = user.Pronouns
+	}
+
+	return claims
+}
+
+// createAccessToken signs an access token that lets the client act as the user within the scopes
+func createAccessToken(keys *leash_auth.Keys, user models.User, clientID string, scopes []string) (jwt.Token, string, error) {
+	tok, err := jwt.NewBuilder().
+		Issuer(leash_auth.ISSUER).
+		Subject(strconv.FormatUint(uint64(user.ID), 10)).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(tokenExpiration)).
+		Audience([]string{"leash", leash_auth.OAUTH_AUDIENCE}).
+		Claim("client_id", clientID).
+		Claim("scope", strings.Join(scopes, " ")).
+		Claim("stamp", user.SecurityStamp).
+		Build()
+	if err != nil {
+		return nil, "", err
+	}
+
+	signed, err := keys.Sign(tok)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tok, string(signed), nil
+}
+
+// createIDToken signs an OpenID Connect ID token for the client
+func createIDToken(keys *leash_auth.Keys, user models.User, code models.OAuthCode) (string, error) {
+	builder := jwt.NewBuilder().
+		Issuer(issuerURL).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(tokenExpiration)).
+		Audience([]string{code.ClientID})
+
+	for name, value := range userClaims(user, code.Scopes) {
+		builder = builder.Claim(name, value)
+	}
+
+	if code.Nonce != "" {
+		builder = builder.Claim("nonce", code.Nonce)
+	}
+
+	tok, err := builder.Build()
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := keys.Sign(tok)
+	if err != nil {
+		return "", err
+	}
+
+	return string(signed), nil
+}
+
+// RegisterDiscoveryEndpoint registers the OpenID Connect discovery document
+func RegisterDiscoveryEndpoint(app fiber.Router) {
+	app.Get("/.well-known/openid-configuration", func(c *fiber.Ctx) error {
+		scopes := make([]string, len(leash_auth.OAUTH_SCOPES))
+		for i, scope := range leash_auth.OAUTH_SCOPES {
+			scopes[i] = scope.Name
+		}
+
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+		return c.JSON(fiber.Map{
+			"issuer":                                issuerURL,
+			"authorization_endpoint":                issuerURL + "/oauth/authorize",
+			"token_endpoint":                        issuerURL + "/oauth/token",
+			"introspection_endpoint":                issuerURL + "/oauth/introspect",
+			"userinfo_endpoint":                     issuerURL + "/oauth/userinfo",
+			"jwks_uri":                              issuerURL + "/.well-known/jwks.json",
+			"scopes_supported":                      scopes,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		})
+	})
+}
+
+// RegisterOAuthEndpoints registers the OAuth2 authorization server endpoints
+func RegisterOAuthEndpoints(oauth_ep fiber.Router) {
+	// Authorization endpoint, the user approves the request on the frontend consent page
+	oauth_ep.Get("/authorize", func(c *fiber.Ctx) error {
+		if consentURL == "" {
+			return fiber.NewError(fiber.StatusNotFound, "The OAuth server is not enabled")
+		}
+
+		return c.Redirect(consentURL + "?" + string(c.Request().URI().QueryString()))
+	})
+
+	registerConsentEndpoints(oauth_ep)
+	registerTokenEndpoints(oauth_ep)
+}
+
+// registerConsentEndpoints registers the endpoints the frontend consent page uses
+func registerConsentEndpoints(oauth_ep fiber.Router) {
+	consent_ep := oauth_ep.Group("/consent", leash_auth.AuthenticationMiddleware, func(c *fiber.Ctx) error {
+		authentication := leash_auth.GetAuthentication(c)
+
+		// Only a user signed in to Leash itself can approve a client
+		if !authentication.IsUser() {
+			return fiber.NewError(fiber.StatusUnauthorized, "You must be signed in to approve an application")
+		}
+
+		if authentication.Authorize("leash.oauth:authorize") != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "You are not authorized to approve applications")
+		}
+
+		return c.Next()
+	})
+
+	// Endpoint to describe an authorization request to the user
+	consent_ep.Get("/", models.GetQueryMiddleware[authorizeRequest], func(c *fiber.Ctx) error {
+		req := c.Locals("query").(authorizeRequest)
+
+		client, requested, err := validateAuthorizeRequest(leash_auth.GetDB(c), req)
+		if err != nil {
+			return err
+		}
+
+		scopes := make([]leash_auth.OAuthScope, len(requested))
+		for i, name := range requested {
+			scopes[i], _ = leash_auth.GetOAuthScope(name)
+		}
+
+		return c.JSON(fiber.Map{
+			"client": fiber.Map{
+				"client_id":   client.ClientID,
+				"name":        client.Name,
+				"description": client.Description,
+			},
+			"scopes":       scopes,
+			"redirect_uri": req.RedirectURI,
+		})
+	})
+
+	// Endpoint to approve or deny an authorization request, returns where to send the user
+	type consentRequest struct {
+		authorizeRequest
+		Approve bool `json:"approve" xml:"approve" form:"approve"`
+	}
+	consent_ep.Post("/", models.GetBodyMiddleware[consentRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		user := leash_auth.GetAuthentication(c).User
+		req := c.Locals("body").(consentRequest)
+
+		_, scopes, err := validateAuthorizeRequest(db, req.authorizeRequest)
+		if err != nil {
+			return err
+		}
+
+		params := map[string]string{
+			"state": req.State,
+		}
+
+		if req.Approve {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				log.Error("Failed to generate OAuth code: %s\n", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			code := base64.RawURLEncoding.EncodeToString(b)
+
+			res := db.Create(&models.OAuthCode{
+				Hash:          leash_auth.HashOAuthSecret(code),
+				ClientID:      req.ClientID,
+				UserID:        user.ID,
+				RedirectURI:   req.RedirectURI,
+				Scopes:        scopes,
+				CodeChallenge: req.CodeChallenge,
+				Nonce:         req.Nonce,
+				ExpiresAt:     time.Now().Add(codeExpiration),
+			})
+			if res.Error != nil {
+				log.Error("Failed to create OAuth code: %s\n", res.Error)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			params["code"] = code
+		} else {
+			params["error"] = "access_denied"
+		}
+
+		redirect, err := redirectWith(req.RedirectURI, params)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid redirect URI")
+		}
+
+		return c.JSON(fiber.Map{
+			"redirect_to": redirect,
+		})
+	})
+}
+
+// registerTokenEndpoints registers the endpoints clients call directly
+func registerTokenEndpoints(oauth_ep fiber.Router) {
+	// Token endpoint, exchanges an authorization code for tokens
+	type tokenRequest struct {
+		GrantType    string `json:"grant_type" xml:"grant_type" form:"grant_type"`
+		Code         string `json:"code" xml:"code" form:"code"`
+		RedirectURI  string `json:"redirect_uri" xml:"redirect_uri" form:"redirect_uri"`
+		CodeVerifier string `json:"code_verifier" xml:"code_verifier" form:"code_verifier"`
+		ClientID     string `json:"client_id" xml:"client_id" form:"client_id"`
+		ClientSecret string `json:"client_secret" xml:"client_secret" form:"client_secret"`
+	}
+	oauth_ep.Post("/token", func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		keys := leash_auth.GetKeys(c)
+
+		c.Set(fiber.HeaderCacheControl, "no-store")
+
+		var req tokenRequest
+		if err := c.BodyParser(&req); err != nil {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_request", "Invalid request body")
+		}
+
+		client, ok := authenticateClient(c, db, req.ClientID, req.ClientSecret)
+		if !ok {
+			return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		}
+
+		if req.GrantType != "authorization_code" {
+			return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported")
+		}
+
+		var code models.OAuthCode
+		if res := db.Limit(1).Where("hash = ?", leash_auth.HashOAuthSecret(req.Code)).Find(&code); res.Error != nil || res.RowsAffected == 0 {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		}
+
+		// Codes can only be used once
+		res := db.Model(&models.OAuthCode{}).Where("hash = ? AND used_at IS NULL", code.Hash).Update("used_at", time.Now())
+		if res.Error != nil {
+			log.Error("Failed to use OAuth code: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if res.RowsAffected == 0 {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Authorization code already used")
+		}
+
+		if code.ExpiresAt.Before(time.Now()) || code.ClientID != client.ClientID || code.RedirectURI != req.RedirectURI {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		}
+
+		if !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Invalid code verifier")
+		}
+
+		var user models.User
+		if res := db.Limit(1).Where("id = ?", code.UserID).Find(&user); res.Error != nil || res.RowsAffected == 0 {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		}
+
+		// Users who can no longer sign in to Leash can not sign in to other apps either
+		if leash_auth.SignInAuthentication(user, c).Authorize("leash:login") != nil {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "User can not sign in")
+		}
+
+		tok, accessToken, err := createAccessToken(keys, user, client.ClientID, code.Scopes)
+		if err != nil {
+			log.Error("Failed to create OAuth access token: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		response := fiber.Map{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   int(time.Until(tok.Expiration()).Seconds()),
+			"scope":        strings.Join(code.Scopes, " "),
+		}
+
+		if slices.Contains(code.Scopes, "openid") {
+			idToken, err := createIDToken(keys, user, code)
+			if err != nil {
+				log.Error("Failed to create OAuth ID token: %s\n", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+
+			response["id_token"] = idToken
+		}
+
+		return c.JSON(response)
+	})
+
+	// Introspection endpoint, lets confidential clients check whether an access token is still active
+	type introspectRequest struct {
+		Token        string `json:"token" xml:"token" form:"token"`
+		ClientID     string `json:"client_id" xml:"client_id" form:"client_id"`
+		ClientSecret string `json:"client_secret" xml:"client_secret" form:"client_secret"`
+	}
+	oauth_ep.Post("/introspect", func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		keys := leash_auth.GetKeys(c)
+
+		var req introspectRequest
+		if err := c.BodyParser(&req); err != nil {
+			return oauthError(c, fiber.StatusBadRequest, "invalid_request", "Invalid request body")
+		}
+
+		client, ok := authenticateClient(c, db, req.ClientID, req.ClientSecret)
+		if !ok || !client.Confidential {
+			return oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		}
+
+		inactive := fiber.Map{"active": false}
+		if !leash_auth.IsOAuthToken(req.Token) {
+			return c.JSON(inactive)
+		}
+
+		user, grant, err := leash_auth.ParseOAuthToken(db, keys, req.Token)
+		if err != nil {
+			return c.JSON(inactive)
+		}
+
+		// The token has already been verified, this only reads the timestamps
+		tok, err := jwt.ParseInsecure([]byte(req.Token))
+		if err != nil {
+			return c.JSON(inactive)
+		}
+
+		return c.JSON(fiber.Map{
+			"active":     true,
+			"scope":      strings.Join(grant.Scopes, " "),
+			"client_id":  grant.ClientID,
+			"sub":        tok.Subject(),
+			"username":   user.Email,
+			"token_type": "Bearer",
+			"exp":        tok.Expiration().Unix(),
+			"iat":        tok.IssuedAt().Unix(),
+		})
+	})
+
+	// UserInfo endpoint, returns the claims about the user the access token allows
+	oauth_ep.Get("/userinfo", leash_auth.AuthenticationMiddleware, func(c *fiber.Ctx) error {
+		authentication := leash_auth.GetAuthentication(c)
+
+		if !authentication.IsOAuth() || !authentication.Data.(leash_auth.OAuthGrant).HasScope("openid") {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		return c.JSON(userClaims(authentication.User, authentication.Data.(leash_auth.OAuthGrant).Scopes))
+	})
+}
@@ -0,0 +1,158 @@
+package leash_signin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+)
+
+const (
+	REGISTRATION_DISABLED = "disabled"
+	REGISTRATION_OPEN     = "open"
+	REGISTRATION_APPROVAL = "approval"
+)
+
+const registrationTokenExpiration = 30 * time.Minute
+
+var registrationMode = REGISTRATION_DISABLED
+
+// SetRegistrationMode sets whether unknown users can register themselves and if staff need to approve them
+func SetRegistrationMode(mode string) error {
+	switch mode {
+	case REGISTRATION_DISABLED, REGISTRATION_OPEN, REGISTRATION_APPROVAL:
+		registrationMode = mode
+		return nil
+	default:
+		return fmt.Errorf("invalid registration mode %q", mode)
+	}
+}
+
+// createRegistrationToken creates a token that lets an authenticated email register an account
+func createRegistrationToken(keys *leash_auth.Keys, email string) (string, time.Time, error) {
+	tok, err := jwt.NewBuilder().
+		Issuer(leash_auth.ISSUER).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(registrationTokenExpiration)).
+		Audience([]string{"leash", "registration"}).
+		Claim("email", email).
+		Build()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed, err := keys.Sign(tok)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(signed), tok.Expiration(), nil
+}
+
+// registerRegistrationEndpoint registers the endpoint for users to create their own account
+func registerRegistrationEndpoint(auth_ep fiber.Router) {
+	type registrationRequest struct {
+		Token    string `json:"token" xml:"token" form:"token" validate:"required"`
+		Name     string `json:"name" xml:"name" form:"name" validate:"required"`
+		Pronouns string `json:"pronouns" xml:"pronouns" form:"pronouns" validate:"required"`
+		Type     string `json:"type" xml:"type" form:"type" validate:"required,oneof=undergrad grad employee alumni program other"`
+
+		// Student-like fields
+		GraduationYear int    `json:"graduation_year" xml:"graduation_year" form:"graduation_year" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program,numeric"`
+		Major          string `json:"major" xml:"major" form:"major" validate:"required_if=Type undergrad,required_if=Type grad,required_if=Type alumni,required_if=Type program"`
+
+		// Employee-like fields
+		Department string `json:"department" xml:"department" form:"department" validate:"required_if=Type employee"`
+		JobTitle   string `json:"job_title" xml:"job_title" form:"job_title" validate:"required_if=Type employee"`
+	}
+
+	type registrationResponse struct {
+		User             models.User `json:"user"`
+		Token            string      `json:"token,omitempty"`
+		ExpiresAt        *time.Time  `json:"expires_at,omitempty"`
+		RefreshToken     string      `json:"refresh_token,omitempty"`
+		RefreshExpiresAt *time.Time  `json:"refresh_expires_at,omitempty"`
+	}
+
+	auth_ep.Post("/register", models.GetBodyMiddleware[registrationRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		keys := leash_auth.GetKeys(c)
+		req := c.Locals("body").(registrationRequest)
+
+		if registrationMode == REGISTRATION_DISABLED {
+			return fiber.NewError(fiber.StatusForbidden, "Registration is disabled")
+		}
+
+		// Parse the registration token
+		tok, err := keys.Parse(req.Token, []string{"leash", "registration"})
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid registration token")
+		}
+
+		val, valid := tok.Get("email")
+		if !valid {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid registration token")
+		}
+
+		email, ok := val.(string)
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid registration token")
+		}
+
+		// Self-registered users are always members
+		user, err := leash_api.RegisterUser(c, models.User{
+			Email:           email,
+			Name:            req.Name,
+			Pronouns:        req.Pronouns,
+			Role:            "member",
+			Type:            req.Type,
+			PendingApproval: registrationMode == REGISTRATION_APPROVAL,
+			GraduationYear:  req.GraduationYear,
+			Major:           req.Major,
+			Department:      req.Department,
+			JobTitle:        req.JobTitle,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Approval is needed before the user can sign in
+		if user.PendingApproval {
+			return c.Status(fiber.StatusAccepted).JSON(registrationResponse{
+				User: user,
+			})
+		}
+
+		// Check if user has permission to login
+		if leash_auth.SignInAuthentication(user, c).Authorize("leash:login") != nil {
+			return c.Status(fiber.StatusCreated).JSON(registrationResponse{
+				User: user,
+			})
+		}
+
+		session, err := createSession(c, user)
+		if err != nil {
+			log.Error("Failed to create session: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		tokens, err := issueSessionTokens(db, keys, user, session)
+		if err != nil {
+			log.Error("Failed to issue session tokens: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(registrationResponse{
+			User:             user,
+			Token:            tokens.Token,
+			ExpiresAt:        &tokens.ExpiresAt,
+			RefreshToken:     tokens.RefreshToken,
+			RefreshExpiresAt: &tokens.RefreshExpiresAt,
+		})
+	})
+}
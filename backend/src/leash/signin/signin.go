@@ -1,26 +1,27 @@
 package leash_signin
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
 	"time"
 
 	"github.com/disgoorg/log"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	leash_api "github.com/mkrcx/mkrcx/src/leash/api"
 	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 )
 
-const userTokenExpiration = 7 * 24 * time.Hour
-
 // NoAPIKeyMiddleware is a middleware that checks if the user has an API key
 func NoAPIKeyMiddleware(c *fiber.Ctx) error {
 	authentication := leash_auth.GetAuthentication(c)
 
-	// Check if the user has an API key
-	if authentication.IsAPIKey() {
+	// Check if the user has an API key, OAuth client tokens can not manage sessions either
+	if authentication.IsAPIKey() || authentication.IsOAuth() {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
@@ -32,22 +33,41 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 	auth_ep.Use(leash_auth.AuthenticationMiddleware)
 	auth_ep.Use(NoAPIKeyMiddleware)
 
+	// Endpoint to list the enabled login providers, the first is the default
+	auth_ep.Get("/providers", func(c *fiber.Ctx) error {
+		return c.JSON(leash_auth.GetExternalProviders(c).List())
+	})
+
 	// Endpoint to initialize login in
 	type signinRequest struct {
-		Return string `query:"return"`
-		State  string `query:"state"`
+		Return   string `query:"return"`
+		State    string `query:"state"`
+		Provider string `query:"provider"`
 	}
 
 	auth_ep.Get("/login", models.GetQueryMiddleware[signinRequest], func(c *fiber.Ctx) error {
 		keys := leash_auth.GetKeys(c)
-		externalAuth := leash_auth.GetExternalAuth(c)
 		req := c.Locals("query").(signinRequest)
 
+		provider, ok := leash_auth.GetExternalProviders(c).Get(req.Provider)
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Unknown provider")
+		}
+
 		// Default return to /
 		if req.Return == "" {
 			req.Return = "/"
 		}
 
+		// The provider puts the nonce in its ID token, which ties the token to this login
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Error("Failed to generate the login nonce: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		nonce := base64.RawURLEncoding.EncodeToString(b)
+
 		// Create a token to store the return location signed by the server
 		tok, err := jwt.NewBuilder().
 			Issuer(leash_auth.ISSUER).
@@ -56,6 +76,8 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 			Audience([]string{"leash", "login-callback"}).
 			Claim("return", req.Return).
 			Claim("state", req.State).
+			Claim("provider", provider.Name).
+			Claim("nonce", nonce).
 			Build()
 
 		if err != nil {
@@ -69,20 +91,19 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 
-		url := externalAuth.GetAuthURL(string(signed))
+		url := provider.Authenticator.GetAuthURL(string(signed), nonce)
 		return c.Redirect(url)
 	})
 
-	// Endpoint to handle the callback from google
+	// Endpoint to handle the callback from the login provider
 	type signinCallbackRequest struct {
 		Code  string `query:"code" validate:"required"`
 		State string `query:"state" validate:"required"`
 	}
 
-	auth_ep.Get("/callback", models.GetQueryMiddleware[signinCallbackRequest], func(c *fiber.Ctx) error {
+	auth_ep.Get("/callback", leash_auth.RateLimitMiddleware(leash_auth.RATE_LIMIT_SIGNIN), leash_auth.LockoutMiddleware(fiber.StatusBadRequest, fiber.StatusUnauthorized), models.GetQueryMiddleware[signinCallbackRequest], func(c *fiber.Ctx) error {
 		db := leash_auth.GetDB(c)
 		keys := leash_auth.GetKeys(c)
-		externalAuth := leash_auth.GetExternalAuth(c)
 		req := c.Locals("query").(signinCallbackRequest)
 
 		// Parse the state token
@@ -118,7 +139,36 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 			return c.Status(fiber.StatusBadRequest).SendString("Invalid state")
 		}
 
-		email, err := externalAuth.Callback(c.Context(), req.Code)
+		// Get the login provider from the state token, falling back to the default provider
+		providerName := ""
+		if val, valid = tok.Get("provider"); valid {
+			providerName, ok = val.(string)
+			if !ok {
+				log.Error("Failed to convert provider from state token\n")
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid state")
+			}
+		}
+
+		provider, ok := leash_auth.GetExternalProviders(c).Get(providerName)
+		if !ok {
+			log.Error("Unknown provider in state token: %s\n", providerName)
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid state")
+		}
+
+		// Get the nonce the provider's ID token must carry from the state token
+		val, valid = tok.Get("nonce")
+		if !valid {
+			log.Error("Failed to get nonce from state token\n")
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid state")
+		}
+
+		nonce, ok := val.(string)
+		if !ok || nonce == "" {
+			log.Error("Failed to convert nonce from state token\n")
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid state")
+		}
+
+		email, err := provider.Authenticator.Callback(c.Context(), req.Code, nonce)
 		if err != nil {
 			log.Error("Failed to get email from external auth: %s\n", err)
 			return c.Status(fiber.StatusBadRequest).SendString("Invalid code")
@@ -126,8 +176,19 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 
 		// Check if the user exists
 		var user models.User
-		res := db.Limit(1).Where(models.User{Email: email}).Or(models.User{PendingEmail: &email}).Find(&user)
+		res := db.Limit(1).Where(models.User{Email: email}).Or("pending_email = ? AND (pending_email_expires_at IS NULL OR pending_email_expires_at > ?)", email, time.Now()).Find(&user)
 		if res.Error != nil || res.RowsAffected == 0 {
+			// Let the user register with the email they signed in with
+			if registrationMode != REGISTRATION_DISABLED {
+				signed, expiresAt, err := createRegistrationToken(keys, email)
+				if err != nil {
+					log.Error("Failed to create the registration token: %s\n", err)
+					return c.SendStatus(fiber.StatusInternalServerError)
+				}
+
+				return c.Redirect(ret + "?registration_token=" + signed + "&expires_at=" + expiresAt.Format(time.RFC3339) + "&state=" + state)
+			}
+
 			// The user does not exist
 			c.Set("Content-Type", "text/html")
 			return c.Status(fiber.StatusUnauthorized).SendString(
@@ -144,10 +205,30 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 						<br>
 						<p>If you already have an account, please log in with the email you used to create your account.</p>
 						<br>
-						<a href="/auth/login?return=%s">Retry Login</a>
+						<a href="/auth/login?return=%s&provider=%s">Retry Login</a>
 					</body>
 				</html>
-			`, ret))
+			`, ret, provider.Name))
+		}
+
+		// Check if the user is still waiting for their registration to be approved
+		if user.PendingApproval {
+			c.Set("Content-Type", "text/html")
+			return c.Status(fiber.StatusForbidden).SendString(`
+				<html>
+					<head>
+						<title>Awaiting Approval</title>
+					</head>
+
+					<body>
+						<h1>Awaiting Approval</h1>
+						<br>
+						<p>Your account has been registered and is waiting to be approved by staff.</p>
+						<br>
+						<p>You will be able to log in once it has been approved.</p>
+					</body>
+				</html>
+			`)
 		}
 
 		// Check if the user signed in with a pending email
@@ -169,42 +250,62 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 			return c.SendStatus(fiber.StatusUnauthorized)
 		}
 
-		session_id := uuid.New().String()
-
-		// Create a session token
-		tok, err = jwt.NewBuilder().
-			Issuer(leash_auth.ISSUER).
-			IssuedAt(time.Now()).
-			Expiration(time.Now().Add(userTokenExpiration)).
-			Audience([]string{"leash", "session"}).
-			Claim("email", email).
-			Claim("session", session_id).
-			Build()
+		session, err := createSession(c, user)
 		if err != nil {
-			log.Error("Failed to build the session token: %s\n", err)
+			log.Error("Failed to create session: %s\n", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 
-		signed, err := keys.Sign(tok)
+		// The session tokens are not put in the redirect, the frontend exchanges the code for them
+		code, err := createLoginCode(keys, session)
 		if err != nil {
-			log.Error("Failed to sign the session token: %s\n", err)
+			log.Error("Failed to create login code: %s\n", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 
-		session := models.Session{
-			SessionID: session_id,
-			UserID:    user.ID,
-			ExpiresAt: tok.Expiration(),
-		}
+		return c.Redirect(ret + "?code=" + code + "&state=" + state)
+	})
 
-		// Create the session
-		res = db.Create(&session)
-		if res.Error != nil {
-			log.Error("Failed to create session: %s\n", res.Error)
+	registerTokenEndpoints(auth_ep)
+	registerRegistrationEndpoint(auth_ep)
+
+	// Endpoint to verify a pending email from the link sent to it
+	type verifyEmailRequest struct {
+		Token string `query:"token" validate:"required"`
+	}
+	auth_ep.Get("/verify_email", models.GetQueryMiddleware[verifyEmailRequest], func(c *fiber.Ctx) error {
+		req := c.Locals("query").(verifyEmailRequest)
+
+		user, err := leash_api.VerifyPendingEmail(c, req.Token)
+
+		title := "Email Verified"
+		message := fmt.Sprintf("Your email has been changed to %s.", html.EscapeString(user.Email))
+		status := fiber.StatusOK
+
+		var ferr *fiber.Error
+		if errors.As(err, &ferr) {
+			title = "Verification Failed"
+			message = html.EscapeString(ferr.Message)
+			status = ferr.Code
+		} else if err != nil {
+			log.Error("Failed to verify pending email: %s\n", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 
-		return c.Redirect(ret + "?token=" + string(signed) + "&expires_at=" + session.ExpiresAt.Format(time.RFC3339) + "&state=" + state)
+		c.Set("Content-Type", "text/html")
+		return c.Status(status).SendString(fmt.Sprintf(`
+			<html>
+				<head>
+					<title>%s</title>
+				</head>
+
+				<body>
+					<h1>%s</h1>
+					<br>
+					<p>%s</p>
+				</body>
+			</html>
+		`, title, title, message))
 	})
 
 	// Endpoint to logout
@@ -263,70 +364,4 @@ func RegisterAuthenticationEndpoints(auth_ep fiber.Router) {
 
 		return c.SendString("Authorized")
 	})
-
-	// Endpoint to refresh the session token
-	auth_ep.Get("/refresh", func(c *fiber.Ctx) error {
-		db := leash_auth.GetDB(c)
-		keys := leash_auth.GetKeys(c)
-		authentication := leash_auth.GetAuthentication(c)
-
-		// This should only be called with a valid user session token
-		if !authentication.IsUser() {
-			return c.SendStatus(fiber.StatusUnauthorized)
-		}
-
-		var session = models.Session{
-			SessionID: authentication.Data.(string),
-		}
-
-		// Get the session
-		res := db.Limit(1).Where(&session).Find(&session)
-		if res.Error != nil || res.RowsAffected == 0 {
-			return c.SendStatus(fiber.StatusUnauthorized)
-		}
-
-		// Check if the session is expired
-		if session.ExpiresAt.Before(time.Now()) {
-			db.Delete(&session)
-			return c.SendStatus(fiber.StatusUnauthorized)
-		}
-
-		// Create a new session token
-		tok, err := jwt.NewBuilder().
-			Issuer(leash_auth.ISSUER).
-			IssuedAt(time.Now()).
-			Expiration(time.Now().Add(userTokenExpiration)).
-			Audience([]string{"leash", "session"}).
-			Claim("email", authentication.User.Email).
-			Claim("session", authentication.Data).
-			Build()
-
-		if err != nil {
-			log.Error("Failed to build the session token: %s\n", err)
-			return c.SendStatus(fiber.StatusInternalServerError)
-		}
-
-		signed, err := keys.Sign(tok)
-		if err != nil {
-			log.Error("Failed to sign the session token: %s\n", err)
-			return c.SendStatus(fiber.StatusInternalServerError)
-		}
-
-		// Update the session
-		session.ExpiresAt = tok.Expiration()
-		res = db.Save(&session)
-		if res.Error != nil {
-			log.Error("Failed to update session: %s\n", res.Error)
-			return c.SendStatus(fiber.StatusInternalServerError)
-		}
-
-		// Return the new session token and expiration
-		return c.JSON(struct {
-			Token     string    `json:"token"`
-			ExpiresAt time.Time `json:"expires_at"`
-		}{
-			Token:     string(signed),
-			ExpiresAt: tok.Expiration(),
-		})
-	})
 }
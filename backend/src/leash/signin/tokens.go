@@ -0,0 +1,261 @@
+package leash_signin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	leash_auth "github.com/mkrcx/mkrcx/src/shared/authentication"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// accessTokenExpiration is how long an access token can be used before it has to be refreshed
+	accessTokenExpiration = 15 * time.Minute
+
+	// sessionExpiration is how long a session lasts without being refreshed
+	sessionExpiration = 7 * 24 * time.Hour
+
+	// loginCodeExpiration is how long the code passed back from the login callback can be exchanged
+	loginCodeExpiration = 2 * time.Minute
+)
+
+// sessionTokens is an access token and the refresh token that renews it
+type sessionTokens struct {
+	Token            string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// createSession creates a session for the user, tokens are issued for it separately
+func createSession(c *fiber.Ctx, user models.User) (models.Session, error) {
+	session := models.Session{
+		SessionID: uuid.New().String(),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(sessionExpiration),
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+
+	// Create the session
+	res := leash_auth.GetDB(c).Create(&session)
+	if res.Error != nil {
+		return models.Session{}, res.Error
+	}
+
+	return session, nil
+}
+
+// createLoginCode creates the short lived code the login callback redirects with, it is exchanged for the session tokens
+func createLoginCode(keys *leash_auth.Keys, session models.Session) (string, error) {
+	tok, err := jwt.NewBuilder().
+		Issuer(leash_auth.ISSUER).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(loginCodeExpiration)).
+		Audience([]string{"leash", "login-code"}).
+		Claim("session", session.SessionID).
+		Build()
+	if err != nil {
+		return "", err
+	}
+
+	signed, err := keys.Sign(tok)
+	if err != nil {
+		return "", err
+	}
+
+	return string(signed), nil
+}
+
+// hashRefreshToken returns the hash a refresh token is stored as
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueSessionTokens signs a new access token for the session and stores a new refresh token
+func issueSessionTokens(db *gorm.DB, keys *leash_auth.Keys, user models.User, session models.Session) (sessionTokens, error) {
+	// Access tokens never outlive their session
+	expiresAt := time.Now().Add(accessTokenExpiration)
+	if session.ExpiresAt.Before(expiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+
+	tok, err := jwt.NewBuilder().
+		Issuer(leash_auth.ISSUER).
+		IssuedAt(time.Now()).
+		Expiration(expiresAt).
+		Audience([]string{"leash", "session"}).
+		Claim("email", user.Email).
+		Claim("session", session.SessionID).
+		Claim("stamp", user.SecurityStamp).
+		Build()
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	signed, err := keys.Sign(tok)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return sessionTokens{}, err
+	}
+
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+
+	res := db.Create(&models.RefreshToken{
+		Hash:      hashRefreshToken(refresh),
+		SessionID: session.SessionID,
+		ExpiresAt: session.ExpiresAt,
+	})
+	if res.Error != nil {
+		return sessionTokens{}, res.Error
+	}
+
+	return sessionTokens{
+		Token:            string(signed),
+		ExpiresAt:        tok.Expiration(),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// revokeSession deletes a session along with every refresh token issued for it
+func revokeSession(db *gorm.DB, session_id string) error {
+	if err := db.Unscoped().Where("session_id = ?", session_id).Delete(&models.RefreshToken{}).Error; err != nil {
+		return err
+	}
+
+	return db.Where("api_key = ?", session_id).Delete(&models.Session{}).Error
+}
+
+// getSessionUser returns an unexpired session and the user it belongs to
+func getSessionUser(db *gorm.DB, session_id string) (models.Session, models.User, bool) {
+	var session models.Session
+	if res := db.Limit(1).Where("api_key = ?", session_id).Find(&session); res.Error != nil || res.RowsAffected == 0 {
+		return session, models.User{}, false
+	}
+
+	if session.ExpiresAt.Before(time.Now()) {
+		return session, models.User{}, false
+	}
+
+	var user models.User
+	if res := db.Limit(1).Where("id = ?", session.UserID).Find(&user); res.Error != nil || res.RowsAffected == 0 {
+		return session, user, false
+	}
+
+	return session, user, true
+}
+
+// registerTokenEndpoints registers the endpoints that issue and renew session tokens
+func registerTokenEndpoints(auth_ep fiber.Router) {
+	// Endpoint to exchange the code from the login callback for the session tokens
+	type tokenRequest struct {
+		Code string `json:"code" xml:"code" form:"code" validate:"required"`
+	}
+	auth_ep.Post("/token", models.GetBodyMiddleware[tokenRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		keys := leash_auth.GetKeys(c)
+		req := c.Locals("body").(tokenRequest)
+
+		tok, err := keys.Parse(req.Code, []string{"leash", "login-code"})
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid login code")
+		}
+
+		val, valid := tok.Get("session")
+		session_id, ok := val.(string)
+		if !valid || !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid login code")
+		}
+
+		session, user, ok := getSessionUser(db, session_id)
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid login code")
+		}
+
+		// A login code can only be exchanged once, before the session has any refresh tokens
+		var count int64
+		db.Unscoped().Model(&models.RefreshToken{}).Where("session_id = ?", session.SessionID).Count(&count)
+		if count != 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Login code already used")
+		}
+
+		tokens, err := issueSessionTokens(db, keys, user, session)
+		if err != nil {
+			log.Error("Failed to issue session tokens: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.JSON(tokens)
+	})
+
+	// Endpoint to exchange a refresh token for new session tokens
+	type refreshRequest struct {
+		RefreshToken string `json:"refresh_token" xml:"refresh_token" form:"refresh_token" validate:"required"`
+	}
+	auth_ep.Post("/refresh", models.GetBodyMiddleware[refreshRequest], func(c *fiber.Ctx) error {
+		db := leash_auth.GetDB(c)
+		keys := leash_auth.GetKeys(c)
+		req := c.Locals("body").(refreshRequest)
+
+		var refresh models.RefreshToken
+		if res := db.Limit(1).Where("hash = ?", hashRefreshToken(req.RefreshToken)).Find(&refresh); res.Error != nil || res.RowsAffected == 0 {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid refresh token")
+		}
+
+		// Mark the refresh token as used, a token that was already used has leaked so the whole session is revoked
+		now := time.Now()
+		res := db.Model(&models.RefreshToken{}).Where("hash = ? AND used_at IS NULL", refresh.Hash).Update("used_at", now)
+		if res.Error != nil {
+			log.Error("Failed to use refresh token: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if res.RowsAffected == 0 {
+			log.Warn("Refresh token reused, revoking session %s\n", refresh.SessionID)
+
+			if err := revokeSession(db, refresh.SessionID); err != nil {
+				log.Error("Failed to revoke session: %s\n", err)
+			}
+
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid refresh token")
+		}
+
+		if refresh.ExpiresAt.Before(now) {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid refresh token")
+		}
+
+		session, user, ok := getSessionUser(db, refresh.SessionID)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid refresh token")
+		}
+
+		// Refreshing keeps the session alive
+		session.ExpiresAt = now.Add(sessionExpiration)
+		if res := db.Save(&session); res.Error != nil {
+			log.Error("Failed to update session: %s\n", res.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		tokens, err := issueSessionTokens(db, keys, user, session)
+		if err != nil {
+			log.Error("Failed to issue session tokens: %s\n", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.JSON(tokens)
+	})
+}
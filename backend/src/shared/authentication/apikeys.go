@@ -0,0 +1,189 @@
+package leash_authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// LEGACY_APIKEY_PREFIX starts the prefix of api keys issued before keys had a prefix, see LegacyAPIKeyPrefix
+const LEGACY_APIKEY_PREFIX = "legacy-"
+
+// APIKEY_RATE_WINDOW is the window an api key's RateLimit is counted over
+const APIKEY_RATE_WINDOW = time.Minute
+
+// Reasons a request with a valid api key was rejected
+const (
+	APIKEY_REJECTION_IP         = "ip_not_allowed"
+	APIKEY_REJECTION_RATE_LIMIT = "rate_limited"
+)
+
+// HashAPIKeySecret returns the hash the secret part of an api key is stored as
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// LegacyAPIKeyPrefix returns the prefix an api key issued as a bare UUID was given when it was hashed
+func LegacyAPIKeyPrefix(key string) string {
+	return LEGACY_APIKEY_PREFIX + HashAPIKeySecret(key)[:16]
+}
+
+// GenerateAPIKey generates a new api key, the prefix identifies it and only the hash of the secret is stored
+func GenerateAPIKey() (models.APIKey, error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return models.APIKey{}, err
+	}
+
+	prefix := hex.EncodeToString(b[:8])
+	secret := base64.RawURLEncoding.EncodeToString(b[8:])
+
+	return models.APIKey{
+		Key:        prefix,
+		SecretHash: HashAPIKeySecret(secret),
+		Token:      prefix + "." + secret,
+	}, nil
+}
+
+// SplitAPIKey splits an api key into its prefix and secret
+func SplitAPIKey(token string) (string, string) {
+	// Secrets never contain a dot, so the last one separates them
+	if i := strings.LastIndex(token, "."); i != -1 {
+		return token[:i], token[i+1:]
+	}
+
+	// Keys issued before prefixes were the secret alone
+	return LegacyAPIKeyPrefix(token), token
+}
+
+// FindAPIKey returns the api key for a token, comparing the secret in constant time
+func FindAPIKey(db *gorm.DB, token string) (models.APIKey, bool) {
+	prefix, secret := SplitAPIKey(token)
+
+	var apiKey models.APIKey
+	if res := db.Limit(1).Where("api_key = ?", prefix).Find(&apiKey); res.Error != nil || res.RowsAffected == 0 {
+		return apiKey, false
+	}
+
+	hash := HashAPIKeySecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(apiKey.SecretHash)) != 1 {
+		return apiKey, false
+	}
+
+	return apiKey, true
+}
+
+// touchAPIKey records the last use of an api key, only writing when it is older than SESSION_ACTIVITY_INTERVAL
+func touchAPIKey(db *gorm.DB, key string) error {
+	now := time.Now()
+
+	return db.Model(&models.APIKey{}).
+		Where("api_key = ?", key).
+		Where("last_used_at IS NULL OR last_used_at < ?", now.Add(-SESSION_ACTIVITY_INTERVAL)).
+		Update("last_used_at", now).Error
+}
+
+// ParseAPIKeyCIDR parses an entry of an api key's AllowedCIDRs, a bare address only matches itself
+func ParseAPIKeyCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: cidr}
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// apiKeyAllowsIP returns true if the api key may be used from the ip
+func apiKeyAllowsIP(apiKey models.APIKey, ip string) bool {
+	if len(apiKey.AllowedCIDRs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, cidr := range apiKey.AllowedCIDRs {
+		network, err := ParseAPIKeyCIDR(cidr)
+		if err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowAPIKeyRequest counts a request against the api key's rate limit, returning false once it is used up
+func allowAPIKeyRequest(apiKey models.APIKey) bool {
+	hits, _, err := rateLimitStore.Hit("apikey-limit:"+apiKey.Key, APIKEY_RATE_WINDOW)
+	if err != nil {
+		// A broken store should not take the server down with it
+		log.Error("Failed to count api key request: %s\n", err)
+		return true
+	}
+
+	return hits <= apiKey.RateLimit
+}
+
+// shouldRecordAPIKeyRejection returns true if the rejection has not been recorded in the current window, so a
+// misbehaving client does not flood the rejection log
+func shouldRecordAPIKeyRejection(rejection models.APIKeyRejection) bool {
+	hits, _, err := rateLimitStore.Hit("apikey-rejection:"+rejection.Key+"|"+rejection.Reason+"|"+rejection.IP, APIKEY_RATE_WINDOW)
+	return err != nil || hits == 1
+}
+
+// rejectAPIKey records that a request with the api key was rejected
+func rejectAPIKey(db *gorm.DB, apiKey models.APIKey, ip string, reason string) {
+	rejection := models.APIKeyRejection{
+		Key:    apiKey.Key,
+		IP:     ip,
+		Reason: reason,
+	}
+
+	if !shouldRecordAPIKeyRejection(rejection) {
+		return
+	}
+
+	log.Warn("Rejected api key %s from %s: %s\n", apiKey.Key, ip, reason)
+	if err := db.Create(&rejection).Error; err != nil {
+		log.Error("Failed to record api key rejection: %s\n", err)
+	}
+}
+
+// CheckAPIKeyRestrictions returns an error if the api key's AllowedCIDRs or RateLimit reject a request from the ip
+func CheckAPIKeyRestrictions(db *gorm.DB, apiKey models.APIKey, ip string) error {
+	if !apiKeyAllowsIP(apiKey, ip) {
+		rejectAPIKey(db, apiKey, ip, APIKEY_REJECTION_IP)
+		return fiber.NewError(fiber.StatusForbidden, "API Key is not allowed from this address")
+	}
+
+	if apiKey.RateLimit > 0 && !allowAPIKeyRequest(apiKey) {
+		rejectAPIKey(db, apiKey, ip, APIKEY_REJECTION_RATE_LIMIT)
+		return fiber.NewError(fiber.StatusTooManyRequests, "API Key rate limit exceeded")
+	}
+
+	return nil
+}
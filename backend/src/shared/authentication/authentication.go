@@ -12,6 +12,7 @@ import (
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"github.com/disgoorg/log"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"gorm.io/gorm"
@@ -23,8 +24,16 @@ const (
 	AUTHENTICATOR_LOGGED_OUT Authenticator = iota
 	AUTHENTICATOR_USER
 	AUTHENTICATOR_APIKEY
+	AUTHENTICATOR_OAUTH
 )
 
+// SESSION_ACTIVITY_INTERVAL is how stale a session's last use can get before a request records it again
+const SESSION_ACTIVITY_INTERVAL = time.Minute
+
+// ErrInvalidCredentials is returned for credentials that are wrong rather than expired or revoked, only these count
+// towards a lockout
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 type Authentication struct {
 	Authenticator Authenticator
 	User          models.User
@@ -67,6 +76,18 @@ func ParseSessionToken(db *gorm.DB, keys *Keys, token string) (*models.User, str
 		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
 	}
 
+	// Tokens issued under an older security stamp have been revoked
+	stamp := ""
+	if s, valid := tok.Get("stamp"); valid {
+		if stamp, ok = s.(string); !ok {
+			return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+		}
+	}
+
+	if stamp != user.SecurityStamp {
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Session revoked")
+	}
+
 	return user, session_str, nil
 }
 
@@ -85,6 +106,11 @@ func (a Authentication) IsAPIKey() bool {
 	return a.Authenticator == AUTHENTICATOR_APIKEY
 }
 
+// IsOAuth returns true if the user in the current context is using an access token issued to an OAuth client
+func (a Authentication) IsOAuth() bool {
+	return a.Authenticator == AUTHENTICATOR_OAUTH
+}
+
 // Authorize returns nil if the user in the current context is authorized to perform the given action
 func (a Authentication) Authorize(permission string) error {
 	if a.IsLoggedOut() {
@@ -97,6 +123,13 @@ func (a Authentication) Authorize(permission string) error {
 		}
 	}
 
+	// OAuth clients are limited to the permissions of their scopes
+	if a.IsOAuth() {
+		if !a.Enforcer.HasPermissionForScopes(a.Data.(OAuthGrant).Scopes, permission) {
+			return errors.New("not authorized")
+		}
+	}
+
 	if a.Enforcer.HasPermissionForUser(a.User, permission) {
 		return nil
 	}
@@ -124,6 +157,11 @@ func (e EnforcerWrapper) HasPermissionForAPIKey(apikey models.APIKey, permission
 
 // HasPermissionForUser returns true if the user supplied is authorized to perform the given action
 func (e EnforcerWrapper) HasPermissionForUser(user models.User, permission string) bool {
+	// Users waiting for approval have no permissions
+	if user.PendingApproval {
+		return false
+	}
+
 	val, err := e.Enforcer.Enforce("role:"+user.Role, permission)
 	if err != nil {
 		return false
@@ -180,7 +218,7 @@ const (
 	ctxDBKey           string = "db"
 	ctxKeysKey         string = "keys"
 	ctxHMACSecretKey   string = "hmac_secret"
-	ctxExternalAuthKey string = "external_auth"
+	ctxExternalAuthKey string = "external_providers"
 	ctxEnforcerKey     string = "enforcer"
 )
 
@@ -206,6 +244,25 @@ func AuthenticateHeader(authorization string, db *gorm.DB, keys *Keys, e *casbin
 		// Get the token from the authorization header
 		token := strings.TrimPrefix(authorization, "Bearer ")
 
+		// A token Leash did not sign is a guess, one that is only expired or revoked is not
+		if err := keys.Verify(token); err != nil {
+			return authentication, ErrInvalidCredentials
+		}
+
+		if IsOAuthToken(token) {
+			user, grant, err := ParseOAuthToken(db, keys, token)
+			if err != nil {
+				return authentication, err
+			}
+
+			return Authentication{
+				Authenticator: AUTHENTICATOR_OAUTH,
+				User:          *user,
+				Data:          grant,
+				Enforcer:      enforcer,
+			}, nil
+		}
+
 		user, session_str, err := ParseSessionToken(db, keys, token)
 		if err != nil {
 			return authentication, err
@@ -238,13 +295,14 @@ func AuthenticateHeader(authorization string, db *gorm.DB, keys *Keys, e *casbin
 		key := strings.TrimPrefix(authorization, "API-Key ")
 
 		// Check if the api key exists
-		var apiKey = models.APIKey{
-			Key: key,
+		apiKey, ok := FindAPIKey(db, key)
+		if !ok {
+			// The api key does not exist or the secret is wrong
+			return authentication, ErrInvalidCredentials
 		}
 
-		if res := db.Limit(1).Where(&apiKey).Find(&apiKey); res.Error != nil || res.RowsAffected == 0 {
-			// The api key does not exist
-			return authentication, errors.New("API Key not found")
+		if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+			return authentication, errors.New("API Key expired")
 		}
 
 		// Check if the user exists
@@ -268,6 +326,20 @@ func AuthenticateHeader(authorization string, db *gorm.DB, keys *Keys, e *casbin
 	return authentication, nil
 }
 
+// touchSession records the last use of a session, only writing when it changed or is older than SESSION_ACTIVITY_INTERVAL
+func touchSession(db *gorm.DB, session_id string, ip string, userAgent string) error {
+	now := time.Now()
+
+	return db.Model(&models.Session{}).
+		Where("api_key = ?", session_id).
+		Where("last_used_at IS NULL OR last_used_at < ? OR ip <> ? OR user_agent <> ?", now.Add(-SESSION_ACTIVITY_INTERVAL), ip, userAgent).
+		Updates(map[string]interface{}{
+			"last_used_at": now,
+			"ip":           ip,
+			"user_agent":   userAgent,
+		}).Error
+}
+
 // AuthenticationMiddleware is the middleware that handles authentication
 func AuthenticationMiddleware(c *fiber.Ctx) error {
 	db := GetDB(c)
@@ -284,11 +356,37 @@ func AuthenticationMiddleware(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Database connection error")
 	}
 
+	// Locked out identities are turned away before their credentials are checked again
+	identities := lockoutIdentities(c)
+	if err := checkLockout(c, identities); err != nil {
+		return err
+	}
+
 	authentication, err := AuthenticateHeader(c.Get("Authorization"), db, GetKeys(c), GetEnforcer(c))
 	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			recordAuthenticationFailure(identities)
+		}
+
 		return c.SendStatus(fiber.StatusUnauthorized)
 	}
 
+	if authentication.IsUser() {
+		if err := touchSession(db, authentication.Data.(string), c.IP(), c.Get(fiber.HeaderUserAgent)); err != nil {
+			log.Error("Failed to update session activity: %s\n", err)
+		}
+	}
+
+	if authentication.IsAPIKey() {
+		if err := CheckAPIKeyRestrictions(db, authentication.Data.(models.APIKey), c.IP()); err != nil {
+			return err
+		}
+
+		if err := touchAPIKey(db, authentication.Data.(models.APIKey).Key); err != nil {
+			log.Error("Failed to update api key activity: %s\n", err)
+		}
+	}
+
 	c.Locals(ctxAuthKey, authentication)
 	return c.Next()
 }
@@ -371,12 +469,12 @@ func InitializeCasbin(db *gorm.DB) (*casbin.Enforcer, error) {
 }
 
 // LocalsMiddleware is the middleware that sets the locals for common objects
-func LocalsMiddleware(db *gorm.DB, keys *Keys, hmacSecret []byte, externalAuth ExternalAuthenticator, enforcer *casbin.Enforcer) fiber.Handler {
+func LocalsMiddleware(db *gorm.DB, keys *Keys, hmacSecret []byte, externalProviders *ExternalProviders, enforcer *casbin.Enforcer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		c.Locals(ctxDBKey, db)
 		c.Locals(ctxKeysKey, keys)
 		c.Locals(ctxHMACSecretKey, hmacSecret)
-		c.Locals(ctxExternalAuthKey, externalAuth)
+		c.Locals(ctxExternalAuthKey, externalProviders)
 		c.Locals(ctxEnforcerKey, enforcer)
 		return c.Next()
 	}
@@ -396,9 +494,9 @@ func GetHMAC(c *fiber.Ctx) hash.Hash {
 	return hmac.New(md5.New, c.Locals(ctxHMACSecretKey).([]byte))
 }
 
-// GetGoogle returns the google oauth2 config from the current context
-func GetExternalAuth(c *fiber.Ctx) ExternalAuthenticator {
-	return c.Locals(ctxExternalAuthKey).(ExternalAuthenticator)
+// GetExternalProviders returns the external sign in providers from the current context
+func GetExternalProviders(c *fiber.Ctx) *ExternalProviders {
+	return c.Locals(ctxExternalAuthKey).(*ExternalProviders)
 }
 
 // GetEnforcer returns the casbin enforcer from the current context
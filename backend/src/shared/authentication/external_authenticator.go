@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/mkrcx/mkrcx/src/shared/models"
 	"golang.org/x/oauth2"
@@ -11,10 +12,79 @@ import (
 )
 
 type ExternalAuthenticator interface {
-	// GetAuthURL returns the URL to redirect the user to for authentication
-	GetAuthURL(state string) string
-	// Authenticate authenticates a user and returns the user's email
-	Callback(ctx context.Context, code string) (string, error)
+	// GetAuthURL returns the URL to redirect the user to for authentication, the nonce is sent to providers that
+	// issue ID tokens
+	GetAuthURL(state string, nonce string) string
+	// Authenticate authenticates a user and returns the user's email, ID tokens must carry the nonce sent with the
+	// auth URL
+	Callback(ctx context.Context, code string, nonce string) (string, error)
+}
+
+// ExternalProvider is a named external authenticator that users can choose to sign in with
+type ExternalProvider struct {
+	Name          string                `json:"name"`
+	DisplayName   string                `json:"display_name"`
+	Authenticator ExternalAuthenticator `json:"-"`
+}
+
+// ExternalProviders is the registry of enabled sign in providers, the first registered is the default
+type ExternalProviders struct {
+	providers []ExternalProvider
+}
+
+// NewExternalProviders creates an empty provider registry
+func NewExternalProviders() *ExternalProviders {
+	return &ExternalProviders{
+		providers: []ExternalProvider{},
+	}
+}
+
+// Register adds a provider to the registry, names must be unique
+func (p *ExternalProviders) Register(name string, displayName string, authenticator ExternalAuthenticator) error {
+	if name == "" {
+		return errors.New("provider name is required")
+	}
+
+	if _, ok := p.Get(name); ok {
+		return fmt.Errorf("provider %q is already registered", name)
+	}
+
+	p.providers = append(p.providers, ExternalProvider{
+		Name:          name,
+		DisplayName:   displayName,
+		Authenticator: authenticator,
+	})
+
+	return nil
+}
+
+// Get returns the provider with the given name, or the default provider if the name is empty
+func (p *ExternalProviders) Get(name string) (ExternalProvider, bool) {
+	if name == "" {
+		return p.Default()
+	}
+
+	for _, provider := range p.providers {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+
+	return ExternalProvider{}, false
+}
+
+// Default returns the first registered provider
+func (p *ExternalProviders) Default() (ExternalProvider, bool) {
+	if len(p.providers) == 0 {
+		return ExternalProvider{}, false
+	}
+
+	return p.providers[0], true
+}
+
+// List returns every registered provider in registration order
+func (p *ExternalProviders) List() []ExternalProvider {
+	return append([]ExternalProvider{}, p.providers...)
 }
 
 type GoogleAuthenticator struct {
@@ -23,11 +93,12 @@ type GoogleAuthenticator struct {
 
 var _ ExternalAuthenticator = (*GoogleAuthenticator)(nil)
 
-func (g *GoogleAuthenticator) GetAuthURL(state string) string {
+// GetAuthURL ignores the nonce, the user is looked up from the userinfo endpoint rather than an ID token
+func (g *GoogleAuthenticator) GetAuthURL(state string, nonce string) string {
 	return g.googleOauth.AuthCodeURL(state)
 }
 
-func (g *GoogleAuthenticator) Callback(ctx context.Context, code string) (string, error) {
+func (g *GoogleAuthenticator) Callback(ctx context.Context, code string, nonce string) (string, error) {
 	userinfo := &struct {
 		Email string `json:"email" validate:"required,email"`
 	}{}
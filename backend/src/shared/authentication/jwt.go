@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"strconv"
@@ -11,20 +12,25 @@ import (
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
 const (
 	ISSUER = "mkrcx"
+
+	// KEY_RETIRED_AT is the key file parameter recording when a key stopped signing tokens
+	KEY_RETIRED_AT = "retired_at"
 )
 
 type Keys struct {
 	publicKey  jwk.Key
 	privateKey jwk.Key
+	publicKeys jwk.Set
 }
 
-// GenerateJWTKeySet generates a new set of JWT keys
-func GenerateJWTKeySet() (jwk.Set, error) {
+// GenerateJWTKey generates a new RSA signing key
+func GenerateJWTKey() (jwk.Key, error) {
 	raw, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, err
@@ -36,16 +42,80 @@ func GenerateJWTKeySet() (jwk.Set, error) {
 	}
 
 	// Set the key ID, algorithm, and usage
-	key.Set(jwk.KeyIDKey, "sig-"+strconv.FormatInt(time.Now().Unix(), 10))
+	key.Set(jwk.KeyIDKey, "sig-"+strconv.FormatInt(time.Now().UnixNano(), 10))
 	key.Set(jwk.AlgorithmKey, jwa.RS256)
 	key.Set(jwk.KeyUsageKey, jwk.ForSignature)
 
+	return key, nil
+}
+
+// GenerateJWTKeySet generates a new set of JWT keys
+func GenerateJWTKeySet() (jwk.Set, error) {
+	key, err := GenerateJWTKey()
+	if err != nil {
+		return nil, err
+	}
+
 	keys := jwk.NewSet()
 	keys.AddKey(key)
 
 	return keys, nil
 }
 
+// RotateKeys adds a new signing key to the set and retires the previous ones,
+// retired keys are kept to verify tokens until they have been retired for longer than retain
+func RotateKeys(keys jwk.Set, retain time.Duration) (jwk.Key, []string, error) {
+	now := time.Now()
+	expired := []jwk.Key{}
+
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+
+		retiredAt, ok := key.Get(KEY_RETIRED_AT)
+		if !ok {
+			// Stored as a float so it reads back the same once parsed from the key file
+			key.Set(KEY_RETIRED_AT, float64(now.Unix()))
+			continue
+		}
+
+		retired, ok := retiredAt.(float64)
+		if !ok {
+			return nil, nil, errors.New("invalid " + KEY_RETIRED_AT + " in key " + key.KeyID())
+		}
+
+		if time.Unix(int64(retired), 0).Add(retain).Before(now) {
+			expired = append(expired, key)
+		}
+	}
+
+	removed := make([]string, len(expired))
+	for i, key := range expired {
+		keys.RemoveKey(key)
+		removed[i] = key.KeyID()
+	}
+
+	key, err := GenerateJWTKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys.AddKey(key)
+
+	return key, removed, nil
+}
+
+// writeKeyFile writes a JWT key set to a file
+func writeKeyFile(key_file string, keys jwk.Set) error {
+	// Format the key file
+	buf, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write the key file
+	return os.WriteFile(key_file, buf, 0600)
+}
+
 // CreateOrGetKeysFromFile initializes the JWT key set from a file
 func CreateOrGetKeysFromFile(key_file string) (jwk.Set, error) {
 	// Generate a key if it doesn't exist
@@ -55,14 +125,7 @@ func CreateOrGetKeysFromFile(key_file string) (jwk.Set, error) {
 			return nil, err
 		}
 
-		// Format the key file
-		buf, err := json.MarshalIndent(keys, "", "  ")
-		if err != nil {
-			return nil, err
-		}
-
-		// Write the key file
-		err = os.WriteFile(key_file, buf, 0600)
+		err = writeKeyFile(key_file, keys)
 		if err != nil {
 			return nil, err
 		}
@@ -94,21 +157,54 @@ func CreateOrGetKeysFromFile(key_file string) (jwk.Set, error) {
 	return keys, nil
 }
 
-// CreateKeys initializes the keys from a JWK set
-func CreateKeys(keys jwk.Set) (*Keys, error) {
-	// Get the first key
-	privateKey, _ := keys.Key(0)
+// RotateKeyFile adds a new signing key to the key file, see RotateKeys
+func RotateKeyFile(key_file string, retain time.Duration) (jwk.Key, []string, error) {
+	keys, err := CreateOrGetKeysFromFile(key_file)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Create the public key from the private key
-	publicKey, err := privateKey.PublicKey()
+	key, removed, err := RotateKeys(keys, retain)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if err := writeKeyFile(key_file, keys); err != nil {
+		return nil, nil, err
+	}
+
+	return key, removed, nil
+}
+
+// CreateKeys initializes the keys from a JWK set, the newest key signs and every key verifies
+func CreateKeys(keys jwk.Set) (*Keys, error) {
+	if keys.Len() == 0 {
+		return nil, errors.New("the key set is empty")
 	}
 
+	publicKeys := jwk.NewSet()
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+
+		// Create the public key from the private key
+		publicKey, err := key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+
+		publicKey.Remove(KEY_RETIRED_AT)
+		publicKeys.AddKey(publicKey)
+	}
+
+	// Get the newest key
+	privateKey, _ := keys.Key(keys.Len() - 1)
+	publicKey, _ := publicKeys.Key(publicKeys.Len() - 1)
+
 	// Return the keys
 	return &Keys{
 		publicKey:  publicKey,
 		privateKey: privateKey,
+		publicKeys: publicKeys,
 	}, nil
 }
 
@@ -117,6 +213,11 @@ func (keys Keys) GetPublicKey() jwk.Key {
 	return keys.publicKey
 }
 
+// GetPublicKeys returns the public keys of every key that can verify tokens
+func (keys Keys) GetPublicKeys() jwk.Set {
+	return keys.publicKeys
+}
+
 // GetPrivateKey returns the private key
 func (keys Keys) GetPrivateKey() jwk.Key {
 	return keys.privateKey
@@ -127,10 +228,16 @@ func (keys Keys) Sign(token jwt.Token) ([]byte, error) {
 	return jwt.Sign(token, jwt.WithKey(jwa.RS256, keys.privateKey))
 }
 
+// Verify checks a token is signed by one of the keys, without validating its claims
+func (keys Keys) Verify(token string) error {
+	_, err := jws.Verify([]byte(token), jws.WithKeySet(keys.publicKeys, jws.WithInferAlgorithmFromKey(true)))
+	return err
+}
+
 // Parse parses and validates a token
 func (keys Keys) Parse(token string, audience []string) (jwt.Token, error) {
 	// Parse the token
-	tok, err := jwt.ParseString(token, jwt.WithKey(jwa.RS256, keys.publicKey))
+	tok, err := jwt.ParseString(token, jwt.WithKeySet(keys.publicKeys, jws.WithInferAlgorithmFromKey(true)))
 	if err != nil {
 		return nil, err
 	}
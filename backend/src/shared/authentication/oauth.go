@@ -0,0 +1,132 @@
+package leash_authentication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"gorm.io/gorm"
+)
+
+// OAUTH_AUDIENCE is the audience of access tokens issued to OAuth clients
+const OAUTH_AUDIENCE = "oauth"
+
+// OAuthGrant is what an OAuth access token lets a client do on behalf of its user
+type OAuthGrant struct {
+	ClientID string
+	Scopes   []string
+}
+
+// HasScope returns true if the grant includes the scope
+func (g OAuthGrant) HasScope(scope string) bool {
+	return slices.Contains(g.Scopes, scope)
+}
+
+// IsOAuthToken reports whether a bearer token is an OAuth access token rather than a session token, it does not verify the token
+func IsOAuthToken(token string) bool {
+	tok, err := jwt.ParseInsecure([]byte(token))
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(tok.Audience(), OAUTH_AUDIENCE)
+}
+
+// ParseOAuthToken parses an OAuth access token and returns the user it was issued for and what it grants
+func ParseOAuthToken(db *gorm.DB, keys *Keys, token string) (*models.User, OAuthGrant, error) {
+	grant := OAuthGrant{}
+
+	tok, err := keys.Parse(token, []string{"leash", OAUTH_AUDIENCE})
+	if err != nil {
+		return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+	}
+
+	id, err := strconv.ParseUint(tok.Subject(), 10, 0)
+	if err != nil {
+		return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+	}
+
+	claims := map[string]string{}
+	for _, name := range []string{"client_id", "scope", "stamp"} {
+		val, _ := tok.Get(name)
+		claim, ok := val.(string)
+		if !ok && name != "stamp" {
+			return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+		}
+
+		claims[name] = claim
+	}
+
+	grant.ClientID = claims["client_id"]
+	grant.Scopes = strings.Fields(claims["scope"])
+
+	// Deleting a client revokes every token issued to it
+	var client models.OAuthClient
+	if res := db.Limit(1).Where("client_id = ?", grant.ClientID).Find(&client); res.Error != nil || res.RowsAffected == 0 {
+		return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+	}
+
+	var user = &models.User{}
+	if res := db.Limit(1).Where("id = ?", id).Find(user); res.Error != nil || res.RowsAffected == 0 {
+		return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Authorization header error")
+	}
+
+	// Tokens issued under an older security stamp have been revoked
+	if claims["stamp"] != user.SecurityStamp {
+		return nil, grant, fiber.NewError(fiber.StatusUnauthorized, "Session revoked")
+	}
+
+	return user, grant, nil
+}
+
+// HasPermissionForScopes returns true if any of the OAuth scopes grants the permission
+func (e EnforcerWrapper) HasPermissionForScopes(scopes []string, permission string) bool {
+	for _, scope := range scopes {
+		val, err := e.Enforcer.Enforce("scope:"+scope, permission)
+		if err == nil && val {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OAuthScope is a scope OAuth clients can request, its permissions are the casbin policies of scope:<name>
+type OAuthScope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// OAUTH_SCOPES are the scopes OAuth clients can be registered with, shown to users on the consent screen
+var OAUTH_SCOPES = []OAuthScope{
+	{Name: "openid", Description: "Sign you in with your Leash account"},
+	{Name: "email", Description: "See your email address"},
+	{Name: "profile", Description: "See your name, pronouns and permissions"},
+	{Name: "trainings", Description: "See your trainings"},
+	{Name: "holds", Description: "See the holds on your account"},
+	{Name: "visits", Description: "See your visit history"},
+	{Name: "equipment", Description: "See the equipment in the space"},
+	{Name: "access", Description: "Check whether people can use equipment, if you are allowed to"},
+}
+
+// GetOAuthScope returns the scope with the given name
+func GetOAuthScope(name string) (OAuthScope, bool) {
+	for _, scope := range OAUTH_SCOPES {
+		if scope.Name == name {
+			return scope, true
+		}
+	}
+
+	return OAuthScope{}, false
+}
+
+// HashOAuthSecret returns the hash OAuth client secrets and codes are stored as
+func HashOAuthSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,201 @@
+package leash_authentication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/mkrcx/mkrcx/src/shared/models"
+	"golang.org/x/oauth2"
+)
+
+// OIDC_DISCOVERY_PATH is appended to the issuer URL to find the provider metadata
+const OIDC_DISCOVERY_PATH = "/.well-known/openid-configuration"
+
+type OIDCConfig struct {
+	// Issuer is the issuer URL, used for discovery and checked against the iss claim
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes defaults to openid, email and profile, openid is always requested
+	Scopes []string
+	// EmailClaim is the ID token claim holding the user's email, defaults to email
+	EmailClaim string
+	// DomainClaim is the ID token claim checked against AllowedDomains, defaults to the domain of the email
+	DomainClaim string
+	// AllowedDomains restricts sign in to these domains when not empty
+	AllowedDomains []string
+}
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer" validate:"required"`
+	AuthorizationEndpoint string `json:"authorization_endpoint" validate:"required,url"`
+	TokenEndpoint         string `json:"token_endpoint" validate:"required,url"`
+	JWKSURI               string `json:"jwks_uri" validate:"required,url"`
+}
+
+type OIDCAuthenticator struct {
+	config OIDCConfig
+	oauth  oauth2.Config
+	keys   jwk.Set
+}
+
+var _ ExternalAuthenticator = (*OIDCAuthenticator)(nil)
+
+// discoverOIDCProvider fetches the provider metadata from the issuer
+func discoverOIDCProvider(ctx context.Context, issuer string) (oidcProviderMetadata, error) {
+	var metadata oidcProviderMetadata
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+OIDC_DISCOVERY_PATH, nil)
+	if err != nil {
+		return metadata, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return metadata, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return metadata, fmt.Errorf("oidc discovery failed: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return metadata, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+
+	if models.ValidateStruct(metadata) != nil {
+		return metadata, errors.New("oidc discovery failed: incomplete provider metadata")
+	}
+
+	if metadata.Issuer != issuer {
+		return metadata, fmt.Errorf("oidc discovery failed: issuer %q does not match %q", metadata.Issuer, issuer)
+	}
+
+	return metadata, nil
+}
+
+// GetOIDCAuthenticator discovers the provider from its issuer URL and returns an authenticator for it
+func GetOIDCAuthenticator(ctx context.Context, config OIDCConfig) (*OIDCAuthenticator, error) {
+	if config.EmailClaim == "" {
+		config.EmailClaim = "email"
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	metadata, err := discoverOIDCProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the signing keys, refreshing them in the background so provider key rotation is picked up
+	cache := jwk.NewCache(ctx)
+	if err := cache.Register(metadata.JWKSURI, jwk.WithMinRefreshInterval(15*time.Minute)); err != nil {
+		return nil, err
+	}
+
+	if _, err := cache.Refresh(ctx, metadata.JWKSURI); err != nil {
+		return nil, fmt.Errorf("failed to fetch oidc signing keys: %w", err)
+	}
+
+	return &OIDCAuthenticator{
+		config: config,
+		oauth: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  metadata.AuthorizationEndpoint,
+				TokenURL: metadata.TokenEndpoint,
+			},
+		},
+		keys: jwk.NewCachedSet(cache, metadata.JWKSURI),
+	}, nil
+}
+
+func (o *OIDCAuthenticator) GetAuthURL(state string, nonce string) string {
+	return o.oauth.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce))
+}
+
+func (o *OIDCAuthenticator) Callback(ctx context.Context, code string, nonce string) (string, error) {
+	// Exchange the code for a token
+	tok, err := o.oauth.Exchange(ctx, code)
+	if err != nil {
+		return "", err
+	}
+
+	idToken, ok := tok.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return "", errors.New("missing id token")
+	}
+
+	return o.VerifyIDToken(idToken, nonce)
+}
+
+// VerifyIDToken checks the ID token signature and claims, including that it was issued for the nonce, and returns
+// the user's email
+func (o *OIDCAuthenticator) VerifyIDToken(idToken string, nonce string) (string, error) {
+	// Without a nonce a token issued for another login would be accepted
+	if nonce == "" {
+		return "", errors.New("missing nonce")
+	}
+
+	tok, err := jwt.ParseString(idToken,
+		jwt.WithKeySet(o.keys, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(o.config.Issuer),
+		jwt.WithAudience(o.config.ClientID),
+		jwt.WithClaimValue("nonce", nonce),
+		jwt.WithAcceptableSkew(time.Minute),
+	)
+	if err != nil {
+		return "", fmt.Errorf("invalid id token: %w", err)
+	}
+
+	claims := tok.PrivateClaims()
+
+	email, _ := claims[o.config.EmailClaim].(string)
+	if models.ValidateStruct(struct {
+		Email string `validate:"required,email"`
+	}{email}) != nil {
+		return "", errors.New("invalid email")
+	}
+
+	// Providers that do not verify emails omit the claim, only reject an explicit false
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		return "", errors.New("email is not verified")
+	}
+
+	if len(o.config.AllowedDomains) > 0 {
+		domain := email[strings.LastIndex(email, "@")+1:]
+		if o.config.DomainClaim != "" {
+			domain, _ = claims[o.config.DomainClaim].(string)
+		}
+
+		if !slices.ContainsFunc(o.config.AllowedDomains, func(allowed string) bool {
+			return strings.EqualFold(allowed, domain)
+		}) {
+			return "", errors.New("domain is not allowed")
+		}
+	}
+
+	return email, nil
+}
@@ -0,0 +1,304 @@
+package leash_authentication
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disgoorg/log"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Rate limit buckets, each is counted separately and configured with SetRateLimits
+const (
+	RATE_LIMIT_REQUESTS = "requests"
+	RATE_LIMIT_LOOKUPS  = "lookups"
+	RATE_LIMIT_SIGNIN   = "signin"
+)
+
+// RateLimit allows Max hits per Window, a zero Max disables it
+type RateLimit struct {
+	Max    int
+	Window time.Duration
+}
+
+// Enabled returns true if the limit applies
+func (l RateLimit) Enabled() bool {
+	return l.Max > 0 && l.Window > 0
+}
+
+// RateLimits configures the rate limit buckets and the lockout after repeated authentication failures
+type RateLimits struct {
+	Buckets map[string]RateLimit
+
+	// IPs with Lockout.Max authentication failures for the same claimed api key or user within Lockout.Window are
+	// locked out of it until the window ends
+	Lockout RateLimit
+}
+
+// RateLimitStore counts hits against keys in fixed windows, implement it to share limits between servers
+type RateLimitStore interface {
+	// Hit counts a hit against the key, returning the hits in the current window and when it ends
+	Hit(key string, window time.Duration) (int, time.Time, error)
+
+	// Get returns the hits against the key in the current window without counting one
+	Get(key string) (int, time.Time, error)
+
+	// Reset forgets the hits against the key
+	Reset(key string) error
+}
+
+type memoryRateLimitWindow struct {
+	hits  int
+	reset time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore for a single server
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	windows   map[string]memoryRateLimitWindow
+	lastPurge time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		windows:   map[string]memoryRateLimitWindow{},
+		lastPurge: time.Now(),
+	}
+}
+
+// Hit counts a hit against the key, returning the hits in the current window and when it ends
+func (s *MemoryRateLimitStore) Hit(key string, window time.Duration) (int, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	// Forget windows that have ended, at most once a minute
+	if now.Sub(s.lastPurge) >= time.Minute {
+		for k, w := range s.windows {
+			if !now.Before(w.reset) {
+				delete(s.windows, k)
+			}
+		}
+
+		s.lastPurge = now
+	}
+
+	w, ok := s.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = memoryRateLimitWindow{reset: now.Add(window)}
+	}
+
+	w.hits++
+	s.windows[key] = w
+
+	return w.hits, w.reset, nil
+}
+
+// Get returns the hits against the key in the current window without counting one
+func (s *MemoryRateLimitStore) Get(key string) (int, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w, ok := s.windows[key]
+	if !ok || !time.Now().Before(w.reset) {
+		return 0, time.Time{}, nil
+	}
+
+	return w.hits, w.reset, nil
+}
+
+// Reset forgets the hits against the key
+func (s *MemoryRateLimitStore) Reset(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.windows, key)
+	return nil
+}
+
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+var rateLimits RateLimits
+
+// SetRateLimits sets the store hits are counted in, including api key rate limits, and the limits enforced by the
+// rate limit middlewares
+func SetRateLimits(store RateLimitStore, limits RateLimits) {
+	rateLimitStore = store
+	rateLimits = limits
+}
+
+// RateLimitIdentities returns who a request is counted against, the api key or signed in user when there is one, and always the IP
+func RateLimitIdentities(c *fiber.Ctx) []string {
+	identities := []string{"ip:" + c.IP()}
+
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if strings.HasPrefix(authorization, "API-Key ") {
+		// Prefixes are public, so the key is identified by its secret too and nobody else can use up its limit
+		prefix, secret := SplitAPIKey(strings.TrimPrefix(authorization, "API-Key "))
+		return append(identities, "apikey:"+prefix+":"+HashAPIKeySecret(secret)[:16])
+	}
+
+	keys, ok := c.Locals(ctxKeysKey).(*Keys)
+	if !ok || !strings.HasPrefix(authorization, "Bearer ") {
+		return identities
+	}
+
+	// Only tokens signed by Leash identify a user, anything else is counted against the IP
+	tok, err := keys.Parse(strings.TrimPrefix(authorization, "Bearer "), []string{"leash"})
+	if err != nil {
+		return identities
+	}
+
+	if email, ok := tok.Get("email"); ok {
+		if email, ok := email.(string); ok {
+			return append(identities, "user:"+email)
+		}
+	}
+
+	if tok.Subject() != "" {
+		return append(identities, "user:"+tok.Subject())
+	}
+
+	return identities
+}
+
+// tooManyRequests returns the error for a request rejected until reset
+func tooManyRequests(c *fiber.Ctx, reset time.Time, message string) error {
+	retryAfter := int(time.Until(reset).Seconds()) + 1
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+
+	return fiber.NewError(fiber.StatusTooManyRequests, message)
+}
+
+// RateLimitMiddleware rejects requests once any of their identities has used up the bucket's limit
+func RateLimitMiddleware(bucket string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := rateLimits.Buckets[bucket]
+		if !limit.Enabled() {
+			return c.Next()
+		}
+
+		for _, identity := range RateLimitIdentities(c) {
+			hits, reset, err := rateLimitStore.Hit(bucket+":"+identity, limit.Window)
+			if err != nil {
+				// A broken store should not take the server down with it
+				log.Error("Failed to count rate limit hit: %s\n", err)
+				continue
+			}
+
+			c.Set("X-RateLimit-Limit", strconv.Itoa(limit.Max))
+			if hits > limit.Max {
+				return tooManyRequests(c, reset, "Too many requests")
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// lockoutIdentities returns who a failed authentication is counted against, the IP together with the api key prefix
+// or user the request claims to be. The claim is not verified, so it is never used without the IP and nobody can lock
+// out a key or user by failing on their behalf from somewhere else
+func lockoutIdentities(c *fiber.Ctx) []string {
+	identity := "ip:" + c.IP()
+
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if strings.HasPrefix(authorization, "API-Key ") {
+		prefix, _ := SplitAPIKey(strings.TrimPrefix(authorization, "API-Key "))
+		return []string{identity + ":apikey:" + prefix}
+	}
+
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return []string{identity}
+	}
+
+	tok, err := jwt.ParseInsecure([]byte(strings.TrimPrefix(authorization, "Bearer ")))
+	if err != nil {
+		return []string{identity}
+	}
+
+	if email, ok := tok.Get("email"); ok {
+		if email, ok := email.(string); ok {
+			return []string{identity + ":user:" + email}
+		}
+	}
+
+	if tok.Subject() != "" {
+		return []string{identity + ":user:" + tok.Subject()}
+	}
+
+	return []string{identity}
+}
+
+// checkLockout returns an error if any of the identities is locked out
+func checkLockout(c *fiber.Ctx, identities []string) error {
+	limit := rateLimits.Lockout
+	if !limit.Enabled() {
+		return nil
+	}
+
+	for _, identity := range identities {
+		failures, reset, err := rateLimitStore.Get("lockout:" + identity)
+		if err != nil {
+			log.Error("Failed to check lockout: %s\n", err)
+			continue
+		}
+
+		if failures >= limit.Max {
+			return tooManyRequests(c, reset, "Too many failed attempts, try again later")
+		}
+	}
+
+	return nil
+}
+
+// recordAuthenticationFailure counts a failed authentication against the identities
+func recordAuthenticationFailure(identities []string) {
+	limit := rateLimits.Lockout
+	if !limit.Enabled() {
+		return
+	}
+
+	for _, identity := range identities {
+		failures, _, err := rateLimitStore.Hit("lockout:"+identity, limit.Window)
+		if err != nil {
+			log.Error("Failed to count authentication failure: %s\n", err)
+			continue
+		}
+
+		if failures == limit.Max {
+			log.Warn("Locking out %s after %d failed attempts\n", identity, failures)
+		}
+	}
+}
+
+// LockoutMiddleware rejects requests from locked out identities and counts responses with the failure statuses
+// towards locking them out
+func LockoutMiddleware(failureStatuses ...int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identities := lockoutIdentities(c)
+		if err := checkLockout(c, identities); err != nil {
+			return err
+		}
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+
+		for _, failure := range failureStatuses {
+			if status == failure {
+				recordAuthenticationFailure(identities)
+				break
+			}
+		}
+
+		return err
+	}
+}
@@ -35,6 +35,15 @@ type User struct {
 	Role         string
 	Type         string
 
+	// Pending emails that are not verified by this time are dropped
+	PendingEmailExpiresAt *time.Time `json:",omitempty"`
+
+	// Self-registered users wait for staff approval before they can sign in
+	PendingApproval bool `json:",omitempty"`
+
+	// Session tokens issued under a different security stamp are rejected
+	SecurityStamp string `json:"-"`
+
 	// Student-like fields
 	GraduationYear int
 	Major          string
@@ -48,6 +57,7 @@ type User struct {
 	APIKeys       []APIKey       `json:",omitempty"`
 	UserUpdates   []UserUpdate   `json:",omitempty"`
 	Notifications []Notification `json:",omitempty"`
+	Visits        []Visit        `json:",omitempty"`
 
 	Permissions []string `gorm:"-"`
 }
@@ -78,12 +88,26 @@ func (u *User) AfterCreate(tx *gorm.DB) (err error) {
 
 type APIKey struct {
 	Model
+
+	// Key is the public prefix of the api key, the secret after it is only stored hashed
 	Key         string `gorm:"column:api_key;primaryKey;size:36"`
+	SecretHash  string `json:"-"`
 	UserID      uint
 	Description string
 	FullAccess  bool
+	ExpiresAt   *time.Time `json:",omitempty"`
+	LastUsedAt  *time.Time `json:",omitempty"`
+
+	// Requests from outside these networks are rejected, an empty list allows any address
+	AllowedCIDRs []string `gorm:"serializer:json"`
+
+	// RateLimit is the number of requests allowed per minute, 0 is unlimited
+	RateLimit int
 
 	Permissions []string `gorm:"-"`
+
+	// Token is the full api key, it is only set when the key is created
+	Token string `gorm:"-" json:",omitempty"`
 }
 
 // AfterFind GORM hook that loads the permissions for an api key from casbin
@@ -110,14 +134,63 @@ func (a *APIKey) AfterCreate(tx *gorm.DB) (err error) {
 	return nil
 }
 
+// APIKeyRejection records a request made with a valid api key that its restrictions rejected
+type APIKeyRejection struct {
+	Model
+	ID     uint   `gorm:"primarykey"`
+	Key    string `gorm:"column:api_key;index"`
+	IP     string
+	Reason string
+}
+
 type Training struct {
 	Model
 	ID        uint `gorm:"primarykey"`
 	UserID    uint
 	Name      string
 	Level     string
+	ExpiresAt *time.Time `json:",omitempty"`
 	AddedBy   uint
 	RemovedBy uint `json:",omitempty"`
+
+	Expired bool `gorm:"-" json:",omitempty"`
+}
+
+// AfterFind GORM hook that marks expired trainings
+func (t *Training) AfterFind(tx *gorm.DB) (err error) {
+	t.Expired = t.IsExpired()
+	return nil
+}
+
+// IsExpired returns true if the training has passed its expiry date
+func (t *Training) IsExpired() bool {
+	return t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now())
+}
+
+type TrainingDefinition struct {
+	Model
+	ID            uint   `gorm:"primarykey"`
+	Name          string `gorm:"index"`
+	Description   string
+	Prerequisites []string `gorm:"serializer:json"`
+	Levels        []string `gorm:"serializer:json"`
+	ValidFor      int64
+	AddedBy       uint
+}
+
+// AllowsLevel returns true if the training can be granted at the given level
+func (d *TrainingDefinition) AllowsLevel(level string) bool {
+	if len(d.Levels) == 0 {
+		return true
+	}
+
+	for _, l := range d.Levels {
+		if l == level {
+			return true
+		}
+	}
+
+	return false
 }
 
 type Hold struct {
@@ -145,6 +218,36 @@ func (h *Hold) AfterFind(tx *gorm.DB) (err error) {
 	return nil
 }
 
+type Equipment struct {
+	Model
+	ID               uint   `gorm:"primarykey"`
+	Name             string `gorm:"index"`
+	Description      string
+	Location         string
+	RequiredTraining string `json:",omitempty"`
+	MinimumLevel     string `json:",omitempty"`
+	Status           string `gorm:"default:operational"`
+	StatusReason     string `json:",omitempty"`
+	StatusUpdatedBy  uint   `json:",omitempty"`
+	AddedBy          uint
+}
+
+// IsOperational returns true if the equipment is in service
+func (e *Equipment) IsOperational() bool {
+	return e.Status == "" || e.Status == "operational"
+}
+
+type Visit struct {
+	Model
+	ID           uint  `gorm:"primarykey"`
+	UserID       uint  `gorm:"index"`
+	User         *User `json:",omitempty"`
+	CheckIn      time.Time
+	CheckOut     *time.Time `gorm:"index" json:",omitempty"`
+	Method       string
+	AutoCheckout bool
+}
+
 type UserUpdate struct {
 	Model
 	ID       uint `gorm:"primarykey"`
@@ -169,9 +272,81 @@ type Notification struct {
 
 type Session struct {
 	Model
-	SessionID string `gorm:"column:api_key;primaryKey"`
-	UserID    uint
+	SessionID  string `gorm:"column:api_key;primaryKey"`
+	UserID     uint
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time `json:",omitempty"`
+	IP         string
+	UserAgent  string
+}
+
+// RefreshToken is an opaque token that renews a session's access token, only its hash is stored
+type RefreshToken struct {
+	Model
+	Hash      string `gorm:"primaryKey"`
+	SessionID string `gorm:"index"`
 	ExpiresAt time.Time
+
+	// Refresh tokens are single use, presenting a used one again revokes the session
+	UsedAt *time.Time
+}
+
+// OAuthClient is an application that signs users in through Leash as an OAuth2 authorization server
+type OAuthClient struct {
+	Model
+	ID           uint   `gorm:"primarykey"`
+	ClientID     string `gorm:"unique"`
+	SecretHash   string `json:"-"`
+	Name         string
+	Description  string
+	RedirectURIs []string `gorm:"serializer:json"`
+	Scopes       []string `gorm:"serializer:json"`
+
+	// Confidential clients authenticate with their secret, public clients rely on PKCE alone
+	Confidential bool
+	AddedBy      uint
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for tokens, only its hash is stored
+type OAuthCode struct {
+	Model
+	Hash          string `gorm:"primaryKey"`
+	ClientID      string
+	UserID        uint
+	RedirectURI   string
+	Scopes        []string `gorm:"serializer:json"`
+	CodeChallenge string
+	Nonce         string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+// AuditEvent records a change made through the API, who made it and what it changed
+type AuditEvent struct {
+	Model
+	ID         uint `gorm:"primarykey"`
+	ActorID    uint `gorm:"index"`
+	AuthMethod string
+	APIKey     string `json:",omitempty"`
+	Action     string `gorm:"index"`
+	TargetType string `gorm:"index:idx_audit_events_target"`
+	TargetID   string `gorm:"index:idx_audit_events_target"`
+
+	// Before and After are the target as JSON, empty when it did not exist
+	Before string `json:",omitempty"`
+	After  string `json:",omitempty"`
+
+	Status    int
+	IP        string
+	RequestID string `gorm:"index"`
+}
+
+// PolicySeed records a default casbin policy that has been added once, so it is not added back after being removed
+type PolicySeed struct {
+	Model
+	Type    string `gorm:"primaryKey;size:8"`
+	Subject string `gorm:"primaryKey;size:191"`
+	Object  string `gorm:"primaryKey;size:191"`
 }
 
 type Feed struct {
@@ -194,6 +369,30 @@ type FeedMessage struct {
 	PendingUserData      string `json:",omitempty"`
 }
 
+type Webhook struct {
+	Model
+	ID          uint `gorm:"primarykey"`
+	URL         string
+	Secret      string `json:"-"`
+	Description string
+	Events      []string `gorm:"serializer:json"`
+	Active      bool
+	AddedBy     uint
+}
+
+type WebhookDelivery struct {
+	Model
+	ID         uint `gorm:"primarykey"`
+	WebhookID  uint `gorm:"index"`
+	DeliveryID string
+	Event      string
+	Payload    string
+	Attempt    int
+	StatusCode int
+	Error      string `json:",omitempty"`
+	Success    bool
+}
+
 var validate = validator.New()
 
 type ErrorResponse struct {
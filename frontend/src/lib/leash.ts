@@ -39,6 +39,7 @@ export const allPermissions = [
 	'leash.users.self.apikeys:create',
 	'leash.users.self.apikeys:get',
 	'leash.users.self.apikeys:update',
+	'leash.users.self.apikeys:restrict',
 	'leash.users.self.apikeys:delete',
 	'leash.users.self.notifications:target',
 	'leash.users.self.notifications:list',
@@ -70,6 +71,7 @@ export const allPermissions = [
 	'leash.users.others.apikeys:get',
 	'leash.users.others.apikeys:delete',
 	'leash.users.others.apikeys:update',
+	'leash.users.others.apikeys:restrict',
 	'leash.users.others.notifications:target',
 	'leash.users.others.notifications:list',
 	'leash.users.others.notifications:get',
@@ -85,6 +87,7 @@ export const allPermissions = [
 	'leash.apikeys:get',
 	'leash.apikeys:delete',
 	'leash.apikeys:update',
+	'leash.apikeys:restrict',
 	'leash.notifications:get',
 	'leash.notifications:delete'
 ];
@@ -115,6 +118,7 @@ interface LeashUser {
 	Pronouns: string;
 	Role: string;
 	Type: string;
+	PendingApproval?: boolean;
 
 	// Student-like fields
 	GraduationYear: number;
@@ -142,7 +146,25 @@ interface LeashAPIKey {
 	UserID: number;
 	Description: string;
 	FullAccess: boolean;
+	ExpiresAt?: string;
+	LastUsedAt?: string;
+	AllowedCIDRs: string[] | null;
+	RateLimit: number;
 	Permissions: string[];
+
+	// Only returned when the key is created
+	Token?: string;
+}
+
+export interface LeashAPIKeyRejection {
+	ID: number;
+	CreatedAt: string;
+	UpdatedAt: string;
+	DeletedAt?: string;
+
+	Key: string;
+	IP: string;
+	Reason: 'ip_not_allowed' | 'rate_limited';
 }
 export const enum TrainingLevel {
 	IN_PROGRESS = 'in_progress',
@@ -223,9 +245,64 @@ interface LeashNotification {
 	AddedBy: number;
 }
 
-interface LeashTokenRefresh {
+export interface LeashLoginProvider {
+	name: string;
+	display_name: string;
+}
+
+interface LeashSessionTokens {
 	token: string;
 	expires_at: string;
+	refresh_token: string;
+	refresh_expires_at: string;
+}
+
+export interface SessionTokens {
+	token: string;
+	expiresAt: Date;
+	refreshToken: string;
+	refreshExpiresAt: Date;
+}
+
+const sessionTokens = (tokens: LeashSessionTokens): SessionTokens => ({
+	token: tokens.token,
+	expiresAt: new Date(tokens.expires_at),
+	refreshToken: tokens.refresh_token,
+	refreshExpiresAt: new Date(tokens.refresh_expires_at)
+});
+
+export interface OAuthScope {
+	name: string;
+	description: string;
+}
+
+export interface OAuthConsent {
+	client: {
+		client_id: string;
+		name: string;
+		description: string;
+	};
+	scopes: OAuthScope[];
+	redirect_uri: string;
+}
+
+export interface UserRegistrationOptions {
+	name: string;
+	pronouns: string;
+	type: string;
+
+	// Student-like fields
+	graduationYear?: number;
+	major?: string;
+
+	// Employee-like fields
+	department?: string;
+	jobTitle?: string;
+}
+
+export interface LeashRegistration {
+	user: User;
+	tokens?: SessionTokens;
 }
 
 export interface UserCreateOptions {
@@ -275,12 +352,19 @@ export interface APIKeyCreateOptions {
 	description?: string;
 	fullAccess?: boolean;
 	permissions?: string[];
+	expiresAt?: Date;
+	allowedCIDRs?: string[];
+	rateLimit?: number;
 }
 
 export interface APIKeyUpdateOptions {
 	description?: string;
 	fullAccess?: boolean;
 	permissions?: string[];
+	// null clears the expiry so the key never expires
+	expiresAt?: Date | null;
+	allowedCIDRs?: string[];
+	rateLimit?: number;
 }
 
 export interface TrainingCreateOptions {
@@ -363,6 +447,62 @@ export class ListAllCache<T> {
 	}
 }
 
+export interface LeashAuditEvent {
+	ID: number;
+	CreatedAt: string;
+	UpdatedAt: string;
+	DeletedAt?: string;
+
+	ActorID: number;
+	AuthMethod: 'session' | 'apikey' | 'oauth';
+	APIKey?: string;
+	Action: string;
+	TargetType: string;
+	TargetID: string;
+
+	// The target as JSON before and after the change
+	Before?: string;
+	After?: string;
+
+	Status: number;
+	IP: string;
+	RequestID: string;
+}
+
+// Keys are sent snake cased, so IDs are spelled Id
+export interface AuditEventListOptions extends LeashListOptions {
+	actorId?: number;
+	authMethod?: 'session' | 'apikey' | 'oauth';
+	apiKey?: string;
+	action?: string;
+	targetType?: string;
+	targetId?: string;
+	requestId?: string;
+	start?: number;
+	end?: number;
+}
+
+export interface LeashRole {
+	Name: string;
+	Inherits: string[];
+	Members: string[];
+	Permissions: string[];
+
+	// Default roles are seeded by Leash and can not be deleted
+	Default: boolean;
+
+	// Only returned for a single role, everything it inherits through the hierarchy
+	ImplicitRoles?: string[];
+	ImplicitPermissions?: string[];
+}
+
+export interface RoleCreateOptions {
+	name: string;
+	inherits?: string[];
+	members?: string[];
+	permissions?: string[];
+}
+
 export interface LeashUserSearchOptions extends LeashListOptions, LeashUserOptions {
 	showService?: boolean;
 }
@@ -400,7 +540,8 @@ export class LeashAPI {
 		const r = await this.fetchFunction(`${this.leashURL}${endpoint}`, {
 			method: method,
 			headers: {
-				Authorization: `Bearer ${this.token}`,
+				// Logged out requests, like registering, must not send an empty token
+				...(this.token ? { Authorization: `Bearer ${this.token}` } : {}),
 				'Content-Type': 'application/json'
 			},
 			redirect: 'follow',
@@ -500,6 +641,34 @@ export class LeashAPI {
 		return new User(this, user, `/api/users/${user.ID}`);
 	}
 
+	public async register(
+		registrationToken: string,
+		{ name, pronouns, type, graduationYear, major, department, jobTitle }: UserRegistrationOptions
+	): Promise<LeashRegistration> {
+		const registration = await this.leashFetch<
+			{ user: LeashUser } & Partial<LeashSessionTokens>
+		>(`/auth/register`, 'POST', {
+			token: registrationToken,
+			name,
+			pronouns,
+			type,
+			graduation_year: graduationYear,
+			major,
+			department,
+			job_title: jobTitle
+		});
+
+		const { user, token, expires_at, refresh_token, refresh_expires_at } = registration;
+
+		return {
+			user: new User(this, user, `/api/users/${user.ID}`),
+			tokens:
+				token && expires_at && refresh_token && refresh_expires_at
+					? sessionTokens({ token, expires_at, refresh_token, refresh_expires_at })
+					: undefined
+		};
+	}
+
 	public async createServiceUser({ name, permissions }: ServiceUserCreateOptions): Promise<User> {
 		const user = await this.leashFetch<LeashUser>(`/api/users/service`, 'POST', {
 			name,
@@ -595,8 +764,28 @@ export class LeashAPI {
 		);
 	}
 
-	public async refreshTokens(): Promise<LeashTokenRefresh> {
-		return this.leashFetch<LeashTokenRefresh>(`/auth/refresh`, 'GET');
+	public async exchangeLoginCode(code: string): Promise<SessionTokens> {
+		return this.leashFetch<LeashSessionTokens>(`/auth/token`, 'POST', { code }).then(sessionTokens);
+	}
+
+	public async refreshTokens(refreshToken: string): Promise<SessionTokens> {
+		return this.leashFetch<LeashSessionTokens>(`/auth/refresh`, 'POST', {
+			refresh_token: refreshToken
+		}).then(sessionTokens);
+	}
+
+	// Describes an OAuth authorization request, given the query string the client sent to /oauth/authorize
+	public async oauthConsent(query: string): Promise<OAuthConsent> {
+		return this.leashFetch<OAuthConsent>(`/oauth/consent?${query}`, 'GET');
+	}
+
+	// Approves or denies an OAuth authorization request, returning where to send the user back to
+	public async oauthAuthorize(query: string, approve: boolean): Promise<string> {
+		const params = Object.fromEntries(new URLSearchParams(query));
+		return this.leashFetch<{ redirect_to: string }>(`/oauth/consent`, 'POST', {
+			...params,
+			approve
+		}).then((response) => response.redirect_to);
 	}
 
 	public async validateToken(): Promise<boolean> {
@@ -608,10 +797,77 @@ export class LeashAPI {
 		}
 	}
 
-	public login(login: string, return_to: string): string {
+	public async getAuditEvents(
+		options: AuditEventListOptions = {},
+		noCache = false
+	): Promise<LeashListResponse<LeashAuditEvent>> {
+		return this.leashList<LeashAuditEvent, AuditEventListOptions>(`/api/audit`, options, noCache);
+	}
+
+	public async getRoles(noCache = false): Promise<LeashListResponse<LeashRole>> {
+		return this.leashList<LeashRole, LeashListOptions>(`/api/roles`, {}, noCache);
+	}
+
+	public async getRole(name: string, noCache = false): Promise<LeashRole> {
+		return this.leashGet<LeashRole>(`/api/roles/${encodeURIComponent(name)}`, {}, noCache);
+	}
+
+	public async createRole({
+		name,
+		inherits,
+		members,
+		permissions
+	}: RoleCreateOptions): Promise<LeashRole> {
+		return this.leashFetch<LeashRole>(`/api/roles`, 'POST', {
+			name,
+			inherits,
+			members,
+			permissions
+		});
+	}
+
+	public async deleteRole(name: string): Promise<void> {
+		await this.leashFetch(`/api/roles/${encodeURIComponent(name)}`, 'DELETE', undefined, true);
+	}
+
+	// Members are users as user:<id>, user roles as role:<role> or other roles as leash:<role>
+	private async changeRole(
+		name: string,
+		field: 'permissions' | 'members',
+		value: string,
+		method: 'PUT' | 'DELETE'
+	): Promise<LeashRole> {
+		return this.leashFetch<LeashRole>(
+			`/api/roles/${encodeURIComponent(name)}/${field}/${encodeURIComponent(value)}`,
+			method
+		);
+	}
+
+	public async addRolePermission(name: string, permission: string): Promise<LeashRole> {
+		return this.changeRole(name, 'permissions', permission, 'PUT');
+	}
+
+	public async removeRolePermission(name: string, permission: string): Promise<LeashRole> {
+		return this.changeRole(name, 'permissions', permission, 'DELETE');
+	}
+
+	public async addRoleMember(name: string, member: string): Promise<LeashRole> {
+		return this.changeRole(name, 'members', member, 'PUT');
+	}
+
+	public async removeRoleMember(name: string, member: string): Promise<LeashRole> {
+		return this.changeRole(name, 'members', member, 'DELETE');
+	}
+
+	public async loginProviders(): Promise<LeashLoginProvider[]> {
+		return this.leashFetch<LeashLoginProvider[]>(`/auth/providers`, 'GET');
+	}
+
+	public login(login: string, return_to: string, provider?: string): string {
 		const state = btoa(return_to);
+		const providerQuery = provider ? `&provider=${encodeURIComponent(provider)}` : '';
 
-		return `${this.leashURL}/auth/login?return=${login}&state=${state}`;
+		return `${this.leashURL}/auth/login?return=${login}&state=${state}${providerQuery}`;
 	}
 
 	public logout(return_to: string): string {
@@ -629,6 +885,7 @@ export class User {
 
 	email: string;
 	pendingEmail?: string;
+	pendingApproval: boolean;
 	cardId: string;
 	name: string;
 	pronouns: string;
@@ -669,6 +926,7 @@ export class User {
 
 		this.email = user.Email;
 		this.pendingEmail = user.PendingEmail;
+		this.pendingApproval = user.PendingApproval ?? false;
 		this.cardId = user.CardID;
 		this.name = user.Name;
 		this.pronouns = user.Pronouns;
@@ -969,12 +1227,18 @@ export class User {
 	async createAPIKey({
 		description,
 		fullAccess,
-		permissions
+		permissions,
+		expiresAt,
+		allowedCIDRs,
+		rateLimit
 	}: APIKeyCreateOptions): Promise<APIKey> {
 		const key = await this.api.leashFetch<LeashAPIKey>(`${this.endpointPrefix}/apikeys`, 'POST', {
 			description,
 			full_access: fullAccess,
-			permissions
+			permissions,
+			expires_at: expiresAt?.toISOString(),
+			allowed_cidrs: allowedCIDRs,
+			rate_limit: rateLimit
 		});
 
 		this.APIKeysCache.invalidate();
@@ -1112,8 +1376,15 @@ export class APIKey {
 	private userID: number;
 	description: string;
 	fullAccess: boolean;
+	expiresAt?: Date;
+	lastUsedAt?: Date;
+	allowedCIDRs: string[];
+	rateLimit: number;
 	permissions: string[];
 
+	// The full key, only known right after it is created
+	token?: string;
+
 	private endpointPrefix: string;
 
 	constructor(api: LeashAPI, key: LeashAPIKey, endpointPrefix: string) {
@@ -1128,7 +1399,18 @@ export class APIKey {
 		this.userID = key.UserID;
 		this.description = key.Description;
 		this.fullAccess = key.FullAccess;
+		if (key.ExpiresAt) {
+			this.expiresAt = new Date(key.ExpiresAt);
+		}
+
+		if (key.LastUsedAt) {
+			this.lastUsedAt = new Date(key.LastUsedAt);
+		}
+
+		this.allowedCIDRs = key.AllowedCIDRs ?? [];
+		this.rateLimit = key.RateLimit;
 		this.permissions = key.Permissions;
+		this.token = key.Token;
 
 		this.endpointPrefix = endpointPrefix;
 	}
@@ -1149,15 +1431,37 @@ export class APIKey {
 		await this.api.leashFetch(`${this.endpointPrefix}`, 'DELETE', undefined, true);
 	}
 
-	async update({ description, fullAccess, permissions }: APIKeyUpdateOptions): Promise<APIKey> {
+	async update({
+		description,
+		fullAccess,
+		permissions,
+		expiresAt,
+		allowedCIDRs,
+		rateLimit
+	}: APIKeyUpdateOptions): Promise<APIKey> {
 		const updated = await this.api.leashFetch<LeashAPIKey>(`${this.endpointPrefix}`, 'PATCH', {
 			description,
 			full_access: fullAccess,
-			permissions
+			permissions,
+			expires_at: expiresAt?.toISOString(),
+			clear_expires_at: expiresAt === null ? true : undefined,
+			allowed_cidrs: allowedCIDRs,
+			rate_limit: rateLimit
 		});
 
 		return new APIKey(this.api, updated, this.endpointPrefix);
 	}
+
+	async getRejections(
+		options: LeashListOptions = {},
+		noCache = false
+	): Promise<LeashListResponse<LeashAPIKeyRejection>> {
+		return this.api.leashList<LeashAPIKeyRejection, LeashListOptions>(
+			`${this.endpointPrefix}/rejections`,
+			options,
+			noCache
+		);
+	}
 }
 
 export class Training {
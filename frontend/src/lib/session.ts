@@ -0,0 +1,22 @@
+import type { Cookies } from '@sveltejs/kit';
+import type { SessionTokens } from './leash';
+
+// setSessionCookies stores the access token and the refresh token that renews it
+export const setSessionCookies = (cookies: Cookies, tokens: SessionTokens): void => {
+	cookies.set('token', tokens.token, {
+		expires: tokens.expiresAt,
+		path: '/'
+	});
+
+	cookies.set('refresh_token', tokens.refreshToken, {
+		expires: tokens.refreshExpiresAt,
+		path: '/',
+		httpOnly: true
+	});
+};
+
+// clearSessionCookies removes both session tokens
+export const clearSessionCookies = (cookies: Cookies): void => {
+	cookies.delete('token', { path: '/' });
+	cookies.delete('refresh_token', { path: '/' });
+};
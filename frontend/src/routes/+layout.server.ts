@@ -1,10 +1,12 @@
 import type { LayoutServerLoad } from './$types';
 import { LeashAPI } from '$lib/leash';
+import { clearSessionCookies, setSessionCookies } from '$lib/session';
 import { env } from '$env/dynamic/public';
 import { error } from '@sveltejs/kit';
 
 export const load: LayoutServerLoad = async ({ fetch, cookies }) => {
 	const token = cookies.get('token') || '';
+	const refreshToken = cookies.get('refresh_token') || '';
 	const leashURL = env.PUBLIC_LEASH_ENDPOINT;
 	if (!leashURL) {
 		throw new Error('LEASH_ENDPOINT not set');
@@ -13,16 +15,23 @@ export const load: LayoutServerLoad = async ({ fetch, cookies }) => {
 	const api = new LeashAPI(token, leashURL);
 	api.overrideFetchFunction(fetch);
 
-	if (token) {
+	if (token || refreshToken) {
 		try {
-			if (await api.validateToken()) {
-				const refresh = await api.refreshTokens();
-				cookies.set('token', refresh.token, {
-					expires: new Date(refresh.expires_at),
-					path: '/'
-				});
-			} else {
-				cookies.delete('token', { path: '/' });
+			// Access tokens are short lived, renew them with the refresh token once they stop working
+			if (!token || !(await api.validateToken())) {
+				if (refreshToken) {
+					// Leash rejects the expired access token before looking at the refresh token, so leave it out
+					const refreshAPI = new LeashAPI('', leashURL);
+					refreshAPI.overrideFetchFunction(fetch);
+
+					try {
+						setSessionCookies(cookies, await refreshAPI.refreshTokens(refreshToken));
+					} catch (e) {
+						clearSessionCookies(cookies);
+					}
+				} else {
+					clearSessionCookies(cookies);
+				}
 			}
 		} catch (e) {
 			error(500, 'Error communicating with Leash');
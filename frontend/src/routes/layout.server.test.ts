@@ -0,0 +1,68 @@
+import { describe, it, expect, vi } from 'vitest';
+import type { Cookies } from '@sveltejs/kit';
+import { load } from './+layout.server';
+
+vi.mock('$env/dynamic/public', () => ({
+	env: { PUBLIC_LEASH_ENDPOINT: 'http://leash.test' }
+}));
+
+// mockCookies keeps cookies in a map, enough for the session helpers
+const mockCookies = (values: Record<string, string>): Cookies =>
+	({
+		get: (name: string) => values[name],
+		set: (name: string, value: string) => {
+			values[name] = value;
+		},
+		delete: (name: string) => {
+			delete values[name];
+		}
+	}) as unknown as Cookies;
+
+// mockLeash answers like Leash does for an expired access token, which is rejected on every endpoint
+const mockLeash = () =>
+	vi.fn(async (input: RequestInfo | URL, init?: RequestInit) => {
+		const headers = (init?.headers || {}) as Record<string, string>;
+		if (headers.Authorization === 'Bearer expired') {
+			return new Response('Unauthorized', { status: 401 });
+		}
+
+		if (String(input) === 'http://leash.test/auth/refresh') {
+			return new Response(
+				JSON.stringify({
+					token: 'renewed',
+					expires_at: new Date(Date.now() + 60_000).toISOString(),
+					refresh_token: 'next-refresh',
+					refresh_expires_at: new Date(Date.now() + 3_600_000).toISOString()
+				}),
+				{ status: 200 }
+			);
+		}
+
+		return new Response('Unauthorized', { status: 401 });
+	});
+
+describe('layout load', () => {
+	it('renews an expired access token with the refresh token', async () => {
+		const values: Record<string, string> = { token: 'expired', refresh_token: 'valid-refresh' };
+		const fetch = mockLeash();
+
+		const data = await load({ fetch, cookies: mockCookies(values) } as never);
+
+		expect(data).toMatchObject({ token: 'renewed' });
+		expect(values.refresh_token).toBe('next-refresh');
+
+		const [, init] = fetch.mock.calls.find(([url]) => String(url).endsWith('/auth/refresh')) || [];
+		expect((init?.headers as Record<string, string>).Authorization).toBeUndefined();
+	});
+
+	it('signs out when the refresh token is rejected too', async () => {
+		const values: Record<string, string> = { token: 'expired', refresh_token: 'expired' };
+
+		const fetch = vi.fn(async () => new Response('Unauthorized', { status: 401 }));
+
+		const data = await load({ fetch, cookies: mockCookies(values) } as never);
+
+		expect(data).toMatchObject({ token: undefined });
+		expect(values.refresh_token).toBeUndefined();
+	});
+});
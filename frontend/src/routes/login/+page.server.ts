@@ -2,6 +2,7 @@ import { base } from '$app/paths';
 import { redirect } from '@sveltejs/kit';
 import type { PageServerLoad } from './$types';
 import { LeashAPI } from '$lib/leash';
+import { setSessionCookies } from '$lib/session';
 
 export const load: PageServerLoad = async ({ parent, fetch, url, cookies }) => {
 	const { token, leashURL } = await parent();
@@ -12,15 +13,21 @@ export const load: PageServerLoad = async ({ parent, fetch, url, cookies }) => {
 		previousPage = root;
 	}
 
-	const loginToken = url.searchParams.get('token');
+	const code = url.searchParams.get('code');
 	const state = url.searchParams.get('state');
-	const expires_at = url.searchParams.get('expires_at');
 
-	if (loginToken && state && expires_at) {
-		cookies.set('token', loginToken, {
-			expires: new Date(expires_at),
-			path: '/'
-		});
+	// Unknown users who are allowed to register are sent to the registration form
+	const registrationToken = url.searchParams.get('registration_token');
+	if (registrationToken && state) {
+		const params = new URLSearchParams({ registration_token: registrationToken, state });
+		redirect(307, `${base}/register?${params}`);
+	}
+
+	if (code && state) {
+		// Exchange the code from the login callback for the session tokens
+		const api = new LeashAPI('', leashURL);
+		api.overrideFetchFunction(fetch);
+		setSessionCookies(cookies, await api.exchangeLoginCode(code));
 
 		let ret = atob(state);
 
@@ -33,7 +40,8 @@ export const load: PageServerLoad = async ({ parent, fetch, url, cookies }) => {
 		if (token === undefined) {
 			const api = new LeashAPI('', leashURL);
 			api.overrideFetchFunction(fetch);
-			redirect(307, api.login(url.origin + url.pathname, previousPage));
+			const provider = url.searchParams.get('provider') || undefined;
+			redirect(307, api.login(url.origin + url.pathname, previousPage, provider));
 		} else {
 			redirect(307, previousPage);
 		}
@@ -2,6 +2,7 @@ import { base } from '$app/paths';
 import { redirect } from '@sveltejs/kit';
 import type { PageServerLoad } from './$types';
 import { LeashAPI } from '$lib/leash';
+import { clearSessionCookies } from '$lib/session';
 
 export const load: PageServerLoad = async ({ parent, fetch, url, cookies }) => {
 	const { token, leashURL } = await parent();
@@ -12,7 +13,7 @@ export const load: PageServerLoad = async ({ parent, fetch, url, cookies }) => {
 		const api = new LeashAPI(token, leashURL);
 		api.overrideFetchFunction(fetch);
 
-		cookies.delete('token', { path: '/' });
+		clearSessionCookies(cookies);
 		redirect(307, api.logout(root));
 	} else {
 		redirect(307, root);
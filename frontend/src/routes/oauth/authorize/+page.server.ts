@@ -0,0 +1,54 @@
+import { base } from '$app/paths';
+import { error, fail, redirect } from '@sveltejs/kit';
+import type { Actions, PageServerLoad, RequestEvent } from './$types';
+import { LeashAPI } from '$lib/leash';
+import { env } from '$env/dynamic/public';
+
+export const load: PageServerLoad = async ({ parent, fetch, url }) => {
+	const { token, leashURL } = await parent();
+
+	// Sign in first, then come back to approve the application
+	if (!token) {
+		redirect(307, `${base}/login?return_to=${encodeURIComponent(url.href)}`);
+	}
+
+	const api = new LeashAPI(token, leashURL);
+	api.overrideFetchFunction(fetch);
+
+	try {
+		return {
+			consent: await api.oauthConsent(url.searchParams.toString()),
+			query: url.searchParams.toString()
+		};
+	} catch (e) {
+		error(400, e instanceof Error ? e.message : String(e));
+	}
+};
+
+const decide =
+	(approve: boolean) =>
+	async ({ request, fetch, cookies }: RequestEvent) => {
+		const leashURL = env.PUBLIC_LEASH_ENDPOINT;
+		if (!leashURL) {
+			throw new Error('LEASH_ENDPOINT not set');
+		}
+
+		const data = await request.formData();
+
+		const api = new LeashAPI(cookies.get('token') || '', leashURL);
+		api.overrideFetchFunction(fetch);
+
+		let redirectTo;
+		try {
+			redirectTo = await api.oauthAuthorize(data.get('query')?.toString() ?? '', approve);
+		} catch (e) {
+			return fail(400, { error: e instanceof Error ? e.message : String(e) });
+		}
+
+		redirect(303, redirectTo);
+	};
+
+export const actions: Actions = {
+	approve: decide(true),
+	deny: decide(false)
+};
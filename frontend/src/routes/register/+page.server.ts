@@ -0,0 +1,67 @@
+import { base } from '$app/paths';
+import { fail, redirect } from '@sveltejs/kit';
+import type { Actions, PageServerLoad } from './$types';
+import { LeashAPI } from '$lib/leash';
+import { setSessionCookies } from '$lib/session';
+import { env } from '$env/dynamic/public';
+
+export const load: PageServerLoad = async ({ url }) => {
+	const registrationToken = url.searchParams.get('registration_token');
+	const state = url.searchParams.get('state');
+
+	if (!registrationToken || !state) {
+		redirect(307, `${base}/login`);
+	}
+
+	return {
+		registrationToken,
+		state
+	};
+};
+
+export const actions: Actions = {
+	default: async ({ request, fetch, url, cookies }) => {
+		const leashURL = env.PUBLIC_LEASH_ENDPOINT;
+		if (!leashURL) {
+			throw new Error('LEASH_ENDPOINT not set');
+		}
+
+		const data = await request.formData();
+
+		const registrationToken = data.get('registration_token')?.toString() ?? '';
+		const state = data.get('state')?.toString() ?? '';
+		const graduationYear = parseInt(data.get('graduation_year')?.toString() ?? '');
+
+		const api = new LeashAPI('', leashURL);
+		api.overrideFetchFunction(fetch);
+
+		let registration;
+		try {
+			registration = await api.register(registrationToken, {
+				name: data.get('name')?.toString() ?? '',
+				pronouns: data.get('pronouns')?.toString() ?? '',
+				type: data.get('type')?.toString() ?? '',
+				graduationYear: isNaN(graduationYear) ? undefined : graduationYear,
+				major: data.get('major')?.toString() || undefined,
+				department: data.get('department')?.toString() || undefined,
+				jobTitle: data.get('job_title')?.toString() || undefined
+			});
+		} catch (e) {
+			return fail(400, { error: e instanceof Error ? e.message : String(e) });
+		}
+
+		if (registration.user.pendingApproval || !registration.tokens) {
+			return { pending: true };
+		}
+
+		setSessionCookies(cookies, registration.tokens);
+
+		const root = url.origin + base;
+		let ret = atob(state);
+		if (ret.includes('/login') || ret.includes('/register')) {
+			ret = root;
+		}
+
+		redirect(303, ret);
+	}
+};